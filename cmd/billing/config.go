@@ -1,13 +1,25 @@
 package main
 
-import "gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+import (
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"time"
+)
 
 type Config struct {
 	DB struct {
 		Master  util.DBConfig `mapstructure:"master" validate:"required"`
 		Replica util.DBConfig `mapstructure:"replica" validate:"required"`
 	} `mapstructure:"db" validate:"required"`
-	Brokers       []string `mapstructure:"brokers" validate:"required"`
-	RedisAddr     string   `mapstructure:"redisAddr" validate:"required"`
-	RedisPassword string   `mapstructure:"redisPassword"`
+	Kafka           util.KafkaConfig               `mapstructure:"kafka" validate:"required"`
+	Workers         int                            `mapstructure:"workers"`
+	Retry           util.RetryConfig               `mapstructure:"retry" validate:"required"`
+	Tracing         util.TracingConfig             `mapstructure:"tracing" validate:"required"`
+	Metrics         util.MetricsConfig             `mapstructure:"metrics" validate:"required"`
+	Log             util.LogConfig                 `mapstructure:"log" validate:"required"`
+	Codec           util.CodecConfig               `mapstructure:"codec" validate:"required"`
+	Producers       map[string]util.ProducerConfig `mapstructure:"producers" validate:"dive"`
+	Dedup           util.RetentionConfig           `mapstructure:"dedup" validate:"required"`
+	ShutdownTimeout time.Duration                  `mapstructure:"shutdownTimeout" validate:"required"`
+	RedisAddr       string                         `mapstructure:"redisAddr" validate:"required"`
+	RedisPassword   string                         `mapstructure:"redisPassword"`
 }
@@ -3,11 +3,23 @@ package main
 import (
 	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/billing"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/cache"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/lifecycle"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/migrate"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
-	"log"
+	"net/http"
+	"os"
 	"path"
 	"runtime"
 )
@@ -24,18 +36,47 @@ func main() {
 		&cfg,
 	)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		logger.Default().Fatal("load config", logger.Err(err))
 	}
 
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		logger.Default().Fatal("parse log level", logger.Err(err))
+	}
+
+	lg := logger.New(os.Stdout, level).With(logger.String("service", "billing"))
+	logger.SetDefault(lg)
+
 	dbMasterSource := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		cfg.DB.Master.Host, cfg.DB.Master.Port, cfg.DB.Master.User, cfg.DB.Master.Password, cfg.DB.Master.Name, cfg.DB.Master.SSLMode,
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(dbMasterSource, migrations.Billing, os.Args[2:]); err != nil {
+			lg.Fatal("migrate", logger.Err(err))
+		}
+		return
+	}
+
+	app := lifecycle.New(cfg.ShutdownTimeout)
+
+	shutdownTracing, err := tracing.Init(app.Context(), "billing", cfg.Tracing)
+	if err != nil {
+		lg.Fatal("init tracing", logger.Err(err))
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
 	dbMaster, err := util.OpenDB(dbMasterSource)
 	if err != nil {
-		log.Fatalf("failed to open dbMaster: %v", err)
+		lg.Fatal("failed to open dbMaster", logger.Err(err))
 	}
+	app.OnShutdown("db master", func(context.Context) error {
+		dbMaster.Close()
+		return nil
+	})
+
+	metrics.RegisterPool("master", dbMaster)
 
 	dbReplicaSource := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
@@ -44,48 +85,113 @@ func main() {
 
 	dbReplica, err := util.OpenDB(dbReplicaSource)
 	if err != nil {
-		log.Fatalf("failed to open dbReplica: %v", err)
+		lg.Fatal("failed to open dbReplica", logger.Err(err))
+	}
+	app.OnShutdown("db replica", func(context.Context) error {
+		dbReplica.Close()
+		return nil
+	})
+
+	metrics.RegisterPool("replica", dbReplica)
+
+	codec, codecs, err := events.NewCodecs(cfg.Codec)
+	if err != nil {
+		lg.Fatal("init codecs", logger.Err(err))
 	}
 
 	repo := billing.NewPgRepo(dbMaster, dbReplica)
 
-	pendingPaymentsProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "pending_payments")
+	pendingPaymentsProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicPendingPayments, cfg.Producers[events.TopicPendingPayments], kafka.WithProducerName("billing"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("pending_payments producer", pendingPaymentsProducer)
 
-	paidPaymentsProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "paid_payments")
+	paidPaymentsProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicPaidPayments, cfg.Producers[events.TopicPaidPayments], kafka.WithProducerName("billing"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("paid_payments producer", paidPaymentsProducer)
 
-	resetProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "reset")
+	resetProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicReset, cfg.Producers[events.TopicReset], kafka.WithProducerName("billing"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("reset producer", resetProducer)
 
 	kafkaClient := billing.NewKafkaClient(pendingPaymentsProducer, paidPaymentsProducer, resetProducer)
 
 	cch := cache.NewRedisClient(cfg.RedisAddr, cfg.RedisPassword)
+	app.OnClose("redis", cch)
 
 	svc := billing.NewService(repo, kafkaClient, cch)
 
-	hdl := billing.NewKafkaHandler(svc)
+	dlqProducer, err := kafka.NewSaramaProducer(cfg.Kafka, "")
+	if err != nil {
+		lg.Fatal("create sarama producer", logger.Err(err))
+	}
+	app.OnClose("dlq producer", dlqProducer)
+
+	progress := health.NewProgress(cfg.Metrics.StallTimeout)
+
+	retry := middleware.Retry(middleware.RetryPolicy{
+		MaxAttempts:      cfg.Retry.MaxAttempts,
+		InitialBackoff:   cfg.Retry.InitialBackoff,
+		MaxBackoff:       cfg.Retry.MaxBackoff,
+		DeadLetterSuffix: cfg.Retry.DeadLetterSuffix,
+		Permanent:        []error{billing.ErrInvalidMsg, billing.ErrNotFound, billing.ErrFailedPrecondition},
+	}, dlqProducer)
+
+	hdl := billing.NewKafkaHandler(
+		svc,
+		router.WithWorkers(cfg.Workers),
+		router.WithMiddlewares(retry, middleware.Progress(progress)),
+		router.WithCodecs(codecs...),
+	)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	brokersChecker := kafka.NewBrokersChecker(cfg.Kafka)
+	app.OnClose("brokers checker", brokersChecker)
+
+	checker := health.NewChecker(health.DefaultTimeout)
+
+	opsMux := http.NewServeMux()
+	opsMux.Handle("/metrics", metrics.Handler())
+	checker.Register(opsMux)
+
+	app.Serve("ops server", &http.Server{
+		Addr:    cfg.Metrics.Addr,
+		Handler: opsMux,
+	})
+
+	cleaner := dedup.NewCleaner(dbMaster, cfg.Dedup.Retention, cfg.Dedup.Interval, cfg.Dedup.BatchSize)
+	app.Go("dedup cleaner", func(ctx context.Context) error {
+		cleaner.Run(ctx, progress)
+		return nil
+	})
 
 	consumer, err := kafka.NewSaramaConsumer(
-		ctx,
-		cfg.Brokers,
-		[]string{"reserved_orders", "receipts", "reset", "cancel"},
+		app.Context(),
+		cfg.Kafka,
+		[]string{
+			events.TopicReservedOrders,
+			events.TopicReceipts,
+			events.TopicReset,
+			events.TopicCancel,
+		},
 		"billing",
 		hdl,
 	)
 	if err != nil {
-		log.Fatalf("init consumer err: %v", err)
+		lg.Fatal("init consumer err", logger.Err(err))
 	}
+	app.OnShutdown("consumer", consumer.Shutdown)
+
+	checker.AddLiveness("progress", progress)
+	checker.AddReadiness("db_master", dbMaster)
+	checker.AddReadiness("db_replica", dbReplica)
+	checker.AddReadiness("redis", cch)
+	checker.AddReadiness("kafka", brokersChecker)
+	checker.AddReadiness("consumer", consumer)
 
-	<-ctx.Done()
-	consumer.Close()
+	app.Exit()
 }
@@ -0,0 +1,8 @@
+package main
+
+import "gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+
+type Config struct {
+	Kafka            util.KafkaConfig `mapstructure:"kafka" validate:"required"`
+	DeadLetterSuffix string           `mapstructure:"deadLetterSuffix" validate:"required"`
+}
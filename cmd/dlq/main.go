@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: dlq <list|replay> -topics <topic,...> [flags]
+
+Lists or replays messages from dead-letter topics. Topics are the original ones,
+the dead-letter suffix from the config is appended to them.
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	if cmd != "list" && cmd != "replay" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	topics := fs.String("topics", "", "comma separated original topics, e.g. saved_orders,reset")
+	orderID := fs.String("order-id", "", "select messages of the order")
+	errSubstr := fs.String("error", "", "select messages whose error contains the substring")
+	since := fs.String("since", "", "select messages failed at or after the time (RFC3339)")
+	until := fs.String("until", "", "select messages failed at or before the time (RFC3339)")
+	limit := fs.Int("limit", 0, "max number of messages per topic, 0 means no limit")
+	dryRun := fs.Bool("dry-run", false, "print messages to be replayed without sending them")
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("parse flags: %v", err)
+	}
+
+	if *topics == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f := filter{
+		OrderID:   *orderID,
+		ErrSubstr: *errSubstr,
+	}
+
+	var err error
+	if f.Since, err = parseTime(*since); err != nil {
+		log.Fatalf("parse since: %v", err)
+	}
+	if f.Until, err = parseTime(*until); err != nil {
+		log.Fatalf("parse until: %v", err)
+	}
+
+	_, filename, _, _ := runtime.Caller(0)
+	rootDir := path.Join(path.Dir(filename), "../..")
+
+	var cfg Config
+
+	err = util.LoadConfig(
+		path.Join(rootDir, "configs"),
+		"dlq",
+		&cfg,
+	)
+	if err != nil {
+		log.Fatalf("load config: %v", err)
+	}
+
+	saramaCfg, err := kafka.NewSaramaConfig(cfg.Kafka)
+	if err != nil {
+		log.Fatalf("create sarama config: %v", err)
+	}
+
+	client, err := sarama.NewClient(cfg.Kafka.Brokers, saramaCfg)
+	if err != nil {
+		log.Fatalf("create sarama client: %v", err)
+	}
+	defer client.Close()
+
+	var dls []*deadLetter
+	for _, topic := range strings.Split(*topics, ",") {
+		res, err := readDeadLetters(client, strings.TrimSpace(topic)+cfg.DeadLetterSuffix, f, *limit)
+		if err != nil {
+			log.Fatalf("read dead letters of %s: %v", topic, err)
+		}
+		dls = append(dls, res...)
+	}
+
+	switch cmd {
+	case "list":
+		printDeadLetters(dls)
+	case "replay":
+		newProducer := func(topic string) (kafka.RawProducer, error) {
+			return kafka.NewSaramaProducer(cfg.Kafka, topic)
+		}
+		if err := replay(newProducer, dls, *dryRun); err != nil {
+			log.Fatalf("replay: %v", err)
+		}
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func printDeadLetters(dls []*deadLetter) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DLQ\tPARTITION\tOFFSET\tORDER\tTOPIC\tATTEMPTS\tFAILED AT\tERROR")
+	for _, dl := range dls {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%d\t%s\t%s\n",
+			dl.Topic, dl.Partition, dl.Offset, dl.Key, dl.OriginalTopic, dl.Attempts,
+			dl.FailedAt.Format(time.RFC3339), dl.Err,
+		)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d message(s)\n", len(dls))
+}
+
+// replay sends dead letters back to their original topics with the producers created by newProducer
+// and prints a summary.
+func replay(newProducer func(topic string) (kafka.RawProducer, error), dls []*deadLetter, dryRun bool) error {
+	producers := make(map[string]kafka.RawProducer)
+	defer func() {
+		for _, p := range producers {
+			p.Close()
+		}
+	}()
+
+	sent := make(map[string]int)
+	for _, dl := range dls {
+		if dl.OriginalTopic == "" {
+			log.Printf("skip %s/%d/%d: no original topic", dl.Topic, dl.Partition, dl.Offset)
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("would replay %s/%d/%d to %s: order %s\n", dl.Topic, dl.Partition, dl.Offset, dl.OriginalTopic, dl.Key)
+			sent[dl.OriginalTopic]++
+			continue
+		}
+
+		p, ok := producers[dl.OriginalTopic]
+		if !ok {
+			var err error
+			p, err = newProducer(dl.OriginalTopic)
+			if err != nil {
+				return fmt.Errorf("create sarama producer: %w", err)
+			}
+			producers[dl.OriginalTopic] = p
+		}
+
+		if err := p.SendRawMessage(dl.replayMessage()); err != nil {
+			return fmt.Errorf("send %s/%d/%d: %w", dl.Topic, dl.Partition, dl.Offset, err)
+		}
+		fmt.Printf("replayed %s/%d/%d to %s: order %s\n", dl.Topic, dl.Partition, dl.Offset, dl.OriginalTopic, dl.Key)
+		sent[dl.OriginalTopic]++
+	}
+
+	topics := make([]string, 0, len(sent))
+	for topic := range sent {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	verb := "replayed"
+	if dryRun {
+		verb = "would replay"
+	}
+
+	fmt.Println()
+	for _, topic := range topics {
+		fmt.Printf("%s %d message(s) to %s\n", verb, sent[topic], topic)
+	}
+	fmt.Printf("%s %d of %d message(s)\n", verb, total(sent), len(dls))
+
+	return nil
+}
+
+func total(m map[string]int) int {
+	var n int
+	for _, v := range m {
+		n += v
+	}
+	return n
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const readTimeout = 5 * time.Second
+
+// deadLetter is a message read from a dead-letter topic.
+type deadLetter struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []*sarama.RecordHeader
+
+	OriginalTopic string
+	Err           string
+	Attempts      int
+	FailedAt      time.Time
+}
+
+func newDeadLetter(msg *sarama.ConsumerMessage) *deadLetter {
+	dl := &deadLetter{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   msg.Headers,
+		FailedAt:  msg.Timestamp,
+	}
+
+	for _, h := range msg.Headers {
+		switch string(h.Key) {
+		case middleware.HeaderDLQOriginalTopic:
+			dl.OriginalTopic = string(h.Value)
+		case middleware.HeaderDLQError:
+			dl.Err = string(h.Value)
+		case middleware.HeaderDLQAttempts:
+			dl.Attempts, _ = strconv.Atoi(string(h.Value))
+		case middleware.HeaderDLQFailedAt:
+			if ts, err := time.Parse(time.RFC3339Nano, string(h.Value)); err == nil {
+				dl.FailedAt = ts
+			}
+		}
+	}
+
+	return dl
+}
+
+// replayMessage builds the message to be sent back to the original topic.
+// Dead-letter headers are dropped, the rest of them are kept as is.
+func (dl *deadLetter) replayMessage() *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: dl.OriginalTopic,
+		Value: sarama.ByteEncoder(dl.Value),
+	}
+	if dl.Key != nil {
+		msg.Key = sarama.ByteEncoder(dl.Key)
+	}
+
+	for _, h := range dl.Headers {
+		if strings.HasPrefix(string(h.Key), "dlq-") {
+			continue
+		}
+		msg.Headers = append(msg.Headers, *h)
+	}
+
+	return msg
+}
+
+// filter selects dead letters to be listed or replayed. Zero fields match everything.
+type filter struct {
+	OrderID   string
+	ErrSubstr string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f filter) match(dl *deadLetter) bool {
+	if f.OrderID != "" && string(dl.Key) != f.OrderID {
+		return false
+	}
+	if f.ErrSubstr != "" && !strings.Contains(dl.Err, f.ErrSubstr) {
+		return false
+	}
+	if !f.Since.IsZero() && dl.FailedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && dl.FailedAt.After(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// readDeadLetters reads every partition of a topic from the oldest message up to
+// the newest one at the moment of the call and returns the ones matching the filter.
+func readDeadLetters(client sarama.Client, topic string, f filter, limit int) ([]*deadLetter, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("new consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("partitions: %w", err)
+	}
+
+	var res []*deadLetter
+	for _, partition := range partitions {
+		oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, fmt.Errorf("get oldest offset: %w", err)
+		}
+
+		newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, fmt.Errorf("get newest offset: %w", err)
+		}
+
+		if oldest >= newest {
+			continue
+		}
+
+		pc, err := consumer.ConsumePartition(topic, partition, oldest)
+		if err != nil {
+			return nil, fmt.Errorf("consume partition %d: %w", partition, err)
+		}
+
+	loop:
+		for {
+			select {
+			case msg, ok := <-pc.Messages():
+				if !ok {
+					break loop
+				}
+
+				if dl := newDeadLetter(msg); f.match(dl) {
+					res = append(res, dl)
+					if limit > 0 && len(res) >= limit {
+						break loop
+					}
+				}
+
+				if msg.Offset >= newest-1 {
+					break loop
+				}
+			case <-time.After(readTimeout):
+				// The rest of the offsets are not messages, e.g. transaction markers.
+				break loop
+			}
+		}
+
+		if err := pc.Close(); err != nil {
+			return nil, fmt.Errorf("close partition consumer %d: %w", partition, err)
+		}
+
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	failedAt := time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC)
+	dl := &deadLetter{Key: []byte("42"), Err: "handle message: not enough stock", FailedAt: failedAt}
+
+	for _, tc := range []struct {
+		name   string
+		filter filter
+		want   bool
+	}{
+		{name: "zero", want: true},
+		{name: "order", filter: filter{OrderID: "42"}, want: true},
+		{name: "another order", filter: filter{OrderID: "4"}},
+		{name: "error", filter: filter{ErrSubstr: "not enough"}, want: true},
+		{name: "another error", filter: filter{ErrSubstr: "timeout"}},
+		{name: "since", filter: filter{Since: failedAt}, want: true},
+		{name: "since later", filter: filter{Since: failedAt.Add(time.Second)}},
+		{name: "until", filter: filter{Until: failedAt}, want: true},
+		{name: "until earlier", filter: filter{Until: failedAt.Add(-time.Second)}},
+		{name: "all", filter: filter{OrderID: "42", ErrSubstr: "stock", Since: failedAt.Add(-time.Hour), Until: failedAt.Add(time.Hour)}, want: true},
+		{name: "all but one", filter: filter{OrderID: "42", ErrSubstr: "stock", Since: failedAt.Add(time.Hour)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.match(dl); got != tc.want {
+				t.Fatalf("match: got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	failedAt := time.Date(2030, 1, 2, 12, 0, 0, 5, time.UTC)
+	msg := &sarama.ConsumerMessage{
+		Topic:     "orders.dlq",
+		Partition: 1,
+		Offset:    7,
+		Key:       []byte("42"),
+		Value:     []byte("order"),
+		Timestamp: failedAt.Add(time.Minute),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("message-id"), Value: []byte("id")},
+			{Key: []byte(middleware.HeaderDLQError), Value: []byte("not enough stock")},
+			{Key: []byte(middleware.HeaderDLQAttempts), Value: []byte("5")},
+			{Key: []byte(middleware.HeaderDLQOriginalTopic), Value: []byte("orders")},
+			{Key: []byte(middleware.HeaderDLQFailedAt), Value: []byte(failedAt.Format(time.RFC3339Nano))},
+		},
+	}
+
+	dl := newDeadLetter(msg)
+	if dl.OriginalTopic != "orders" || dl.Err != "not enough stock" || dl.Attempts != 5 {
+		t.Fatalf("dead letter: got topic %q, error %q, attempts %d", dl.OriginalTopic, dl.Err, dl.Attempts)
+	}
+	if !dl.FailedAt.Equal(failedAt) {
+		t.Fatalf("failed at: got %s, want %s", dl.FailedAt, failedAt)
+	}
+
+	t.Run("failed at defaults to the timestamp", func(t *testing.T) {
+		msg := *msg
+		msg.Headers = msg.Headers[:1]
+
+		if dl := newDeadLetter(&msg); !dl.FailedAt.Equal(msg.Timestamp) {
+			t.Fatalf("failed at: got %s, want %s", dl.FailedAt, msg.Timestamp)
+		}
+	})
+
+	t.Run("replay message", func(t *testing.T) {
+		replayed := dl.replayMessage()
+		if replayed.Topic != "orders" {
+			t.Fatalf("topic: got %q, want orders", replayed.Topic)
+		}
+		if want := []sarama.RecordHeader{{Key: []byte("message-id"), Value: []byte("id")}}; !reflect.DeepEqual(replayed.Headers, want) {
+			t.Fatalf("headers: got %v, want %v", replayed.Headers, want)
+		}
+		if !reflect.DeepEqual(replayed.Key, sarama.ByteEncoder("42")) {
+			t.Fatalf("key: got %v, want 42", replayed.Key)
+		}
+	})
+
+	t.Run("replay message without key", func(t *testing.T) {
+		dl := *dl
+		dl.Key = nil
+
+		if replayed := dl.replayMessage(); replayed.Key != nil {
+			t.Fatalf("key: got %v, want none", replayed.Key)
+		}
+	})
+}
+
+// TestReplay forwards failed messages to dead-letter topics the way consumers do and replays them.
+func TestReplay(t *testing.T) {
+	b := kafkatest.NewBroker()
+
+	dlq, err := kafka.NewSaramaProducerFrom(b.SyncProducer(), "")
+	if err != nil {
+		t.Fatalf("create dead-letter producer: %v", err)
+	}
+
+	retry := middleware.Retry(middleware.RetryPolicy{MaxAttempts: 1, DeadLetterSuffix: ".dlq"}, dlq)
+	fail := retry(func(context.Context, string, []byte) error {
+		return errors.New("not enough stock")
+	})
+
+	originals := []*sarama.ConsumerMessage{
+		{Topic: "saved_orders", Key: []byte("1"), Value: []byte("order 1"), Headers: []*sarama.RecordHeader{{Key: []byte("message-id"), Value: []byte("1")}}},
+		{Topic: "saved_orders", Key: []byte("2"), Value: []byte("order 2"), Headers: []*sarama.RecordHeader{{Key: []byte("message-id"), Value: []byte("2")}}},
+		{Topic: "reset", Key: []byte("3"), Value: []byte("reset 3")},
+	}
+	for _, msg := range originals {
+		ctx := router.ContextWithMessage(context.Background(), msg)
+		if err := fail(ctx, msg.Topic, msg.Value); !router.IsHandled(err) {
+			t.Fatalf("handle %s: got %v, want handled", msg.Key, err)
+		}
+	}
+
+	f := filter{ErrSubstr: "stock"}
+
+	var dls []*deadLetter
+	for _, topic := range []string{"saved_orders.dlq", "reset.dlq"} {
+		for _, msg := range b.Messages(topic) {
+			if dl := newDeadLetter(msg); f.match(dl) {
+				dls = append(dls, dl)
+			}
+		}
+	}
+	if len(dls) != 3 {
+		t.Fatalf("dead letters: got %d, want 3", len(dls))
+	}
+
+	// A dead letter of an unknown topic is skipped.
+	dls = append(dls, &deadLetter{Topic: "unknown.dlq", Key: []byte("4")})
+
+	producers := make(map[string]int)
+	newProducer := func(topic string) (kafka.RawProducer, error) {
+		producers[topic]++
+		return kafka.NewSaramaProducerFrom(b.SyncProducer(), topic)
+	}
+
+	if err := replay(newProducer, dls, true); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(producers) != 0 || len(b.Messages("saved_orders")) != 0 {
+		t.Fatal("dry run: messages sent")
+	}
+
+	if err := replay(newProducer, dls, false); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if want := map[string]int{"saved_orders": 1, "reset": 1}; !reflect.DeepEqual(producers, want) {
+		t.Fatalf("producers: got %v, want %v", producers, want)
+	}
+
+	for _, topic := range []string{"saved_orders", "reset"} {
+		var want []*sarama.ConsumerMessage
+		for _, msg := range originals {
+			if msg.Topic == topic {
+				want = append(want, msg)
+			}
+		}
+
+		got := b.Messages(topic)
+		if len(got) != len(want) {
+			t.Fatalf("replayed to %s: got %d, want %d", topic, len(got), len(want))
+		}
+		for i, msg := range got {
+			if string(msg.Key) != string(want[i].Key) || string(msg.Value) != string(want[i].Value) {
+				t.Fatalf("replayed to %s: got %s=%s, want %s=%s", topic, msg.Key, msg.Value, want[i].Key, want[i].Value)
+			}
+			if !reflect.DeepEqual(headerMap(msg.Headers), headerMap(want[i].Headers)) {
+				t.Fatalf("replayed headers of %s: got %v, want %v", msg.Key, headerMap(msg.Headers), headerMap(want[i].Headers))
+			}
+		}
+	}
+}
+
+func headerMap(headers []*sarama.RecordHeader) map[string]string {
+	m := make(map[string]string, len(headers))
+	for _, h := range headers {
+		m[string(h.Key)] = string(h.Value)
+	}
+	return m
+}
@@ -3,10 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/notification"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/lifecycle"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/migrate"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
-	"log"
+	"net/http"
+	"os"
 	"path"
 	"runtime"
 )
@@ -23,46 +35,124 @@ func main() {
 		&cfg,
 	)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		logger.Default().Fatal("load config", logger.Err(err))
 	}
 
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		logger.Default().Fatal("parse log level", logger.Err(err))
+	}
+
+	lg := logger.New(os.Stdout, level).With(logger.String("service", "notifications"))
+	logger.SetDefault(lg)
+
 	dbSource := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		cfg.DB.Host, cfg.DB.Port, cfg.DB.User, cfg.DB.Password, cfg.DB.Name, cfg.DB.SSLMode,
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(dbSource, migrations.Notifications, os.Args[2:]); err != nil {
+			lg.Fatal("migrate", logger.Err(err))
+		}
+		return
+	}
+
+	app := lifecycle.New(cfg.ShutdownTimeout)
+
+	shutdownTracing, err := tracing.Init(app.Context(), "notifications", cfg.Tracing)
+	if err != nil {
+		lg.Fatal("init tracing", logger.Err(err))
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
 	db, err := util.OpenDB(dbSource)
 	if err != nil {
-		log.Fatalf("failed to open db: %v", err)
+		lg.Fatal("failed to open db", logger.Err(err))
+	}
+	app.OnShutdown("db", func(context.Context) error {
+		db.Close()
+		return nil
+	})
+
+	metrics.RegisterPool("main", db)
+
+	codec, codecs, err := events.NewCodecs(cfg.Codec)
+	if err != nil {
+		lg.Fatal("init codecs", logger.Err(err))
 	}
 
 	repo := notification.NewPgRepo(db)
 
-	emailNotificationsProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "email_notifications")
+	emailNotificationsProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicEmailNotifications, cfg.Producers[events.TopicEmailNotifications], kafka.WithProducerName("notifications"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("email_notifications producer", emailNotificationsProducer)
 
 	kafkaClient := notification.NewKafkaClient(emailNotificationsProducer)
 
 	svc := notification.NewService(repo, kafkaClient)
 
-	hdl := notification.NewKafkaHandler(svc)
+	dlqProducer, err := kafka.NewSaramaProducer(cfg.Kafka, "")
+	if err != nil {
+		lg.Fatal("create sarama producer", logger.Err(err))
+	}
+	app.OnClose("dlq producer", dlqProducer)
+
+	progress := health.NewProgress(cfg.Metrics.StallTimeout)
+
+	retry := middleware.Retry(middleware.RetryPolicy{
+		MaxAttempts:      cfg.Retry.MaxAttempts,
+		InitialBackoff:   cfg.Retry.InitialBackoff,
+		MaxBackoff:       cfg.Retry.MaxBackoff,
+		DeadLetterSuffix: cfg.Retry.DeadLetterSuffix,
+		Permanent:        []error{notification.ErrInvalidMsg, notification.ErrNotFound, notification.ErrFailedPrecondition},
+	}, dlqProducer)
+
+	hdl := notification.NewKafkaHandler(
+		svc,
+		router.WithWorkers(cfg.Workers),
+		router.WithMiddlewares(retry, middleware.Progress(progress)),
+		router.WithCodecs(codecs...),
+	)
+
+	brokersChecker := kafka.NewBrokersChecker(cfg.Kafka)
+	app.OnClose("brokers checker", brokersChecker)
+
+	checker := health.NewChecker(health.DefaultTimeout)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	opsMux := http.NewServeMux()
+	opsMux.Handle("/metrics", metrics.Handler())
+	checker.Register(opsMux)
+
+	app.Serve("ops server", &http.Server{
+		Addr:    cfg.Metrics.Addr,
+		Handler: opsMux,
+	})
+
+	cleaner := dedup.NewCleaner(db, cfg.Dedup.Retention, cfg.Dedup.Interval, cfg.Dedup.BatchSize)
+	app.Go("dedup cleaner", func(ctx context.Context) error {
+		cleaner.Run(ctx, progress)
+		return nil
+	})
 
 	consumer, err := kafka.NewSaramaConsumer(
-		ctx,
-		cfg.Brokers,
-		[]string{"paid_orders", "check"},
+		app.Context(),
+		cfg.Kafka,
+		[]string{events.TopicPaidOrders, events.TopicCheck},
 		"orders",
 		hdl,
 	)
 	if err != nil {
-		log.Fatalf("init consumer err: %v", err)
+		lg.Fatal("init consumer err", logger.Err(err))
 	}
+	app.OnShutdown("consumer", consumer.Shutdown)
+
+	checker.AddLiveness("progress", progress)
+	checker.AddReadiness("db", db)
+	checker.AddReadiness("kafka", brokersChecker)
+	checker.AddReadiness("consumer", consumer)
 
-	<-ctx.Done()
-	consumer.Close()
+	app.Exit()
 }
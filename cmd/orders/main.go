@@ -2,11 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/order"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/lifecycle"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/migrate"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
-	"log"
+	"net/http"
+	"os"
 	"path"
 	"runtime"
 )
@@ -23,58 +36,197 @@ func main() {
 		&cfg,
 	)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		logger.Default().Fatal("load config", logger.Err(err))
 	}
 
-	log.Printf("config: %#v", cfg)
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		logger.Default().Fatal("parse log level", logger.Err(err))
+	}
+
+	lg := logger.New(os.Stdout, level).With(logger.String("service", "orders"))
+	logger.SetDefault(lg)
 
 	dbSource := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		cfg.DB.Host, cfg.DB.Port, cfg.DB.User, cfg.DB.Password, cfg.DB.Name, cfg.DB.SSLMode,
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(dbSource, migrations.Orders, os.Args[2:]); err != nil {
+			lg.Fatal("migrate", logger.Err(err))
+		}
+		return
+	}
+
+	app := lifecycle.New(cfg.ShutdownTimeout)
+
+	shutdownTracing, err := tracing.Init(app.Context(), "orders", cfg.Tracing)
+	if err != nil {
+		lg.Fatal("init tracing", logger.Err(err))
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
+	lg.Debug("config loaded", logger.Any("config", cfg))
+
 	db, err := util.OpenDB(dbSource)
 	if err != nil {
-		log.Fatalf("failed to open db: %v", err)
+		lg.Fatal("failed to open db", logger.Err(err))
+	}
+	app.OnShutdown("db", func(context.Context) error {
+		db.Close()
+		return nil
+	})
+
+	metrics.RegisterPool("main", db)
+
+	codec, codecs, err := events.NewCodecs(cfg.Codec)
+	if err != nil {
+		lg.Fatal("init codecs", logger.Err(err))
+	}
+
+	timeouts := make(order.Timeouts, len(cfg.Timeouts.Steps))
+	for name, timeout := range cfg.Timeouts.Steps {
+		status, err := order.ParseStatus(name)
+		if err != nil {
+			lg.Fatal("parse timeout step", logger.Err(err))
+		}
+		if status == order.Paid {
+			lg.Fatal("parse timeout step", logger.Err(errors.New("paid orders cannot time out")))
+		}
+		timeouts[status] = timeout
+	}
+
+	repo := order.NewPgRepo(db, timeouts)
+
+	// The outbox relay marks messages sent once SendMessage returns, so they must be delivered by then.
+	for topic, producerCfg := range cfg.Producers {
+		if producerCfg.Async {
+			lg.Fatal("outbox producers must be synchronous", logger.String("topic", topic))
+		}
+	}
+
+	savedOrdersProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicSavedOrders, cfg.Producers[events.TopicSavedOrders], kafka.WithProducerName("orders"), kafka.WithCodec(codec))
+	if err != nil {
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("saved_orders producer", savedOrdersProducer)
 
-	repo := order.NewPgRepo(db)
+	paidOrdersProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicPaidOrders, cfg.Producers[events.TopicPaidOrders], kafka.WithProducerName("orders"), kafka.WithCodec(codec))
+	if err != nil {
+		lg.Fatal("create sarama producer", logger.Err(err))
+	}
+	app.OnClose("paid_orders producer", paidOrdersProducer)
 
-	savedOrdersProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "saved_orders")
+	resetProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicReset, cfg.Producers[events.TopicReset], kafka.WithProducerName("orders"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("reset producer", resetProducer)
 
-	paidOrdersProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "paid_orders")
+	cancelProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicCancel, cfg.Producers[events.TopicCancel], kafka.WithProducerName("orders"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("cancel producer", cancelProducer)
+
+	relay := order.NewOutboxRelay(
+		repo,
+		map[string]kafka.Producer{
+			events.TopicSavedOrders: savedOrdersProducer,
+			events.TopicPaidOrders:  paidOrdersProducer,
+			events.TopicReset:       resetProducer,
+			events.TopicCancel:      cancelProducer,
+		},
+		cfg.Outbox.Interval,
+		cfg.Outbox.BatchSize,
+	)
+
+	watcher := order.NewTimeoutWatcher(repo, cfg.Timeouts.Interval, cfg.Timeouts.BatchSize)
 
-	resetProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "reset")
+	svc := order.NewService(repo)
+
+	dlqProducer, err := kafka.NewSaramaProducer(cfg.Kafka, "")
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("dlq producer", dlqProducer)
+
+	progress := health.NewProgress(cfg.Metrics.StallTimeout)
+
+	retry := middleware.Retry(middleware.RetryPolicy{
+		MaxAttempts:      cfg.Retry.MaxAttempts,
+		InitialBackoff:   cfg.Retry.InitialBackoff,
+		MaxBackoff:       cfg.Retry.MaxBackoff,
+		DeadLetterSuffix: cfg.Retry.DeadLetterSuffix,
+		Permanent:        []error{order.ErrInvalidMsg, order.ErrNotFound, order.ErrFailedPrecondition, order.ErrIllegalTransition},
+	}, dlqProducer)
+
+	hdl := order.NewKafkaHandler(
+		svc,
+		router.WithWorkers(cfg.Workers),
+		router.WithMiddlewares(retry, middleware.Progress(progress)),
+		router.WithCodecs(codecs...),
+	)
 
-	kafkaClient := order.NewKafkaClient(savedOrdersProducer, paidOrdersProducer, resetProducer)
+	brokersChecker := kafka.NewBrokersChecker(cfg.Kafka)
+	app.OnClose("brokers checker", brokersChecker)
 
-	svc := order.NewService(repo, kafkaClient)
+	checker := health.NewChecker(health.DefaultTimeout)
 
-	hdl := order.NewKafkaHandler(svc)
+	opsMux := http.NewServeMux()
+	opsMux.Handle("/metrics", metrics.Handler())
+	checker.Register(opsMux)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	app.Serve("ops server", &http.Server{
+		Addr:    cfg.Metrics.Addr,
+		Handler: opsMux,
+	})
+
+	app.Go("outbox relay", func(ctx context.Context) error {
+		relay.Run(ctx, progress)
+		return nil
+	})
+	app.Go("timeout watcher", func(ctx context.Context) error {
+		watcher.Run(ctx, progress)
+		return nil
+	})
+
+	cleaner := dedup.NewCleaner(db, cfg.Dedup.Retention, cfg.Dedup.Interval, cfg.Dedup.BatchSize)
+	app.Go("dedup cleaner", func(ctx context.Context) error {
+		cleaner.Run(ctx, progress)
+		return nil
+	})
+
+	app.Serve("http server", &http.Server{
+		Addr:    cfg.HTTP.Addr,
+		Handler: order.NewHTTPHandler(svc),
+	})
 
 	consumer, err := kafka.NewSaramaConsumer(
-		ctx,
-		cfg.Brokers,
-		[]string{"new_orders", "reset", "cancel", "paid_payments"},
+		app.Context(),
+		cfg.Kafka,
+		[]string{
+			events.TopicNewOrders,
+			events.TopicReservedOrders,
+			events.TopicPendingPayments,
+			events.TopicPaidPayments,
+			events.TopicCollectedOrders,
+			events.TopicReset,
+			events.TopicCancel,
+		},
 		"orders",
 		hdl,
 	)
 	if err != nil {
-		log.Fatalf("init consumer err: %v", err)
+		lg.Fatal("init consumer err", logger.Err(err))
 	}
+	app.OnShutdown("consumer", consumer.Shutdown)
+
+	checker.AddLiveness("progress", progress)
+	checker.AddReadiness("db", db)
+	checker.AddReadiness("kafka", brokersChecker)
+	checker.AddReadiness("consumer", consumer)
 
-	<-ctx.Done()
-	consumer.Close()
+	app.Exit()
 }
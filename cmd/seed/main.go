@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util/random"
 	"log"
@@ -41,7 +42,26 @@ func seedWarehouses(ctx context.Context, cfg Config) error {
 		return fmt.Errorf("failed to open db: %w", err)
 	}
 
-	query := "INSERT INTO quantities (product_id, quantity) VALUES ($1, $2) ON CONFLICT (product_id) DO NOTHING"
+	repo := stock.NewPgRepo(db)
+
+	warehouseIDs := make([]uint64, 0, 3)
+	for i := 1; i <= 3; i++ {
+		var id uint64
+		err := db.QueryRow(ctx, `
+INSERT INTO warehouses (name) VALUES ($1)
+ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+RETURNING warehouse_id`,
+			fmt.Sprintf("warehouse-%d", i),
+		).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("db query row: %w", err)
+		}
+		warehouseIDs = append(warehouseIDs, id)
+	}
+
+	productQuery := `
+INSERT INTO products (product_id, sku, name, price, weight, active) VALUES ($1, $2, $3, $4, $5, true)
+ON CONFLICT DO NOTHING`
 
 	ids := make(map[int64]struct{}, 50)
 
@@ -56,11 +76,26 @@ func seedWarehouses(ctx context.Context, cfg Config) error {
 			}
 		}
 
-		qnt := random.From0To1000()
-		_, err := db.Exec(ctx, query, id, qnt)
+		price := float64(random.Int(100, 100000)) / 100
+		weight := random.Int(10, 20000)
+		_, err := db.Exec(ctx, productQuery, id, fmt.Sprintf("SKU-%d", id), random.String(8), price, weight)
 		if err != nil {
 			return fmt.Errorf("db exec: %w", err)
 		}
+
+		// Restocking records the quantities in the inventory ledger.
+		for _, warehouseID := range warehouseIDs {
+			_, err := repo.Restock(ctx, stock.RestockReq{
+				WarehouseID: warehouseID,
+				ProductID:   uint64(id),
+				Quantity:    uint64(random.From1To1000()),
+				Reason:      stock.ReasonDelivery,
+				Note:        "seed",
+			})
+			if err != nil {
+				return fmt.Errorf("restock: %w", err)
+			}
+		}
 	}
 
 	return nil
@@ -1,8 +1,26 @@
 package main
 
-import "gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+import (
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"time"
+)
 
 type Config struct {
-	DB      util.DBConfig `mapstructure:"db" validate:"required"`
-	Brokers []string      `mapstructure:"brokers" validate:"required"`
+	DB              util.DBConfig                  `mapstructure:"db" validate:"required"`
+	Kafka           util.KafkaConfig               `mapstructure:"kafka" validate:"required"`
+	Workers         int                            `mapstructure:"workers"`
+	Retry           util.RetryConfig               `mapstructure:"retry" validate:"required"`
+	Tracing         util.TracingConfig             `mapstructure:"tracing" validate:"required"`
+	Metrics         util.MetricsConfig             `mapstructure:"metrics" validate:"required"`
+	Log             util.LogConfig                 `mapstructure:"log" validate:"required"`
+	Codec           util.CodecConfig               `mapstructure:"codec" validate:"required"`
+	Producers       map[string]util.ProducerConfig `mapstructure:"producers" validate:"dive"`
+	Dedup           util.RetentionConfig           `mapstructure:"dedup" validate:"required"`
+	Transactions    util.TransactionsConfig        `mapstructure:"transactions"`
+	ShutdownTimeout time.Duration                  `mapstructure:"shutdownTimeout" validate:"required"`
+	// Admin.Token authorizes the admin API requests and may refer to environment variables, e.g. ${ADMIN_TOKEN}.
+	Admin struct {
+		Addr  string `mapstructure:"addr" validate:"required"`
+		Token string `mapstructure:"token" validate:"required"`
+	} `mapstructure:"admin" validate:"required"`
 }
@@ -3,10 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/lifecycle"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/migrate"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
-	"log"
+	"net/http"
+	"os"
 	"path"
 	"runtime"
 )
@@ -23,51 +35,170 @@ func main() {
 		&cfg,
 	)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		logger.Default().Fatal("load config", logger.Err(err))
 	}
 
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		logger.Default().Fatal("parse log level", logger.Err(err))
+	}
+
+	lg := logger.New(os.Stdout, level).With(logger.String("service", "stock"))
+	logger.SetDefault(lg)
+
 	dbSource := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		cfg.DB.Host, cfg.DB.Port, cfg.DB.User, cfg.DB.Password, cfg.DB.Name, cfg.DB.SSLMode,
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(dbSource, migrations.Stock, os.Args[2:]); err != nil {
+			lg.Fatal("migrate", logger.Err(err))
+		}
+		return
+	}
+
+	app := lifecycle.New(cfg.ShutdownTimeout)
+
+	shutdownTracing, err := tracing.Init(app.Context(), "stock", cfg.Tracing)
+	if err != nil {
+		lg.Fatal("init tracing", logger.Err(err))
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
 	db, err := util.OpenDB(dbSource)
 	if err != nil {
-		log.Fatalf("failed to open db: %v", err)
+		lg.Fatal("failed to open db", logger.Err(err))
+	}
+	app.OnShutdown("db", func(context.Context) error {
+		db.Close()
+		return nil
+	})
+
+	metrics.RegisterPool("main", db)
+
+	codec, codecs, err := events.NewCodecs(cfg.Codec)
+	if err != nil {
+		lg.Fatal("init codecs", logger.Err(err))
 	}
 
 	repo := stock.NewPgRepo(db)
 
-	reservedOrdersProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "reserved_orders")
+	reservedOrdersProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicReservedOrders, cfg.Producers[events.TopicReservedOrders], kafka.WithProducerName("stock"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("reserved_orders producer", reservedOrdersProducer)
 
-	resetProducer, err := kafka.NewSaramaProducer(cfg.Brokers, "reset")
+	collectedOrdersProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicCollectedOrders, cfg.Producers[events.TopicCollectedOrders], kafka.WithProducerName("stock"), kafka.WithCodec(codec))
 	if err != nil {
-		log.Fatalf("create sarama producer: %v", err)
+		lg.Fatal("create sarama producer", logger.Err(err))
 	}
+	app.OnClose("collected_orders producer", collectedOrdersProducer)
 
-	kafkaClient := stock.NewKafkaClient(reservedOrdersProducer, resetProducer)
+	resetProducer, err := kafka.NewProducer(cfg.Kafka, events.TopicReset, cfg.Producers[events.TopicReset], kafka.WithProducerName("stock"), kafka.WithCodec(codec))
+	if err != nil {
+		lg.Fatal("create sarama producer", logger.Err(err))
+	}
+	app.OnClose("reset producer", resetProducer)
+
+	kafkaClient := stock.NewKafkaClient(reservedOrdersProducer, collectedOrdersProducer, resetProducer)
 
 	svc := stock.NewService(repo, kafkaClient)
 
-	hdl := stock.NewKafkaHandler(svc)
+	dlqProducer, err := kafka.NewSaramaProducer(cfg.Kafka, "")
+	if err != nil {
+		lg.Fatal("create sarama producer", logger.Err(err))
+	}
+	app.OnClose("dlq producer", dlqProducer)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	progress := health.NewProgress(cfg.Metrics.StallTimeout)
+
+	retry := middleware.Retry(middleware.RetryPolicy{
+		MaxAttempts:      cfg.Retry.MaxAttempts,
+		InitialBackoff:   cfg.Retry.InitialBackoff,
+		MaxBackoff:       cfg.Retry.MaxBackoff,
+		DeadLetterSuffix: cfg.Retry.DeadLetterSuffix,
+		Permanent:        []error{stock.ErrInvalidMsg, stock.ErrNotFound, stock.ErrNotEnough, stock.ErrFailedPrecondition},
+	}, dlqProducer)
+
+	routerOpts := []router.Option{
+		router.WithWorkers(cfg.Workers),
+		router.WithMiddlewares(retry, middleware.Progress(progress)),
+		router.WithCodecs(codecs...),
+	}
+
+	if cfg.Transactions.Enabled {
+		instance := os.ExpandEnv(cfg.Transactions.Instance)
+		if instance == "" {
+			lg.Fatal("transactions instance is empty", logger.String("instance", cfg.Transactions.Instance))
+		}
+
+		txProducer, err := kafka.NewSaramaTxProducer(cfg.Kafka, cfg.Transactions.ID+"-"+instance)
+		if err != nil {
+			lg.Fatal("create transactional producer", logger.Err(err))
+		}
+		app.OnClose("transactional producer", txProducer)
+
+		routerOpts = append(routerOpts, router.WithTransactions(txProducer, "stock"))
+	}
+
+	hdl := stock.NewKafkaHandler(svc, routerOpts...)
+
+	brokersChecker := kafka.NewBrokersChecker(cfg.Kafka)
+	app.OnClose("brokers checker", brokersChecker)
+
+	checker := health.NewChecker(health.DefaultTimeout)
+
+	opsMux := http.NewServeMux()
+	opsMux.Handle("/metrics", metrics.Handler())
+	checker.Register(opsMux)
+
+	app.Serve("ops server", &http.Server{
+		Addr:    cfg.Metrics.Addr,
+		Handler: opsMux,
+	})
+
+	adminToken := os.ExpandEnv(cfg.Admin.Token)
+	if adminToken == "" {
+		lg.Fatal("admin token is empty", logger.String("token", cfg.Admin.Token))
+	}
+
+	app.Serve("admin server", &http.Server{
+		Addr:    cfg.Admin.Addr,
+		Handler: stock.NewHTTPHandler(svc, adminToken),
+	})
+
+	cleaner := dedup.NewCleaner(db, cfg.Dedup.Retention, cfg.Dedup.Interval, cfg.Dedup.BatchSize,
+		// Tombstones of cancelled orders are kept for the orders redelivered late, as processed messages are.
+		dedup.WithTable("cancelled_orders", "cancelled_at", cfg.Dedup.Retention),
+	)
+	app.Go("dedup cleaner", func(ctx context.Context) error {
+		cleaner.Run(ctx, progress)
+		return nil
+	})
 
 	consumer, err := kafka.NewSaramaConsumer(
-		ctx,
-		cfg.Brokers,
-		[]string{"saved_orders", "reset", "cancel", "paid_orders"},
+		app.Context(),
+		cfg.Kafka,
+		[]string{
+			events.TopicSavedOrders,
+			events.TopicReset,
+			events.TopicCancel,
+			events.TopicPaidOrders,
+		},
 		"stock",
 		hdl,
 	)
 	if err != nil {
-		log.Fatalf("init consumer err: %v", err)
+		lg.Fatal("init consumer err", logger.Err(err))
 	}
+	app.OnShutdown("consumer", consumer.Shutdown)
+
+	checker.AddLiveness("progress", progress)
+	checker.AddReadiness("db", db)
+	checker.AddReadiness("kafka", brokersChecker)
+	checker.AddReadiness("consumer", consumer)
 
-	<-ctx.Done()
-	consumer.Close()
+	app.Exit()
 }
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX processed_messages_processed_at_idx ON processed_messages (processed_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS processed_messages_processed_at_idx;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+// Package migrations embeds the goose migrations of the service databases, one directory per service,
+// so that the binaries apply them without the sources, see migrate.Run.
+package migrations
+
+import "embed"
+
+// Directories of the service migrations in FS.
+const (
+	Billing       = "billing"
+	Notifications = "notifications"
+	Orders        = "orders"
+	Stock         = "stock"
+)
+
+// FS holds the migrations of every service.
+//
+//go:embed billing/*.sql notifications/*.sql orders/*.sql stock/*.sql
+var FS embed.FS
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE outbox
+(
+    id         bigserial PRIMARY KEY,
+    topic      varchar   NOT NULL,
+    key        varchar   NOT NULL,
+    payload    jsonb     NOT NULL,
+    created_at timestamp NOT NULL DEFAULT now(),
+    sent_at    timestamp
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS outbox;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TYPE order_status AS ENUM ('created', 'reserved', 'payment_pending', 'paid', 'collected', 'cancelled', 'failed');
+
+CREATE TABLE orders_statuses
+(
+    order_id   bigint PRIMARY KEY REFERENCES orders (order_id),
+    status     order_status NOT NULL DEFAULT 'created',
+    updated_at timestamp    NOT NULL DEFAULT now()
+);
+
+CREATE TABLE orders_statuses_history
+(
+    id          bigserial PRIMARY KEY,
+    order_id    bigint       NOT NULL REFERENCES orders (order_id),
+    from_status order_status,
+    to_status   order_status NOT NULL,
+    reason      varchar      NOT NULL,
+    created_at  timestamp    NOT NULL DEFAULT now()
+);
+
+CREATE INDEX orders_statuses_history_order_id_idx ON orders_statuses_history (order_id);
+
+INSERT INTO orders_statuses (order_id)
+SELECT order_id
+FROM orders;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS orders_statuses_history;
+DROP TABLE IF EXISTS orders_statuses;
+DROP TYPE IF EXISTS order_status;
+-- +goose StatementEnd
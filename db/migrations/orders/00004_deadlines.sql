@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE orders_deadlines
+(
+    order_id   bigint PRIMARY KEY REFERENCES orders (order_id),
+    status     order_status NOT NULL,
+    expires_at timestamp    NOT NULL
+);
+
+CREATE INDEX orders_deadlines_expires_at_idx ON orders_deadlines (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS orders_deadlines;
+-- +goose StatementEnd
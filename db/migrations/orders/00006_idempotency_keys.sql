@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE idempotency_keys
+(
+    key          varchar PRIMARY KEY,
+    request_hash varchar   NOT NULL,
+    order_id     bigint    NOT NULL REFERENCES orders (order_id),
+    created_at   timestamp NOT NULL DEFAULT now()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS idempotency_keys;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE processed_messages
+(
+    topic        varchar   NOT NULL,
+    partition    integer   NOT NULL,
+    "offset"     bigint    NOT NULL,
+    processed_at timestamp NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (topic, partition, "offset")
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS processed_messages;
+-- +goose StatementEnd
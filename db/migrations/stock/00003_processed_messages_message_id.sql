@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE processed_messages ADD COLUMN message_id varchar;
+
+CREATE UNIQUE INDEX processed_messages_message_id_idx ON processed_messages (message_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS processed_messages_message_id_idx;
+
+ALTER TABLE processed_messages DROP COLUMN IF EXISTS message_id;
+-- +goose StatementEnd
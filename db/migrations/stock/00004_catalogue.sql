@@ -0,0 +1,97 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE products
+(
+    product_id bigint PRIMARY KEY,
+    sku        varchar         NOT NULL UNIQUE,
+    name       varchar         NOT NULL,
+    price      decimal(32, 16) NOT NULL CHECK (price >= 0),
+    weight     bigint          NOT NULL CHECK (weight >= 0),
+    active     boolean         NOT NULL DEFAULT true
+);
+
+COMMENT ON COLUMN products.weight IS 'grams';
+
+CREATE TABLE warehouses
+(
+    warehouse_id bigserial PRIMARY KEY,
+    name         varchar NOT NULL UNIQUE
+);
+
+CREATE TABLE inventory
+(
+    warehouse_id bigint NOT NULL REFERENCES warehouses (warehouse_id),
+    product_id   bigint NOT NULL REFERENCES products (product_id),
+    quantity     bigint NOT NULL CHECK (quantity >= 0),
+
+    PRIMARY KEY (warehouse_id, product_id)
+);
+
+CREATE INDEX inventory_product_id_idx ON inventory (product_id);
+
+-- The stock kept so far moves to the default warehouse, its products get placeholder details.
+INSERT INTO products (product_id, sku, name, price, weight)
+SELECT product_id, 'SKU-' || product_id, 'product ' || product_id, 0, 0
+FROM quantities;
+
+INSERT INTO warehouses (name)
+SELECT 'default'
+WHERE EXISTS(SELECT 1 FROM quantities);
+
+INSERT INTO inventory (warehouse_id, product_id, quantity)
+SELECT w.warehouse_id, q.product_id, q.quantity
+FROM quantities q,
+     warehouses w
+WHERE w.name = 'default';
+
+ALTER TABLE reservations ADD COLUMN warehouse_id bigint;
+
+UPDATE reservations
+SET warehouse_id = (SELECT warehouse_id FROM warehouses WHERE name = 'default');
+
+ALTER TABLE reservations ALTER COLUMN warehouse_id SET NOT NULL;
+ALTER TABLE reservations DROP CONSTRAINT reservations_pkey;
+ALTER TABLE reservations DROP CONSTRAINT reservations_product_id_fkey;
+ALTER TABLE reservations ADD PRIMARY KEY (order_id, product_id, warehouse_id);
+ALTER TABLE reservations
+    ADD FOREIGN KEY (warehouse_id, product_id) REFERENCES inventory (warehouse_id, product_id);
+
+DROP TABLE quantities;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE quantities
+(
+    product_id bigint PRIMARY KEY,
+    quantity   bigint NOT NULL CHECK (quantity >= 0)
+);
+
+INSERT INTO quantities (product_id, quantity)
+SELECT product_id, sum(quantity)
+FROM inventory
+GROUP BY product_id;
+
+-- Reservations split across warehouses are merged back.
+ALTER TABLE reservations RENAME TO reservations_by_warehouse;
+ALTER TABLE reservations_by_warehouse DROP CONSTRAINT reservations_pkey;
+
+CREATE TABLE reservations
+(
+    order_id   bigint NOT NULL,
+    product_id bigint NOT NULL REFERENCES quantities (product_id),
+    quantity   bigint NOT NULL CHECK (quantity >= 0),
+
+    PRIMARY KEY (order_id, product_id)
+);
+
+INSERT INTO reservations (order_id, product_id, quantity)
+SELECT order_id, product_id, sum(quantity)
+FROM reservations_by_warehouse
+GROUP BY order_id, product_id;
+
+DROP TABLE reservations_by_warehouse;
+DROP TABLE IF EXISTS inventory;
+DROP TABLE IF EXISTS warehouses;
+DROP TABLE IF EXISTS products;
+-- +goose StatementEnd
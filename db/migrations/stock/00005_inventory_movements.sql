@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE inventory_movements
+(
+    movement_id  bigserial PRIMARY KEY,
+    warehouse_id bigint      NOT NULL,
+    product_id   bigint      NOT NULL,
+    kind         varchar     NOT NULL,
+    reason       varchar,
+    order_id     bigint,
+    delta        bigint      NOT NULL,
+    quantity     bigint      NOT NULL CHECK (quantity >= 0),
+    note         varchar     NOT NULL DEFAULT '',
+    created_at   timestamptz NOT NULL DEFAULT now(),
+
+    FOREIGN KEY (warehouse_id, product_id) REFERENCES inventory (warehouse_id, product_id)
+);
+
+COMMENT ON TABLE inventory_movements IS 'append-only, the deltas of a warehouse and product sum up to its quantity';
+
+CREATE INDEX inventory_movements_product_id_idx ON inventory_movements (product_id, movement_id);
+
+-- The quantities kept so far are the opening balances of the ledger.
+INSERT INTO inventory_movements (warehouse_id, product_id, kind, reason, delta, quantity)
+SELECT warehouse_id, product_id, 'set', 'opening', quantity, quantity
+FROM inventory
+ORDER BY warehouse_id, product_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS inventory_movements;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE cancelled_orders
+(
+    order_id     bigint      NOT NULL PRIMARY KEY,
+    cancelled_at timestamptz NOT NULL DEFAULT now()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS cancelled_orders;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX processed_messages_processed_at_idx ON processed_messages (processed_at);
+
+CREATE INDEX cancelled_orders_cancelled_at_idx ON cancelled_orders (cancelled_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS cancelled_orders_cancelled_at_idx;
+
+DROP INDEX IF EXISTS processed_messages_processed_at_idx;
+-- +goose StatementEnd
@@ -1,15 +1,17 @@
 package billing
 
 import (
+	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
 )
 
 // KafkaClient sends predefined messages to kafka.
 type KafkaClient interface {
-	SendPendingPayment(payment Payment) error
-	SendPaidPayment(payment Payment) error
-	SendReset(msg ResetMsg) error
+	SendPendingPayment(ctx context.Context, payment events.Payment) error
+	SendPaidPayment(ctx context.Context, payment events.Payment) error
+	SendReset(ctx context.Context, msg events.ResetMsg) error
 }
 
 type kafkaClient struct {
@@ -31,22 +33,22 @@ func NewKafkaClient(
 	}
 }
 
-func (c *kafkaClient) SendPendingPayment(payment Payment) error {
-	if err := c.pendingPaymentsProducer.SendMessage(fmt.Sprint(payment.OrderID), payment); err != nil {
+func (c *kafkaClient) SendPendingPayment(ctx context.Context, payment events.Payment) error {
+	if err := c.pendingPaymentsProducer.SendMessage(ctx, fmt.Sprint(payment.OrderID), payment); err != nil {
 		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
 	}
 	return nil
 }
 
-func (c *kafkaClient) SendPaidPayment(payment Payment) error {
-	if err := c.paidPaymentsProducer.SendMessage(fmt.Sprint(payment.OrderID), payment); err != nil {
+func (c *kafkaClient) SendPaidPayment(ctx context.Context, payment events.Payment) error {
+	if err := c.paidPaymentsProducer.SendMessage(ctx, fmt.Sprint(payment.OrderID), payment); err != nil {
 		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
 	}
 	return nil
 }
 
-func (c *kafkaClient) SendReset(msg ResetMsg) error {
-	if err := c.resetProducer.SendMessage(fmt.Sprint(msg.OrderID), msg); err != nil {
+func (c *kafkaClient) SendReset(ctx context.Context, msg events.ResetMsg) error {
+	if err := c.resetProducer.SendMessage(ctx, fmt.Sprint(msg.OrderID), msg); err != nil {
 		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
 	}
 	return nil
@@ -1,10 +1,23 @@
 package billing
 
-import "errors"
+import (
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+)
 
 var (
-	ErrInternal   = errors.New("internal")
-	ErrNotFound   = errors.New("not found")
-	ErrNotEnough  = errors.New("not enough")
-	ErrInvalidMsg = errors.New("invalid message")
+	ErrInternal           = errors.New("internal")
+	ErrNotFound           = errors.New("not found")
+	ErrNotEnough          = errors.New("not enough")
+	ErrInvalidMsg         = errors.New("invalid message")
+	ErrFailedPrecondition = errors.New("failed precondition")
 )
+
+// errorClasses label message handling errors in metrics.
+var errorClasses = metrics.ErrorClasses{
+	{Name: "invalid_msg", Err: ErrInvalidMsg},
+	{Name: "not_found", Err: ErrNotFound},
+	{Name: "not_enough", Err: ErrNotEnough},
+	{Name: "failed_precondition", Err: ErrFailedPrecondition},
+	{Name: "internal", Err: ErrInternal},
+}
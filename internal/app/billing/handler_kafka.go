@@ -1,31 +1,30 @@
 package billing
 
 import (
-	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 )
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Shopify/sarama"
 )
 
 type KafkaHandler struct {
-	svc      Service
-	router   *router.SaramaRouter
-	validate *validator.Validate
+	svc    Service
+	router *router.SaramaRouter
 }
 
 func NewKafkaHandler(
 	svc Service,
+	opts ...router.Option,
 ) *KafkaHandler {
 	h := &KafkaHandler{
-		svc:      svc,
-		router:   router.NewSaramaRouter(),
-		validate: validator.New(),
+		svc:    svc,
+		router: router.NewSaramaRouter(opts...),
 	}
 
 	h.setupRoutes()
@@ -35,22 +34,22 @@ func NewKafkaHandler(
 
 func (h *KafkaHandler) setupRoutes() {
 	h.router.Use(middleware.Logger)
+	h.router.Use(middleware.Metrics(errorClasses))
+	h.router.Use(middleware.SkipDuplicates)
 
-	h.router.Handle("reserved_orders", h.createPayment)
-	h.router.Handle("receipts", h.approvePayment)
-	h.router.Handle("cancel", h.cancel)
-	h.router.Handle("reset", h.reset)
+	h.router.Handle(events.TopicReservedOrders, h.createPayment)
+	h.router.Handle(events.TopicReceipts, h.approvePayment)
+	h.router.Handle(events.TopicCancel, h.cancel)
+	h.router.Handle(events.TopicReset, h.reset)
 }
 
-func (h *KafkaHandler) createPayment(ctx context.Context, _ string, raw []byte) error {
-	var msg Order
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) createPayment(ctx context.Context, topic string, raw []byte) error {
+	var msg events.Order
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.AddPayment(ctx, msg.OrderID, msg.UserID, msg.Total); err != nil {
 		return fmt.Errorf("createPayment: %w", err)
@@ -59,15 +58,13 @@ func (h *KafkaHandler) createPayment(ctx context.Context, _ string, raw []byte)
 	return nil
 }
 
-func (h *KafkaHandler) approvePayment(ctx context.Context, _ string, raw []byte) error {
-	var msg Receipt
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) approvePayment(ctx context.Context, topic string, raw []byte) error {
+	var msg events.Receipt
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.ApprovePayment(ctx, msg.OrderID); err != nil {
 		return fmt.Errorf("approve payment: %w", err)
@@ -76,15 +73,13 @@ func (h *KafkaHandler) approvePayment(ctx context.Context, _ string, raw []byte)
 	return nil
 }
 
-func (h *KafkaHandler) reset(ctx context.Context, _ string, raw []byte) error {
-	var msg ResetMsg
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) reset(ctx context.Context, topic string, raw []byte) error {
+	var msg events.ResetMsg
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.CancelPayment(ctx, msg.OrderID); err != nil {
 		return fmt.Errorf("cancel reservations: %w", err)
@@ -93,15 +88,13 @@ func (h *KafkaHandler) reset(ctx context.Context, _ string, raw []byte) error {
 	return nil
 }
 
-func (h *KafkaHandler) cancel(ctx context.Context, _ string, raw []byte) error {
-	var msg CancelMsg
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) cancel(ctx context.Context, topic string, raw []byte) error {
+	var msg events.CancelMsg
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.CancelPayment(ctx, msg.OrderID); err != nil {
 		return fmt.Errorf("cancel reservations: %w", err)
@@ -110,6 +103,11 @@ func (h *KafkaHandler) cancel(ctx context.Context, _ string, raw []byte) error {
 	return nil
 }
 
+// Abort cancels handling in flight, see router.SaramaRouter.Abort.
+func (h *KafkaHandler) Abort() {
+	h.router.Abort()
+}
+
 func (h *KafkaHandler) Setup(session sarama.ConsumerGroupSession) error {
 	return h.router.Setup(session)
 }
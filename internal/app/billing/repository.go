@@ -7,8 +7,16 @@ import (
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"time"
 )
 
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/billing")
+
 const (
 	paymentsTable        = "payments"
 	paymentStatusesTable = "payments_statuses"
@@ -35,6 +43,10 @@ func NewPgRepo(dbMaster *pgxpool.Pool, dbReplica *pgxpool.Pool) *pgRepo {
 
 func (r *pgRepo) AddPayment(ctx context.Context, orderID uint64, userID uint64, total float64) error {
 	if err := r.execTx(ctx, r.dbMaster, func(q *pgQueries) error {
+		if err := q.claim(ctx); err != nil {
+			return fmt.Errorf("claim: %w", err)
+		}
+
 		if err := q.createPayment(ctx, orderID, userID, total); err != nil {
 			return fmt.Errorf("create payment: %w", err)
 		}
@@ -59,6 +71,10 @@ func (r *pgRepo) GetPayment(ctx context.Context, orderID uint64) (*Payment, erro
 func (r *pgRepo) ApprovePayment(ctx context.Context, orderID uint64) (*Payment, error) {
 	var p *Payment
 	if err := r.execTx(ctx, r.dbMaster, func(q *pgQueries) error {
+		if err := q.claim(ctx); err != nil {
+			return fmt.Errorf("claim: %w", err)
+		}
+
 		var err error
 
 		if err = q.updateStatus(ctx, orderID, Paid); err != nil {
@@ -88,7 +104,14 @@ func (r *pgRepo) CancelPayment(ctx context.Context, orderID uint64) error {
 
 // execTx creates a database transaction with ReadCommitted isolation level and
 // execute provided function in the scope of the transaction.
-func (r *pgRepo) execTx(ctx context.Context, db *pgxpool.Pool, fn func(queries *pgQueries) error) error {
+func (r *pgRepo) execTx(ctx context.Context, db *pgxpool.Pool, fn func(queries *pgQueries) error) (err error) {
+	ctx, span := tracer.Start(ctx, "pgRepo.execTx")
+	start := time.Now()
+	defer func() {
+		metrics.DBTxDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
 	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
 	if err != nil {
 		return fmt.Errorf("%w: begin transaction: %v", ErrInternal, err)
@@ -98,6 +121,8 @@ func (r *pgRepo) execTx(ctx context.Context, db *pgxpool.Pool, fn func(queries *
 	err = fn(q)
 
 	if err != nil {
+		logger.Debug(ctx, "roll back transaction", logger.Err(err))
+
 		if rbErr := tx.Rollback(ctx); rbErr != nil {
 			return fmt.Errorf("tx: %w, rb: %v", err, rbErr)
 		}
@@ -123,16 +148,36 @@ type pgQueries struct {
 	db DBTX
 }
 
+// claim marks the message being handled as processed, see dedup.Claim.
+func (q *pgQueries) claim(ctx context.Context) error {
+	if err := dedup.Claim(ctx, q.db); err != nil {
+		if errors.Is(err, dedup.ErrDuplicate) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
 var createPaymentQuery = fmt.Sprintf(`
 INSERT INTO %s
 (order_id, user_id, total)
 VALUES ($1, $2, $3)
+ON CONFLICT (order_id) DO NOTHING
 `, paymentsTable)
 
+// createPayment creates the payment of the order. An order has one payment, so an existing one
+// means the order has already been handled, e.g. stock has sent the reserved order again,
+// and dedup.ErrDuplicate is returned.
 func (q *pgQueries) createPayment(ctx context.Context, orderID uint64, userID uint64, total float64) error {
-	if _, err := q.db.Exec(ctx, createPaymentQuery, orderID, userID, total); err != nil {
+	tag, err := q.db.Exec(ctx, createPaymentQuery, orderID, userID, total)
+	if err != nil {
 		return fmt.Errorf("%w: dbMaster exec: %v", ErrInternal, err)
 	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: payment of order %d exists", dedup.ErrDuplicate, orderID)
+	}
 
 	return nil
 }
@@ -164,6 +209,13 @@ VALUES ($1)
 
 func (q *pgQueries) createStatus(ctx context.Context, orderID uint64) error {
 	if _, err := q.db.Exec(ctx, createStatusQuery, orderID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.ConstraintName {
+			case "payments_statuses_pkey":
+				return fmt.Errorf("%w: dbMaster exec: %v", ErrFailedPrecondition, err)
+			}
+		}
 		return fmt.Errorf("%w: dbMaster exec: %v", ErrInternal, err)
 	}
 
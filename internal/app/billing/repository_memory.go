@@ -0,0 +1,119 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"sync"
+)
+
+type memoryPayment struct {
+	payment Payment
+	status  PaymentStatus
+}
+
+type memoryRepo struct {
+	// mu makes every method atomic like a database transaction.
+	mu        sync.Mutex
+	processed *dedup.Processed
+	payments  map[uint64]*memoryPayment
+}
+
+// NewMemoryRepo creates an instance of memoryRepo, a repository keeping payments in memory, e.g. in tests.
+// It behaves the way pgRepo does.
+func NewMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		processed: dedup.NewProcessed(),
+		payments:  make(map[uint64]*memoryPayment),
+	}
+}
+
+func (r *memoryRepo) AddPayment(ctx context.Context, orderID uint64, userID uint64, total float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.processed.Check(ctx); err != nil {
+		return fmt.Errorf("claim: %w", err)
+	}
+
+	if _, ok := r.payments[orderID]; ok {
+		return fmt.Errorf("create payment: %w: payment of order %d exists", dedup.ErrDuplicate, orderID)
+	}
+
+	r.payments[orderID] = &memoryPayment{
+		payment: Payment{
+			OrderID: orderID,
+			UserID:  userID,
+			Total:   total,
+		},
+		status: Pending,
+	}
+
+	r.processed.Record(ctx)
+
+	return nil
+}
+
+func (r *memoryRepo) GetPayment(_ context.Context, orderID uint64) (*Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.getPayment(orderID)
+}
+
+func (r *memoryRepo) ApprovePayment(ctx context.Context, orderID uint64) (*Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.processed.Check(ctx); err != nil {
+		return nil, fmt.Errorf("claim: %w", err)
+	}
+
+	p, err := r.getPayment(orderID)
+	if err != nil {
+		return nil, fmt.Errorf("get payment: %w", err)
+	}
+
+	r.payments[orderID].status = Paid
+
+	r.processed.Record(ctx)
+
+	return p, nil
+}
+
+func (r *memoryRepo) CancelPayment(_ context.Context, orderID uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.payments[orderID]; ok {
+		p.status = Cancelled
+	}
+
+	return nil
+}
+
+// Status returns the status of the order payment.
+func (r *memoryRepo) Status(orderID uint64) (PaymentStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.payments[orderID]
+	if !ok {
+		return 0, fmt.Errorf("%w: payment of order %d", ErrNotFound, orderID)
+	}
+
+	return p.status, nil
+}
+
+// getPayment returns the payment the way pgRepo does, i.e. without the user. r.mu must be held.
+func (r *memoryRepo) getPayment(orderID uint64) (*Payment, error) {
+	p, ok := r.payments[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: payment of order %d", ErrNotFound, orderID)
+	}
+
+	return &Payment{
+		OrderID: orderID,
+		Total:   p.payment.Total,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package billing_test
+
+import (
+	"context"
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/billing"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/pgtest"
+	"testing"
+)
+
+func TestMemoryRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T) billing.Repository {
+		return billing.NewMemoryRepo()
+	})
+}
+
+func TestPgRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T) billing.Repository {
+		db := pgtest.Open(t, migrations.Billing)
+		return billing.NewPgRepo(db, db)
+	})
+}
+
+// testRepository runs the tests every Repository implementation has to pass.
+func testRepository(t *testing.T, newRepo func(t *testing.T) billing.Repository) {
+	ctx := context.Background()
+
+	requirePayment := func(t *testing.T, got *billing.Payment, orderID uint64, total float64) {
+		t.Helper()
+
+		// Payments are read without the user.
+		if got.OrderID != orderID || got.Total != total {
+			t.Fatalf("payment: got %+v, want one of order %d with total %v", got, orderID, total)
+		}
+	}
+
+	t.Run("add and get", func(t *testing.T) {
+		repo := newRepo(t)
+
+		if err := repo.AddPayment(ctx, 1, 2, 99.5); err != nil {
+			t.Fatalf("add payment: %v", err)
+		}
+
+		p, err := repo.GetPayment(ctx, 1)
+		if err != nil {
+			t.Fatalf("get payment: %v", err)
+		}
+		requirePayment(t, p, 1, 99.5)
+
+		// Another message for the order, e.g. the reserved order sent again, is a duplicate.
+		if err := repo.AddPayment(ctx, 1, 2, 10); !errors.Is(err, dedup.ErrDuplicate) {
+			t.Fatalf("add payment again: got %v, want %v", err, dedup.ErrDuplicate)
+		}
+		p, err = repo.GetPayment(ctx, 1)
+		if err != nil {
+			t.Fatalf("get payment: %v", err)
+		}
+		requirePayment(t, p, 1, 99.5)
+
+		if _, err := repo.GetPayment(ctx, 2); !errors.Is(err, billing.ErrNotFound) {
+			t.Fatalf("get missing payment: got %v, want %v", err, billing.ErrNotFound)
+		}
+	})
+
+	t.Run("approve", func(t *testing.T) {
+		repo := newRepo(t)
+
+		if err := repo.AddPayment(ctx, 1, 2, 99.5); err != nil {
+			t.Fatalf("add payment: %v", err)
+		}
+
+		p, err := repo.ApprovePayment(ctx, 1)
+		if err != nil {
+			t.Fatalf("approve payment: %v", err)
+		}
+		requirePayment(t, p, 1, 99.5)
+
+		if _, err := repo.ApprovePayment(ctx, 2); !errors.Is(err, billing.ErrNotFound) {
+			t.Fatalf("approve missing payment: got %v, want %v", err, billing.ErrNotFound)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		repo := newRepo(t)
+
+		if err := repo.AddPayment(ctx, 1, 2, 99.5); err != nil {
+			t.Fatalf("add payment: %v", err)
+		}
+		if err := repo.CancelPayment(ctx, 1); err != nil {
+			t.Fatalf("cancel payment: %v", err)
+		}
+
+		// Cancelling a payment that has not been added is not an error, the saga may be reset before it is.
+		if err := repo.CancelPayment(ctx, 2); err != nil {
+			t.Fatalf("cancel missing payment: %v", err)
+		}
+	})
+
+	t.Run("duplicate messages", func(t *testing.T) {
+		repo := newRepo(t)
+
+		msgCtx := kafkatest.HandlerContext(ctx, events.TopicReservedOrders, 1, "message-1")
+		if err := repo.AddPayment(msgCtx, 1, 2, 99.5); err != nil {
+			t.Fatalf("add payment: %v", err)
+		}
+
+		// The message is redelivered either at the same offset or, e.g. sent twice by a producer, at another one.
+		for _, dupCtx := range []context.Context{
+			msgCtx,
+			kafkatest.HandlerContext(ctx, events.TopicReservedOrders, 2, "message-1"),
+		} {
+			if err := repo.AddPayment(dupCtx, 2, 2, 99.5); !errors.Is(err, dedup.ErrDuplicate) {
+				t.Fatalf("add payment duplicate: got %v, want %v", err, dedup.ErrDuplicate)
+			}
+		}
+		if _, err := repo.GetPayment(ctx, 2); !errors.Is(err, billing.ErrNotFound) {
+			t.Fatalf("get payment of duplicate: got %v, want %v", err, billing.ErrNotFound)
+		}
+
+		// A receipt failing to approve is not recorded, so its redelivery is handled again.
+		receiptCtx := kafkatest.HandlerContext(ctx, events.TopicReceipts, 1, "message-2")
+		if _, err := repo.ApprovePayment(receiptCtx, 3); !errors.Is(err, billing.ErrNotFound) {
+			t.Fatalf("approve missing payment: got %v, want %v", err, billing.ErrNotFound)
+		}
+		if err := repo.AddPayment(ctx, 3, 2, 10); err != nil {
+			t.Fatalf("add payment: %v", err)
+		}
+		if _, err := repo.ApprovePayment(receiptCtx, 3); err != nil {
+			t.Fatalf("approve redelivered: %v", err)
+		}
+		if _, err := repo.ApprovePayment(receiptCtx, 3); !errors.Is(err, dedup.ErrDuplicate) {
+			t.Fatalf("approve duplicate: got %v, want %v", err, dedup.ErrDuplicate)
+		}
+	})
+}
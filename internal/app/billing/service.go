@@ -2,9 +2,12 @@ package billing
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/cache"
-	"log"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 	"time"
 )
 
@@ -29,14 +32,20 @@ func NewService(repo Repository, kafkaClient KafkaClient, cache cache.Cache) *se
 	}
 }
 
+// AddPayment adds the pending payment of the order and sends it. A duplicate of the message,
+// or another reserved order of the order, has been added by an earlier delivery, which may have
+// failed to send the pending payment after committing it, so the pending payment is sent again.
 func (s *service) AddPayment(ctx context.Context, orderID uint64, userID uint64, total float64) error {
-	if err := s.repo.AddPayment(ctx, orderID, userID, total); err != nil {
+	err := s.repo.AddPayment(ctx, orderID, userID, total)
+	if err != nil && !errors.Is(err, dedup.ErrDuplicate) {
 		err = fmt.Errorf("add payment: %w", err)
 
-		go s.kafkaClient.SendReset(ResetMsg{
-			OrderID: orderID,
-			ErrMsg:  err.Error(),
-		})
+		if shouldReset(err) {
+			s.sendReset(ctx, events.ResetMsg{
+				OrderID: orderID,
+				ErrMsg:  err.Error(),
+			})
+		}
 
 		return err
 	}
@@ -46,14 +55,18 @@ func (s *service) AddPayment(ctx context.Context, orderID uint64, userID uint64,
 		UserID:  userID,
 		Total:   total,
 	}, time.Hour*24); err != nil {
-		log.Printf("[ERROR] set cache value: %v", err)
+		logger.Error(ctx, "set cache value", logger.Err(err))
 	}
 
-	if err := s.kafkaClient.SendPendingPayment(Payment{
+	if sendErr := s.kafkaClient.SendPendingPayment(ctx, events.Payment{
 		OrderID: orderID,
 		Total:   total,
-	}); err != nil {
-		return fmt.Errorf("send pending payment: %w", err)
+	}); sendErr != nil {
+		return fmt.Errorf("send pending payment: %w", sendErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("add payment: %w", err)
 	}
 
 	return nil
@@ -67,7 +80,7 @@ func (s *service) GetPayment(ctx context.Context, orderID uint64) (*Payment, err
 		}
 		return nil, fmt.Errorf("%w: payment value of invalid type", ErrInternal)
 	}
-	log.Printf("[ERROR] get cache value: %v", err)
+	logger.Warn(ctx, "get cache value", logger.Err(err))
 
 	payment, err := s.repo.GetPayment(ctx, orderID)
 	if err != nil {
@@ -75,30 +88,43 @@ func (s *service) GetPayment(ctx context.Context, orderID uint64) (*Payment, err
 	}
 
 	if err := s.cache.Set(ctx, fmt.Sprint(orderID), *payment, time.Hour*24); err != nil {
-		log.Printf("[ERROR] set cache value: %v", err)
+		logger.Error(ctx, "set cache value", logger.Err(err))
 	}
 
 	return payment, nil
 }
 
+// ApprovePayment approves the payment of the order and sends the paid payment,
+// again for a duplicate of the message the way AddPayment does.
 func (s *service) ApprovePayment(ctx context.Context, orderID uint64) error {
 	p, err := s.repo.ApprovePayment(ctx, orderID)
-	if err != nil {
+	if errors.Is(err, dedup.ErrDuplicate) {
+		var getErr error
+		if p, getErr = s.repo.GetPayment(ctx, orderID); getErr != nil {
+			return fmt.Errorf("get payment: %w", getErr)
+		}
+	} else if err != nil {
 		err = fmt.Errorf("approve payment: %w", err)
 
-		go s.kafkaClient.SendReset(ResetMsg{
-			OrderID: orderID,
-			ErrMsg:  err.Error(),
-		})
+		if shouldReset(err) {
+			s.sendReset(ctx, events.ResetMsg{
+				OrderID: orderID,
+				ErrMsg:  err.Error(),
+			})
+		}
 
 		return err
 	}
 
-	if err := s.kafkaClient.SendPaidPayment(Payment{
+	if sendErr := s.kafkaClient.SendPaidPayment(ctx, events.Payment{
 		OrderID: orderID,
 		Total:   p.Total,
-	}); err != nil {
-		return fmt.Errorf("send pending payment: %w", err)
+	}); sendErr != nil {
+		return fmt.Errorf("send paid payment: %w", sendErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("approve payment: %w", err)
 	}
 
 	return nil
@@ -111,3 +137,19 @@ func (s *service) CancelPayment(ctx context.Context, orderID uint64) error {
 
 	return nil
 }
+
+// shouldReset reports whether the saga of the order is reset after handling its message failed with err.
+// Internal errors are retried and duplicates have already been handled, so only the errors meaning
+// the order cannot be processed reset it. The reset is sent before the handler returns, so the message
+// is not acknowledged before the reset is out.
+func shouldReset(err error) bool {
+	return !errors.Is(err, ErrInternal) && !errors.Is(err, dedup.ErrDuplicate)
+}
+
+// sendReset sends the reset of the order saga. A failure is only logged, as the error that caused
+// the reset is what the handler reports.
+func (s *service) sendReset(ctx context.Context, msg events.ResetMsg) {
+	if err := s.kafkaClient.SendReset(ctx, msg); err != nil {
+		logger.Error(ctx, "send reset", logger.Err(err))
+	}
+}
@@ -0,0 +1,95 @@
+package billing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/billing"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/cache"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"testing"
+)
+
+// fakeClient records the messages sent, failing the first fail sends like an unavailable broker.
+type fakeClient struct {
+	fail    int
+	pending []events.Payment
+	paid    []events.Payment
+	resets  []events.ResetMsg
+}
+
+func (c *fakeClient) send() error {
+	if c.fail > 0 {
+		c.fail--
+		return fmt.Errorf("%w: broker unavailable", billing.ErrInternal)
+	}
+	return nil
+}
+
+func (c *fakeClient) SendPendingPayment(_ context.Context, payment events.Payment) error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	c.pending = append(c.pending, payment)
+	return nil
+}
+
+func (c *fakeClient) SendPaidPayment(_ context.Context, payment events.Payment) error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	c.paid = append(c.paid, payment)
+	return nil
+}
+
+func (c *fakeClient) SendReset(_ context.Context, msg events.ResetMsg) error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	c.resets = append(c.resets, msg)
+	return nil
+}
+
+// TestServiceResendsDuplicates checks that a retried message, whose first delivery committed
+// the payment but failed to send the output, sends the output instead of being skipped.
+func TestServiceResendsDuplicates(t *testing.T) {
+	ctx := context.Background()
+
+	repo := billing.NewMemoryRepo()
+	client := &fakeClient{fail: 1}
+	svc := billing.NewService(repo, client, cache.NewMemory())
+
+	addCtx := kafkatest.HandlerContext(ctx, events.TopicReservedOrders, 1, "message-1")
+
+	if err := svc.AddPayment(addCtx, 1, 2, 100); !errors.Is(err, billing.ErrInternal) {
+		t.Fatalf("add payment: got %v, want %v", err, billing.ErrInternal)
+	}
+	if err := svc.AddPayment(addCtx, 1, 2, 100); !errors.Is(err, dedup.ErrDuplicate) {
+		t.Fatalf("add payment retried: got %v, want %v", err, dedup.ErrDuplicate)
+	}
+	if want := (events.Payment{OrderID: 1, Total: 100}); len(client.pending) != 1 || client.pending[0] != want {
+		t.Fatalf("pending payments: got %+v, want %+v", client.pending, want)
+	}
+
+	client.fail = 1
+	approveCtx := kafkatest.HandlerContext(ctx, events.TopicReceipts, 1, "message-2")
+
+	if err := svc.ApprovePayment(approveCtx, 1); !errors.Is(err, billing.ErrInternal) {
+		t.Fatalf("approve payment: got %v, want %v", err, billing.ErrInternal)
+	}
+	if err := svc.ApprovePayment(approveCtx, 1); !errors.Is(err, dedup.ErrDuplicate) {
+		t.Fatalf("approve payment retried: got %v, want %v", err, dedup.ErrDuplicate)
+	}
+	if want := (events.Payment{OrderID: 1, Total: 100}); len(client.paid) != 1 || client.paid[0] != want {
+		t.Fatalf("paid payments: got %+v, want %+v", client.paid, want)
+	}
+
+	if status, err := repo.Status(1); err != nil || status != billing.Paid {
+		t.Fatalf("payment status: got %d, %v, want %d", status, err, billing.Paid)
+	}
+	if len(client.resets) != 0 {
+		t.Fatalf("resets: got %+v, want none", client.resets)
+	}
+}
@@ -1,13 +1,15 @@
 package notification
 
 import (
+	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
 )
 
 // KafkaClient sends predefined messages to kafka.
 type KafkaClient interface {
-	SendEmailNotification(notification EmailNotification) error
+	SendEmailNotification(ctx context.Context, notification events.EmailNotification) error
 }
 
 type kafkaClient struct {
@@ -23,8 +25,8 @@ func NewKafkaClient(
 	}
 }
 
-func (c *kafkaClient) SendEmailNotification(notification EmailNotification) error {
-	if err := c.emailNotificationsProducer.SendMessage(fmt.Sprint(notification.OrderID), notification); err != nil {
+func (c *kafkaClient) SendEmailNotification(ctx context.Context, notification events.EmailNotification) error {
+	if err := c.emailNotificationsProducer.SendMessage(ctx, fmt.Sprint(notification.OrderID), notification); err != nil {
 		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
 	}
 	return nil
@@ -8,8 +8,3 @@ type Notification struct {
 	UserID    uint64    `json:"user_id"`
 	Timestamp time.Time `json:"timestamp"`
 }
-
-type EmailNotification struct {
-	OrderID uint64
-	UserID  uint64
-}
@@ -1,6 +1,9 @@
 package notification
 
-import "errors"
+import (
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+)
 
 var (
 	ErrInternal           = errors.New("internal")
@@ -9,3 +12,12 @@ var (
 	ErrInvalidMsg         = errors.New("invalid message")
 	ErrFailedPrecondition = errors.New("failed precondition")
 )
+
+// errorClasses label message handling errors in metrics.
+var errorClasses = metrics.ErrorClasses{
+	{Name: "invalid_msg", Err: ErrInvalidMsg},
+	{Name: "not_found", Err: ErrNotFound},
+	{Name: "not_enough", Err: ErrNotEnough},
+	{Name: "failed_precondition", Err: ErrFailedPrecondition},
+	{Name: "internal", Err: ErrInternal},
+}
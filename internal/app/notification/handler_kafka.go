@@ -2,27 +2,26 @@ package notification
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Shopify/sarama"
-	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 )
 
 type KafkaHandler struct {
-	svc      Service
-	router   *router.SaramaRouter
-	validate *validator.Validate
+	svc    Service
+	router *router.SaramaRouter
 }
 
 func NewKafkaHandler(
 	svc Service,
+	opts ...router.Option,
 ) *KafkaHandler {
 	h := &KafkaHandler{
-		svc:      svc,
-		router:   router.NewSaramaRouter(),
-		validate: validator.New(),
+		svc:    svc,
+		router: router.NewSaramaRouter(opts...),
 	}
 
 	h.setupRoutes()
@@ -32,20 +31,20 @@ func NewKafkaHandler(
 
 func (h *KafkaHandler) setupRoutes() {
 	h.router.Use(middleware.Logger)
+	h.router.Use(middleware.Metrics(errorClasses))
+	h.router.Use(middleware.SkipDuplicates)
 
-	h.router.Handle("paid_orders", h.createDelayedNotification)
-	h.router.Handle("check", h.check)
+	h.router.Handle(events.TopicPaidOrders, h.createDelayedNotification)
+	h.router.Handle(events.TopicCheck, h.check)
 }
 
-func (h *KafkaHandler) createDelayedNotification(ctx context.Context, _ string, raw []byte) error {
-	var msg Order
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) createDelayedNotification(ctx context.Context, topic string, raw []byte) error {
+	var msg events.Order
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	_, err := h.svc.CreateNotification(ctx, msg.OrderID, msg.UserID, msg.DeliveryDate)
 	if err != nil {
@@ -55,14 +54,10 @@ func (h *KafkaHandler) createDelayedNotification(ctx context.Context, _ string,
 	return nil
 }
 
-func (h *KafkaHandler) check(ctx context.Context, _ string, raw []byte) error {
-	var msg CheckReq
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
-	}
-
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) check(ctx context.Context, topic string, raw []byte) error {
+	var msg events.Check
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
 	if err := h.svc.Check(ctx); err != nil {
@@ -72,6 +67,11 @@ func (h *KafkaHandler) check(ctx context.Context, _ string, raw []byte) error {
 	return nil
 }
 
+// Abort cancels handling in flight, see router.SaramaRouter.Abort.
+func (h *KafkaHandler) Abort() {
+	h.router.Abort()
+}
+
 func (h *KafkaHandler) Setup(session sarama.ConsumerGroupSession) error {
 	return h.router.Setup(session)
 }
@@ -4,11 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
 	"time"
 )
 
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/notification")
+
 var (
 	notificationsTable = "notifications"
 )
@@ -28,17 +36,23 @@ func NewPgRepo(db *pgxpool.Pool) *pgRepo {
 	}
 }
 
-var createNotification = fmt.Sprintf(`
-INSERT INTO %s
-(order_id, user_id, ts)
-VALUES ($1, $2, $3)
-RETURNING id
-`, notificationsTable)
-
 func (r *pgRepo) CreateNotification(ctx context.Context, orderID uint64, userID uint64, ts time.Time) (uint64, error) {
 	var id uint64
-	if err := r.db.QueryRow(ctx, createNotification, orderID, userID, ts).Scan(&id); err != nil {
-		return 0, fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	if err := r.execTx(ctx, func(q *pgQueries) error {
+		if err := q.claim(ctx); err != nil {
+			return fmt.Errorf("claim: %w", err)
+		}
+
+		var err error
+
+		id, err = q.createNotification(ctx, orderID, userID, ts)
+		if err != nil {
+			return fmt.Errorf("create notification: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("execTx: %w", err)
 	}
 
 	return id, nil
@@ -76,3 +90,77 @@ func (r *pgRepo) GetTodayNotifications(ctx context.Context) ([]*Notification, er
 
 	return notifications, nil
 }
+
+// execTx creates a database transaction with ReadCommitted isolation level and
+// execute provided function in the scope of the transaction.
+func (r *pgRepo) execTx(ctx context.Context, fn func(queries *pgQueries) error) (err error) {
+	ctx, span := tracer.Start(ctx, "pgRepo.execTx")
+	start := time.Now()
+	defer func() {
+		metrics.DBTxDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
+	tx, err := r.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return fmt.Errorf("%w: begin transaction: %v", ErrInternal, err)
+	}
+
+	q := &pgQueries{db: tx}
+	err = fn(q)
+
+	if err != nil {
+		logger.Debug(ctx, "roll back transaction", logger.Err(err))
+
+		if rbErr := tx.Rollback(ctx); rbErr != nil {
+			return fmt.Errorf("tx: %w, rb: %v", err, rbErr)
+		}
+		return fmt.Errorf("transaction: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: commit transaction: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+// DBTX is an interface that both *pgxpool.Pool and pgx.Tx implements.
+type DBTX interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+type pgQueries struct {
+	db DBTX
+}
+
+// claim marks the message being handled as processed, see dedup.Claim.
+func (q *pgQueries) claim(ctx context.Context) error {
+	if err := dedup.Claim(ctx, q.db); err != nil {
+		if errors.Is(err, dedup.ErrDuplicate) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var createNotificationQuery = fmt.Sprintf(`
+INSERT INTO %s
+(order_id, user_id, ts)
+VALUES ($1, $2, $3)
+RETURNING id
+`, notificationsTable)
+
+func (q *pgQueries) createNotification(ctx context.Context, orderID uint64, userID uint64, ts time.Time) (uint64, error) {
+	var id uint64
+	if err := q.db.QueryRow(ctx, createNotificationQuery, orderID, userID, ts).Scan(&id); err != nil {
+		return 0, fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,62 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"sync"
+	"time"
+)
+
+type memoryRepo struct {
+	// mu makes every method atomic like a database transaction.
+	mu            sync.Mutex
+	processed     *dedup.Processed
+	notifications []*Notification
+}
+
+// NewMemoryRepo creates an instance of memoryRepo, a repository keeping notifications in memory, e.g. in tests.
+// It behaves the way pgRepo does.
+func NewMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		processed: dedup.NewProcessed(),
+	}
+}
+
+func (r *memoryRepo) CreateNotification(ctx context.Context, orderID uint64, userID uint64, ts time.Time) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.processed.Check(ctx); err != nil {
+		return 0, fmt.Errorf("claim: %w", err)
+	}
+
+	n := &Notification{
+		ID:        uint64(len(r.notifications) + 1),
+		OrderID:   orderID,
+		UserID:    userID,
+		Timestamp: ts,
+	}
+	r.notifications = append(r.notifications, n)
+
+	r.processed.Record(ctx)
+
+	return n.ID, nil
+}
+
+func (r *memoryRepo) GetTodayNotifications(_ context.Context) ([]*Notification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	y, m, d := time.Now().Date()
+
+	var notifications []*Notification
+	for _, n := range r.notifications {
+		if ny, nm, nd := n.Timestamp.Date(); ny == y && nm == m && nd == d {
+			n := *n
+			notifications = append(notifications, &n)
+		}
+	}
+
+	return notifications, nil
+}
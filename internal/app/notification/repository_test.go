@@ -0,0 +1,83 @@
+package notification_test
+
+import (
+	"context"
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/notification"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/pgtest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T) notification.Repository {
+		return notification.NewMemoryRepo()
+	})
+}
+
+func TestPgRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T) notification.Repository {
+		return notification.NewPgRepo(pgtest.Open(t, migrations.Notifications))
+	})
+}
+
+// testRepository runs the tests every Repository implementation has to pass.
+func testRepository(t *testing.T, newRepo func(t *testing.T) notification.Repository) {
+	ctx := context.Background()
+
+	t.Run("today notifications", func(t *testing.T) {
+		repo := newRepo(t)
+
+		// Well before today in any time zone.
+		if _, err := repo.CreateNotification(ctx, 1, 2, time.Now().Add(-48*time.Hour)); err != nil {
+			t.Fatalf("create notification: %v", err)
+		}
+
+		id, err := repo.CreateNotification(ctx, 2, 3, time.Now())
+		if err != nil {
+			t.Fatalf("create notification: %v", err)
+		}
+
+		notifications, err := repo.GetTodayNotifications(ctx)
+		if err != nil {
+			t.Fatalf("get notifications: %v", err)
+		}
+		if len(notifications) != 1 {
+			t.Fatalf("notifications: got %d, want 1", len(notifications))
+		}
+		if n := notifications[0]; n.ID != id || n.OrderID != 2 || n.UserID != 3 {
+			t.Fatalf("notification: got %+v, want %d of order 2 and user 3", n, id)
+		}
+	})
+
+	t.Run("duplicate messages", func(t *testing.T) {
+		repo := newRepo(t)
+
+		msgCtx := kafkatest.HandlerContext(ctx, events.TopicPaidOrders, 1, "message-1")
+		if _, err := repo.CreateNotification(msgCtx, 1, 2, time.Now()); err != nil {
+			t.Fatalf("create notification: %v", err)
+		}
+
+		// The message is redelivered either at the same offset or, e.g. sent twice by a producer, at another one.
+		for _, dupCtx := range []context.Context{
+			msgCtx,
+			kafkatest.HandlerContext(ctx, events.TopicPaidOrders, 2, "message-1"),
+		} {
+			if _, err := repo.CreateNotification(dupCtx, 1, 2, time.Now()); !errors.Is(err, dedup.ErrDuplicate) {
+				t.Fatalf("create notification duplicate: got %v, want %v", err, dedup.ErrDuplicate)
+			}
+		}
+
+		notifications, err := repo.GetTodayNotifications(ctx)
+		if err != nil {
+			t.Fatalf("get notifications: %v", err)
+		}
+		if len(notifications) != 1 {
+			t.Fatalf("notifications: got %d, want 1", len(notifications))
+		}
+	})
+}
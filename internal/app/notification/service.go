@@ -3,7 +3,8 @@ package notification
 import (
 	"context"
 	"fmt"
-	"log"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 	"time"
 )
 
@@ -42,11 +43,11 @@ func (s service) Check(ctx context.Context) error {
 	for _, ntf := range notifications {
 		ntf := ntf
 		go func() {
-			if err := s.kafkaClient.SendEmailNotification(EmailNotification{
+			if err := s.kafkaClient.SendEmailNotification(ctx, events.EmailNotification{
 				OrderID: ntf.OrderID,
 				UserID:  ntf.UserID,
 			}); err != nil {
-				log.Printf("send email notification: %v", err)
+				logger.Error(ctx, "send email notification", logger.Uint64("order_id", ntf.OrderID), logger.Err(err))
 			}
 		}()
 	}
@@ -1,15 +1,31 @@
 package order
 
-import "time"
+import (
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"time"
+)
 
 type CreateOrderReq struct {
-	UserID       uint64    `json:"user_id" validate:"required"`
-	Items        []*Item   `json:"items" validate:"required"`
-	DeliveryDate time.Time `json:"delivery_date" validate:"required"`
-	Email        string    `json:"email" validate:"required"`
-	Total        float64   `json:"total" validate:"required"`
+	UserID       uint64         `json:"user_id" validate:"required"`
+	Items        []*events.Item `json:"items" validate:"required"`
+	DeliveryDate time.Time      `json:"delivery_date" validate:"required"`
+	Email        string         `json:"email" validate:"required"`
+	Total        float64        `json:"total" validate:"required"`
 }
 
-type Payment struct {
-	OrderID uint64 `json:"order_id" validate:"required"`
+type CreateOrderResp struct {
+	OrderID uint64 `json:"order_id"`
+}
+
+// OrderInfo is the order along with its saga status.
+type OrderInfo struct {
+	events.Order
+	Status  Status          `json:"status"`
+	History []*StatusChange `json:"history,omitempty"`
+}
+
+// OrdersPage is a page of user orders. NextPageToken is empty on the last page.
+type OrdersPage struct {
+	Orders        []*OrderInfo `json:"orders"`
+	NextPageToken string       `json:"next_page_token,omitempty"`
 }
@@ -1,6 +1,9 @@
 package order
 
-import "errors"
+import (
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+)
 
 var (
 	ErrInternal           = errors.New("internal")
@@ -8,4 +11,15 @@ var (
 	ErrNotEnough          = errors.New("not enough")
 	ErrInvalidMsg         = errors.New("invalid message")
 	ErrFailedPrecondition = errors.New("failed precondition")
+	ErrIllegalTransition  = errors.New("illegal transition")
 )
+
+// errorClasses label message handling errors in metrics.
+var errorClasses = metrics.ErrorClasses{
+	{Name: "invalid_msg", Err: ErrInvalidMsg},
+	{Name: "not_found", Err: ErrNotFound},
+	{Name: "not_enough", Err: ErrNotEnough},
+	{Name: "failed_precondition", Err: ErrFailedPrecondition},
+	{Name: "illegal_transition", Err: ErrIllegalTransition},
+	{Name: "internal", Err: ErrInternal},
+}
@@ -0,0 +1,225 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
+// HTTPHandler serves orders API:
+//
+//	POST /orders
+//	GET /orders/{order_id}
+//	GET /users/{user_id}/orders?page_size=20&page_token=...
+//
+// The API is not authenticated, so the orders it returns have their emails redacted.
+type HTTPHandler struct {
+	svc      Service
+	mux      *http.ServeMux
+	validate *validator.Validate
+}
+
+func NewHTTPHandler(svc Service) *HTTPHandler {
+	h := &HTTPHandler{
+		svc:      svc,
+		mux:      http.NewServeMux(),
+		validate: validator.New(),
+	}
+
+	h.setupRoutes()
+
+	return h
+}
+
+func (h *HTTPHandler) setupRoutes() {
+	h.mux.HandleFunc("/orders", h.create)
+	h.mux.HandleFunc("/orders/", h.getOrder)
+	h.mux.HandleFunc("/users/", h.listUserOrders)
+}
+
+// ServeHTTP traces the request, continuing the trace of the caller if any, and adds its method and path to the log fields.
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx = logger.WithFields(ctx,
+		logger.String("http_method", r.Method),
+		logger.String("http_path", r.URL.Path),
+	)
+	ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+		),
+	)
+	defer span.End()
+
+	h.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// create accepts the order and returns its id right away, the saga proceeds asynchronously.
+// Requests retried with the same Idempotency-Key header get the order created by the first one.
+func (h *HTTPHandler) create(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s must not be longer than %d", idempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+
+	var req CreateOrderReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decode: %v", err))
+		return
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("validate: %v", err))
+		return
+	}
+
+	var id uint64
+	var err error
+	created := true
+
+	if key == "" {
+		id, err = h.svc.Create(r.Context(), req)
+	} else {
+		id, created, err = h.svc.CreateIdempotent(r.Context(), key, req)
+	}
+	if err != nil {
+		writeServiceError(r.Context(), w, err)
+		return
+	}
+
+	if !created {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+
+	writeJSON(w, http.StatusAccepted, CreateOrderResp{OrderID: id})
+}
+
+func (h *HTTPHandler) getOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	orderID, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/orders/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	ctx := logger.WithFields(r.Context(), logger.Uint64("order_id", orderID))
+
+	order, err := h.svc.GetOrder(ctx, orderID)
+	if err != nil {
+		writeServiceError(ctx, w, err)
+		return
+	}
+	order.Email = redactEmail(order.Email)
+
+	writeJSON(w, http.StatusOK, order)
+}
+
+func (h *HTTPHandler) listUserOrders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	if len(parts) != 2 || parts[1] != "orders" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	pageSize := defaultPageSize
+	if v := r.URL.Query().Get("page_size"); v != "" {
+		pageSize, err = strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			writeError(w, http.StatusBadRequest, "page_size must be between 1 and 100")
+			return
+		}
+	}
+
+	page, err := h.svc.ListUserOrders(r.Context(), userID, r.URL.Query().Get("page_token"), pageSize)
+	if err != nil {
+		writeServiceError(r.Context(), w, err)
+		return
+	}
+	for _, order := range page.Orders {
+		order.Email = redactEmail(order.Email)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// redactEmail keeps the domain of an email only, e.g. ***@example.com.
+func redactEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "***"
+	}
+
+	return "***" + email[at:]
+}
+
+func writeServiceError(ctx context.Context, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidMsg):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, ErrFailedPrecondition):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		logger.Error(ctx, "handle http request", logger.Err(err))
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Default().Error("write http response", logger.Err(err))
+	}
+}
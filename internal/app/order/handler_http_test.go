@@ -0,0 +1,274 @@
+package order_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/order"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerCreateIdempotent(t *testing.T) {
+	const body = `{"user_id": 1, "items": [{"product_id": 1, "quantity": 1}], "delivery_date": "2030-01-02T00:00:00Z", "email": "user@example.com", "total": 99.5}`
+
+	h := order.NewHTTPHandler(order.NewService(order.NewMemoryRepo(nil)))
+
+	post := func(t *testing.T, key string, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	orderID := func(t *testing.T, w *httptest.ResponseRecorder) uint64 {
+		t.Helper()
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status: got %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+		}
+
+		var resp order.CreateOrderResp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return resp.OrderID
+	}
+
+	first := post(t, "key", body)
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("first request: replayed")
+	}
+	id := orderID(t, first)
+
+	t.Run("retried request is replayed", func(t *testing.T) {
+		w := post(t, "key", body)
+		if w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatal("retried request: not replayed")
+		}
+		if got := orderID(t, w); got != id {
+			t.Fatalf("order id: got %d, want %d", got, id)
+		}
+	})
+
+	t.Run("key used with another request", func(t *testing.T) {
+		w := post(t, "key", strings.Replace(body, `"total": 99.5`, `"total": 100`, 1))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status: got %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+		}
+	})
+
+	t.Run("key too long", func(t *testing.T) {
+		w := post(t, strings.Repeat("k", 256), body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("status: got %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+		}
+	})
+
+	t.Run("another key creates another order", func(t *testing.T) {
+		if got := orderID(t, post(t, "another key", body)); got == id {
+			t.Fatalf("order id: got %d, want a new order", got)
+		}
+	})
+
+	t.Run("no key creates another order", func(t *testing.T) {
+		w := post(t, "", body)
+		if w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatal("request without key: replayed")
+		}
+		if got := orderID(t, w); got == id {
+			t.Fatalf("order id: got %d, want a new order", got)
+		}
+	})
+}
+
+// orderResp is an order returned by the API.
+type orderResp struct {
+	OrderID uint64         `json:"order_id"`
+	UserID  uint64         `json:"user_id"`
+	Email   string         `json:"email"`
+	Items   []*events.Item `json:"items"`
+	Status  string         `json:"status"`
+	History []struct {
+		To     string `json:"to"`
+		Reason string `json:"reason"`
+	} `json:"history"`
+}
+
+type ordersPageResp struct {
+	Orders        []*orderResp `json:"orders"`
+	NextPageToken string       `json:"next_page_token"`
+}
+
+// get serves a GET request and decodes a successful response into resp.
+func get(t *testing.T, h http.Handler, target string, status int, resp interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if w.Code != status {
+		t.Fatalf("GET %s: got %d, want %d: %s", target, w.Code, status, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "user@") {
+		t.Fatalf("GET %s: got an email: %s", target, w.Body)
+	}
+	if resp == nil {
+		return
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatalf("GET %s: decode response: %v", target, err)
+	}
+}
+
+// createOrders creates an order of each user in turn and returns their ids.
+func createOrders(t *testing.T, svc order.Service, userIDs ...uint64) []uint64 {
+	t.Helper()
+
+	ids := make([]uint64, 0, len(userIDs))
+	for _, userID := range userIDs {
+		id, err := svc.Create(context.Background(), order.CreateOrderReq{
+			UserID:       userID,
+			Items:        []*events.Item{{ProductID: 1, Quantity: 2}, {ProductID: 2, Quantity: 1}},
+			DeliveryDate: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC),
+			Email:        "user@example.com",
+			Total:        99.5,
+		})
+		if err != nil {
+			t.Fatalf("create order: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestHTTPHandlerGetOrder(t *testing.T) {
+	svc := order.NewService(order.NewMemoryRepo(nil))
+	h := order.NewHTTPHandler(svc)
+
+	id := createOrders(t, svc, 1)[0]
+	if err := svc.Transition(context.Background(), id, order.Reserved, "stock reserved"); err != nil {
+		t.Fatalf("transition: %v", err)
+	}
+
+	var got orderResp
+	get(t, h, fmt.Sprintf("/orders/%d", id), http.StatusOK, &got)
+
+	if got.OrderID != id || got.UserID != 1 || len(got.Items) != 2 {
+		t.Fatalf("order: got %+v, want order %d of user 1 with 2 items", got, id)
+	}
+	if got.Email != "***@example.com" {
+		t.Fatalf("email: got %q, want it redacted", got.Email)
+	}
+	if got.Status != "reserved" {
+		t.Fatalf("status: got %q, want reserved", got.Status)
+	}
+	if len(got.History) != 2 || got.History[0].To != "created" || got.History[1].To != "reserved" || got.History[1].Reason != "stock reserved" {
+		t.Fatalf("history: got %+v, want created and reserved", got.History)
+	}
+
+	t.Run("missing order", func(t *testing.T) {
+		get(t, h, fmt.Sprintf("/orders/%d", id+1), http.StatusNotFound, nil)
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		get(t, h, "/orders/first", http.StatusNotFound, nil)
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/orders/%d", id), nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("status: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestHTTPHandlerListUserOrders(t *testing.T) {
+	svc := order.NewService(order.NewMemoryRepo(nil))
+	h := order.NewHTTPHandler(svc)
+
+	ids := createOrders(t, svc, 1, 2, 1, 1)
+
+	t.Run("pages", func(t *testing.T) {
+		var got []uint64
+
+		target := "/users/1/orders?page_size=2"
+		for pages := 0; ; pages++ {
+			if pages == 3 {
+				t.Fatalf("pages: got more than 2, orders %v", got)
+			}
+
+			var page ordersPageResp
+			get(t, h, target, http.StatusOK, &page)
+
+			for _, o := range page.Orders {
+				if o.UserID != 1 || o.Email != "***@example.com" || o.Status != "created" || len(o.Items) != 2 {
+					t.Fatalf("order: got %+v, want a created order of user 1 with a redacted email", o)
+				}
+				got = append(got, o.OrderID)
+			}
+
+			if page.NextPageToken == "" {
+				break
+			}
+			target = "/users/1/orders?page_size=2&page_token=" + page.NextPageToken
+		}
+
+		// Newest first.
+		if want := []uint64{ids[3], ids[2], ids[0]}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("orders: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("default page size", func(t *testing.T) {
+		var page ordersPageResp
+		get(t, h, "/users/2/orders", http.StatusOK, &page)
+
+		if len(page.Orders) != 1 || page.Orders[0].OrderID != ids[1] || page.NextPageToken != "" {
+			t.Fatalf("page: got %+v, want order %d", page, ids[1])
+		}
+	})
+
+	t.Run("user without orders", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/3/orders", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != `{"orders":[]}` {
+			t.Fatalf("body: got %s, want no orders", body)
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		status int
+	}{
+		{name: "page size too small", target: "/users/1/orders?page_size=0", status: http.StatusBadRequest},
+		{name: "page size too large", target: "/users/1/orders?page_size=101", status: http.StatusBadRequest},
+		{name: "invalid page size", target: "/users/1/orders?page_size=ten", status: http.StatusBadRequest},
+		{name: "invalid page token", target: "/users/1/orders?page_token=next", status: http.StatusBadRequest},
+		{name: "invalid user id", target: "/users/first/orders", status: http.StatusNotFound},
+		{name: "unknown path", target: "/users/1/payments", status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			get(t, h, tc.target, tc.status, nil)
+		})
+	}
+}
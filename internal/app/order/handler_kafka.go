@@ -2,27 +2,26 @@ package order
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Shopify/sarama"
-	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 )
 
 type KafkaHandler struct {
-	svc      Service
-	router   *router.SaramaRouter
-	validate *validator.Validate
+	svc    Service
+	router *router.SaramaRouter
 }
 
 func NewKafkaHandler(
 	svc Service,
+	opts ...router.Option,
 ) *KafkaHandler {
 	h := &KafkaHandler{
-		svc:      svc,
-		router:   router.NewSaramaRouter(),
-		validate: validator.New(),
+		svc:    svc,
+		router: router.NewSaramaRouter(opts...),
 	}
 
 	h.setupRoutes()
@@ -32,40 +31,57 @@ func NewKafkaHandler(
 
 func (h *KafkaHandler) setupRoutes() {
 	h.router.Use(middleware.Logger)
-
-	h.router.Handle("new_orders", h.create)
-	h.router.Handle("paid_payments", h.handlePaidPayment)
-	h.router.Handle("reset", h.reset)
-	h.router.Handle("cancel", h.cancel)
+	h.router.Use(middleware.Metrics(errorClasses))
+	h.router.Use(middleware.SkipDuplicates)
+
+	h.router.Handle(events.TopicNewOrders, h.create)
+	h.router.Handle(events.TopicReservedOrders, h.transition(Reserved, "stock reserved"))
+	h.router.Handle(events.TopicPendingPayments, h.transition(PaymentPending, "payment pending"))
+	h.router.Handle(events.TopicPaidPayments, h.handlePaidPayment)
+	h.router.Handle(events.TopicCollectedOrders, h.transition(Collected, "stock collected"))
+	h.router.Handle(events.TopicReset, h.reset)
+	h.router.Handle(events.TopicCancel, h.cancel)
 }
 
-func (h *KafkaHandler) create(ctx context.Context, _ string, raw []byte) error {
-	var req CreateOrderReq
-	if err := json.Unmarshal(raw, &req); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
-	}
-
-	if err := h.validate.Struct(req); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) create(ctx context.Context, topic string, raw []byte) error {
+	var req events.NewOrder
+	if err := events.Decode(ctx, topic, raw, &req); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if _, err := h.svc.Create(ctx, req); err != nil {
+	if _, err := h.svc.Create(ctx, CreateOrderReq(req)); err != nil {
 		return fmt.Errorf("create: %w", err)
 	}
 
 	return nil
 }
 
-func (h *KafkaHandler) handlePaidPayment(ctx context.Context, _ string, raw []byte) error {
-	var req Payment
-	if err := json.Unmarshal(raw, &req); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+// transition returns a handler moving the order referenced by a message to a given status.
+func (h *KafkaHandler) transition(to Status, reason string) router.HandlerFunc {
+	return func(ctx context.Context, topic string, raw []byte) error {
+		var msg events.OrderRef
+		if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
+		}
+
+		ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
+
+		if err := h.svc.Transition(ctx, msg.OrderID, to, reason); err != nil {
+			return fmt.Errorf("transition: %w", err)
+		}
+
+		return nil
 	}
+}
 
-	if err := h.validate.Struct(req); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) handlePaidPayment(ctx context.Context, topic string, raw []byte) error {
+	var req events.Payment
+	if err := events.Decode(ctx, topic, raw, &req); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", req.OrderID))
+
 	if err := h.svc.SendPaidOrder(ctx, req.OrderID); err != nil {
 		return fmt.Errorf("create: %w", err)
 	}
@@ -73,40 +89,41 @@ func (h *KafkaHandler) handlePaidPayment(ctx context.Context, _ string, raw []by
 	return nil
 }
 
-func (h *KafkaHandler) reset(ctx context.Context, _ string, raw []byte) error {
-	var msg ResetMsg
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) reset(ctx context.Context, topic string, raw []byte) error {
+	var msg events.ResetMsg
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
-	if err := h.svc.Delete(ctx, msg.OrderID); err != nil {
-		return fmt.Errorf("delete: %w", err)
+	if err := h.svc.Transition(ctx, msg.OrderID, Failed, "reset: "+msg.ErrMsg); err != nil {
+		return fmt.Errorf("transition: %w", err)
 	}
 
 	return nil
 }
 
-func (h *KafkaHandler) cancel(ctx context.Context, _ string, raw []byte) error {
-	var msg CancelMsg
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) cancel(ctx context.Context, topic string, raw []byte) error {
+	var msg events.CancelMsg
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
-	if err := h.svc.Delete(ctx, msg.OrderID); err != nil {
-		return fmt.Errorf("cancel: %w", err)
+	if err := h.svc.Transition(ctx, msg.OrderID, Cancelled, "cancel: "+msg.Reason); err != nil {
+		return fmt.Errorf("transition: %w", err)
 	}
 
 	return nil
 }
 
+// Abort cancels handling in flight, see router.SaramaRouter.Abort.
+func (h *KafkaHandler) Abort() {
+	h.router.Abort()
+}
+
 func (h *KafkaHandler) Setup(session sarama.ConsumerGroupSession) error {
 	return h.router.Setup(session)
 }
@@ -0,0 +1,86 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"time"
+)
+
+// OutboxRelay publishes messages from the outbox to kafka and marks them sent.
+type OutboxRelay struct {
+	repo      Repository
+	producers map[string]kafka.Producer
+	interval  time.Duration
+	batchSize int
+}
+
+// NewOutboxRelay creates an instance of OutboxRelay. Producers are looked up by
+// the topic of an outbox message.
+func NewOutboxRelay(
+	repo Repository,
+	producers map[string]kafka.Producer,
+	interval time.Duration,
+	batchSize int,
+) *OutboxRelay {
+	return &OutboxRelay{
+		repo:      repo,
+		producers: producers,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run relays the outbox every interval until ctx is done.
+// A full batch is followed by the next one right away. Every batch is a step of the progress.
+func (r *OutboxRelay) Run(ctx context.Context, progress *health.Progress) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			end := progress.Begin()
+			n, err := r.Relay(ctx)
+			end()
+			if err != nil {
+				logger.Error(ctx, "relay outbox", logger.Err(err))
+			}
+
+			if err == nil && n == r.batchSize {
+				timer.Reset(0)
+			} else {
+				timer.Reset(r.interval)
+			}
+		}
+	}
+}
+
+// Relay publishes a batch of pending messages and returns the number of messages published.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	return r.repo.RelayOutbox(ctx, r.batchSize, func(msg *OutboxMessage) error {
+		return r.send(ctx, msg)
+	})
+}
+
+func (r *OutboxRelay) send(ctx context.Context, msg *OutboxMessage) error {
+	p, ok := r.producers[msg.Topic]
+	if !ok {
+		return fmt.Errorf("%w: no producer for topic %q", ErrInternal, msg.Topic)
+	}
+
+	if msg.Envelope.MessageID != "" {
+		ctx = kafka.ContextWithOutgoingEnvelope(ctx, msg.Envelope)
+	}
+
+	if err := p.SendMessage(ctx, msg.Key, json.RawMessage(msg.Payload)); err != nil {
+		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
+	}
+
+	return nil
+}
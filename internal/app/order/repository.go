@@ -2,32 +2,62 @@ package order
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
 	"time"
 )
 
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/order")
+
 const (
-	ordersTable      = "orders"
-	ordersItemsTable = "orders_items"
+	ordersTable              = "orders"
+	ordersItemsTable         = "orders_items"
+	ordersStatusesTable      = "orders_statuses"
+	ordersStatusHistoryTable = "orders_statuses_history"
+	ordersDeadlinesTable     = "orders_deadlines"
+	idempotencyKeysTable     = "idempotency_keys"
+	outboxTable              = "outbox"
 )
 
+// errKeyTaken means that an idempotency key has been stored by a concurrent transaction.
+var errKeyTaken = errors.New("idempotency key taken")
+
 type Repository interface {
 	Create(ctx context.Context, req CreateOrderReq) (uint64, error)
-	Delete(ctx context.Context, orderID uint64) error
-	Get(ctx context.Context, orderID uint64) (*Order, error)
+	CreateIdempotent(ctx context.Context, key string, reqHash string, req CreateOrderReq) (uint64, bool, error)
+	Get(ctx context.Context, orderID uint64) (*OrderInfo, error)
+	ListByUser(ctx context.Context, userID uint64, afterID uint64, limit int) ([]*OrderInfo, error)
+	Transition(ctx context.Context, orderID uint64, to Status, reason string) error
+	GetStatus(ctx context.Context, orderID uint64) (Status, error)
+	GetHistory(ctx context.Context, orderID uint64) ([]*StatusChange, error)
+	MarkPaid(ctx context.Context, orderID uint64, reason string) error
+	EnqueueReset(ctx context.Context, msg events.ResetMsg) error
+	ExpireDeadlines(ctx context.Context, limit int) (int, error)
+	RelayOutbox(ctx context.Context, limit int, fn func(msg *OutboxMessage) error) (int, error)
 }
 
 type pgRepo struct {
-	db *pgxpool.Pool
+	db       *pgxpool.Pool
+	timeouts Timeouts
 }
 
-func NewPgRepo(db *pgxpool.Pool) *pgRepo {
+// NewPgRepo creates an instance of pgRepo. Every time the order moves to a status
+// with a timeout a deadline is set for it, see ExpireDeadlines.
+func NewPgRepo(db *pgxpool.Pool, timeouts Timeouts) *pgRepo {
 	return &pgRepo{
-		db: db,
+		db:       db,
+		timeouts: timeouts,
 	}
 }
 
@@ -35,33 +65,191 @@ func (r *pgRepo) Create(ctx context.Context, req CreateOrderReq) (uint64, error)
 	var id uint64
 
 	if err := r.execTx(ctx, func(q *pgQueries) error {
+		if err := q.claim(ctx); err != nil {
+			return fmt.Errorf("claim: %w", err)
+		}
+
 		var err error
 
-		id, err = q.createOrder(ctx, req.UserID, req.DeliveryDate, req.Email, req.Total)
+		id, err = r.create(ctx, q, req)
+
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("exec tx: %w", err)
+	}
+
+	return id, nil
+}
+
+// CreateIdempotent creates the order unless the idempotency key has already been used.
+// In that case the order created with the key is returned, provided that the request hash
+// matches the stored one, and created is false.
+func (r *pgRepo) CreateIdempotent(
+	ctx context.Context,
+	key string,
+	reqHash string,
+	req CreateOrderReq,
+) (id uint64, created bool, err error) {
+	id, created, err = r.createIdempotent(ctx, key, reqHash, req)
+	if errors.Is(err, errKeyTaken) {
+		// The key has been stored by a concurrent request, so it is looked up once again.
+		id, created, err = r.createIdempotent(ctx, key, reqHash, req)
+	}
+
+	return id, created, err
+}
+
+func (r *pgRepo) createIdempotent(ctx context.Context, key string, reqHash string, req CreateOrderReq) (uint64, bool, error) {
+	var id uint64
+	var created bool
+
+	if err := r.execTx(ctx, func(q *pgQueries) error {
+		var err error
+
+		var storedHash string
+		id, storedHash, err = q.getIdempotencyKey(ctx, key)
+		if err == nil {
+			if storedHash != reqHash {
+				return fmt.Errorf("%w: idempotency key has been used with another request", ErrFailedPrecondition)
+			}
+			return nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("get idempotency key: %w", err)
+		}
+
+		id, err = r.create(ctx, q, req)
 		if err != nil {
-			return fmt.Errorf("create req: %w", err)
+			return fmt.Errorf("create: %w", err)
 		}
 
-		if err := q.createOrderItems(ctx, id, req.Items); err != nil {
-			return fmt.Errorf("create req items: %w", err)
+		if err := q.createIdempotencyKey(ctx, key, reqHash, id); err != nil {
+			return fmt.Errorf("create idempotency key: %w", err)
 		}
 
+		created = true
+
 		return nil
 	}); err != nil {
-		return 0, fmt.Errorf("exec tx: %w", err)
+		return 0, false, fmt.Errorf("exec tx: %w", err)
+	}
+
+	return id, created, nil
+}
+
+// create creates the order in the scope of a transaction and puts it into the outbox.
+func (r *pgRepo) create(ctx context.Context, q *pgQueries, req CreateOrderReq) (uint64, error) {
+	id, err := q.createOrder(ctx, req.UserID, req.DeliveryDate, req.Email, req.Total)
+	if err != nil {
+		return 0, fmt.Errorf("create req: %w", err)
+	}
+
+	if err := q.createOrderItems(ctx, id, req.Items); err != nil {
+		return 0, fmt.Errorf("create req items: %w", err)
+	}
+
+	if err := q.createStatus(ctx, id); err != nil {
+		return 0, fmt.Errorf("create status: %w", err)
+	}
+
+	if err := q.createStatusChange(ctx, id, nil, Created, "order created"); err != nil {
+		return 0, fmt.Errorf("create status change: %w", err)
+	}
+
+	if err := q.setDeadline(ctx, id, Created, r.timeouts[Created]); err != nil {
+		return 0, fmt.Errorf("set deadline: %w", err)
+	}
+
+	if err := q.createOutboxMessage(ctx, events.TopicSavedOrders, fmt.Sprint(id), events.Order{
+		OrderID:      id,
+		UserID:       req.UserID,
+		DeliveryDate: req.DeliveryDate,
+		Email:        req.Email,
+		Total:        req.Total,
+		Items:        req.Items,
+	}); err != nil {
+		return 0, fmt.Errorf("create outbox message: %w", err)
 	}
 
 	return id, nil
 }
 
-func (r *pgRepo) Delete(ctx context.Context, orderID uint64) error {
+// Get returns the order with its items, status and status history. They are read in one
+// read-only transaction, so they are consistent with each other.
+func (r *pgRepo) Get(ctx context.Context, orderID uint64) (*OrderInfo, error) {
+	info := &OrderInfo{}
+	if err := r.execTxWith(ctx, readOnlyTx, func(q *pgQueries) error {
+		order, err := q.getOrder(ctx, orderID)
+		if err != nil {
+			return fmt.Errorf("get order: %w", err)
+		}
+		info.Order = *order
+
+		info.Items, err = q.getOrderItems(ctx, orderID)
+		if err != nil {
+			return fmt.Errorf("get order items: %w", err)
+		}
+
+		info.Status, err = q.getStatus(ctx, orderID, false)
+		if err != nil {
+			return fmt.Errorf("get status: %w", err)
+		}
+
+		info.History, err = q.getStatusHistory(ctx, orderID)
+		if err != nil {
+			return fmt.Errorf("get status history: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("exec tx: %w", err)
+	}
+
+	return info, nil
+}
+
+// ListByUser returns up to limit orders of the user along with their statuses, newest first.
+// Only orders older than afterID are returned unless it is zero.
+func (r *pgRepo) ListByUser(ctx context.Context, userID uint64, afterID uint64, limit int) ([]*OrderInfo, error) {
+	var orders []*OrderInfo
 	if err := r.execTx(ctx, func(q *pgQueries) error {
-		if err := q.deleteOrderItems(ctx, orderID); err != nil {
-			return fmt.Errorf("delete order items: %w", err)
+		var err error
+
+		orders, err = q.listUserOrders(ctx, userID, afterID, limit)
+		if err != nil {
+			return fmt.Errorf("list user orders: %w", err)
+		}
+
+		ids := make([]uint64, 0, len(orders))
+		byID := make(map[uint64]*OrderInfo, len(orders))
+		for _, o := range orders {
+			ids = append(ids, o.OrderID)
+			byID[o.OrderID] = o
+		}
+
+		items, err := q.getOrdersItems(ctx, ids)
+		if err != nil {
+			return fmt.Errorf("get orders items: %w", err)
 		}
 
-		if err := q.deleteOrder(ctx, orderID); err != nil {
-			return fmt.Errorf("delete order: %w", err)
+		for orderID, orderItems := range items {
+			byID[orderID].Items = orderItems
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("exec tx: %w", err)
+	}
+
+	return orders, nil
+}
+
+// Transition moves the order to a given status and records the change in the history.
+// Redelivered and late transitions are skipped, illegal ones fail with ErrIllegalTransition.
+func (r *pgRepo) Transition(ctx context.Context, orderID uint64, to Status, reason string) error {
+	if err := r.execTx(ctx, func(q *pgQueries) error {
+		if _, err := q.transition(ctx, orderID, to, reason, r.timeouts[to]); err != nil {
+			return fmt.Errorf("transition: %w", err)
 		}
 
 		return nil
@@ -72,12 +260,30 @@ func (r *pgRepo) Delete(ctx context.Context, orderID uint64) error {
 	return nil
 }
 
-func (r *pgRepo) Get(ctx context.Context, orderID uint64) (*Order, error) {
-	var order *Order
+func (r *pgRepo) GetStatus(ctx context.Context, orderID uint64) (Status, error) {
+	q := &pgQueries{db: r.db}
+	return q.getStatus(ctx, orderID, false)
+}
+
+func (r *pgRepo) GetHistory(ctx context.Context, orderID uint64) ([]*StatusChange, error) {
+	q := &pgQueries{db: r.db}
+	return q.getStatusHistory(ctx, orderID)
+}
+
+// MarkPaid moves the order to Paid status and puts it into the outbox to be published as a paid order.
+// Nothing is published if the order has already been paid.
+func (r *pgRepo) MarkPaid(ctx context.Context, orderID uint64, reason string) error {
 	if err := r.execTx(ctx, func(q *pgQueries) error {
-		var err error
+		applied, err := q.transition(ctx, orderID, Paid, reason, r.timeouts[Paid])
+		if err != nil {
+			return fmt.Errorf("transition: %w", err)
+		}
+
+		if !applied {
+			return nil
+		}
 
-		order, err = q.getOrder(ctx, orderID)
+		order, err := q.getOrder(ctx, orderID)
 		if err != nil {
 			return fmt.Errorf("get order: %w", err)
 		}
@@ -87,18 +293,137 @@ func (r *pgRepo) Get(ctx context.Context, orderID uint64) (*Order, error) {
 			return fmt.Errorf("get order items: %w", err)
 		}
 
+		if err := q.createOutboxMessage(ctx, events.TopicPaidOrders, fmt.Sprint(orderID), order); err != nil {
+			return fmt.Errorf("create outbox message: %w", err)
+		}
+
 		return nil
 	}); err != nil {
-		return nil, fmt.Errorf("exec tx: %w", err)
+		return fmt.Errorf("exec tx: %w", err)
+	}
+
+	return nil
+}
+
+// EnqueueReset puts the reset message into the outbox.
+func (r *pgRepo) EnqueueReset(ctx context.Context, msg events.ResetMsg) error {
+	q := &pgQueries{db: r.db}
+	if err := q.createOutboxMessage(ctx, events.TopicReset, fmt.Sprint(msg.OrderID), msg); err != nil {
+		return fmt.Errorf("create outbox message: %w", err)
+	}
+
+	return nil
+}
+
+// ExpireDeadlines cancels up to limit orders whose deadlines have passed and puts cancel
+// messages into the outbox. Deadlines locked by another watcher are skipped and the ones
+// of paid orders are removed, see Timeouts. It returns the number of cancelled orders.
+func (r *pgRepo) ExpireDeadlines(ctx context.Context, limit int) (int, error) {
+	var n int
+
+	if err := r.execTx(ctx, func(q *pgQueries) error {
+		deadlines, err := q.getExpiredDeadlines(ctx, limit)
+		if err != nil {
+			return fmt.Errorf("get expired deadlines: %w", err)
+		}
+
+		for _, d := range deadlines {
+			if d.status == Paid {
+				if err := q.setDeadline(ctx, d.orderID, Paid, 0); err != nil {
+					return fmt.Errorf("set deadline: %w", err)
+				}
+				continue
+			}
+
+			reason := fmt.Sprintf("timeout: order has been %s for too long", d.status)
+
+			applied, err := q.transition(ctx, d.orderID, Cancelled, reason, r.timeouts[Cancelled])
+			if err != nil {
+				return fmt.Errorf("transition: %w", err)
+			}
+
+			if !applied {
+				if err := q.setDeadline(ctx, d.orderID, Cancelled, 0); err != nil {
+					return fmt.Errorf("set deadline: %w", err)
+				}
+				continue
+			}
+
+			if err := q.createOutboxMessage(ctx, events.TopicCancel, fmt.Sprint(d.orderID), events.CancelMsg{
+				OrderID: d.orderID,
+				Reason:  reason,
+			}); err != nil {
+				return fmt.Errorf("create outbox message: %w", err)
+			}
+
+			n++
+		}
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("exec tx: %w", err)
+	}
+
+	return n, nil
+}
+
+// RelayOutbox locks up to limit pending outbox messages, passes them to fn one by one
+// and marks the ones fn succeeded on as sent. Messages locked by another relay are skipped.
+// It stops on the first fn error and returns the number of messages sent along with the error.
+func (r *pgRepo) RelayOutbox(ctx context.Context, limit int, fn func(msg *OutboxMessage) error) (int, error) {
+	var sent int
+	var sendErr error
+
+	if err := r.execTx(ctx, func(q *pgQueries) error {
+		msgs, err := q.getPendingOutboxMessages(ctx, limit)
+		if err != nil {
+			return fmt.Errorf("get pending outbox messages: %w", err)
+		}
+
+		for _, msg := range msgs {
+			if err := fn(msg); err != nil {
+				sendErr = err
+				break
+			}
+
+			if err := q.markOutboxMessageSent(ctx, msg.ID); err != nil {
+				return fmt.Errorf("mark outbox message sent: %w", err)
+			}
+			sent++
+		}
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("exec tx: %w", err)
 	}
 
-	return order, nil
+	if sendErr != nil {
+		return sent, fmt.Errorf("send: %w", sendErr)
+	}
+
+	return sent, nil
 }
 
+// readOnlyTx are the options of transactions reading several tables at once, they see a snapshot
+// of the database taken at their first query.
+var readOnlyTx = pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+
 // execTx creates a database transaction with ReadCommitted isolation level and
 // execute provided function in the scope of the transaction.
 func (r *pgRepo) execTx(ctx context.Context, fn func(queries *pgQueries) error) error {
-	tx, err := r.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	return r.execTxWith(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, fn)
+}
+
+// execTxWith is execTx creating a transaction with given options.
+func (r *pgRepo) execTxWith(ctx context.Context, opts pgx.TxOptions, fn func(queries *pgQueries) error) (err error) {
+	ctx, span := tracer.Start(ctx, "pgRepo.execTx")
+	start := time.Now()
+	defer func() {
+		metrics.DBTxDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
+	tx, err := r.db.BeginTx(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("%w: begin transaction: %v", ErrInternal, err)
 	}
@@ -107,6 +432,8 @@ func (r *pgRepo) execTx(ctx context.Context, fn func(queries *pgQueries) error)
 	err = fn(q)
 
 	if err != nil {
+		logger.Debug(ctx, "roll back transaction", logger.Err(err))
+
 		if rbErr := tx.Rollback(ctx); rbErr != nil {
 			return fmt.Errorf("tx: %w, rb: %v", err, rbErr)
 		}
@@ -132,6 +459,18 @@ type pgQueries struct {
 	db DBTX
 }
 
+// claim marks the message being handled as processed, see dedup.Claim.
+func (q *pgQueries) claim(ctx context.Context) error {
+	if err := dedup.Claim(ctx, q.db); err != nil {
+		if errors.Is(err, dedup.ErrDuplicate) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
 var createOrderQuery = fmt.Sprintf(`
 INSERT INTO %s
 (user_id, delivery_date, email, total)
@@ -163,7 +502,7 @@ func (q *pgQueries) createOrder(
 
 var createOrderItemQuery = fmt.Sprintf("INSERT INTO %s (order_id, product_id, quantity) VALUES ($1, $2, $3)", ordersItemsTable)
 
-func (q *pgQueries) createOrderItems(ctx context.Context, orderID uint64, items []*Item) error {
+func (q *pgQueries) createOrderItems(ctx context.Context, orderID uint64, items []*events.Item) error {
 	for _, item := range items {
 		if _, err := q.db.Exec(ctx, createOrderItemQuery, orderID, item.ProductID, item.Quantity); err != nil {
 			var pgErr *pgconn.PgError
@@ -184,33 +523,13 @@ func (q *pgQueries) createOrderItems(ctx context.Context, orderID uint64, items
 	return nil
 }
 
-var deleteOrderQuery = fmt.Sprintf("DELETE FROM %s WHERE order_id = $1", ordersTable)
-
-func (q *pgQueries) deleteOrder(ctx context.Context, orderID uint64) error {
-	if _, err := q.db.Exec(ctx, deleteOrderQuery, orderID); err != nil {
-		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
-	}
-
-	return nil
-}
-
-var deleteOrderItemsQuery = fmt.Sprintf("DELETE FROM %s WHERE order_id = $1", ordersItemsTable)
-
-func (q *pgQueries) deleteOrderItems(ctx context.Context, orderID uint64) error {
-	if _, err := q.db.Exec(ctx, deleteOrderItemsQuery, orderID); err != nil {
-		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
-	}
-
-	return nil
-}
-
 var getOrderQuery = fmt.Sprintf(`
 SELECT user_id, delivery_date, email, total 
 FROM %s WHERE order_id = $1
 `, ordersTable)
 
-func (q *pgQueries) getOrder(ctx context.Context, orderID uint64) (*Order, error) {
-	o := Order{
+func (q *pgQueries) getOrder(ctx context.Context, orderID uint64) (*events.Order, error) {
+	o := events.Order{
 		OrderID: orderID,
 	}
 
@@ -231,8 +550,8 @@ func (q *pgQueries) getOrder(ctx context.Context, orderID uint64) (*Order, error
 
 var getOrderItemsQuery = fmt.Sprintf("SELECT product_id, quantity FROM %s WHERE order_id = $1", ordersItemsTable)
 
-func (q *pgQueries) getOrderItems(ctx context.Context, orderID uint64) ([]*Item, error) {
-	var items []*Item
+func (q *pgQueries) getOrderItems(ctx context.Context, orderID uint64) ([]*events.Item, error) {
+	var items []*events.Item
 	rows, err := q.db.Query(ctx, getOrderItemsQuery, orderID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -249,7 +568,7 @@ func (q *pgQueries) getOrderItems(ctx context.Context, orderID uint64) ([]*Item,
 			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
 		}
 
-		items = append(items, &Item{
+		items = append(items, &events.Item{
 			ProductID: productID,
 			Quantity:  quantity,
 		})
@@ -261,3 +580,377 @@ func (q *pgQueries) getOrderItems(ctx context.Context, orderID uint64) ([]*Item,
 
 	return items, nil
 }
+
+var createOutboxMessageQuery = fmt.Sprintf(
+	"INSERT INTO %s (topic, key, payload, envelope) VALUES ($1, $2, $3, $4)",
+	outboxTable,
+)
+
+// createOutboxMessage puts the message into the outbox. Its envelope is created right away,
+// so it is caused by the message being handled in ctx rather than by the relay.
+func (q *pgQueries) createOutboxMessage(ctx context.Context, topic string, key string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%w: marshal: %v", ErrInternal, err)
+	}
+
+	env, err := kafka.NewEnvelope(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: new envelope: %v", ErrInternal, err)
+	}
+
+	envB, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("%w: marshal envelope: %v", ErrInternal, err)
+	}
+
+	if _, err := q.db.Exec(ctx, createOutboxMessageQuery, topic, key, b, envB); err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var getPendingOutboxMessagesQuery = fmt.Sprintf(`
+SELECT id, topic, key, payload, envelope
+FROM %s
+WHERE sent_at IS NULL
+ORDER BY id
+LIMIT $1
+FOR UPDATE SKIP LOCKED
+`, outboxTable)
+
+func (q *pgQueries) getPendingOutboxMessages(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	rows, err := q.db.Query(ctx, getPendingOutboxMessagesQuery, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+	}
+	defer rows.Close()
+
+	var msgs []*OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var env []byte
+		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &msg.Payload, &env); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		}
+
+		// Messages enqueued before envelopes were stored get a new one when sent.
+		if env != nil {
+			if err := json.Unmarshal(env, &msg.Envelope); err != nil {
+				return nil, fmt.Errorf("%w: unmarshal envelope: %v", ErrInternal, err)
+			}
+		}
+
+		msgs = append(msgs, &msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return msgs, nil
+}
+
+var markOutboxMessageSentQuery = fmt.Sprintf("UPDATE %s SET sent_at = now() WHERE id = $1", outboxTable)
+
+func (q *pgQueries) markOutboxMessageSent(ctx context.Context, id uint64) error {
+	if _, err := q.db.Exec(ctx, markOutboxMessageSentQuery, id); err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var listUserOrdersQuery = fmt.Sprintf(`
+SELECT o.order_id, o.user_id, o.delivery_date, o.email, o.total, s.status
+FROM %s o
+JOIN %s s ON s.order_id = o.order_id
+WHERE o.user_id = $1 AND ($2::bigint = 0 OR o.order_id < $2)
+ORDER BY o.order_id DESC
+LIMIT $3
+`, ordersTable, ordersStatusesTable)
+
+func (q *pgQueries) listUserOrders(ctx context.Context, userID uint64, afterID uint64, limit int) ([]*OrderInfo, error) {
+	rows, err := q.db.Query(ctx, listUserOrdersQuery, userID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+	}
+	defer rows.Close()
+
+	var orders []*OrderInfo
+	for rows.Next() {
+		var o OrderInfo
+		if err := rows.Scan(&o.OrderID, &o.UserID, &o.DeliveryDate, &o.Email, &o.Total, &o.Status); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		}
+
+		orders = append(orders, &o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return orders, nil
+}
+
+var getOrdersItemsQuery = fmt.Sprintf("SELECT order_id, product_id, quantity FROM %s WHERE order_id = ANY ($1)", ordersItemsTable)
+
+func (q *pgQueries) getOrdersItems(ctx context.Context, orderIDs []uint64) (map[uint64][]*events.Item, error) {
+	rows, err := q.db.Query(ctx, getOrdersItemsQuery, orderIDs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+	}
+	defer rows.Close()
+
+	items := make(map[uint64][]*events.Item, len(orderIDs))
+	for rows.Next() {
+		var orderID uint64
+		var item events.Item
+		if err := rows.Scan(&orderID, &item.ProductID, &item.Quantity); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		}
+
+		items[orderID] = append(items[orderID], &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return items, nil
+}
+
+var getIdempotencyKeyQuery = fmt.Sprintf("SELECT order_id, request_hash FROM %s WHERE key = $1", idempotencyKeysTable)
+
+func (q *pgQueries) getIdempotencyKey(ctx context.Context, key string) (uint64, string, error) {
+	var orderID uint64
+	var reqHash string
+	if err := q.db.QueryRow(ctx, getIdempotencyKeyQuery, key).Scan(&orderID, &reqHash); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, "", fmt.Errorf("%w: db query row: %v", ErrNotFound, err)
+		}
+		return 0, "", fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	}
+
+	return orderID, reqHash, nil
+}
+
+var createIdempotencyKeyQuery = fmt.Sprintf(
+	"INSERT INTO %s (key, request_hash, order_id) VALUES ($1, $2, $3)",
+	idempotencyKeysTable,
+)
+
+func (q *pgQueries) createIdempotencyKey(ctx context.Context, key string, reqHash string, orderID uint64) error {
+	if _, err := q.db.Exec(ctx, createIdempotencyKeyQuery, key, reqHash, orderID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.ConstraintName {
+			case "idempotency_keys_pkey":
+				return fmt.Errorf("%w: db exec: %v", errKeyTaken, err)
+			}
+		}
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var createStatusQuery = fmt.Sprintf("INSERT INTO %s (order_id) VALUES ($1)", ordersStatusesTable)
+
+func (q *pgQueries) createStatus(ctx context.Context, orderID uint64) error {
+	if _, err := q.db.Exec(ctx, createStatusQuery, orderID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.ConstraintName {
+			case "orders_statuses_pkey":
+				fallthrough
+			case "orders_statuses_order_id_fkey":
+				return fmt.Errorf("%w: db exec: %v", ErrFailedPrecondition, err)
+			}
+		}
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var (
+	getStatusQuery          = fmt.Sprintf("SELECT status FROM %s WHERE order_id = $1", ordersStatusesTable)
+	getStatusForUpdateQuery = getStatusQuery + " FOR UPDATE"
+)
+
+func (q *pgQueries) getStatus(ctx context.Context, orderID uint64, forUpdate bool) (Status, error) {
+	query := getStatusQuery
+	if forUpdate {
+		query = getStatusForUpdateQuery
+	}
+
+	var status Status
+	if err := q.db.QueryRow(ctx, query, orderID).Scan(&status); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%w: db query row: %v", ErrNotFound, err)
+		}
+		return 0, fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	}
+
+	return status, nil
+}
+
+var updateStatusQuery = fmt.Sprintf("UPDATE %s SET status = $2, updated_at = now() WHERE order_id = $1", ordersStatusesTable)
+
+func (q *pgQueries) updateStatus(ctx context.Context, orderID uint64, status Status) error {
+	if _, err := q.db.Exec(ctx, updateStatusQuery, orderID, status); err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+// transition moves the order to a given status unless the transition has to be skipped
+// and replaces the order deadline with the one of the new status.
+// It reports whether the status has been changed.
+func (q *pgQueries) transition(ctx context.Context, orderID uint64, to Status, reason string, timeout time.Duration) (bool, error) {
+	from, err := q.getStatus(ctx, orderID, true)
+	if err != nil {
+		return false, fmt.Errorf("get status: %w", err)
+	}
+
+	apply, err := checkTransition(from, to)
+	if err != nil || !apply {
+		return false, err
+	}
+
+	if err := q.updateStatus(ctx, orderID, to); err != nil {
+		return false, fmt.Errorf("update status: %w", err)
+	}
+
+	if err := q.createStatusChange(ctx, orderID, &from, to, reason); err != nil {
+		return false, fmt.Errorf("create status change: %w", err)
+	}
+
+	if err := q.setDeadline(ctx, orderID, to, timeout); err != nil {
+		return false, fmt.Errorf("set deadline: %w", err)
+	}
+
+	return true, nil
+}
+
+var createStatusChangeQuery = fmt.Sprintf(`
+INSERT INTO %s
+(order_id, from_status, to_status, reason)
+VALUES ($1, $2, $3, $4)
+`, ordersStatusHistoryTable)
+
+func (q *pgQueries) createStatusChange(ctx context.Context, orderID uint64, from *Status, to Status, reason string) error {
+	if _, err := q.db.Exec(ctx, createStatusChangeQuery, orderID, from, to, reason); err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var getStatusHistoryQuery = fmt.Sprintf(`
+SELECT from_status, to_status, reason, created_at
+FROM %s
+WHERE order_id = $1
+ORDER BY id
+`, ordersStatusHistoryTable)
+
+func (q *pgQueries) getStatusHistory(ctx context.Context, orderID uint64) ([]*StatusChange, error) {
+	rows, err := q.db.Query(ctx, getStatusHistoryQuery, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+	}
+	defer rows.Close()
+
+	var history []*StatusChange
+	for rows.Next() {
+		var change StatusChange
+		var from *string
+		if err := rows.Scan(&from, &change.To, &change.Reason, &change.Timestamp); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		}
+
+		if from != nil {
+			status, err := ParseStatus(*from)
+			if err != nil {
+				return nil, fmt.Errorf("parse status: %w", err)
+			}
+			change.From = &status
+		}
+
+		history = append(history, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return history, nil
+}
+
+var (
+	upsertDeadlineQuery = fmt.Sprintf(`
+INSERT INTO %s AS d (order_id, status, expires_at)
+VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+ON CONFLICT (order_id)
+DO UPDATE SET status = EXCLUDED.status, expires_at = EXCLUDED.expires_at
+`, ordersDeadlinesTable)
+	deleteDeadlineQuery = fmt.Sprintf("DELETE FROM %s WHERE order_id = $1", ordersDeadlinesTable)
+)
+
+// setDeadline sets the order deadline to timeout from now, zero timeout removes the deadline.
+func (q *pgQueries) setDeadline(ctx context.Context, orderID uint64, status Status, timeout time.Duration) error {
+	var err error
+	if timeout > 0 {
+		_, err = q.db.Exec(ctx, upsertDeadlineQuery, orderID, status, timeout.Milliseconds())
+	} else {
+		_, err = q.db.Exec(ctx, deleteDeadlineQuery, orderID)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+type deadline struct {
+	orderID uint64
+	status  Status
+}
+
+var getExpiredDeadlinesQuery = fmt.Sprintf(`
+SELECT order_id, status
+FROM %s
+WHERE expires_at <= now()
+ORDER BY expires_at
+LIMIT $1
+FOR UPDATE SKIP LOCKED
+`, ordersDeadlinesTable)
+
+func (q *pgQueries) getExpiredDeadlines(ctx context.Context, limit int) ([]*deadline, error) {
+	rows, err := q.db.Query(ctx, getExpiredDeadlinesQuery, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+	}
+	defer rows.Close()
+
+	var deadlines []*deadline
+	for rows.Next() {
+		var d deadline
+		if err := rows.Scan(&d.orderID, &d.status); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		}
+
+		deadlines = append(deadlines, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return deadlines, nil
+}
@@ -0,0 +1,465 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxQuantity is the largest quantity a bigint column holds.
+const maxQuantity = math.MaxInt64
+
+type memoryOrder struct {
+	order   events.Order
+	status  Status
+	history []*StatusChange
+}
+
+type memoryDeadline struct {
+	status    Status
+	expiresAt time.Time
+}
+
+type memoryIdempotencyKey struct {
+	orderID uint64
+	reqHash string
+}
+
+type memoryOutboxMessage struct {
+	msg    OutboxMessage
+	locked bool
+	sent   bool
+}
+
+type memoryRepo struct {
+	timeouts Timeouts
+
+	// mu makes every method atomic like a database transaction.
+	mu        sync.Mutex
+	processed *dedup.Processed
+	lastID    uint64
+	orders    map[uint64]*memoryOrder
+	deadlines map[uint64]memoryDeadline
+	keys      map[string]memoryIdempotencyKey
+	outbox    []*memoryOutboxMessage
+}
+
+// NewMemoryRepo creates an instance of memoryRepo, a repository keeping orders in memory, e.g. in tests.
+// It behaves the way pgRepo does.
+func NewMemoryRepo(timeouts Timeouts) *memoryRepo {
+	return &memoryRepo{
+		timeouts:  timeouts,
+		processed: dedup.NewProcessed(),
+		orders:    make(map[uint64]*memoryOrder),
+		deadlines: make(map[uint64]memoryDeadline),
+		keys:      make(map[string]memoryIdempotencyKey),
+	}
+}
+
+func (r *memoryRepo) Create(ctx context.Context, req CreateOrderReq) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.processed.Check(ctx); err != nil {
+		return 0, fmt.Errorf("claim: %w", err)
+	}
+
+	id, err := r.create(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	r.processed.Record(ctx)
+
+	return id, nil
+}
+
+func (r *memoryRepo) CreateIdempotent(ctx context.Context, key string, reqHash string, req CreateOrderReq) (uint64, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if k, ok := r.keys[key]; ok {
+		if k.reqHash != reqHash {
+			return 0, false, fmt.Errorf("%w: idempotency key has been used with another request", ErrFailedPrecondition)
+		}
+		return k.orderID, false, nil
+	}
+
+	id, err := r.create(ctx, req)
+	if err != nil {
+		return 0, false, fmt.Errorf("create: %w", err)
+	}
+
+	r.keys[key] = memoryIdempotencyKey{
+		orderID: id,
+		reqHash: reqHash,
+	}
+
+	return id, true, nil
+}
+
+// create creates the order and puts it into the outbox. r.mu must be held.
+func (r *memoryRepo) create(ctx context.Context, req CreateOrderReq) (uint64, error) {
+	products := make(map[uint64]struct{}, len(req.Items))
+	items := make([]*events.Item, 0, len(req.Items))
+	for _, item := range req.Items {
+		if item.Quantity > maxQuantity {
+			return 0, fmt.Errorf("%w: quantity %d is out of range", ErrInternal, item.Quantity)
+		}
+		if _, ok := products[item.ProductID]; ok {
+			return 0, fmt.Errorf("%w: product %d is ordered twice", ErrFailedPrecondition, item.ProductID)
+		}
+		products[item.ProductID] = struct{}{}
+
+		item := *item
+		items = append(items, &item)
+	}
+
+	id := r.lastID + 1
+	y, m, d := req.DeliveryDate.Date()
+
+	order := events.Order{
+		OrderID: id,
+		UserID:  req.UserID,
+		// Delivery dates are stored without time.
+		DeliveryDate: time.Date(y, m, d, 0, 0, 0, 0, time.UTC),
+		Email:        req.Email,
+		Total:        req.Total,
+		Items:        items,
+	}
+
+	// The message carries the delivery date as requested.
+	msg := order
+	msg.DeliveryDate = req.DeliveryDate
+
+	if err := r.enqueue(ctx, events.TopicSavedOrders, fmt.Sprint(id), msg); err != nil {
+		return 0, fmt.Errorf("create outbox message: %w", err)
+	}
+
+	r.lastID = id
+	r.orders[id] = &memoryOrder{
+		order:  order,
+		status: Created,
+		history: []*StatusChange{{
+			To:        Created,
+			Reason:    "order created",
+			Timestamp: time.Now(),
+		}},
+	}
+	r.setDeadline(id, Created, r.timeouts[Created])
+
+	return id, nil
+}
+
+func (r *memoryRepo) Get(_ context.Context, orderID uint64) (*OrderInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: order %d", ErrNotFound, orderID)
+	}
+
+	return &OrderInfo{
+		Order:   o.copyOrder(),
+		Status:  o.status,
+		History: o.copyHistory(),
+	}, nil
+}
+
+func (r *memoryRepo) ListByUser(_ context.Context, userID uint64, afterID uint64, limit int) ([]*OrderInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var orders []*OrderInfo
+	for id, o := range r.orders {
+		if o.order.UserID != userID || (afterID != 0 && id >= afterID) {
+			continue
+		}
+
+		orders = append(orders, &OrderInfo{
+			Order:  o.copyOrder(),
+			Status: o.status,
+		})
+	}
+
+	sort.Slice(orders, func(i, j int) bool { return orders[i].OrderID > orders[j].OrderID })
+	if len(orders) > limit {
+		orders = orders[:limit]
+	}
+
+	return orders, nil
+}
+
+func (r *memoryRepo) Transition(_ context.Context, orderID uint64, to Status, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.transition(orderID, to, reason); err != nil {
+		return fmt.Errorf("transition: %w", err)
+	}
+
+	return nil
+}
+
+func (r *memoryRepo) GetStatus(_ context.Context, orderID uint64) (Status, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[orderID]
+	if !ok {
+		return 0, fmt.Errorf("%w: order %d", ErrNotFound, orderID)
+	}
+
+	return o.status, nil
+}
+
+func (r *memoryRepo) GetHistory(_ context.Context, orderID uint64) ([]*StatusChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[orderID]
+	if !ok {
+		return nil, nil
+	}
+
+	return o.copyHistory(), nil
+}
+
+func (r *memoryRepo) MarkPaid(ctx context.Context, orderID uint64, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[orderID]
+	if !ok {
+		return fmt.Errorf("transition: %w: order %d", ErrNotFound, orderID)
+	}
+
+	apply, err := checkTransition(o.status, Paid)
+	if err != nil {
+		return fmt.Errorf("transition: %w", err)
+	}
+	if !apply {
+		return nil
+	}
+
+	if err := r.enqueue(ctx, events.TopicPaidOrders, fmt.Sprint(orderID), o.copyOrder()); err != nil {
+		return fmt.Errorf("create outbox message: %w", err)
+	}
+
+	if _, err := r.transition(orderID, Paid, reason); err != nil {
+		return fmt.Errorf("transition: %w", err)
+	}
+
+	return nil
+}
+
+func (r *memoryRepo) EnqueueReset(ctx context.Context, msg events.ResetMsg) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enqueue(ctx, events.TopicReset, fmt.Sprint(msg.OrderID), msg); err != nil {
+		return fmt.Errorf("create outbox message: %w", err)
+	}
+
+	return nil
+}
+
+func (r *memoryRepo) ExpireDeadlines(ctx context.Context, limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	var expired []uint64
+	for id, d := range r.deadlines {
+		if !d.expiresAt.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return r.deadlines[expired[i]].expiresAt.Before(r.deadlines[expired[j]].expiresAt)
+	})
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	// Paid orders never time out, see Timeouts.
+	cancelled := expired[:0]
+	for _, id := range expired {
+		if r.deadlines[id].status == Paid {
+			r.setDeadline(id, Paid, 0)
+			continue
+		}
+		cancelled = append(cancelled, id)
+	}
+	expired = cancelled
+
+	// Transitions are checked first, so that nothing is changed if any of them fails.
+	for _, id := range expired {
+		if _, err := checkTransition(r.orders[id].status, Cancelled); err != nil {
+			return 0, fmt.Errorf("transition: %w", err)
+		}
+	}
+
+	var n int
+	for _, id := range expired {
+		reason := fmt.Sprintf("timeout: order has been %s for too long", r.deadlines[id].status)
+
+		applied, err := r.transition(id, Cancelled, reason)
+		if err != nil {
+			return n, fmt.Errorf("transition: %w", err)
+		}
+
+		if !applied {
+			r.setDeadline(id, Cancelled, 0)
+			continue
+		}
+
+		if err := r.enqueue(ctx, events.TopicCancel, fmt.Sprint(id), events.CancelMsg{
+			OrderID: id,
+			Reason:  reason,
+		}); err != nil {
+			return n, fmt.Errorf("create outbox message: %w", err)
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// RelayOutbox passes pending messages to fn without holding the repository, so fn may use it.
+// The messages are locked meanwhile, so concurrent relays skip them.
+func (r *memoryRepo) RelayOutbox(_ context.Context, limit int, fn func(msg *OutboxMessage) error) (int, error) {
+	r.mu.Lock()
+	var pending []*memoryOutboxMessage
+	for _, m := range r.outbox {
+		if len(pending) == limit {
+			break
+		}
+		if !m.sent && !m.locked {
+			m.locked = true
+			pending = append(pending, m)
+		}
+	}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		for _, m := range pending {
+			m.locked = false
+		}
+		r.mu.Unlock()
+	}()
+
+	var sent int
+	for _, m := range pending {
+		msg := m.msg
+		if err := fn(&msg); err != nil {
+			return sent, fmt.Errorf("send: %w", err)
+		}
+
+		r.mu.Lock()
+		m.sent = true
+		r.mu.Unlock()
+		sent++
+	}
+
+	return sent, nil
+}
+
+// transition moves the order to a given status unless the transition has to be skipped
+// and replaces the order deadline with the one of the new status. r.mu must be held.
+func (r *memoryRepo) transition(orderID uint64, to Status, reason string) (bool, error) {
+	o, ok := r.orders[orderID]
+	if !ok {
+		return false, fmt.Errorf("%w: order %d", ErrNotFound, orderID)
+	}
+
+	apply, err := checkTransition(o.status, to)
+	if err != nil || !apply {
+		return false, err
+	}
+
+	from := o.status
+	o.status = to
+	o.history = append(o.history, &StatusChange{
+		From:      &from,
+		To:        to,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+
+	r.setDeadline(orderID, to, r.timeouts[to])
+
+	return true, nil
+}
+
+// setDeadline sets the order deadline to timeout from now, zero timeout removes the deadline.
+// r.mu must be held.
+func (r *memoryRepo) setDeadline(orderID uint64, status Status, timeout time.Duration) {
+	if timeout <= 0 {
+		delete(r.deadlines, orderID)
+		return
+	}
+
+	r.deadlines[orderID] = memoryDeadline{
+		status:    status,
+		expiresAt: time.Now().Add(timeout),
+	}
+}
+
+// enqueue puts the message into the outbox. r.mu must be held.
+func (r *memoryRepo) enqueue(ctx context.Context, topic string, key string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%w: marshal: %v", ErrInternal, err)
+	}
+
+	env, err := kafka.NewEnvelope(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: new envelope: %v", ErrInternal, err)
+	}
+
+	r.outbox = append(r.outbox, &memoryOutboxMessage{
+		msg: OutboxMessage{
+			ID:       uint64(len(r.outbox) + 1),
+			Topic:    topic,
+			Key:      key,
+			Payload:  b,
+			Envelope: env,
+		},
+	})
+
+	return nil
+}
+
+// copyOrder returns a copy of the order safe to be changed by the caller.
+func (o *memoryOrder) copyOrder() events.Order {
+	order := o.order
+	order.Items = make([]*events.Item, 0, len(o.order.Items))
+	for _, item := range o.order.Items {
+		item := *item
+		order.Items = append(order.Items, &item)
+	}
+
+	return order
+}
+
+func (o *memoryOrder) copyHistory() []*StatusChange {
+	history := make([]*StatusChange, 0, len(o.history))
+	for _, change := range o.history {
+		change := *change
+		history = append(history, &change)
+	}
+
+	return history
+}
@@ -0,0 +1,567 @@
+package order_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/order"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/pgtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T, timeouts order.Timeouts) order.Repository {
+		return order.NewMemoryRepo(timeouts)
+	})
+}
+
+func TestPgRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T, timeouts order.Timeouts) order.Repository {
+		return order.NewPgRepo(pgtest.Open(t, migrations.Orders), timeouts)
+	})
+}
+
+// testRepository runs the tests every Repository implementation has to pass.
+func testRepository(t *testing.T, newRepo func(t *testing.T, timeouts order.Timeouts) order.Repository) {
+	ctx := context.Background()
+
+	newReq := func(userID uint64, items ...*events.Item) order.CreateOrderReq {
+		return order.CreateOrderReq{
+			UserID:       userID,
+			Items:        items,
+			DeliveryDate: time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC),
+			Email:        "user@example.com",
+			Total:        99.5,
+		}
+	}
+
+	create := func(t *testing.T, repo order.Repository, req order.CreateOrderReq) uint64 {
+		t.Helper()
+
+		id, err := repo.Create(ctx, req)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return id
+	}
+
+	requireStatus := func(t *testing.T, repo order.Repository, orderID uint64, want order.Status) {
+		t.Helper()
+
+		got, err := repo.GetStatus(ctx, orderID)
+		if err != nil {
+			t.Fatalf("get status: %v", err)
+		}
+		if got != want {
+			t.Fatalf("status: got %s, want %s", got, want)
+		}
+	}
+
+	// relay relays every pending outbox message and returns them.
+	relay := func(t *testing.T, repo order.Repository) []*order.OutboxMessage {
+		t.Helper()
+
+		var msgs []*order.OutboxMessage
+		if _, err := repo.RelayOutbox(ctx, 100, func(msg *order.OutboxMessage) error {
+			msgs = append(msgs, msg)
+			return nil
+		}); err != nil {
+			t.Fatalf("relay outbox: %v", err)
+		}
+		return msgs
+	}
+
+	requireTopics := func(t *testing.T, msgs []*order.OutboxMessage, want ...string) {
+		t.Helper()
+
+		if len(msgs) != len(want) {
+			t.Fatalf("outbox messages: got %d, want %v", len(msgs), want)
+		}
+		for i, msg := range msgs {
+			if msg.Topic != want[i] {
+				t.Fatalf("outbox message %d: got topic %s, want %s", i, msg.Topic, want[i])
+			}
+		}
+	}
+
+	t.Run("create and get", func(t *testing.T) {
+		repo := newRepo(t, nil)
+		req := newReq(1, &events.Item{ProductID: 1, Quantity: 2}, &events.Item{ProductID: 2, Quantity: 1})
+
+		id := create(t, repo, req)
+
+		got, err := repo.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if got.OrderID != id || got.UserID != req.UserID || got.Email != req.Email || got.Total != req.Total {
+			t.Fatalf("order: got %+v, want %+v", got, req)
+		}
+		if got.Status != order.Created || len(got.History) != 1 || got.History[0].To != order.Created {
+			t.Fatalf("status: got %s, history %+v, want the creation", got.Status, got.History)
+		}
+		// Delivery dates are stored without time.
+		if want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC); !got.DeliveryDate.Equal(want) {
+			t.Fatalf("delivery date: got %v, want %v", got.DeliveryDate, want)
+		}
+
+		quantities := make(map[uint64]uint64, len(got.Items))
+		for _, item := range got.Items {
+			quantities[item.ProductID] = item.Quantity
+		}
+		if len(got.Items) != 2 || quantities[1] != 2 || quantities[2] != 1 {
+			t.Fatalf("items: got %v, want %v", quantities, req.Items)
+		}
+
+		requireStatus(t, repo, id, order.Created)
+
+		history, err := repo.GetHistory(ctx, id)
+		if err != nil {
+			t.Fatalf("get history: %v", err)
+		}
+		if len(history) != 1 || history[0].From != nil || history[0].To != order.Created {
+			t.Fatalf("history: got %+v, want the creation", history)
+		}
+
+		msgs := relay(t, repo)
+		requireTopics(t, msgs, events.TopicSavedOrders)
+
+		var saved events.Order
+		if err := json.Unmarshal(msgs[0].Payload, &saved); err != nil {
+			t.Fatalf("unmarshal saved order: %v", err)
+		}
+		if saved.OrderID != id || len(saved.Items) != 2 {
+			t.Fatalf("saved order: got %+v, want order %d with 2 items", saved, id)
+		}
+		if msgs[0].Envelope.MessageID == "" {
+			t.Fatal("saved order: envelope has no message id")
+		}
+	})
+
+	t.Run("missing order", func(t *testing.T) {
+		repo := newRepo(t, nil)
+
+		if _, err := repo.Get(ctx, 1); !errors.Is(err, order.ErrNotFound) {
+			t.Fatalf("get: got %v, want %v", err, order.ErrNotFound)
+		}
+		if _, err := repo.GetStatus(ctx, 1); !errors.Is(err, order.ErrNotFound) {
+			t.Fatalf("get status: got %v, want %v", err, order.ErrNotFound)
+		}
+		if err := repo.Transition(ctx, 1, order.Reserved, "reserved"); !errors.Is(err, order.ErrNotFound) {
+			t.Fatalf("transition: got %v, want %v", err, order.ErrNotFound)
+		}
+		if err := repo.MarkPaid(ctx, 1, "paid"); !errors.Is(err, order.ErrNotFound) {
+			t.Fatalf("mark paid: got %v, want %v", err, order.ErrNotFound)
+		}
+
+		history, err := repo.GetHistory(ctx, 1)
+		if err != nil || len(history) != 0 {
+			t.Fatalf("get history: got %v, %v, want no changes", history, err)
+		}
+	})
+
+	t.Run("product ordered twice", func(t *testing.T) {
+		repo := newRepo(t, nil)
+
+		_, err := repo.Create(ctx, newReq(1, &events.Item{ProductID: 1, Quantity: 2}, &events.Item{ProductID: 1, Quantity: 1}))
+		if !errors.Is(err, order.ErrFailedPrecondition) {
+			t.Fatalf("create: got %v, want %v", err, order.ErrFailedPrecondition)
+		}
+
+		requireTopics(t, relay(t, repo))
+
+		orders, err := repo.ListByUser(ctx, 1, 0, 10)
+		if err != nil {
+			t.Fatalf("list by user: %v", err)
+		}
+		if len(orders) != 0 {
+			t.Fatalf("orders: got %d, want none", len(orders))
+		}
+	})
+
+	t.Run("transition", func(t *testing.T) {
+		repo := newRepo(t, nil)
+		id := create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+
+		if err := repo.Transition(ctx, id, order.Reserved, "reserved"); err != nil {
+			t.Fatalf("transition: %v", err)
+		}
+		requireStatus(t, repo, id, order.Reserved)
+
+		// A late message moving the order back is skipped.
+		if err := repo.Transition(ctx, id, order.Created, "late"); err != nil {
+			t.Fatalf("transition back: %v", err)
+		}
+		requireStatus(t, repo, id, order.Reserved)
+
+		if err := repo.Transition(ctx, id, order.Collected, "collected"); !errors.Is(err, order.ErrIllegalTransition) {
+			t.Fatalf("illegal transition: got %v, want %v", err, order.ErrIllegalTransition)
+		}
+		requireStatus(t, repo, id, order.Reserved)
+
+		history, err := repo.GetHistory(ctx, id)
+		if err != nil {
+			t.Fatalf("get history: %v", err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("history: got %d changes, want 2", len(history))
+		}
+		if change := history[1]; change.From == nil || *change.From != order.Created || change.To != order.Reserved || change.Reason != "reserved" {
+			t.Fatalf("status change: got %+v, want created -> reserved", change)
+		}
+	})
+
+	t.Run("transition rules", func(t *testing.T) {
+		// paths lead a created order to a status.
+		paths := map[order.Status][]order.Status{
+			order.Created:        nil,
+			order.Reserved:       {order.Reserved},
+			order.PaymentPending: {order.Reserved, order.PaymentPending},
+			order.Paid:           {order.Reserved, order.PaymentPending, order.Paid},
+			order.Collected:      {order.Reserved, order.PaymentPending, order.Paid, order.Collected},
+			order.Cancelled:      {order.Cancelled},
+			order.Failed:         {order.Failed},
+		}
+
+		for _, tc := range []struct {
+			from, to order.Status
+			applied  bool
+			err      error
+		}{
+			// Redelivered messages.
+			{from: order.Created, to: order.Created},
+			{from: order.Reserved, to: order.Reserved},
+			{from: order.Paid, to: order.Paid},
+			{from: order.Collected, to: order.Collected},
+			{from: order.Cancelled, to: order.Cancelled},
+			{from: order.Failed, to: order.Failed},
+			// Compensated orders stay the way they were compensated first.
+			{from: order.Cancelled, to: order.Failed},
+			{from: order.Failed, to: order.Cancelled},
+			// Late messages moving back between non-terminal statuses.
+			{from: order.Reserved, to: order.Created},
+			{from: order.PaymentPending, to: order.Created},
+			{from: order.PaymentPending, to: order.Reserved},
+			{from: order.Paid, to: order.Reserved},
+			{from: order.Paid, to: order.PaymentPending},
+			// Forward moves, skipped steps included.
+			{from: order.Created, to: order.Reserved, applied: true},
+			{from: order.Created, to: order.Paid, applied: true},
+			{from: order.Reserved, to: order.Cancelled, applied: true},
+			{from: order.Paid, to: order.Collected, applied: true},
+			// Terminal orders do not move.
+			{from: order.Created, to: order.Collected, err: order.ErrIllegalTransition},
+			{from: order.Collected, to: order.Cancelled, err: order.ErrIllegalTransition},
+			{from: order.Cancelled, to: order.Reserved, err: order.ErrIllegalTransition},
+			{from: order.Failed, to: order.Collected, err: order.ErrIllegalTransition},
+		} {
+			t.Run(tc.from.String()+" to "+tc.to.String(), func(t *testing.T) {
+				repo := newRepo(t, nil)
+				id := create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+
+				for _, s := range paths[tc.from] {
+					if err := repo.Transition(ctx, id, s, "setup"); err != nil {
+						t.Fatalf("transition to %s: %v", s, err)
+					}
+				}
+				before, err := repo.GetHistory(ctx, id)
+				if err != nil {
+					t.Fatalf("get history: %v", err)
+				}
+
+				if err := repo.Transition(ctx, id, tc.to, "test"); !errors.Is(err, tc.err) {
+					t.Fatalf("transition: got %v, want %v", err, tc.err)
+				}
+
+				want, changes := tc.from, len(before)
+				if tc.applied {
+					want, changes = tc.to, changes+1
+				}
+				requireStatus(t, repo, id, want)
+
+				after, err := repo.GetHistory(ctx, id)
+				if err != nil {
+					t.Fatalf("get history: %v", err)
+				}
+				if len(after) != changes {
+					t.Fatalf("history: got %d changes, want %d", len(after), changes)
+				}
+			})
+		}
+	})
+
+	t.Run("mark paid", func(t *testing.T) {
+		repo := newRepo(t, nil)
+		id := create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+
+		// The payment may be confirmed more than once, the order is sent to be collected once.
+		for i := 0; i < 2; i++ {
+			if err := repo.MarkPaid(ctx, id, "paid"); err != nil {
+				t.Fatalf("mark paid: %v", err)
+			}
+		}
+		requireStatus(t, repo, id, order.Paid)
+
+		requireTopics(t, relay(t, repo), events.TopicSavedOrders, events.TopicPaidOrders)
+
+		if err := repo.Transition(ctx, id, order.Cancelled, "cancelled"); err != nil {
+			t.Fatalf("transition: %v", err)
+		}
+		if err := repo.MarkPaid(ctx, id, "paid"); !errors.Is(err, order.ErrIllegalTransition) {
+			t.Fatalf("mark cancelled order paid: got %v, want %v", err, order.ErrIllegalTransition)
+		}
+		requireStatus(t, repo, id, order.Cancelled)
+		requireTopics(t, relay(t, repo))
+	})
+
+	t.Run("relay outbox", func(t *testing.T) {
+		repo := newRepo(t, nil)
+		create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+		create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+		if err := repo.EnqueueReset(ctx, events.ResetMsg{OrderID: 1, ErrMsg: "reset"}); err != nil {
+			t.Fatalf("enqueue reset: %v", err)
+		}
+
+		failure := errors.New("broker is down")
+
+		var calls int
+		var failed *order.OutboxMessage
+		n, err := repo.RelayOutbox(ctx, 100, func(msg *order.OutboxMessage) error {
+			calls++
+			if calls == 1 {
+				return nil
+			}
+			failed = msg
+			return failure
+		})
+		if !errors.Is(err, failure) {
+			t.Fatalf("relay outbox: got %v, want %v", err, failure)
+		}
+		if n != 1 {
+			t.Fatalf("relayed: got %d, want 1", n)
+		}
+
+		// The relay stops on the first failure, the rest is relayed next time with the same envelopes.
+		msgs := relay(t, repo)
+		requireTopics(t, msgs, events.TopicSavedOrders, events.TopicReset)
+		if msgs[0].Envelope.MessageID != failed.Envelope.MessageID {
+			t.Fatalf("envelope: got message id %s, want %s", msgs[0].Envelope.MessageID, failed.Envelope.MessageID)
+		}
+		if msgs[1].Key != "1" {
+			t.Fatalf("reset message: got key %s, want 1", msgs[1].Key)
+		}
+
+		requireTopics(t, relay(t, repo))
+	})
+
+	t.Run("expire deadlines", func(t *testing.T) {
+		repo := newRepo(t, order.Timeouts{order.Created: time.Millisecond})
+		id := create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+		relay(t, repo)
+
+		time.Sleep(10 * time.Millisecond)
+
+		n, err := repo.ExpireDeadlines(ctx, 10)
+		if err != nil {
+			t.Fatalf("expire deadlines: %v", err)
+		}
+		if n != 1 {
+			t.Fatalf("expired: got %d, want 1", n)
+		}
+		requireStatus(t, repo, id, order.Cancelled)
+
+		history, err := repo.GetHistory(ctx, id)
+		if err != nil {
+			t.Fatalf("get history: %v", err)
+		}
+		if reason := history[len(history)-1].Reason; reason != "timeout: order has been created for too long" {
+			t.Fatalf("reason: got %q", reason)
+		}
+
+		msgs := relay(t, repo)
+		requireTopics(t, msgs, events.TopicCancel)
+
+		var msg events.CancelMsg
+		if err := json.Unmarshal(msgs[0].Payload, &msg); err != nil {
+			t.Fatalf("unmarshal cancel message: %v", err)
+		}
+		if msg.OrderID != id {
+			t.Fatalf("cancel message: got order %d, want %d", msg.OrderID, id)
+		}
+
+		if n, err := repo.ExpireDeadlines(ctx, 10); err != nil || n != 0 {
+			t.Fatalf("expire deadlines again: got %d, %v, want none", n, err)
+		}
+	})
+
+	t.Run("paid orders do not expire", func(t *testing.T) {
+		repo := newRepo(t, order.Timeouts{order.Paid: time.Millisecond})
+		id := create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+
+		if err := repo.MarkPaid(ctx, id, "paid"); err != nil {
+			t.Fatalf("mark paid: %v", err)
+		}
+		relay(t, repo)
+
+		time.Sleep(10 * time.Millisecond)
+
+		for i := 0; i < 2; i++ {
+			if n, err := repo.ExpireDeadlines(ctx, 10); err != nil || n != 0 {
+				t.Fatalf("expire deadlines: got %d, %v, want none", n, err)
+			}
+		}
+		requireStatus(t, repo, id, order.Paid)
+		requireTopics(t, relay(t, repo))
+	})
+
+	t.Run("create idempotent", func(t *testing.T) {
+		repo := newRepo(t, nil)
+		req := newReq(1, &events.Item{ProductID: 1, Quantity: 1})
+
+		id, created, err := repo.CreateIdempotent(ctx, "key", "hash", req)
+		if err != nil || !created {
+			t.Fatalf("create: got %v, %v, want created", created, err)
+		}
+
+		again, created, err := repo.CreateIdempotent(ctx, "key", "hash", req)
+		if err != nil || created || again != id {
+			t.Fatalf("create again: got %d, %v, %v, want %d not created", again, created, err, id)
+		}
+
+		if _, _, err := repo.CreateIdempotent(ctx, "key", "another hash", req); !errors.Is(err, order.ErrFailedPrecondition) {
+			t.Fatalf("create with another request: got %v, want %v", err, order.ErrFailedPrecondition)
+		}
+
+		requireTopics(t, relay(t, repo), events.TopicSavedOrders)
+	})
+
+	t.Run("concurrent create idempotent", func(t *testing.T) {
+		// Concurrent requests with one key race to store it. The ones losing the race look the key
+		// up again and get the order of the winner rather than an error.
+		const requests = 10
+
+		repo := newRepo(t, nil)
+		req := newReq(1, &events.Item{ProductID: 1, Quantity: 1})
+
+		type result struct {
+			id      uint64
+			created bool
+			err     error
+		}
+		results := make(chan result, requests)
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				id, created, err := repo.CreateIdempotent(ctx, "key", "hash", req)
+				results <- result{id: id, created: created, err: err}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(results)
+
+		var ids []uint64
+		var created int
+		for res := range results {
+			if res.err != nil {
+				t.Fatalf("create: %v", res.err)
+			}
+			if res.created {
+				created++
+			}
+			ids = append(ids, res.id)
+		}
+		if created != 1 {
+			t.Fatalf("created: got %d orders, want 1", created)
+		}
+		for _, id := range ids {
+			if id != ids[0] {
+				t.Fatalf("order ids: got %v, want one", ids)
+			}
+		}
+
+		requireTopics(t, relay(t, repo), events.TopicSavedOrders)
+	})
+
+	t.Run("list by user", func(t *testing.T) {
+		repo := newRepo(t, nil)
+
+		first := create(t, repo, newReq(1, &events.Item{ProductID: 1, Quantity: 1}))
+		second := create(t, repo, newReq(1, &events.Item{ProductID: 2, Quantity: 1}))
+		create(t, repo, newReq(2, &events.Item{ProductID: 1, Quantity: 1}))
+		third := create(t, repo, newReq(1, &events.Item{ProductID: 3, Quantity: 1}))
+
+		if err := repo.Transition(ctx, second, order.Reserved, "reserved"); err != nil {
+			t.Fatalf("transition: %v", err)
+		}
+
+		page, err := repo.ListByUser(ctx, 1, 0, 2)
+		if err != nil {
+			t.Fatalf("list by user: %v", err)
+		}
+		if len(page) != 2 || page[0].OrderID != third || page[1].OrderID != second {
+			t.Fatalf("first page: got %d orders, want %d and %d", len(page), third, second)
+		}
+		if page[1].Status != order.Reserved || len(page[1].Items) != 1 || page[1].Items[0].ProductID != 2 {
+			t.Fatalf("order %d: got %+v", second, page[1])
+		}
+
+		page, err = repo.ListByUser(ctx, 1, second, 2)
+		if err != nil {
+			t.Fatalf("list by user: %v", err)
+		}
+		if len(page) != 1 || page[0].OrderID != first {
+			t.Fatalf("last page: got %d orders, want %d", len(page), first)
+		}
+	})
+
+	t.Run("duplicate messages", func(t *testing.T) {
+		repo := newRepo(t, nil)
+		req := newReq(1, &events.Item{ProductID: 1, Quantity: 1})
+
+		msgCtx := kafkatest.HandlerContext(ctx, events.TopicNewOrders, 1, "message-1")
+		if _, err := repo.Create(msgCtx, req); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+
+		// The message is redelivered either at the same offset or, e.g. sent twice by a producer, at another one.
+		for _, dupCtx := range []context.Context{
+			msgCtx,
+			kafkatest.HandlerContext(ctx, events.TopicNewOrders, 2, "message-1"),
+		} {
+			if _, err := repo.Create(dupCtx, req); !errors.Is(err, dedup.ErrDuplicate) {
+				t.Fatalf("create duplicate: got %v, want %v", err, dedup.ErrDuplicate)
+			}
+		}
+
+		// A message failing to create the order is not recorded, so its redelivery is handled again.
+		failCtx := kafkatest.HandlerContext(ctx, events.TopicNewOrders, 3, "message-3")
+		invalid := newReq(1, &events.Item{ProductID: 1, Quantity: 1}, &events.Item{ProductID: 1, Quantity: 1})
+		if _, err := repo.Create(failCtx, invalid); !errors.Is(err, order.ErrFailedPrecondition) {
+			t.Fatalf("create: got %v, want %v", err, order.ErrFailedPrecondition)
+		}
+		if _, err := repo.Create(failCtx, req); err != nil {
+			t.Fatalf("create redelivered: %v", err)
+		}
+
+		orders, err := repo.ListByUser(ctx, 1, 0, 10)
+		if err != nil {
+			t.Fatalf("list by user: %v", err)
+		}
+		if len(orders) != 2 {
+			t.Fatalf("orders: got %d, want 2", len(orders))
+		}
+	})
+}
@@ -2,24 +2,35 @@ package order
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"strconv"
 )
 
 type Service interface {
 	Create(ctx context.Context, req CreateOrderReq) (uint64, error)
-	Delete(ctx context.Context, orderID uint64) error
+	CreateIdempotent(ctx context.Context, key string, req CreateOrderReq) (uint64, bool, error)
+	Transition(ctx context.Context, orderID uint64, to Status, reason string) error
 	SendPaidOrder(ctx context.Context, orderID uint64) error
+	GetHistory(ctx context.Context, orderID uint64) ([]*StatusChange, error)
+	GetOrder(ctx context.Context, orderID uint64) (*OrderInfo, error)
+	ListUserOrders(ctx context.Context, userID uint64, pageToken string, pageSize int) (*OrdersPage, error)
 }
 
 type service struct {
-	repo        Repository
-	kafkaClient KafkaClient
+	repo Repository
 }
 
-func NewService(repo Repository, kafkaClient KafkaClient) *service {
+// NewService creates an instance of service. Outgoing messages are not sent directly
+// but written to the outbox along with the data they describe, see OutboxRelay.
+func NewService(repo Repository) *service {
 	return &service{
-		repo:        repo,
-		kafkaClient: kafkaClient,
+		repo: repo,
 	}
 }
 
@@ -29,37 +40,98 @@ func (s *service) Create(ctx context.Context, req CreateOrderReq) (uint64, error
 		return 0, fmt.Errorf("create: %w", err)
 	}
 
-	if err := s.kafkaClient.SendSavedOrder(Order{
-		OrderID:      id,
-		UserID:       req.UserID,
-		DeliveryDate: req.DeliveryDate,
-		Email:        req.Email,
-		Total:        req.Total,
-		Items:        req.Items,
-	}); err != nil {
-		return 0, fmt.Errorf("send saved order: %w", err)
-	}
-
 	return id, nil
 }
 
-func (s *service) SendPaidOrder(ctx context.Context, orderID uint64) error {
-	order, err := s.repo.Get(ctx, orderID)
+// CreateIdempotent creates the order once per idempotency key. Retried requests with
+// the same key get the order created by the first one and false.
+func (s *service) CreateIdempotent(ctx context.Context, key string, req CreateOrderReq) (uint64, bool, error) {
+	b, err := json.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("get: %w", err)
+		return 0, false, fmt.Errorf("%w: marshal: %v", ErrInternal, err)
 	}
+	sum := sha256.Sum256(b)
+
+	id, created, err := s.repo.CreateIdempotent(ctx, key, hex.EncodeToString(sum[:]), req)
+	if err != nil {
+		return 0, false, fmt.Errorf("create idempotent: %w", err)
+	}
+
+	return id, created, nil
+}
 
-	if err := s.kafkaClient.SendPaidOrder(*order); err != nil {
-		return fmt.Errorf("send paid order: %w", err)
+func (s *service) Transition(ctx context.Context, orderID uint64, to Status, reason string) error {
+	if err := s.repo.Transition(ctx, orderID, to, reason); err != nil {
+		return fmt.Errorf("transition: %w", err)
 	}
 
 	return nil
 }
 
-func (s *service) Delete(ctx context.Context, orderID uint64) error {
-	if err := s.repo.Delete(ctx, orderID); err != nil {
-		return fmt.Errorf("delete: %w", err)
+func (s *service) SendPaidOrder(ctx context.Context, orderID uint64) error {
+	if err := s.repo.MarkPaid(ctx, orderID, "payment approved"); err != nil {
+		err = fmt.Errorf("mark paid: %w", err)
+
+		// Internal errors are retried, so the saga is reset only when the order cannot be processed.
+		if !errors.Is(err, ErrInternal) {
+			if rErr := s.repo.EnqueueReset(ctx, events.ResetMsg{
+				OrderID: orderID,
+				ErrMsg:  err.Error(),
+			}); rErr != nil {
+				logger.Error(ctx, "enqueue reset", logger.Err(rErr))
+			}
+		}
+
+		return err
 	}
 
 	return nil
 }
+
+// GetHistory returns the order status changes from the oldest to the newest one.
+func (s *service) GetHistory(ctx context.Context, orderID uint64) ([]*StatusChange, error) {
+	history, err := s.repo.GetHistory(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("get history: %w", err)
+	}
+
+	return history, nil
+}
+
+// GetOrder returns the order with its current status and status history.
+func (s *service) GetOrder(ctx context.Context, orderID uint64) (*OrderInfo, error) {
+	order, err := s.repo.Get(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+
+	return order, nil
+}
+
+// ListUserOrders returns a page of the user orders, newest first.
+// The page token is the one returned with the previous page, empty for the first page.
+func (s *service) ListUserOrders(ctx context.Context, userID uint64, pageToken string, pageSize int) (*OrdersPage, error) {
+	var afterID uint64
+	if pageToken != "" {
+		var err error
+		if afterID, err = strconv.ParseUint(pageToken, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: page token: %v", ErrInvalidMsg, err)
+		}
+	}
+
+	orders, err := s.repo.ListByUser(ctx, userID, afterID, pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("list by user: %w", err)
+	}
+
+	if orders == nil {
+		orders = []*OrderInfo{}
+	}
+
+	page := &OrdersPage{Orders: orders}
+	if len(orders) == pageSize {
+		page.NextPageToken = fmt.Sprint(orders[len(orders)-1].OrderID)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,125 @@
+package order
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// Status is a state of the order saga.
+type Status int
+
+const (
+	Created Status = iota
+	Reserved
+	PaymentPending
+	Paid
+	Collected
+	Cancelled
+	Failed
+)
+
+var statusNames = map[Status]string{
+	Created:        "created",
+	Reserved:       "reserved",
+	PaymentPending: "payment_pending",
+	Paid:           "paid",
+	Collected:      "collected",
+	Cancelled:      "cancelled",
+	Failed:         "failed",
+}
+
+// transitions lists statuses the order may move to from a given one. Steps of the happy path
+// may be skipped since messages of different topics are not delivered in order.
+var transitions = map[Status][]Status{
+	Created:        {Reserved, PaymentPending, Paid, Cancelled, Failed},
+	Reserved:       {PaymentPending, Paid, Cancelled, Failed},
+	PaymentPending: {Paid, Cancelled, Failed},
+	Paid:           {Collected, Cancelled, Failed},
+}
+
+// ParseStatus parses status name.
+func ParseStatus(str string) (Status, error) {
+	for s, name := range statusNames {
+		if name == str {
+			return s, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: unexpected status <%#v>", ErrInternal, str)
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	name, ok := statusNames[s]
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected value <%#v>", ErrInternal, s)
+	}
+	return []byte(name), nil
+}
+
+func (s *Status) Scan(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%w: value of unexpected type <%#v>", ErrInternal, v)
+	}
+
+	var err error
+	*s, err = ParseStatus(str)
+
+	return err
+}
+
+func (s Status) Value() (driver.Value, error) {
+	name, ok := statusNames[s]
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected value <%#v>", ErrInternal, s)
+	}
+	return name, nil
+}
+
+// Terminal reports whether the saga of the order is over.
+func (s Status) Terminal() bool {
+	return s == Collected || s == Cancelled || s == Failed
+}
+
+// checkTransition tells whether the order has to be moved from one status to another.
+// Moving to the current status, back along the happy path or from one compensated status
+// to another is the result of a redelivered or late message and is skipped.
+// Any other transition missing in the transitions table is illegal.
+func checkTransition(from, to Status) (bool, error) {
+	if from == to {
+		return false, nil
+	}
+
+	compensated := func(s Status) bool { return s == Cancelled || s == Failed }
+	if compensated(from) && compensated(to) {
+		return false, nil
+	}
+
+	if !from.Terminal() && !to.Terminal() && to < from {
+		return false, nil
+	}
+
+	for _, s := range transitions[from] {
+		if s == to {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, from, to)
+}
+
+// StatusChange is a record of the order status history.
+type StatusChange struct {
+	From      *Status   `json:"from,omitempty"`
+	To        Status    `json:"to"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
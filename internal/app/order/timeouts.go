@@ -0,0 +1,60 @@
+package order
+
+import (
+	"context"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"time"
+)
+
+// Timeouts are the longest times the order may stay in a status. Once the time is out
+// the order is cancelled and the cancel message is sent for other services to compensate.
+// Paid orders never time out: the payment has been taken, so they are left to collection
+// or manual handling, and a timeout of Paid is ignored.
+type Timeouts map[Status]time.Duration
+
+// TimeoutWatcher cancels orders stuck in a saga step.
+type TimeoutWatcher struct {
+	repo      Repository
+	interval  time.Duration
+	batchSize int
+}
+
+// NewTimeoutWatcher creates an instance of TimeoutWatcher.
+func NewTimeoutWatcher(repo Repository, interval time.Duration, batchSize int) *TimeoutWatcher {
+	return &TimeoutWatcher{
+		repo:      repo,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run cancels expired orders every interval until ctx is done.
+// A full batch is followed by the next one right away. Every batch is a step of the progress.
+func (w *TimeoutWatcher) Run(ctx context.Context, progress *health.Progress) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			end := progress.Begin()
+			n, err := w.repo.ExpireDeadlines(ctx, w.batchSize)
+			end()
+			if err != nil {
+				logger.Error(ctx, "expire deadlines", logger.Err(err))
+			}
+			if n > 0 {
+				logger.Info(ctx, "cancelled expired orders", logger.Int("count", n))
+			}
+
+			if err == nil && n == w.batchSize {
+				timer.Reset(0)
+			} else {
+				timer.Reset(w.interval)
+			}
+		}
+	}
+}
@@ -1,41 +1,54 @@
 package stock
 
 import (
+	"context"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
 )
 
 // KafkaClient sends predefined messages to kafka.
 type KafkaClient interface {
-	SendReservedOrder(order Order) error
-	SendReset(msg ResetMsg) error
+	SendReservedOrder(ctx context.Context, order events.Order) error
+	SendCollectedOrder(ctx context.Context, msg events.CollectedOrder) error
+	SendReset(ctx context.Context, msg events.ResetMsg) error
 }
 
 type kafkaClient struct {
-	reservedOrdersProducer kafka.Producer
-	resetProducer          kafka.Producer
+	reservedOrdersProducer  kafka.Producer
+	collectedOrdersProducer kafka.Producer
+	resetProducer           kafka.Producer
 }
 
 // NewKafkaClient creates and instance of kafkaClient.
 func NewKafkaClient(
 	reservedOrderProducer kafka.Producer,
+	collectedOrdersProducer kafka.Producer,
 	resetProducer kafka.Producer,
 ) *kafkaClient {
 	return &kafkaClient{
-		reservedOrdersProducer: reservedOrderProducer,
-		resetProducer:          resetProducer,
+		reservedOrdersProducer:  reservedOrderProducer,
+		collectedOrdersProducer: collectedOrdersProducer,
+		resetProducer:           resetProducer,
 	}
 }
 
-func (c *kafkaClient) SendReservedOrder(order Order) error {
-	if err := c.reservedOrdersProducer.SendMessage(fmt.Sprint(order.OrderID), order); err != nil {
+func (c *kafkaClient) SendReservedOrder(ctx context.Context, order events.Order) error {
+	if err := c.reservedOrdersProducer.SendMessage(ctx, fmt.Sprint(order.OrderID), order); err != nil {
 		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
 	}
 	return nil
 }
 
-func (c *kafkaClient) SendReset(msg ResetMsg) error {
-	if err := c.resetProducer.SendMessage(fmt.Sprint(msg.OrderID), msg); err != nil {
+func (c *kafkaClient) SendCollectedOrder(ctx context.Context, msg events.CollectedOrder) error {
+	if err := c.collectedOrdersProducer.SendMessage(ctx, fmt.Sprint(msg.OrderID), msg); err != nil {
+		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
+	}
+	return nil
+}
+
+func (c *kafkaClient) SendReset(ctx context.Context, msg events.ResetMsg) error {
+	if err := c.resetProducer.SendMessage(ctx, fmt.Sprint(msg.OrderID), msg); err != nil {
 		return fmt.Errorf("%w: send message: %v", ErrInternal, err)
 	}
 	return nil
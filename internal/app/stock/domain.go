@@ -0,0 +1,313 @@
+package stock
+
+import (
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"math"
+	"sort"
+	"time"
+)
+
+// Product is a catalogue entry. Products that are not active cannot be reserved.
+type Product struct {
+	ID     uint64  `json:"id"`
+	SKU    string  `json:"sku"`
+	Name   string  `json:"name"`
+	Price  float64 `json:"price"`
+	Weight uint64  `json:"weight"` // grams
+	Active bool    `json:"active"`
+}
+
+// Warehouse is a place the products are kept in.
+type Warehouse struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+}
+
+// Stock is the quantity of the product kept in the warehouse.
+type Stock struct {
+	WarehouseID uint64 `json:"warehouse_id"`
+	ProductID   uint64 `json:"product_id"`
+	Quantity    uint64 `json:"quantity"`
+}
+
+// Reservation is the quantity of the product reserved for the order in the warehouse.
+type Reservation struct {
+	OrderID     uint64 `json:"order_id"`
+	ProductID   uint64 `json:"product_id"`
+	WarehouseID uint64 `json:"warehouse_id"`
+	Quantity    uint64 `json:"quantity"`
+}
+
+// MovementKind is what changed the quantity of a product in a warehouse.
+type MovementKind string
+
+const (
+	MovementReserve MovementKind = "reserve"
+	MovementCancel  MovementKind = "cancel"
+	MovementCollect MovementKind = "collect"
+	MovementRestock MovementKind = "restock"
+	MovementSet     MovementKind = "set"
+	MovementAdjust  MovementKind = "adjust"
+)
+
+// Reason is the reason code of a manual change of a quantity.
+type Reason string
+
+const (
+	// ReasonOpening is the quantity kept before the ledger was introduced.
+	ReasonOpening    Reason = "opening"
+	ReasonDelivery   Reason = "delivery"
+	ReasonReturn     Reason = "return"
+	ReasonStocktake  Reason = "stocktake"
+	ReasonDamage     Reason = "damage"
+	ReasonLoss       Reason = "loss"
+	ReasonCorrection Reason = "correction"
+)
+
+var reasons = map[Reason]struct{}{
+	ReasonOpening:    {},
+	ReasonDelivery:   {},
+	ReasonReturn:     {},
+	ReasonStocktake:  {},
+	ReasonDamage:     {},
+	ReasonLoss:       {},
+	ReasonCorrection: {},
+}
+
+// Movement is an entry of the inventory ledger. The deltas of the movements of a product
+// in a warehouse sum up to its quantity, Quantity is the one after the movement.
+// Movements of orders have the OrderID, manual ones have the Reason.
+type Movement struct {
+	ID          uint64       `json:"id"`
+	WarehouseID uint64       `json:"warehouse_id"`
+	ProductID   uint64       `json:"product_id"`
+	Kind        MovementKind `json:"kind"`
+	Reason      Reason       `json:"reason,omitempty"`
+	OrderID     uint64       `json:"order_id,omitempty"`
+	Delta       int64        `json:"delta"`
+	Quantity    uint64       `json:"quantity"`
+	Note        string       `json:"note,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// change is a manual change of the quantity of the product in the warehouse.
+type change struct {
+	kind        MovementKind
+	warehouseID uint64
+	productID   uint64
+	reason      Reason
+	note        string
+	// quantity returns the quantity after the change given the current one.
+	quantity func(current uint64) (uint64, error)
+}
+
+// movement returns the movement changing the current quantity the way c does.
+func (c *change) movement(current uint64) (*Movement, error) {
+	quantity, err := c.quantity(current)
+	if err != nil {
+		return nil, err
+	}
+	if quantity > math.MaxInt64 {
+		return nil, fmt.Errorf("%w: quantity %d is out of range", ErrFailedPrecondition, quantity)
+	}
+
+	return &Movement{
+		WarehouseID: c.warehouseID,
+		ProductID:   c.productID,
+		Kind:        c.kind,
+		Reason:      c.reason,
+		Delta:       int64(quantity) - int64(current),
+		Note:        c.note,
+	}, nil
+}
+
+func checkReason(reason Reason) error {
+	if _, ok := reasons[reason]; !ok {
+		return fmt.Errorf("%w: unknown reason %q", ErrInvalidMsg, reason)
+	}
+
+	return nil
+}
+
+func newRestock(req RestockReq) (*change, error) {
+	if err := checkReason(req.Reason); err != nil {
+		return nil, err
+	}
+	if req.Quantity == 0 {
+		return nil, fmt.Errorf("%w: nothing to restock", ErrInvalidMsg)
+	}
+
+	return &change{
+		kind:        MovementRestock,
+		warehouseID: req.WarehouseID,
+		productID:   req.ProductID,
+		reason:      req.Reason,
+		note:        req.Note,
+		quantity: func(current uint64) (uint64, error) {
+			if req.Quantity > math.MaxInt64-current {
+				return 0, fmt.Errorf("%w: quantity %d + %d is out of range", ErrFailedPrecondition, current, req.Quantity)
+			}
+			return current + req.Quantity, nil
+		},
+	}, nil
+}
+
+func newSetQuantity(req SetQuantityReq) (*change, error) {
+	if err := checkReason(req.Reason); err != nil {
+		return nil, err
+	}
+
+	return &change{
+		kind:        MovementSet,
+		warehouseID: req.WarehouseID,
+		productID:   req.ProductID,
+		reason:      req.Reason,
+		note:        req.Note,
+		quantity: func(uint64) (uint64, error) {
+			return req.Quantity, nil
+		},
+	}, nil
+}
+
+func newAdjustQuantity(req AdjustQuantityReq) (*change, error) {
+	if err := checkReason(req.Reason); err != nil {
+		return nil, err
+	}
+	if req.Delta == 0 {
+		return nil, fmt.Errorf("%w: nothing to adjust", ErrInvalidMsg)
+	}
+
+	return &change{
+		kind:        MovementAdjust,
+		warehouseID: req.WarehouseID,
+		productID:   req.ProductID,
+		reason:      req.Reason,
+		note:        req.Note,
+		quantity: func(current uint64) (uint64, error) {
+			if req.Delta < 0 {
+				// -req.Delta overflows for math.MinInt64, which is never enough anyway.
+				if req.Delta == math.MinInt64 || uint64(-req.Delta) > current {
+					return 0, fmt.Errorf("%w: quantity %d cannot be adjusted by %d", ErrNotEnough, current, req.Delta)
+				}
+				return current - uint64(-req.Delta), nil
+			}
+			if uint64(req.Delta) > math.MaxInt64-current {
+				return 0, fmt.Errorf("%w: quantity %d + %d is out of range", ErrFailedPrecondition, current, req.Delta)
+			}
+			return current + uint64(req.Delta), nil
+		},
+	}, nil
+}
+
+// reservationMovements returns the movements of the reserved products: reserving takes them
+// from the warehouses, cancelling returns them and collecting records that they have left.
+func reservationMovements(kind MovementKind, reservations []*Reservation) []*Movement {
+	movements := make([]*Movement, 0, len(reservations))
+	for _, r := range reservations {
+		m := &Movement{
+			WarehouseID: r.WarehouseID,
+			ProductID:   r.ProductID,
+			Kind:        kind,
+			OrderID:     r.OrderID,
+		}
+
+		switch kind {
+		case MovementReserve:
+			m.Delta = -int64(r.Quantity)
+		case MovementCancel:
+			m.Delta = int64(r.Quantity)
+		}
+
+		movements = append(movements, m)
+	}
+
+	// The rows are updated in the order lockStockQuery locks them in.
+	sort.Slice(movements, func(i, j int) bool {
+		if movements[i].WarehouseID != movements[j].WarehouseID {
+			return movements[i].WarehouseID < movements[j].WarehouseID
+		}
+		return movements[i].ProductID < movements[j].ProductID
+	})
+
+	return movements
+}
+
+// checkItems fails with ErrFailedPrecondition if a product is ordered twice.
+func checkItems(items []*events.Item) error {
+	products := make(map[uint64]struct{}, len(items))
+	for _, item := range items {
+		if _, ok := products[item.ProductID]; ok {
+			return fmt.Errorf("%w: product %d is ordered twice", ErrFailedPrecondition, item.ProductID)
+		}
+		products[item.ProductID] = struct{}{}
+	}
+
+	return nil
+}
+
+// checkProducts fails with ErrNotFound if an item is missing in the catalogue
+// and with ErrFailedPrecondition if its product is not active.
+func checkProducts(items []*events.Item, products map[uint64]*Product) error {
+	for _, item := range items {
+		p, ok := products[item.ProductID]
+		if !ok {
+			return fmt.Errorf("%w: product %d", ErrNotFound, item.ProductID)
+		}
+		if !p.Active {
+			return fmt.Errorf("%w: product %d is not active", ErrFailedPrecondition, item.ProductID)
+		}
+	}
+
+	return nil
+}
+
+// allocate picks the warehouses the items of the order are reserved in. An item is taken
+// from a single warehouse if any has enough of the product, the one having the most of it,
+// otherwise it is split across warehouses starting with the ones having the most.
+// It fails with ErrNotEnough if all the warehouses together do not have enough.
+func allocate(orderID uint64, items []*events.Item, stock []*Stock) ([]*Reservation, error) {
+	byProduct := make(map[uint64][]*Stock, len(items))
+	for _, s := range stock {
+		if s.Quantity > 0 {
+			byProduct[s.ProductID] = append(byProduct[s.ProductID], s)
+		}
+	}
+
+	var reservations []*Reservation
+	for _, item := range items {
+		candidates := byProduct[item.ProductID]
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Quantity != candidates[j].Quantity {
+				return candidates[i].Quantity > candidates[j].Quantity
+			}
+			return candidates[i].WarehouseID < candidates[j].WarehouseID
+		})
+
+		left := item.Quantity
+		for _, s := range candidates {
+			if left == 0 {
+				break
+			}
+
+			quantity := s.Quantity
+			if left < quantity {
+				quantity = left
+			}
+			left -= quantity
+
+			reservations = append(reservations, &Reservation{
+				OrderID:     orderID,
+				ProductID:   item.ProductID,
+				WarehouseID: s.WarehouseID,
+				Quantity:    quantity,
+			})
+		}
+
+		if left > 0 {
+			return nil, fmt.Errorf("%w: product %d lacks %d", ErrNotEnough, item.ProductID, left)
+		}
+	}
+
+	return reservations, nil
+}
@@ -1,35 +1,29 @@
 package stock
 
-import "time"
-
-// ResetMsg represents reset message.
-type ResetMsg struct {
-	OrderID uint64 `json:"order_id" validate:"required"`
-	ErrMsg  string `json:"err_msg" validate:"required"`
-}
-
-// Item represents product with its quantity.
-type Item struct {
-	ProductID uint64 `json:"product_id"`
-	Quantity  uint64 `json:"quantity"`
-}
-
-// Order is a order request message.
-type Order struct {
-	OrderID      uint64    `json:"order_id" validate:"required"`
-	UserID       uint64    `json:"user_id" validate:"required"`
-	Items        []*Item   `json:"items" validate:"required"`
-	DeliveryDate time.Time `json:"delivery_date" validate:"required"`
-	Email        string    `json:"email" validate:"required"`
-	Total        float64   `json:"total" validate:"required"`
+// RestockReq adds the quantity of the product to the warehouse.
+type RestockReq struct {
+	WarehouseID uint64 `json:"warehouse_id" validate:"required"`
+	ProductID   uint64 `json:"product_id" validate:"required"`
+	Quantity    uint64 `json:"quantity" validate:"required"`
+	Reason      Reason `json:"reason" validate:"required"`
+	Note        string `json:"note"`
 }
 
-// CancelMsg represents cancellation message.
-type CancelMsg struct {
-	OrderID uint64 `json:"order_id" validate:"required"`
-	Reason  string `json:"reason" validate:"required"`
+// SetQuantityReq sets the quantity of the product in the warehouse, e.g. after a stocktake.
+type SetQuantityReq struct {
+	WarehouseID uint64 `json:"warehouse_id" validate:"required"`
+	ProductID   uint64 `json:"product_id" validate:"required"`
+	Quantity    uint64 `json:"quantity"`
+	Reason      Reason `json:"reason" validate:"required"`
+	Note        string `json:"note"`
 }
 
-type Payment struct {
-	OrderID uint64 `json:"order_id" validate:"required"`
+// AdjustQuantityReq adds the delta, negative e.g. for damaged products, to the quantity
+// of the product in the warehouse.
+type AdjustQuantityReq struct {
+	WarehouseID uint64 `json:"warehouse_id" validate:"required"`
+	ProductID   uint64 `json:"product_id" validate:"required"`
+	Delta       int64  `json:"delta" validate:"required"`
+	Reason      Reason `json:"reason" validate:"required"`
+	Note        string `json:"note"`
 }
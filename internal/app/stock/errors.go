@@ -1,6 +1,9 @@
 package stock
 
-import "errors"
+import (
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+)
 
 var (
 	ErrInternal           = errors.New("internal")
@@ -8,4 +11,15 @@ var (
 	ErrNotEnough          = errors.New("not enough")
 	ErrInvalidMsg         = errors.New("invalid message")
 	ErrFailedPrecondition = errors.New("failed precondition")
+	// ErrCancelled means the order has been cancelled before its products were reserved.
+	ErrCancelled = errors.New("cancelled")
 )
+
+// errorClasses label message handling errors in metrics.
+var errorClasses = metrics.ErrorClasses{
+	{Name: "invalid_msg", Err: ErrInvalidMsg},
+	{Name: "not_found", Err: ErrNotFound},
+	{Name: "not_enough", Err: ErrNotEnough},
+	{Name: "failed_precondition", Err: ErrFailedPrecondition},
+	{Name: "internal", Err: ErrInternal},
+}
@@ -0,0 +1,224 @@
+package stock
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTPHandler serves stock admin API:
+//
+//	POST /inventory/restock
+//	POST /inventory/set
+//	POST /inventory/adjust
+//	GET /products/{product_id}/stock
+//	GET /products/{product_id}/movements
+//
+// Every change of a quantity takes a reason code and responds with its movement in the inventory ledger.
+// Every request must carry the admin token as "Authorization: Bearer <token>".
+type HTTPHandler struct {
+	svc      Service
+	token    string
+	mux      *http.ServeMux
+	validate *validator.Validate
+}
+
+// NewHTTPHandler creates an instance of HTTPHandler authorizing requests with token.
+// An empty token authorizes no request.
+func NewHTTPHandler(svc Service, token string) *HTTPHandler {
+	h := &HTTPHandler{
+		svc:      svc,
+		token:    token,
+		mux:      http.NewServeMux(),
+		validate: validator.New(),
+	}
+
+	h.setupRoutes()
+
+	return h
+}
+
+func (h *HTTPHandler) setupRoutes() {
+	h.mux.HandleFunc("/inventory/restock", h.restock)
+	h.mux.HandleFunc("/inventory/set", h.setQuantity)
+	h.mux.HandleFunc("/inventory/adjust", h.adjustQuantity)
+	h.mux.HandleFunc("/products/", h.getProduct)
+}
+
+// ServeHTTP traces the request, continuing the trace of the caller if any, and adds its method and path to the log fields.
+// Unauthorized requests are rejected before reaching the routes.
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stock admin"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx = logger.WithFields(ctx,
+		logger.String("http_method", r.Method),
+		logger.String("http_path", r.URL.Path),
+	)
+	ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+		),
+	)
+	defer span.End()
+
+	h.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authorized reports whether the request carries the admin token.
+func (h *HTTPHandler) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if h.token == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *HTTPHandler) restock(w http.ResponseWriter, r *http.Request) {
+	var req RestockReq
+	if !h.decode(w, r, &req) {
+		return
+	}
+
+	m, err := h.svc.Restock(r.Context(), req)
+	if err != nil {
+		writeServiceError(r.Context(), w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (h *HTTPHandler) setQuantity(w http.ResponseWriter, r *http.Request) {
+	var req SetQuantityReq
+	if !h.decode(w, r, &req) {
+		return
+	}
+
+	m, err := h.svc.SetQuantity(r.Context(), req)
+	if err != nil {
+		writeServiceError(r.Context(), w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (h *HTTPHandler) adjustQuantity(w http.ResponseWriter, r *http.Request) {
+	var req AdjustQuantityReq
+	if !h.decode(w, r, &req) {
+		return
+	}
+
+	m, err := h.svc.AdjustQuantity(r.Context(), req)
+	if err != nil {
+		writeServiceError(r.Context(), w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
+
+// decode decodes and validates the body of a POST request into req. It writes the error response
+// and returns false if it fails.
+func (h *HTTPHandler) decode(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decode: %v", err))
+		return false
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("validate: %v", err))
+		return false
+	}
+
+	return true
+}
+
+func (h *HTTPHandler) getProduct(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/products/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	productID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	ctx := logger.WithFields(r.Context(), logger.Uint64("product_id", productID))
+
+	var resp interface{}
+	switch parts[1] {
+	case "stock":
+		resp, err = h.svc.GetStock(ctx, productID)
+	case "movements":
+		resp, err = h.svc.GetMovements(ctx, productID)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeServiceError(ctx, w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeServiceError(ctx context.Context, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidMsg):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, ErrNotEnough), errors.Is(err, ErrFailedPrecondition):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		logger.Error(ctx, "handle http request", logger.Err(err))
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Default().Error("write http response", logger.Err(err))
+	}
+}
@@ -0,0 +1,88 @@
+package stock_test
+
+import (
+	"context"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerAuthorization(t *testing.T) {
+	ctx := context.Background()
+
+	repo := stock.NewMemoryRepo()
+	if err := repo.AddProduct(ctx, stock.Product{ID: 1, SKU: "SKU-1", Name: "kettle", Active: true}); err != nil {
+		t.Fatalf("add product: %v", err)
+	}
+	if _, err := repo.AddWarehouse(ctx, "main"); err != nil {
+		t.Fatalf("add warehouse: %v", err)
+	}
+	svc := stock.NewService(repo, &fakeClient{})
+
+	const restock = `{"warehouse_id": 1, "product_id": 1, "quantity": 10, "reason": "delivery"}`
+
+	do := func(h http.Handler, method, path, auth string) *httptest.ResponseRecorder {
+		var body string
+		if method == http.MethodPost {
+			body = restock
+		}
+
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	h := stock.NewHTTPHandler(svc, "secret")
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+	}{
+		{name: "no token", method: http.MethodPost, path: "/inventory/restock"},
+		{name: "wrong token", method: http.MethodPost, path: "/inventory/restock", auth: "Bearer wrong"},
+		{name: "not bearer", method: http.MethodPost, path: "/inventory/restock", auth: "Basic c2VjcmV0"},
+		{name: "read without token", method: http.MethodGet, path: "/products/1/stock"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := do(h, tc.method, tc.path, tc.auth)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("status: got %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("WWW-Authenticate: not set")
+			}
+		})
+	}
+
+	if q := repo.Quantities()[1]; q != 0 {
+		t.Fatalf("quantity after unauthorized requests: got %d, want 0", q)
+	}
+
+	t.Run("token", func(t *testing.T) {
+		if w := do(h, http.MethodPost, "/inventory/restock", "Bearer secret"); w.Code != http.StatusOK {
+			t.Fatalf("restock: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		if q := repo.Quantities()[1]; q != 10 {
+			t.Fatalf("quantity: got %d, want 10", q)
+		}
+		if w := do(h, http.MethodGet, "/products/1/stock", "Bearer secret"); w.Code != http.StatusOK {
+			t.Fatalf("get stock: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	})
+
+	t.Run("empty token authorizes nothing", func(t *testing.T) {
+		w := do(stock.NewHTTPHandler(svc, ""), http.MethodGet, "/products/1/stock", "Bearer ")
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status: got %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+		}
+	})
+}
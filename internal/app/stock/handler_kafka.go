@@ -2,27 +2,26 @@ package stock
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Shopify/sarama"
-	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 )
 
 type KafkaHandler struct {
-	svc      Service
-	router   *router.SaramaRouter
-	validate *validator.Validate
+	svc    Service
+	router *router.SaramaRouter
 }
 
 func NewKafkaHandler(
 	svc Service,
+	opts ...router.Option,
 ) *KafkaHandler {
 	h := &KafkaHandler{
-		svc:      svc,
-		router:   router.NewSaramaRouter(),
-		validate: validator.New(),
+		svc:    svc,
+		router: router.NewSaramaRouter(opts...),
 	}
 
 	h.setupRoutes()
@@ -32,22 +31,22 @@ func NewKafkaHandler(
 
 func (h *KafkaHandler) setupRoutes() {
 	h.router.Use(middleware.Logger)
+	h.router.Use(middleware.Metrics(errorClasses))
+	h.router.Use(middleware.SkipDuplicates)
 
-	h.router.Handle("saved_orders", h.reserve)
-	h.router.Handle("paid_orders", h.collect)
-	h.router.Handle("cancel", h.cancel)
-	h.router.Handle("reset", h.reset)
+	h.router.Handle(events.TopicSavedOrders, h.reserve)
+	h.router.Handle(events.TopicPaidOrders, h.collect)
+	h.router.Handle(events.TopicCancel, h.cancel)
+	h.router.Handle(events.TopicReset, h.reset)
 }
 
-func (h *KafkaHandler) reserve(ctx context.Context, _ string, raw []byte) error {
-	var msg Order
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) reserve(ctx context.Context, topic string, raw []byte) error {
+	var msg events.Order
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.Reserve(ctx, msg); err != nil {
 		return fmt.Errorf("reserve: %w", err)
@@ -56,15 +55,13 @@ func (h *KafkaHandler) reserve(ctx context.Context, _ string, raw []byte) error
 	return nil
 }
 
-func (h *KafkaHandler) collect(ctx context.Context, _ string, raw []byte) error {
-	var msg Order
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) collect(ctx context.Context, topic string, raw []byte) error {
+	var msg events.Order
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.Collect(ctx, msg.OrderID); err != nil {
 		return fmt.Errorf("reserve: %w", err)
@@ -73,15 +70,13 @@ func (h *KafkaHandler) collect(ctx context.Context, _ string, raw []byte) error
 	return nil
 }
 
-func (h *KafkaHandler) reset(ctx context.Context, _ string, raw []byte) error {
-	var msg ResetMsg
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) reset(ctx context.Context, topic string, raw []byte) error {
+	var msg events.ResetMsg
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.CancelReservation(ctx, msg.OrderID); err != nil {
 		return fmt.Errorf("cancel reservations: %w", err)
@@ -90,15 +85,13 @@ func (h *KafkaHandler) reset(ctx context.Context, _ string, raw []byte) error {
 	return nil
 }
 
-func (h *KafkaHandler) cancel(ctx context.Context, _ string, raw []byte) error {
-	var msg CancelMsg
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidMsg, err)
+func (h *KafkaHandler) cancel(ctx context.Context, topic string, raw []byte) error {
+	var msg events.CancelMsg
+	if err := events.Decode(ctx, topic, raw, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMsg, err)
 	}
 
-	if err := h.validate.Struct(msg); err != nil {
-		return fmt.Errorf("%w: validate: %v", ErrInvalidMsg, err)
-	}
+	ctx = logger.WithFields(ctx, logger.Uint64("order_id", msg.OrderID))
 
 	if err := h.svc.CancelReservation(ctx, msg.OrderID); err != nil {
 		return fmt.Errorf("cancel reservations: %w", err)
@@ -107,6 +100,11 @@ func (h *KafkaHandler) cancel(ctx context.Context, _ string, raw []byte) error {
 	return nil
 }
 
+// Abort cancels handling in flight, see router.SaramaRouter.Abort.
+func (h *KafkaHandler) Abort() {
+	h.router.Abort()
+}
+
 func (h *KafkaHandler) Setup(session sarama.ConsumerGroupSession) error {
 	return h.router.Setup(session)
 }
@@ -7,11 +7,24 @@ import (
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"time"
 )
 
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock")
+
 const (
-	quantitiesTable   = "quantities"
+	productsTable     = "products"
+	warehousesTable   = "warehouses"
+	inventoryTable    = "inventory"
 	reservationsTable = "reservations"
+	movementsTable    = "inventory_movements"
+	cancelledTable    = "cancelled_orders"
 )
 
 // DBTX is an interface that both *pgxpool.Pool and pgx.Tx implements.
@@ -23,9 +36,18 @@ type DBTX interface {
 
 // Repository represents stock database repository.
 type Repository interface {
-	Reserve(ctx context.Context, orderID uint64, items []*Item) error
+	Reserve(ctx context.Context, orderID uint64, items []*events.Item) error
 	CancelReservation(ctx context.Context, orderID uint64) error
 	Collect(ctx context.Context, orderID uint64) error
+	GetReservations(ctx context.Context, orderID uint64) ([]*Reservation, error)
+	AddProduct(ctx context.Context, p Product) error
+	GetProduct(ctx context.Context, productID uint64) (*Product, error)
+	AddWarehouse(ctx context.Context, name string) (uint64, error)
+	GetStock(ctx context.Context, productID uint64) ([]*Stock, error)
+	Restock(ctx context.Context, req RestockReq) (*Movement, error)
+	SetQuantity(ctx context.Context, req SetQuantityReq) (*Movement, error)
+	AdjustQuantity(ctx context.Context, req AdjustQuantityReq) (*Movement, error)
+	GetMovements(ctx context.Context, productID uint64) ([]*Movement, error)
 }
 
 type pgRepo struct {
@@ -43,25 +65,62 @@ func NewPgRepo(db *pgxpool.Pool) *pgRepo {
 	}
 }
 
-// Reserve ...
-func (r *pgRepo) Reserve(ctx context.Context, orderID uint64, items []*Item) error {
+// Reserve reserves the items of the order in the warehouses picked by allocate
+// and records which warehouse every reservation comes from. Every change of stock
+// in this repository is recorded in the inventory ledger along with it.
+// An order cancelled before, e.g. by a timeout that has overtaken the order, fails with ErrCancelled.
+func (r *pgRepo) Reserve(ctx context.Context, orderID uint64, items []*events.Item) error {
 	if err := r.execTx(ctx, func(q *pgQueries) error {
-		enough, err := q.isEnough(ctx, items)
+		if err := q.lockOrder(ctx, orderID); err != nil {
+			return fmt.Errorf("lock order: %w", err)
+		}
+
+		if err := q.checkNotCancelled(ctx, orderID); err != nil {
+			return fmt.Errorf("check cancellation: %w", err)
+		}
+
+		if err := q.claim(ctx); err != nil {
+			return fmt.Errorf("claim: %w", err)
+		}
+
+		if err := checkItems(items); err != nil {
+			return fmt.Errorf("check items: %w", err)
+		}
+
+		ids := make([]uint64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.ProductID)
+		}
+
+		products, err := q.getProducts(ctx, ids)
 		if err != nil {
-			return fmt.Errorf("isEnough: %w", err)
+			return fmt.Errorf("get products: %w", err)
 		}
 
-		if !enough {
-			return ErrNotEnough
+		if err = checkProducts(items, products); err != nil {
+			return fmt.Errorf("check products: %w", err)
 		}
 
-		err = q.createReservations(ctx, orderID, items)
+		if err = q.checkNotReserved(ctx, orderID, ids); err != nil {
+			return fmt.Errorf("check reservations: %w", err)
+		}
+
+		stock, err := q.lockStock(ctx, ids)
+		if err != nil {
+			return fmt.Errorf("lock stock: %w", err)
+		}
+
+		reservations, err := allocate(orderID, items, stock)
 		if err != nil {
+			return fmt.Errorf("allocate: %w", err)
+		}
+
+		if err = q.createReservations(ctx, reservations); err != nil {
 			return fmt.Errorf("createReservations: %w", err)
 		}
 
-		if err = q.reduce(ctx, items); err != nil {
-			return fmt.Errorf("reduce: %w", err)
+		if err = q.move(ctx, reservationMovements(MovementReserve, reservations)); err != nil {
+			return fmt.Errorf("move: %w", err)
 		}
 
 		return nil
@@ -72,15 +131,25 @@ func (r *pgRepo) Reserve(ctx context.Context, orderID uint64, items []*Item) err
 	return nil
 }
 
+// CancelReservation returns the products reserved for the order to the warehouses they have been taken from.
+// The order is recorded cancelled, so it is not reserved if it comes after the cancellation.
 func (r *pgRepo) CancelReservation(ctx context.Context, orderID uint64) error {
 	if err := r.execTx(ctx, func(q *pgQueries) error {
-		items, err := q.removeReservations(ctx, orderID)
+		if err := q.lockOrder(ctx, orderID); err != nil {
+			return fmt.Errorf("lock order: %w", err)
+		}
+
+		if err := q.createCancelled(ctx, orderID); err != nil {
+			return fmt.Errorf("create cancelled: %w", err)
+		}
+
+		reservations, err := q.removeReservations(ctx, orderID)
 		if err != nil {
 			return fmt.Errorf("remove reservations: %w", err)
 		}
 
-		if err = q.increase(ctx, items); err != nil {
-			return fmt.Errorf("increase: %w", err)
+		if err = q.move(ctx, reservationMovements(MovementCancel, reservations)); err != nil {
+			return fmt.Errorf("move: %w", err)
 		}
 
 		return nil
@@ -93,11 +162,19 @@ func (r *pgRepo) CancelReservation(ctx context.Context, orderID uint64) error {
 
 func (r *pgRepo) Collect(ctx context.Context, orderID uint64) error {
 	if err := r.execTx(ctx, func(q *pgQueries) error {
-		_, err := q.removeReservations(ctx, orderID)
+		if err := q.claim(ctx); err != nil {
+			return fmt.Errorf("claim: %w", err)
+		}
+
+		reservations, err := q.removeReservations(ctx, orderID)
 		if err != nil {
 			return fmt.Errorf("remove reservations: %w", err)
 		}
 
+		if err = q.move(ctx, reservationMovements(MovementCollect, reservations)); err != nil {
+			return fmt.Errorf("move: %w", err)
+		}
+
 		return nil
 	}); err != nil {
 		return fmt.Errorf("execTx: %w", err)
@@ -106,9 +183,125 @@ func (r *pgRepo) Collect(ctx context.Context, orderID uint64) error {
 	return nil
 }
 
+// GetReservations returns the reservations of the order ordered by product and warehouse.
+func (r *pgRepo) GetReservations(ctx context.Context, orderID uint64) ([]*Reservation, error) {
+	return r.queries.getReservations(ctx, orderID)
+}
+
+// AddProduct adds the product to the catalogue. Products with the same id or SKU
+// fail with ErrFailedPrecondition.
+func (r *pgRepo) AddProduct(ctx context.Context, p Product) error {
+	return r.queries.createProduct(ctx, p)
+}
+
+func (r *pgRepo) GetProduct(ctx context.Context, productID uint64) (*Product, error) {
+	products, err := r.queries.getProducts(ctx, []uint64{productID})
+	if err != nil {
+		return nil, fmt.Errorf("get products: %w", err)
+	}
+
+	p, ok := products[productID]
+	if !ok {
+		return nil, fmt.Errorf("%w: product %d", ErrNotFound, productID)
+	}
+
+	return p, nil
+}
+
+// AddWarehouse adds a warehouse with the name and returns its id. Names are unique.
+func (r *pgRepo) AddWarehouse(ctx context.Context, name string) (uint64, error) {
+	return r.queries.createWarehouse(ctx, name)
+}
+
+// GetStock returns the quantities of the product in the warehouses keeping it ordered by warehouse.
+func (r *pgRepo) GetStock(ctx context.Context, productID uint64) ([]*Stock, error) {
+	if _, err := r.GetProduct(ctx, productID); err != nil {
+		return nil, fmt.Errorf("get product: %w", err)
+	}
+
+	return r.queries.getStock(ctx, productID)
+}
+
+// Restock adds the quantity of the product to the warehouse.
+func (r *pgRepo) Restock(ctx context.Context, req RestockReq) (*Movement, error) {
+	c, err := newRestock(req)
+	if err != nil {
+		return nil, fmt.Errorf("restock: %w", err)
+	}
+
+	return r.applyChange(ctx, c)
+}
+
+// SetQuantity sets the quantity of the product in the warehouse.
+func (r *pgRepo) SetQuantity(ctx context.Context, req SetQuantityReq) (*Movement, error) {
+	c, err := newSetQuantity(req)
+	if err != nil {
+		return nil, fmt.Errorf("set quantity: %w", err)
+	}
+
+	return r.applyChange(ctx, c)
+}
+
+// AdjustQuantity adds the delta to the quantity of the product in the warehouse. Taking more
+// than the warehouse keeps fails with ErrNotEnough.
+func (r *pgRepo) AdjustQuantity(ctx context.Context, req AdjustQuantityReq) (*Movement, error) {
+	c, err := newAdjustQuantity(req)
+	if err != nil {
+		return nil, fmt.Errorf("adjust quantity: %w", err)
+	}
+
+	return r.applyChange(ctx, c)
+}
+
+// applyChange changes the quantity of the product in the warehouse and records the movement.
+// It fails with ErrNotFound if either is missing.
+func (r *pgRepo) applyChange(ctx context.Context, c *change) (*Movement, error) {
+	var m *Movement
+	if err := r.execTx(ctx, func(q *pgQueries) error {
+		if err := q.ensureStock(ctx, c.warehouseID, c.productID); err != nil {
+			return fmt.Errorf("ensure stock: %w", err)
+		}
+
+		current, err := q.lockQuantity(ctx, c.warehouseID, c.productID)
+		if err != nil {
+			return fmt.Errorf("lock quantity: %w", err)
+		}
+
+		if m, err = c.movement(current); err != nil {
+			return fmt.Errorf("change: %w", err)
+		}
+
+		if err = q.move(ctx, []*Movement{m}); err != nil {
+			return fmt.Errorf("move: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("execTx: %w", err)
+	}
+
+	return m, nil
+}
+
+// GetMovements returns the movements of the product in every warehouse in the order they happened.
+func (r *pgRepo) GetMovements(ctx context.Context, productID uint64) ([]*Movement, error) {
+	if _, err := r.GetProduct(ctx, productID); err != nil {
+		return nil, fmt.Errorf("get product: %w", err)
+	}
+
+	return r.queries.getMovements(ctx, productID)
+}
+
 // execTx creates a database transaction with ReadCommitted isolation level and
 // execute provided function in the scope of the transaction.
-func (r *pgRepo) execTx(ctx context.Context, fn func(queries *pgQueries) error) error {
+func (r *pgRepo) execTx(ctx context.Context, fn func(queries *pgQueries) error) (err error) {
+	ctx, span := tracer.Start(ctx, "pgRepo.execTx")
+	start := time.Now()
+	defer func() {
+		metrics.DBTxDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
 	tx, err := r.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
 	if err != nil {
 		return fmt.Errorf("%w: begin transaction: %v", ErrInternal, err)
@@ -118,6 +311,8 @@ func (r *pgRepo) execTx(ctx context.Context, fn func(queries *pgQueries) error)
 	err = fn(q)
 
 	if err != nil {
+		logger.Debug(ctx, "roll back transaction", logger.Err(err))
+
 		if rbErr := tx.Rollback(ctx); rbErr != nil {
 			return fmt.Errorf("tx: %w, rb: %v", err, rbErr)
 		}
@@ -136,95 +331,300 @@ type pgQueries struct {
 	db DBTX
 }
 
-var getQuantitiesQuery = fmt.Sprintf(`
-SELECT product_id, quantity FROM %s WHERE product_id = ANY ($1)
-`, quantitiesTable)
-
-func (q *pgQueries) isEnough(ctx context.Context, items []*Item) (bool, error) {
-	ids := make([]uint64, 0, len(items))
-	m := make(map[uint64]uint64, len(items))
-	for _, item := range items {
-		ids = append(ids, item.ProductID)
-		m[item.ProductID] = item.Quantity
+// claim marks the message being handled as processed, see dedup.Claim.
+func (q *pgQueries) claim(ctx context.Context) error {
+	if err := dedup.Claim(ctx, q.db); err != nil {
+		if errors.Is(err, dedup.ErrDuplicate) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrInternal, err)
 	}
 
-	rows, err := q.db.Query(ctx, getQuantitiesQuery, ids)
-	if errors.Is(err, pgx.ErrNoRows) {
-		return false, nil
+	return nil
+}
+
+var createProductQuery = fmt.Sprintf(`
+INSERT INTO %s (product_id, sku, name, price, weight, active)
+VALUES ($1, $2, $3, $4, $5, $6)
+`, productsTable)
+
+func (q *pgQueries) createProduct(ctx context.Context, p Product) error {
+	if _, err := q.db.Exec(ctx, createProductQuery, p.ID, p.SKU, p.Name, p.Price, p.Weight, p.Active); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.ConstraintName {
+			case "products_pkey":
+				fallthrough
+			case "products_sku_key":
+				fallthrough
+			case "products_price_check":
+				return fmt.Errorf("%w: db exec: %v", ErrFailedPrecondition, err)
+			}
+		}
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
 	}
+
+	return nil
+}
+
+var getProductsQuery = fmt.Sprintf(`
+SELECT product_id, sku, name, price, weight, active FROM %s WHERE product_id = ANY ($1)
+`, productsTable)
+
+func (q *pgQueries) getProducts(ctx context.Context, ids []uint64) (map[uint64]*Product, error) {
+	rows, err := q.db.Query(ctx, getProductsQuery, ids)
 	if err != nil {
-		return false, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
 	}
 	defer rows.Close()
 
-	var pid uint64
-	var qnt uint64
-	var count uint64
-
+	products := make(map[uint64]*Product, len(ids))
 	for rows.Next() {
-		if err = rows.Scan(&pid, &qnt); err != nil {
-			return false, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		var p Product
+		if err = rows.Scan(&p.ID, &p.SKU, &p.Name, &p.Price, &p.Weight, &p.Active); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
 		}
-		if m[pid] > qnt {
-			return false, nil
+		products[p.ID] = &p
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return products, nil
+}
+
+var createWarehouseQuery = fmt.Sprintf(`
+INSERT INTO %s (name) VALUES ($1) RETURNING warehouse_id
+`, warehousesTable)
+
+func (q *pgQueries) createWarehouse(ctx context.Context, name string) (uint64, error) {
+	var id uint64
+	if err := q.db.QueryRow(ctx, createWarehouseQuery, name).Scan(&id); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.ConstraintName {
+			case "warehouses_name_key":
+				return 0, fmt.Errorf("%w: db exec: %v", ErrFailedPrecondition, err)
+			}
 		}
+		return 0, fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return id, nil
+}
+
+var getStockQuery = fmt.Sprintf(`
+SELECT warehouse_id, product_id, quantity FROM %s WHERE product_id = $1 ORDER BY warehouse_id
+`, inventoryTable)
+
+func (q *pgQueries) getStock(ctx context.Context, productID uint64) ([]*Stock, error) {
+	return q.queryStock(ctx, getStockQuery, productID)
+}
 
-		count++
+// lockStockQuery locks the rows in the same order in every transaction, so they do not deadlock.
+var lockStockQuery = fmt.Sprintf(`
+SELECT warehouse_id, product_id, quantity
+FROM %s
+WHERE product_id = ANY ($1)
+ORDER BY warehouse_id, product_id
+FOR UPDATE
+`, inventoryTable)
+
+// lockStock returns the quantities of the products in every warehouse keeping them
+// and locks them until the end of the transaction.
+func (q *pgQueries) lockStock(ctx context.Context, ids []uint64) ([]*Stock, error) {
+	return q.queryStock(ctx, lockStockQuery, ids)
+}
+
+func (q *pgQueries) queryStock(ctx context.Context, query string, args ...interface{}) ([]*Stock, error) {
+	rows, err := q.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
 	}
+	defer rows.Close()
 
-	if count < uint64(len(m)) {
-		return false, nil
+	var stock []*Stock
+	for rows.Next() {
+		var s Stock
+		if err = rows.Scan(&s.WarehouseID, &s.ProductID, &s.Quantity); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
+		}
+		stock = append(stock, &s)
 	}
 
 	if err = rows.Err(); err != nil {
-		return false, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return stock, nil
+}
+
+var ensureStockQuery = fmt.Sprintf(`
+INSERT INTO %s (warehouse_id, product_id, quantity) VALUES ($1, $2, 0) ON CONFLICT DO NOTHING
+`, inventoryTable)
+
+// ensureStock creates an empty stock of the product in the warehouse unless there is one,
+// so a product can be restocked in a warehouse that has not kept it yet.
+func (q *pgQueries) ensureStock(ctx context.Context, warehouseID uint64, productID uint64) error {
+	if _, err := q.db.Exec(ctx, ensureStockQuery, warehouseID, productID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.ConstraintName {
+			case "inventory_warehouse_id_fkey":
+				fallthrough
+			case "inventory_product_id_fkey":
+				return fmt.Errorf("%w: db exec: %v", ErrNotFound, err)
+			}
+		}
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
 	}
 
-	return true, nil
+	return nil
 }
 
-var increaseQuery = fmt.Sprintf(`
-INSERT INTO %s as q (product_id, quantity)
-VALUES ($1, $2)
-ON CONFLICT (product_id)
-DO UPDATE SET quantity = q.quantity + EXCLUDED.quantity
-`, quantitiesTable)
+var lockQuantityQuery = fmt.Sprintf(`
+SELECT quantity FROM %s WHERE warehouse_id = $1 AND product_id = $2 FOR UPDATE
+`, inventoryTable)
 
-func (q *pgQueries) increase(ctx context.Context, items []*Item) error {
-	for _, item := range items {
-		if _, err := q.db.Exec(ctx, increaseQuery, item.ProductID, item.Quantity); err != nil {
-			return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+func (q *pgQueries) lockQuantity(ctx context.Context, warehouseID uint64, productID uint64) (uint64, error) {
+	var quantity uint64
+	if err := q.db.QueryRow(ctx, lockQuantityQuery, warehouseID, productID).Scan(&quantity); err != nil {
+		return 0, fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	}
+
+	return quantity, nil
+}
+
+var updateQuantityQuery = fmt.Sprintf(`
+UPDATE %s SET quantity = quantity + $3 WHERE warehouse_id = $1 AND product_id = $2 RETURNING quantity
+`, inventoryTable)
+
+var createMovementQuery = fmt.Sprintf(`
+INSERT INTO %s (warehouse_id, product_id, kind, reason, order_id, delta, quantity, note)
+VALUES ($1, $2, $3, NULLIF($4::varchar, ''), NULLIF($5::bigint, 0), $6, $7, $8)
+RETURNING movement_id, created_at
+`, movementsTable)
+
+// move changes the quantities by the deltas of the movements and appends them to the ledger
+// filling in their ids, resulting quantities and times.
+func (q *pgQueries) move(ctx context.Context, movements []*Movement) error {
+	for _, m := range movements {
+		if err := q.db.QueryRow(ctx, updateQuantityQuery, m.WarehouseID, m.ProductID, m.Delta).Scan(&m.Quantity); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				switch pgErr.ConstraintName {
+				case "inventory_quantity_check":
+					return fmt.Errorf("%w: db query row: %v", ErrNotEnough, err)
+				}
+			}
+			return fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+		}
+
+		if err := q.db.QueryRow(ctx, createMovementQuery,
+			m.WarehouseID, m.ProductID, m.Kind, m.Reason, m.OrderID, m.Delta, m.Quantity, m.Note,
+		).Scan(&m.ID, &m.CreatedAt); err != nil {
+			return fmt.Errorf("%w: db query row: %v", ErrInternal, err)
 		}
 	}
 
 	return nil
 }
 
-var reduceQuery = fmt.Sprintf(`
-INSERT INTO %s as q (product_id, quantity)
-VALUES ($1, $2)
-ON CONFLICT (product_id)
-DO UPDATE SET quantity = q.quantity - EXCLUDED.quantity
-`, quantitiesTable)
+var getMovementsQuery = fmt.Sprintf(`
+SELECT movement_id, warehouse_id, product_id, kind, COALESCE(reason, ''), COALESCE(order_id, 0), delta, quantity, note, created_at
+FROM %s
+WHERE product_id = $1
+ORDER BY movement_id
+`, movementsTable)
 
-func (q *pgQueries) reduce(ctx context.Context, items []*Item) error {
-	for _, item := range items {
-		if _, err := q.db.Exec(ctx, reduceQuery, item.ProductID, item.Quantity); err != nil {
-			return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+func (q *pgQueries) getMovements(ctx context.Context, productID uint64) ([]*Movement, error) {
+	rows, err := q.db.Query(ctx, getMovementsQuery, productID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
+	}
+	defer rows.Close()
+
+	var movements []*Movement
+	for rows.Next() {
+		var m Movement
+		if err = rows.Scan(
+			&m.ID, &m.WarehouseID, &m.ProductID, &m.Kind, &m.Reason, &m.OrderID, &m.Delta, &m.Quantity, &m.Note, &m.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
 		}
+		movements = append(movements, &m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
+	}
+
+	return movements, nil
+}
+
+// lockOrder serializes the reservation and the cancellation of the order until the end of the transaction.
+func (q *pgQueries) lockOrder(ctx context.Context, orderID uint64) error {
+	if _, err := q.db.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", int64(orderID)); err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
 	}
 
 	return nil
 }
 
+var createCancelledQuery = fmt.Sprintf(
+	"INSERT INTO %s (order_id) VALUES ($1) ON CONFLICT (order_id) DO NOTHING",
+	cancelledTable,
+)
+
+func (q *pgQueries) createCancelled(ctx context.Context, orderID uint64) error {
+	if _, err := q.db.Exec(ctx, createCancelledQuery, orderID); err != nil {
+		return fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+var checkNotCancelledQuery = fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE order_id = $1)", cancelledTable)
+
+func (q *pgQueries) checkNotCancelled(ctx context.Context, orderID uint64) error {
+	var cancelled bool
+	if err := q.db.QueryRow(ctx, checkNotCancelledQuery, orderID).Scan(&cancelled); err != nil {
+		return fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	}
+	if cancelled {
+		return fmt.Errorf("%w: order %d", ErrCancelled, orderID)
+	}
+
+	return nil
+}
+
+var checkNotReservedQuery = fmt.Sprintf(`
+SELECT product_id FROM %s WHERE order_id = $1 AND product_id = ANY ($2) LIMIT 1
+`, reservationsTable)
+
+// checkNotReserved fails with ErrFailedPrecondition if any of the products has been reserved for the order.
+func (q *pgQueries) checkNotReserved(ctx context.Context, orderID uint64, ids []uint64) error {
+	var productID uint64
+	err := q.db.QueryRow(ctx, checkNotReservedQuery, orderID, ids).Scan(&productID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: db query row: %v", ErrInternal, err)
+	}
+
+	return fmt.Errorf("%w: product %d is reserved for order %d already", ErrFailedPrecondition, productID, orderID)
+}
+
 var createReservationQuery = fmt.Sprintf(
-	"INSERT INTO %s (order_id, product_id, quantity) VALUES ($1, $2, $3)",
+	"INSERT INTO %s (order_id, product_id, warehouse_id, quantity) VALUES ($1, $2, $3, $4)",
 	reservationsTable,
 )
 
-func (q *pgQueries) createReservations(ctx context.Context, orderID uint64, items []*Item) error {
-	for _, item := range items {
-		if _, err := q.db.Exec(ctx, createReservationQuery, orderID, item.ProductID, item.Quantity); err != nil {
+func (q *pgQueries) createReservations(ctx context.Context, reservations []*Reservation) error {
+	for _, r := range reservations {
+		if _, err := q.db.Exec(ctx, createReservationQuery, r.OrderID, r.ProductID, r.WarehouseID, r.Quantity); err != nil {
 			var pgErr *pgconn.PgError
 			if errors.As(err, &pgErr) {
 				switch pgErr.ConstraintName {
@@ -239,38 +639,45 @@ func (q *pgQueries) createReservations(ctx context.Context, orderID uint64, item
 	return nil
 }
 
+var getReservationsQuery = fmt.Sprintf(`
+SELECT order_id, product_id, warehouse_id, quantity
+FROM %s
+WHERE order_id = $1
+ORDER BY product_id, warehouse_id
+`, reservationsTable)
+
+func (q *pgQueries) getReservations(ctx context.Context, orderID uint64) ([]*Reservation, error) {
+	return q.queryReservations(ctx, getReservationsQuery, orderID)
+}
+
 var removeReservationsQuery = fmt.Sprintf(
-	"DELETE FROM %s WHERE order_id = $1 RETURNING product_id, quantity",
+	"DELETE FROM %s WHERE order_id = $1 RETURNING order_id, product_id, warehouse_id, quantity",
 	reservationsTable,
 )
 
-func (q *pgQueries) removeReservations(ctx context.Context, orderID uint64) ([]*Item, error) {
-	rows, err := q.db.Query(ctx, removeReservationsQuery, orderID)
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, nil
-	}
+func (q *pgQueries) removeReservations(ctx context.Context, orderID uint64) ([]*Reservation, error) {
+	return q.queryReservations(ctx, removeReservationsQuery, orderID)
+}
+
+func (q *pgQueries) queryReservations(ctx context.Context, query string, orderID uint64) ([]*Reservation, error) {
+	rows, err := q.db.Query(ctx, query, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("%w: db exec: %v", ErrInternal, err)
+		return nil, fmt.Errorf("%w: db query: %v", ErrInternal, err)
 	}
 	defer rows.Close()
 
-	var items []*Item
-	var pid uint64
-	var qnt uint64
-
+	var reservations []*Reservation
 	for rows.Next() {
-		if err = rows.Scan(&pid, &qnt); err != nil {
+		var r Reservation
+		if err = rows.Scan(&r.OrderID, &r.ProductID, &r.WarehouseID, &r.Quantity); err != nil {
 			return nil, fmt.Errorf("%w: rows scan: %v", ErrInternal, err)
 		}
-		items = append(items, &Item{
-			ProductID: pid,
-			Quantity:  qnt,
-		})
+		reservations = append(reservations, &r)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("%w: rows err: %v", ErrInternal, err)
 	}
 
-	return items, nil
+	return reservations, nil
 }
@@ -0,0 +1,312 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type inventoryKey struct {
+	warehouseID uint64
+	productID   uint64
+}
+
+type memoryRepo struct {
+	// mu makes every method atomic like a database transaction.
+	mu              sync.Mutex
+	processed       *dedup.Processed
+	products        map[uint64]Product
+	skus            map[string]struct{}
+	warehouses      map[string]uint64
+	lastWarehouseID uint64
+	inventory       map[inventoryKey]uint64
+	reservations    map[uint64][]*Reservation
+	cancelled       map[uint64]struct{}
+	movements       []*Movement
+}
+
+// NewMemoryRepo creates an instance of memoryRepo, a repository keeping the catalogue and the stock
+// in memory, e.g. in tests. It behaves the way pgRepo does.
+func NewMemoryRepo() *memoryRepo {
+	return &memoryRepo{
+		processed:    dedup.NewProcessed(),
+		products:     make(map[uint64]Product),
+		skus:         make(map[string]struct{}),
+		warehouses:   make(map[string]uint64),
+		inventory:    make(map[inventoryKey]uint64),
+		reservations: make(map[uint64][]*Reservation),
+		cancelled:    make(map[uint64]struct{}),
+	}
+}
+
+func (r *memoryRepo) Reserve(ctx context.Context, orderID uint64, items []*events.Item) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.cancelled[orderID]; ok {
+		return fmt.Errorf("check cancellation: %w: order %d", ErrCancelled, orderID)
+	}
+
+	if err := r.processed.Check(ctx); err != nil {
+		return fmt.Errorf("claim: %w", err)
+	}
+
+	if err := checkItems(items); err != nil {
+		return fmt.Errorf("check items: %w", err)
+	}
+
+	products := make(map[uint64]*Product, len(items))
+	for _, item := range items {
+		if p, ok := r.products[item.ProductID]; ok {
+			products[p.ID] = &p
+		}
+	}
+
+	if err := checkProducts(items, products); err != nil {
+		return fmt.Errorf("check products: %w", err)
+	}
+
+	for _, reserved := range r.reservations[orderID] {
+		if _, ok := products[reserved.ProductID]; ok {
+			return fmt.Errorf("check reservations: %w: product %d is reserved for order %d already",
+				ErrFailedPrecondition, reserved.ProductID, orderID)
+		}
+	}
+
+	var stock []*Stock
+	for key, quantity := range r.inventory {
+		if _, ok := products[key.productID]; ok {
+			stock = append(stock, &Stock{WarehouseID: key.warehouseID, ProductID: key.productID, Quantity: quantity})
+		}
+	}
+
+	reservations, err := allocate(orderID, items, stock)
+	if err != nil {
+		return fmt.Errorf("allocate: %w", err)
+	}
+
+	r.move(reservationMovements(MovementReserve, reservations))
+	r.reservations[orderID] = append(r.reservations[orderID], reservations...)
+
+	r.processed.Record(ctx)
+
+	return nil
+}
+
+func (r *memoryRepo) CancelReservation(_ context.Context, orderID uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cancelled[orderID] = struct{}{}
+	r.move(reservationMovements(MovementCancel, r.reservations[orderID]))
+	delete(r.reservations, orderID)
+
+	return nil
+}
+
+func (r *memoryRepo) Collect(ctx context.Context, orderID uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.processed.Check(ctx); err != nil {
+		return fmt.Errorf("claim: %w", err)
+	}
+
+	r.move(reservationMovements(MovementCollect, r.reservations[orderID]))
+	delete(r.reservations, orderID)
+
+	r.processed.Record(ctx)
+
+	return nil
+}
+
+func (r *memoryRepo) GetReservations(_ context.Context, orderID uint64) ([]*Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var reservations []*Reservation
+	for _, reservation := range r.reservations[orderID] {
+		reservation := *reservation
+		reservations = append(reservations, &reservation)
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		if reservations[i].ProductID != reservations[j].ProductID {
+			return reservations[i].ProductID < reservations[j].ProductID
+		}
+		return reservations[i].WarehouseID < reservations[j].WarehouseID
+	})
+
+	return reservations, nil
+}
+
+func (r *memoryRepo) AddProduct(_ context.Context, p Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.products[p.ID]; ok {
+		return fmt.Errorf("%w: product %d exists", ErrFailedPrecondition, p.ID)
+	}
+	if _, ok := r.skus[p.SKU]; ok {
+		return fmt.Errorf("%w: product with SKU %s exists", ErrFailedPrecondition, p.SKU)
+	}
+	if p.Price < 0 {
+		return fmt.Errorf("%w: price %v is negative", ErrFailedPrecondition, p.Price)
+	}
+	// Like a bigint column.
+	if p.ID > math.MaxInt64 || p.Weight > math.MaxInt64 {
+		return fmt.Errorf("%w: product %d is out of range", ErrInternal, p.ID)
+	}
+
+	r.products[p.ID] = p
+	r.skus[p.SKU] = struct{}{}
+
+	return nil
+}
+
+func (r *memoryRepo) GetProduct(_ context.Context, productID uint64) (*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.products[productID]
+	if !ok {
+		return nil, fmt.Errorf("%w: product %d", ErrNotFound, productID)
+	}
+
+	return &p, nil
+}
+
+func (r *memoryRepo) AddWarehouse(_ context.Context, name string) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.warehouses[name]; ok {
+		return 0, fmt.Errorf("%w: warehouse %s exists", ErrFailedPrecondition, name)
+	}
+
+	r.lastWarehouseID++
+	r.warehouses[name] = r.lastWarehouseID
+
+	return r.lastWarehouseID, nil
+}
+
+func (r *memoryRepo) GetStock(_ context.Context, productID uint64) ([]*Stock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.products[productID]; !ok {
+		return nil, fmt.Errorf("get product: %w: product %d", ErrNotFound, productID)
+	}
+
+	var stock []*Stock
+	for key, quantity := range r.inventory {
+		if key.productID == productID {
+			stock = append(stock, &Stock{WarehouseID: key.warehouseID, ProductID: productID, Quantity: quantity})
+		}
+	}
+
+	sort.Slice(stock, func(i, j int) bool { return stock[i].WarehouseID < stock[j].WarehouseID })
+
+	return stock, nil
+}
+
+func (r *memoryRepo) Restock(_ context.Context, req RestockReq) (*Movement, error) {
+	c, err := newRestock(req)
+	if err != nil {
+		return nil, fmt.Errorf("restock: %w", err)
+	}
+
+	return r.applyChange(c)
+}
+
+func (r *memoryRepo) SetQuantity(_ context.Context, req SetQuantityReq) (*Movement, error) {
+	c, err := newSetQuantity(req)
+	if err != nil {
+		return nil, fmt.Errorf("set quantity: %w", err)
+	}
+
+	return r.applyChange(c)
+}
+
+func (r *memoryRepo) AdjustQuantity(_ context.Context, req AdjustQuantityReq) (*Movement, error) {
+	c, err := newAdjustQuantity(req)
+	if err != nil {
+		return nil, fmt.Errorf("adjust quantity: %w", err)
+	}
+
+	return r.applyChange(c)
+}
+
+func (r *memoryRepo) applyChange(c *change) (*Movement, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.products[c.productID]; !ok {
+		return nil, fmt.Errorf("%w: product %d", ErrNotFound, c.productID)
+	}
+	if c.warehouseID == 0 || c.warehouseID > r.lastWarehouseID {
+		return nil, fmt.Errorf("%w: warehouse %d", ErrNotFound, c.warehouseID)
+	}
+
+	m, err := c.movement(r.inventory[inventoryKey{c.warehouseID, c.productID}])
+	if err != nil {
+		return nil, fmt.Errorf("change: %w", err)
+	}
+
+	r.move([]*Movement{m})
+
+	return m, nil
+}
+
+func (r *memoryRepo) GetMovements(_ context.Context, productID uint64) ([]*Movement, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.products[productID]; !ok {
+		return nil, fmt.Errorf("get product: %w: product %d", ErrNotFound, productID)
+	}
+
+	var movements []*Movement
+	for _, m := range r.movements {
+		if m.ProductID == productID {
+			m := *m
+			movements = append(movements, &m)
+		}
+	}
+
+	return movements, nil
+}
+
+// move changes the quantities by the deltas of the movements and appends them to the ledger
+// filling in their ids, resulting quantities and times. The deltas have been checked by the caller.
+func (r *memoryRepo) move(movements []*Movement) {
+	for _, m := range movements {
+		key := inventoryKey{m.WarehouseID, m.ProductID}
+		r.inventory[key] = uint64(int64(r.inventory[key]) + m.Delta)
+
+		m.ID = uint64(len(r.movements)) + 1
+		m.Quantity = r.inventory[key]
+		m.CreatedAt = time.Now()
+
+		recorded := *m
+		r.movements = append(r.movements, &recorded)
+	}
+}
+
+// Quantities returns the quantities of the products in stock summed over the warehouses.
+func (r *memoryRepo) Quantities() map[uint64]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	quantities := make(map[uint64]uint64)
+	for key, quantity := range r.inventory {
+		quantities[key.productID] += quantity
+	}
+
+	return quantities
+}
@@ -0,0 +1,554 @@
+package stock_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/pgtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newRepoFunc creates an empty repository.
+type newRepoFunc func(t *testing.T) stock.Repository
+
+func TestMemoryRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T) stock.Repository {
+		return stock.NewMemoryRepo()
+	})
+}
+
+func TestPgRepo(t *testing.T) {
+	testRepository(t, func(t *testing.T) stock.Repository {
+		return stock.NewPgRepo(pgtest.Open(t, migrations.Stock))
+	})
+}
+
+// testRepository runs the tests every Repository implementation has to pass.
+func testRepository(t *testing.T, newRepo newRepoFunc) {
+	ctx := context.Background()
+
+	// newStock creates a repository with a warehouse per given map of product quantities
+	// and the active products mentioned in them. It returns the ids of the warehouses.
+	newStock := func(t *testing.T, warehouses ...map[uint64]uint64) (stock.Repository, []uint64) {
+		t.Helper()
+
+		repo := newRepo(t)
+
+		products := make(map[uint64]struct{})
+		for _, quantities := range warehouses {
+			for productID := range quantities {
+				products[productID] = struct{}{}
+			}
+		}
+		for productID := range products {
+			if err := repo.AddProduct(ctx, stock.Product{
+				ID:     productID,
+				SKU:    fmt.Sprintf("SKU-%d", productID),
+				Name:   fmt.Sprintf("product %d", productID),
+				Price:  9.99,
+				Weight: 100,
+				Active: true,
+			}); err != nil {
+				t.Fatalf("add product: %v", err)
+			}
+		}
+
+		ids := make([]uint64, 0, len(warehouses))
+		for i, quantities := range warehouses {
+			id, err := repo.AddWarehouse(ctx, fmt.Sprintf("warehouse %d", i+1))
+			if err != nil {
+				t.Fatalf("add warehouse: %v", err)
+			}
+			ids = append(ids, id)
+
+			for productID, quantity := range quantities {
+				if _, err := repo.SetQuantity(ctx, stock.SetQuantityReq{
+					WarehouseID: id,
+					ProductID:   productID,
+					Quantity:    quantity,
+					Reason:      stock.ReasonStocktake,
+				}); err != nil {
+					t.Fatalf("set quantity: %v", err)
+				}
+			}
+		}
+
+		return repo, ids
+	}
+
+	// requireQuantities checks the quantities of the products summed over the warehouses.
+	requireQuantities := func(t *testing.T, repo stock.Repository, want map[uint64]uint64) {
+		t.Helper()
+
+		for productID, q := range want {
+			stock, err := repo.GetStock(ctx, productID)
+			if err != nil {
+				t.Fatalf("get stock: %v", err)
+			}
+
+			var got uint64
+			for _, s := range stock {
+				got += s.Quantity
+			}
+			if got != q {
+				t.Fatalf("quantity of product %d: got %d, want %d", productID, got, q)
+			}
+		}
+	}
+
+	requireReservations := func(t *testing.T, repo stock.Repository, orderID uint64, want []*stock.Reservation) {
+		t.Helper()
+
+		got, err := repo.GetReservations(ctx, orderID)
+		if err != nil {
+			t.Fatalf("get reservations: %v", err)
+		}
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Fatalf("reservations: got %s, want %s", format(got), format(want))
+		}
+	}
+
+	t.Run("reserve and cancel", func(t *testing.T) {
+		repo, warehouses := newStock(t, map[uint64]uint64{1: 10, 2: 5})
+
+		if err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 3}, {ProductID: 2, Quantity: 5}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 7, 2: 0})
+		requireReservations(t, repo, 1, []*stock.Reservation{
+			{OrderID: 1, ProductID: 1, WarehouseID: warehouses[0], Quantity: 3},
+			{OrderID: 1, ProductID: 2, WarehouseID: warehouses[0], Quantity: 5},
+		})
+
+		if err := repo.CancelReservation(ctx, 1); err != nil {
+			t.Fatalf("cancel reservation: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10, 2: 5})
+		requireReservations(t, repo, 1, nil)
+
+		// The reservation is gone, cancelling it again changes nothing.
+		if err := repo.CancelReservation(ctx, 1); err != nil {
+			t.Fatalf("cancel reservation again: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10, 2: 5})
+	})
+
+	t.Run("cancelled before reserved", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10})
+
+		// The cancellation of the order overtakes the order, e.g. when it times out before stock gets it.
+		if err := repo.CancelReservation(ctx, 1); err != nil {
+			t.Fatalf("cancel reservation: %v", err)
+		}
+
+		msgCtx := kafkatest.HandlerContext(ctx, events.TopicSavedOrders, 1, "message-1")
+		for i := 0; i < 2; i++ {
+			if err := repo.Reserve(msgCtx, 1, []*events.Item{{ProductID: 1, Quantity: 3}}); !errors.Is(err, stock.ErrCancelled) {
+				t.Fatalf("reserve cancelled order: got %v, want %v", err, stock.ErrCancelled)
+			}
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10})
+		requireReservations(t, repo, 1, nil)
+
+		// Other orders are reserved as usual.
+		if err := repo.Reserve(ctx, 2, []*events.Item{{ProductID: 1, Quantity: 3}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 7})
+	})
+
+	t.Run("not enough", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10, 2: 1})
+
+		err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 3}, {ProductID: 2, Quantity: 2}})
+		if !errors.Is(err, stock.ErrNotEnough) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrNotEnough)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10, 2: 1})
+		requireReservations(t, repo, 1, nil)
+
+		// Nothing has been reserved, so nothing is returned to stock.
+		if err := repo.CancelReservation(ctx, 1); err != nil {
+			t.Fatalf("cancel reservation: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10, 2: 1})
+	})
+
+	t.Run("picks a warehouse", func(t *testing.T) {
+		repo, warehouses := newStock(t, map[uint64]uint64{1: 5, 2: 1}, map[uint64]uint64{1: 8})
+
+		// Each item comes from the warehouse having the most of it.
+		if err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 4}, {ProductID: 2, Quantity: 1}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		requireReservations(t, repo, 1, []*stock.Reservation{
+			{OrderID: 1, ProductID: 1, WarehouseID: warehouses[1], Quantity: 4},
+			{OrderID: 1, ProductID: 2, WarehouseID: warehouses[0], Quantity: 1},
+		})
+
+		// Now both have 4 of the product, the first one is picked.
+		if err := repo.Reserve(ctx, 2, []*events.Item{{ProductID: 1, Quantity: 4}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		requireReservations(t, repo, 2, []*stock.Reservation{
+			{OrderID: 2, ProductID: 1, WarehouseID: warehouses[0], Quantity: 4},
+		})
+		requireQuantities(t, repo, map[uint64]uint64{1: 5, 2: 0})
+	})
+
+	t.Run("splits across warehouses", func(t *testing.T) {
+		repo, warehouses := newStock(t, map[uint64]uint64{1: 3}, map[uint64]uint64{1: 5}, map[uint64]uint64{1: 1})
+
+		if err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 7}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		requireReservations(t, repo, 1, []*stock.Reservation{
+			{OrderID: 1, ProductID: 1, WarehouseID: warehouses[0], Quantity: 2},
+			{OrderID: 1, ProductID: 1, WarehouseID: warehouses[1], Quantity: 5},
+		})
+
+		got, err := repo.GetStock(ctx, 1)
+		if err != nil {
+			t.Fatalf("get stock: %v", err)
+		}
+		want := []*stock.Stock{
+			{WarehouseID: warehouses[0], ProductID: 1, Quantity: 1},
+			{WarehouseID: warehouses[1], ProductID: 1, Quantity: 0},
+			{WarehouseID: warehouses[2], ProductID: 1, Quantity: 1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("stock: got %s, want %s", format(got), format(want))
+		}
+
+		// All the warehouses together do not have enough.
+		if err := repo.Reserve(ctx, 2, []*events.Item{{ProductID: 1, Quantity: 3}}); !errors.Is(err, stock.ErrNotEnough) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrNotEnough)
+		}
+
+		// Cancelled products return to the warehouses they have been taken from.
+		if err := repo.CancelReservation(ctx, 1); err != nil {
+			t.Fatalf("cancel reservation: %v", err)
+		}
+		got, err = repo.GetStock(ctx, 1)
+		if err != nil {
+			t.Fatalf("get stock: %v", err)
+		}
+		want[0].Quantity, want[1].Quantity = 3, 5
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("stock: got %s, want %s", format(got), format(want))
+		}
+	})
+
+	t.Run("unknown product", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10})
+
+		err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 1}})
+		if !errors.Is(err, stock.ErrNotFound) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrNotFound)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10})
+	})
+
+	t.Run("inactive product", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10})
+
+		if err := repo.AddProduct(ctx, stock.Product{ID: 2, SKU: "SKU-2", Name: "discontinued"}); err != nil {
+			t.Fatalf("add product: %v", err)
+		}
+
+		err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 1}})
+		if !errors.Is(err, stock.ErrFailedPrecondition) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrFailedPrecondition)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10})
+	})
+
+	t.Run("product ordered twice", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10})
+
+		err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 1}, {ProductID: 1, Quantity: 2}})
+		if !errors.Is(err, stock.ErrFailedPrecondition) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrFailedPrecondition)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10})
+	})
+
+	t.Run("reserved twice", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10, 2: 5})
+
+		if err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 3}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+
+		err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 2, Quantity: 1}, {ProductID: 1, Quantity: 3}})
+		if !errors.Is(err, stock.ErrFailedPrecondition) {
+			t.Fatalf("reserve again: got %v, want %v", err, stock.ErrFailedPrecondition)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 7, 2: 5})
+
+		// Other orders may reserve the same products.
+		if err := repo.Reserve(ctx, 2, []*events.Item{{ProductID: 1, Quantity: 3}}); err != nil {
+			t.Fatalf("reserve another order: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 4, 2: 5})
+	})
+
+	t.Run("collect", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10})
+
+		if err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 3}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		if err := repo.Collect(ctx, 1); err != nil {
+			t.Fatalf("collect: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 7})
+		requireReservations(t, repo, 1, nil)
+
+		// Collected products have left the stock for good.
+		if err := repo.CancelReservation(ctx, 1); err != nil {
+			t.Fatalf("cancel reservation: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 7})
+	})
+
+	t.Run("catalogue", func(t *testing.T) {
+		repo := newRepo(t)
+
+		p := stock.Product{ID: 1, SKU: "SKU-1", Name: "kettle", Price: 25.5, Weight: 1200, Active: true}
+		if err := repo.AddProduct(ctx, p); err != nil {
+			t.Fatalf("add product: %v", err)
+		}
+
+		got, err := repo.GetProduct(ctx, 1)
+		if err != nil {
+			t.Fatalf("get product: %v", err)
+		}
+		if *got != p {
+			t.Fatalf("product: got %+v, want %+v", *got, p)
+		}
+
+		for _, dup := range []stock.Product{
+			{ID: 1, SKU: "SKU-2", Name: "same id"},
+			{ID: 2, SKU: "SKU-1", Name: "same SKU"},
+		} {
+			if err := repo.AddProduct(ctx, dup); !errors.Is(err, stock.ErrFailedPrecondition) {
+				t.Fatalf("add %s: got %v, want %v", dup.Name, err, stock.ErrFailedPrecondition)
+			}
+		}
+		if err := repo.AddProduct(ctx, stock.Product{ID: 3, SKU: "SKU-3", Price: -1}); !errors.Is(err, stock.ErrFailedPrecondition) {
+			t.Fatalf("add product of negative price: got %v, want %v", err, stock.ErrFailedPrecondition)
+		}
+
+		if _, err := repo.GetProduct(ctx, 2); !errors.Is(err, stock.ErrNotFound) {
+			t.Fatalf("get missing product: got %v, want %v", err, stock.ErrNotFound)
+		}
+		if _, err := repo.GetStock(ctx, 2); !errors.Is(err, stock.ErrNotFound) {
+			t.Fatalf("get stock of missing product: got %v, want %v", err, stock.ErrNotFound)
+		}
+
+		// A product not kept anywhere yet.
+		s, err := repo.GetStock(ctx, 1)
+		if err != nil || len(s) != 0 {
+			t.Fatalf("get stock: got %s, %v, want none", format(s), err)
+		}
+
+		if _, err := repo.AddWarehouse(ctx, "main"); err != nil {
+			t.Fatalf("add warehouse: %v", err)
+		}
+		if _, err := repo.AddWarehouse(ctx, "main"); !errors.Is(err, stock.ErrFailedPrecondition) {
+			t.Fatalf("add warehouse again: got %v, want %v", err, stock.ErrFailedPrecondition)
+		}
+	})
+
+	t.Run("manual changes", func(t *testing.T) {
+		repo, warehouses := newStock(t, map[uint64]uint64{1: 10})
+		w := warehouses[0]
+
+		m, err := repo.Restock(ctx, stock.RestockReq{WarehouseID: w, ProductID: 1, Quantity: 5, Reason: stock.ReasonDelivery, Note: "truck 7"})
+		if err != nil {
+			t.Fatalf("restock: %v", err)
+		}
+		if m.Kind != stock.MovementRestock || m.Reason != stock.ReasonDelivery || m.Delta != 5 || m.Quantity != 15 || m.Note != "truck 7" {
+			t.Fatalf("restock movement: got %+v", *m)
+		}
+
+		m, err = repo.SetQuantity(ctx, stock.SetQuantityReq{WarehouseID: w, ProductID: 1, Quantity: 12, Reason: stock.ReasonStocktake})
+		if err != nil {
+			t.Fatalf("set quantity: %v", err)
+		}
+		if m.Kind != stock.MovementSet || m.Delta != -3 || m.Quantity != 12 {
+			t.Fatalf("set quantity movement: got %+v", *m)
+		}
+
+		m, err = repo.AdjustQuantity(ctx, stock.AdjustQuantityReq{WarehouseID: w, ProductID: 1, Delta: -2, Reason: stock.ReasonDamage})
+		if err != nil {
+			t.Fatalf("adjust quantity: %v", err)
+		}
+		if m.Kind != stock.MovementAdjust || m.Delta != -2 || m.Quantity != 10 {
+			t.Fatalf("adjust quantity movement: got %+v", *m)
+		}
+
+		if _, err := repo.AdjustQuantity(ctx, stock.AdjustQuantityReq{WarehouseID: w, ProductID: 1, Delta: -11, Reason: stock.ReasonLoss}); !errors.Is(err, stock.ErrNotEnough) {
+			t.Fatalf("adjust quantity below zero: got %v, want %v", err, stock.ErrNotEnough)
+		}
+		if _, err := repo.Restock(ctx, stock.RestockReq{WarehouseID: w, ProductID: 1, Quantity: 0, Reason: stock.ReasonDelivery}); !errors.Is(err, stock.ErrInvalidMsg) {
+			t.Fatalf("restock nothing: got %v, want %v", err, stock.ErrInvalidMsg)
+		}
+		if _, err := repo.Restock(ctx, stock.RestockReq{WarehouseID: w, ProductID: 1, Quantity: 1, Reason: "found"}); !errors.Is(err, stock.ErrInvalidMsg) {
+			t.Fatalf("restock with unknown reason: got %v, want %v", err, stock.ErrInvalidMsg)
+		}
+		if _, err := repo.Restock(ctx, stock.RestockReq{WarehouseID: w, ProductID: 2, Quantity: 1, Reason: stock.ReasonDelivery}); !errors.Is(err, stock.ErrNotFound) {
+			t.Fatalf("restock missing product: got %v, want %v", err, stock.ErrNotFound)
+		}
+		if _, err := repo.Restock(ctx, stock.RestockReq{WarehouseID: w + 1, ProductID: 1, Quantity: 1, Reason: stock.ReasonDelivery}); !errors.Is(err, stock.ErrNotFound) {
+			t.Fatalf("restock missing warehouse: got %v, want %v", err, stock.ErrNotFound)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 10})
+
+		// A warehouse that has not kept the product yet.
+		other, err := repo.AddWarehouse(ctx, "other")
+		if err != nil {
+			t.Fatalf("add warehouse: %v", err)
+		}
+		if _, err := repo.Restock(ctx, stock.RestockReq{WarehouseID: other, ProductID: 1, Quantity: 4, Reason: stock.ReasonReturn}); err != nil {
+			t.Fatalf("restock other warehouse: %v", err)
+		}
+
+		got, err := repo.GetStock(ctx, 1)
+		if err != nil {
+			t.Fatalf("get stock: %v", err)
+		}
+		want := []*stock.Stock{
+			{WarehouseID: w, ProductID: 1, Quantity: 10},
+			{WarehouseID: other, ProductID: 1, Quantity: 4},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("stock: got %s, want %s", format(got), format(want))
+		}
+	})
+
+	t.Run("ledger", func(t *testing.T) {
+		repo, warehouses := newStock(t, map[uint64]uint64{1: 4}, map[uint64]uint64{1: 10})
+
+		if err := repo.Reserve(ctx, 1, []*events.Item{{ProductID: 1, Quantity: 12}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		if err := repo.Collect(ctx, 1); err != nil {
+			t.Fatalf("collect: %v", err)
+		}
+		if err := repo.Reserve(ctx, 2, []*events.Item{{ProductID: 1, Quantity: 3}}); !errors.Is(err, stock.ErrNotEnough) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrNotEnough)
+		}
+		if err := repo.Reserve(ctx, 3, []*events.Item{{ProductID: 1, Quantity: 2}}); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		if err := repo.CancelReservation(ctx, 3); err != nil {
+			t.Fatalf("cancel reservation: %v", err)
+		}
+		if _, err := repo.AdjustQuantity(ctx, stock.AdjustQuantityReq{WarehouseID: warehouses[1], ProductID: 1, Delta: 1, Reason: stock.ReasonCorrection}); err != nil {
+			t.Fatalf("adjust quantity: %v", err)
+		}
+
+		got, err := repo.GetMovements(ctx, 1)
+		if err != nil {
+			t.Fatalf("get movements: %v", err)
+		}
+
+		// Every change is recorded in order, the failed reservation changes nothing.
+		w1, w2 := warehouses[0], warehouses[1]
+		want := []*stock.Movement{
+			{WarehouseID: w1, ProductID: 1, Kind: stock.MovementSet, Reason: stock.ReasonStocktake, Delta: 4, Quantity: 4},
+			{WarehouseID: w2, ProductID: 1, Kind: stock.MovementSet, Reason: stock.ReasonStocktake, Delta: 10, Quantity: 10},
+			{WarehouseID: w1, ProductID: 1, Kind: stock.MovementReserve, OrderID: 1, Delta: -2, Quantity: 2},
+			{WarehouseID: w2, ProductID: 1, Kind: stock.MovementReserve, OrderID: 1, Delta: -10, Quantity: 0},
+			{WarehouseID: w1, ProductID: 1, Kind: stock.MovementCollect, OrderID: 1, Delta: 0, Quantity: 2},
+			{WarehouseID: w2, ProductID: 1, Kind: stock.MovementCollect, OrderID: 1, Delta: 0, Quantity: 0},
+			{WarehouseID: w1, ProductID: 1, Kind: stock.MovementReserve, OrderID: 3, Delta: -2, Quantity: 0},
+			{WarehouseID: w1, ProductID: 1, Kind: stock.MovementCancel, OrderID: 3, Delta: 2, Quantity: 2},
+			{WarehouseID: w2, ProductID: 1, Kind: stock.MovementAdjust, Reason: stock.ReasonCorrection, Delta: 1, Quantity: 1},
+		}
+
+		quantities := make(map[uint64]int64)
+		for i, m := range got {
+			if m.ID == 0 || (i > 0 && m.ID <= got[i-1].ID) || m.CreatedAt.IsZero() {
+				t.Fatalf("movement %d: got id %d at %v", i, m.ID, m.CreatedAt)
+			}
+			quantities[m.WarehouseID] += m.Delta
+			m.ID, m.CreatedAt = 0, time.Time{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("movements: got %s, want %s", format(got), format(want))
+		}
+
+		// The quantities are reconstructed from the ledger.
+		s, err := repo.GetStock(ctx, 1)
+		if err != nil {
+			t.Fatalf("get stock: %v", err)
+		}
+		for _, s := range s {
+			if quantities[s.WarehouseID] != int64(s.Quantity) {
+				t.Fatalf("quantity in warehouse %d: ledger has %d, stock has %d", s.WarehouseID, quantities[s.WarehouseID], s.Quantity)
+			}
+		}
+
+		if _, err := repo.GetMovements(ctx, 2); !errors.Is(err, stock.ErrNotFound) {
+			t.Fatalf("get movements of missing product: got %v, want %v", err, stock.ErrNotFound)
+		}
+	})
+
+	t.Run("duplicate messages", func(t *testing.T) {
+		repo, _ := newStock(t, map[uint64]uint64{1: 10})
+		items := []*events.Item{{ProductID: 1, Quantity: 3}}
+
+		msgCtx := kafkatest.HandlerContext(ctx, events.TopicSavedOrders, 1, "message-1")
+		if err := repo.Reserve(msgCtx, 1, items); err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+
+		// The message is redelivered either at the same offset or, e.g. sent twice by a producer, at another one.
+		for _, dupCtx := range []context.Context{
+			msgCtx,
+			kafkatest.HandlerContext(ctx, events.TopicSavedOrders, 2, "message-1"),
+		} {
+			if err := repo.Reserve(dupCtx, 2, items); !errors.Is(err, dedup.ErrDuplicate) {
+				t.Fatalf("reserve duplicate: got %v, want %v", err, dedup.ErrDuplicate)
+			}
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 7})
+
+		// A message failing to reserve is not recorded, so its redelivery is handled again.
+		failCtx := kafkatest.HandlerContext(ctx, events.TopicSavedOrders, 3, "message-3")
+		if err := repo.Reserve(failCtx, 3, []*events.Item{{ProductID: 1, Quantity: 8}}); !errors.Is(err, stock.ErrNotEnough) {
+			t.Fatalf("reserve: got %v, want %v", err, stock.ErrNotEnough)
+		}
+		if err := repo.Reserve(failCtx, 3, []*events.Item{{ProductID: 1, Quantity: 7}}); err != nil {
+			t.Fatalf("reserve redelivered: %v", err)
+		}
+		requireQuantities(t, repo, map[uint64]uint64{1: 0})
+
+		collectCtx := kafkatest.HandlerContext(ctx, events.TopicPaidOrders, 1, "message-4")
+		if err := repo.Collect(collectCtx, 1); err != nil {
+			t.Fatalf("collect: %v", err)
+		}
+		if err := repo.Collect(collectCtx, 1); !errors.Is(err, dedup.ErrDuplicate) {
+			t.Fatalf("collect duplicate: got %v, want %v", err, dedup.ErrDuplicate)
+		}
+	})
+}
+
+// format formats a slice of pointers to structs with their values.
+func format[T any](s []*T) string {
+	values := make([]T, 0, len(s))
+	for _, v := range s {
+		values = append(values, *v)
+	}
+	return fmt.Sprintf("%+v", values)
+}
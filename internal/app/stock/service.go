@@ -2,13 +2,22 @@ package stock
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 )
 
 type Service interface {
-	Reserve(ctx context.Context, order Order) error
+	Reserve(ctx context.Context, order events.Order) error
 	CancelReservation(ctx context.Context, orderID uint64) error
 	Collect(ctx context.Context, orderID uint64) error
+	GetStock(ctx context.Context, productID uint64) ([]*Stock, error)
+	GetMovements(ctx context.Context, productID uint64) ([]*Movement, error)
+	Restock(ctx context.Context, req RestockReq) (*Movement, error)
+	SetQuantity(ctx context.Context, req SetQuantityReq) (*Movement, error)
+	AdjustQuantity(ctx context.Context, req AdjustQuantityReq) (*Movement, error)
 }
 
 type service struct {
@@ -23,20 +32,36 @@ func NewService(repo Repository, kafkaClient KafkaClient) *service {
 	}
 }
 
-func (s *service) Reserve(ctx context.Context, order Order) error {
-	if err := s.repo.Reserve(ctx, order.OrderID, order.Items); err != nil {
+// Reserve reserves the order items and sends the reserved order. A duplicate of the message
+// has been reserved by an earlier delivery, which may have failed to send the reserved order
+// after committing the reservation, so the reserved order is sent again. An order cancelled
+// before it came, e.g. by a timeout, is not reserved and the message is acknowledged,
+// as the saga of the order is over.
+func (s *service) Reserve(ctx context.Context, order events.Order) error {
+	err := s.repo.Reserve(ctx, order.OrderID, order.Items)
+	if errors.Is(err, ErrCancelled) {
+		logger.Info(ctx, "skip reservation of cancelled order", logger.Err(err))
+		return nil
+	}
+	if err != nil && !errors.Is(err, dedup.ErrDuplicate) {
 		err = fmt.Errorf("reserve: %w", err)
 
-		go s.kafkaClient.SendReset(ResetMsg{
-			OrderID: order.OrderID,
-			ErrMsg:  err.Error(),
-		})
+		if shouldReset(err) {
+			s.sendReset(ctx, events.ResetMsg{
+				OrderID: order.OrderID,
+				ErrMsg:  err.Error(),
+			})
+		}
 
 		return err
 	}
 
-	if err := s.kafkaClient.SendReservedOrder(order); err != nil {
-		return fmt.Errorf("send msg to order reservations: %w", err)
+	if sendErr := s.kafkaClient.SendReservedOrder(ctx, order); sendErr != nil {
+		return fmt.Errorf("send msg to order reservations: %w", sendErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("reserve: %w", err)
 	}
 
 	return nil
@@ -50,17 +75,108 @@ func (s *service) CancelReservation(ctx context.Context, orderID uint64) error {
 	return nil
 }
 
+// Collect collects the reserved products of the order and sends the collected order,
+// again for a duplicate of the message the way Reserve does.
 func (s *service) Collect(ctx context.Context, orderID uint64) error {
-	if err := s.repo.Collect(ctx, orderID); err != nil {
+	err := s.repo.Collect(ctx, orderID)
+	if err != nil && !errors.Is(err, dedup.ErrDuplicate) {
 		err = fmt.Errorf("collect: %w", err)
 
-		go s.kafkaClient.SendReset(ResetMsg{
-			OrderID: orderID,
-			ErrMsg:  err.Error(),
-		})
+		if shouldReset(err) {
+			s.sendReset(ctx, events.ResetMsg{
+				OrderID: orderID,
+				ErrMsg:  err.Error(),
+			})
+		}
 
 		return err
 	}
 
+	if sendErr := s.kafkaClient.SendCollectedOrder(ctx, events.CollectedOrder{OrderID: orderID}); sendErr != nil {
+		return fmt.Errorf("send collected order: %w", sendErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("collect: %w", err)
+	}
+
 	return nil
 }
+
+func (s *service) GetStock(ctx context.Context, productID uint64) ([]*Stock, error) {
+	stock, err := s.repo.GetStock(ctx, productID)
+	if err != nil {
+		return nil, fmt.Errorf("get stock: %w", err)
+	}
+
+	return stock, nil
+}
+
+func (s *service) GetMovements(ctx context.Context, productID uint64) ([]*Movement, error) {
+	movements, err := s.repo.GetMovements(ctx, productID)
+	if err != nil {
+		return nil, fmt.Errorf("get movements: %w", err)
+	}
+
+	return movements, nil
+}
+
+func (s *service) Restock(ctx context.Context, req RestockReq) (*Movement, error) {
+	m, err := s.repo.Restock(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("restock: %w", err)
+	}
+
+	logger.Info(ctx, "restocked", movementFields(m)...)
+
+	return m, nil
+}
+
+func (s *service) SetQuantity(ctx context.Context, req SetQuantityReq) (*Movement, error) {
+	m, err := s.repo.SetQuantity(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("set quantity: %w", err)
+	}
+
+	logger.Info(ctx, "set quantity", movementFields(m)...)
+
+	return m, nil
+}
+
+func (s *service) AdjustQuantity(ctx context.Context, req AdjustQuantityReq) (*Movement, error) {
+	m, err := s.repo.AdjustQuantity(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("adjust quantity: %w", err)
+	}
+
+	logger.Info(ctx, "adjusted quantity", movementFields(m)...)
+
+	return m, nil
+}
+
+func movementFields(m *Movement) []logger.Field {
+	return []logger.Field{
+		logger.Uint64("movement_id", m.ID),
+		logger.Uint64("warehouse_id", m.WarehouseID),
+		logger.Uint64("product_id", m.ProductID),
+		logger.String("reason", string(m.Reason)),
+		logger.Int64("delta", m.Delta),
+		logger.Uint64("quantity", m.Quantity),
+	}
+}
+
+// shouldReset reports whether the saga of the order is reset after handling its message failed with err.
+// Internal errors are retried and duplicates have already been handled, so only the errors meaning
+// the order cannot be processed reset it. The reset is sent before the handler returns, so it is part
+// of the kafka transaction of the handler, if any.
+func shouldReset(err error) bool {
+	return !errors.Is(err, ErrInternal) && !errors.Is(err, dedup.ErrDuplicate)
+}
+
+// sendReset sends the reset of the order saga. A failure is only logged, as the error that caused
+// the reset is what the handler reports.
+func (s *service) sendReset(ctx context.Context, msg events.ResetMsg) {
+	if err := s.kafkaClient.SendReset(ctx, msg); err != nil {
+		logger.Error(ctx, "send reset", logger.Err(err))
+	}
+}
@@ -0,0 +1,106 @@
+package stock_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"testing"
+)
+
+// fakeClient records the messages sent, failing the first fail sends like an unavailable broker.
+type fakeClient struct {
+	fail      int
+	reserved  []events.Order
+	collected []events.CollectedOrder
+	resets    []events.ResetMsg
+}
+
+func (c *fakeClient) send() error {
+	if c.fail > 0 {
+		c.fail--
+		return fmt.Errorf("%w: broker unavailable", stock.ErrInternal)
+	}
+	return nil
+}
+
+func (c *fakeClient) SendReservedOrder(_ context.Context, order events.Order) error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	c.reserved = append(c.reserved, order)
+	return nil
+}
+
+func (c *fakeClient) SendCollectedOrder(_ context.Context, msg events.CollectedOrder) error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	c.collected = append(c.collected, msg)
+	return nil
+}
+
+func (c *fakeClient) SendReset(_ context.Context, msg events.ResetMsg) error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	c.resets = append(c.resets, msg)
+	return nil
+}
+
+// TestServiceResendsDuplicates checks that a retried message, whose first delivery committed
+// the side effects but failed to send the output, sends the output instead of being skipped.
+func TestServiceResendsDuplicates(t *testing.T) {
+	ctx := context.Background()
+
+	repo := stock.NewMemoryRepo()
+	if err := repo.AddProduct(ctx, stock.Product{ID: 1, SKU: "SKU-1", Name: "kettle", Active: true}); err != nil {
+		t.Fatalf("add product: %v", err)
+	}
+	warehouseID, err := repo.AddWarehouse(ctx, "main")
+	if err != nil {
+		t.Fatalf("add warehouse: %v", err)
+	}
+	if _, err := repo.SetQuantity(ctx, stock.SetQuantityReq{WarehouseID: warehouseID, ProductID: 1, Quantity: 10, Reason: stock.ReasonStocktake}); err != nil {
+		t.Fatalf("set quantity: %v", err)
+	}
+
+	client := &fakeClient{fail: 1}
+	svc := stock.NewService(repo, client)
+
+	order := events.Order{OrderID: 1, Items: []*events.Item{{ProductID: 1, Quantity: 3}}}
+	reserveCtx := kafkatest.HandlerContext(ctx, events.TopicSavedOrders, 1, "message-1")
+
+	if err := svc.Reserve(reserveCtx, order); !errors.Is(err, stock.ErrInternal) {
+		t.Fatalf("reserve: got %v, want %v", err, stock.ErrInternal)
+	}
+	if err := svc.Reserve(reserveCtx, order); !errors.Is(err, dedup.ErrDuplicate) {
+		t.Fatalf("reserve retried: got %v, want %v", err, dedup.ErrDuplicate)
+	}
+	if len(client.reserved) != 1 || client.reserved[0].OrderID != 1 {
+		t.Fatalf("reserved orders: got %+v, want order 1", client.reserved)
+	}
+	if q := repo.Quantities()[1]; q != 7 {
+		t.Fatalf("quantity: got %d, want 7", q)
+	}
+
+	client.fail = 1
+	collectCtx := kafkatest.HandlerContext(ctx, events.TopicPaidOrders, 1, "message-2")
+
+	if err := svc.Collect(collectCtx, 1); !errors.Is(err, stock.ErrInternal) {
+		t.Fatalf("collect: got %v, want %v", err, stock.ErrInternal)
+	}
+	if err := svc.Collect(collectCtx, 1); !errors.Is(err, dedup.ErrDuplicate) {
+		t.Fatalf("collect retried: got %v, want %v", err, dedup.ErrDuplicate)
+	}
+	if len(client.collected) != 1 || client.collected[0].OrderID != 1 {
+		t.Fatalf("collected orders: got %+v, want order 1", client.collected)
+	}
+
+	if len(client.resets) != 0 {
+		t.Fatalf("resets: got %+v, want none", client.resets)
+	}
+}
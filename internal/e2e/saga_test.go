@@ -0,0 +1,470 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/billing"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/notification"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/order"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/app/stock"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/cache"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const settleTimeout = 10 * time.Second
+
+type stockRepo interface {
+	stock.Repository
+	Quantities() map[uint64]uint64
+}
+
+type billingRepo interface {
+	billing.Repository
+	Status(orderID uint64) (billing.PaymentStatus, error)
+}
+
+// saga is the order, stock, billing and notification services wired together with an in-memory broker.
+type saga struct {
+	broker        *kafkatest.Broker
+	orders        order.Repository
+	stock         stockRepo
+	payments      billingRepo
+	notifications notification.Repository
+	relay         *order.OutboxRelay
+
+	ctx          context.Context
+	stockService stock.Service
+	stockOpts    []router.Option
+}
+
+type sagaOptions struct {
+	quantities   map[uint64]uint64
+	timeouts     order.Timeouts
+	transactions bool
+	// lateStock leaves the stock consumers to the test, see consumeStock.
+	lateStock bool
+}
+
+func newSaga(t *testing.T, opts sagaOptions) *saga {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := &saga{
+		broker:        kafkatest.NewBroker(kafkatest.WithPartitions(3)),
+		orders:        order.NewMemoryRepo(opts.timeouts),
+		stock:         stock.NewMemoryRepo(),
+		payments:      billing.NewMemoryRepo(),
+		notifications: notification.NewMemoryRepo(),
+		ctx:           ctx,
+	}
+
+	s.stockUp(t, opts.quantities)
+
+	s.relay = order.NewOutboxRelay(s.orders, map[string]kafka.Producer{
+		events.TopicSavedOrders: s.producer(t, events.TopicSavedOrders, "orders"),
+		events.TopicPaidOrders:  s.producer(t, events.TopicPaidOrders, "orders"),
+		events.TopicReset:       s.producer(t, events.TopicReset, "orders"),
+		events.TopicCancel:      s.producer(t, events.TopicCancel, "orders"),
+	}, time.Second, 100)
+
+	s.consume(t, ctx, "orders", order.NewKafkaHandler(order.NewService(s.orders)),
+		events.TopicNewOrders,
+		events.TopicReservedOrders,
+		events.TopicPendingPayments,
+		events.TopicPaidPayments,
+		events.TopicCollectedOrders,
+		events.TopicReset,
+		events.TopicCancel,
+	)
+
+	if opts.transactions {
+		s.stockOpts = append(s.stockOpts, router.WithTransactions(s.broker.TxProducer(), "stock"))
+	}
+	s.stockService = stock.NewService(s.stock, stock.NewKafkaClient(
+		s.producer(t, events.TopicReservedOrders, "stock"),
+		s.producer(t, events.TopicCollectedOrders, "stock"),
+		s.producer(t, events.TopicReset, "stock"),
+	))
+	if !opts.lateStock {
+		s.consumeStock(t, "stock",
+			events.TopicSavedOrders,
+			events.TopicReset,
+			events.TopicCancel,
+			events.TopicPaidOrders,
+		)
+	}
+
+	billingClient := billing.NewKafkaClient(
+		s.producer(t, events.TopicPendingPayments, "billing"),
+		s.producer(t, events.TopicPaidPayments, "billing"),
+		s.producer(t, events.TopicReset, "billing"),
+	)
+	s.consume(t, ctx, "billing", billing.NewKafkaHandler(billing.NewService(s.payments, billingClient, cache.NewMemory())),
+		events.TopicReservedOrders,
+		events.TopicReceipts,
+		events.TopicReset,
+		events.TopicCancel,
+	)
+
+	notificationClient := notification.NewKafkaClient(s.producer(t, events.TopicEmailNotifications, "notifications"))
+	s.consume(t, ctx, "notifications", notification.NewKafkaHandler(notification.NewService(s.notifications, notificationClient)),
+		events.TopicPaidOrders,
+		events.TopicCheck,
+	)
+
+	return s
+}
+
+// stockUp adds the products to the catalogue and keeps the quantities of them in a warehouse.
+func (s *saga) stockUp(t *testing.T, quantities map[uint64]uint64) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	warehouseID, err := s.stock.AddWarehouse(ctx, "main")
+	if err != nil {
+		t.Fatalf("add warehouse: %v", err)
+	}
+
+	for productID, quantity := range quantities {
+		if err := s.stock.AddProduct(ctx, stock.Product{
+			ID:     productID,
+			SKU:    fmt.Sprintf("SKU-%d", productID),
+			Name:   fmt.Sprintf("product %d", productID),
+			Price:  10,
+			Active: true,
+		}); err != nil {
+			t.Fatalf("add product: %v", err)
+		}
+		if _, err := s.stock.SetQuantity(ctx, stock.SetQuantityReq{
+			WarehouseID: warehouseID,
+			ProductID:   productID,
+			Quantity:    quantity,
+			Reason:      stock.ReasonStocktake,
+		}); err != nil {
+			t.Fatalf("set quantity: %v", err)
+		}
+	}
+}
+
+func (s *saga) producer(t *testing.T, topic string, name string) kafka.Producer {
+	t.Helper()
+
+	p, err := s.broker.Producer(topic, kafka.WithProducerName(name))
+	if err != nil {
+		t.Fatalf("producer of %s: %v", topic, err)
+	}
+
+	return p
+}
+
+func (s *saga) consume(t *testing.T, ctx context.Context, groupID string, h sarama.ConsumerGroupHandler, topics ...string) {
+	c := s.broker.NewConsumer(ctx, topics, groupID, h)
+	t.Cleanup(func() { c.Close() })
+}
+
+// consumeStock starts a stock consumer of the topics in the consumer group.
+func (s *saga) consumeStock(t *testing.T, groupID string, topics ...string) {
+	s.consume(t, s.ctx, groupID, stock.NewKafkaHandler(s.stockService, s.stockOpts...), topics...)
+}
+
+// send sends a message as another service would, e.g. the gateway placing orders.
+func (s *saga) send(t *testing.T, topic string, key string, msg interface{}) {
+	t.Helper()
+
+	if err := s.producer(t, topic, "e2e").SendMessage(context.Background(), key, msg); err != nil {
+		t.Fatalf("send to %s: %v", topic, err)
+	}
+}
+
+// redeliver sends the message again as it is, e.g. the way a producer retrying a send does.
+func (s *saga) redeliver(t *testing.T, msg *sarama.ConsumerMessage) {
+	t.Helper()
+
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		headers = append(headers, *h)
+	}
+
+	if _, _, err := s.broker.SyncProducer().SendMessage(&sarama.ProducerMessage{
+		Topic:   msg.Topic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}); err != nil {
+		t.Fatalf("redeliver to %s: %v", msg.Topic, err)
+	}
+}
+
+// settle relays the outbox and waits for the services to handle every message until nothing is left.
+func (s *saga) settle(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+
+	for {
+		if err := s.broker.WaitIdle(ctx); err != nil {
+			t.Fatalf("wait for consumers: %v", err)
+		}
+
+		n, err := s.relay.Relay(ctx)
+		if err != nil {
+			t.Fatalf("relay outbox: %v", err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// placeOrder places an order of the items and returns its id, the one the orders service assigns.
+func (s *saga) placeOrder(t *testing.T, items ...*events.Item) uint64 {
+	t.Helper()
+
+	before := len(s.broker.Messages(events.TopicSavedOrders))
+
+	s.send(t, events.TopicNewOrders, "1", events.NewOrder{
+		UserID:       1,
+		Items:        items,
+		DeliveryDate: time.Now(),
+		Email:        "user@example.com",
+		Total:        100,
+	})
+	s.settle(t)
+
+	saved := s.broker.Messages(events.TopicSavedOrders)
+	if len(saved) != before+1 {
+		t.Fatalf("saved orders: got %d messages, want %d", len(saved), before+1)
+	}
+
+	orders, err := s.orders.ListByUser(context.Background(), 1, 0, 1)
+	if err != nil {
+		t.Fatalf("list orders: %v", err)
+	}
+	if len(orders) == 0 {
+		t.Fatal("order has not been created")
+	}
+
+	return orders[0].OrderID
+}
+
+func (s *saga) requireStatus(t *testing.T, orderID uint64, want order.Status) {
+	t.Helper()
+
+	got, err := s.orders.GetStatus(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	if got != want {
+		history, _ := s.orders.GetHistory(context.Background(), orderID)
+		for _, change := range history {
+			t.Logf("%v -> %s: %s", change.From, change.To, change.Reason)
+		}
+		t.Fatalf("order status: got %s, want %s", got, want)
+	}
+}
+
+func (s *saga) requirePayment(t *testing.T, orderID uint64, want billing.PaymentStatus) {
+	t.Helper()
+
+	got, err := s.payments.Status(orderID)
+	if err != nil {
+		t.Fatalf("payment status: %v", err)
+	}
+	if got != want {
+		t.Fatalf("payment status: got %d, want %d", got, want)
+	}
+}
+
+func (s *saga) requireQuantities(t *testing.T, want map[uint64]uint64) {
+	t.Helper()
+
+	if got := s.stock.Quantities(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("stock quantities: got %v, want %v", got, want)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		transactions bool
+	}{
+		{name: "plain"},
+		{name: "stock transactions", transactions: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSaga(t, sagaOptions{
+				quantities:   map[uint64]uint64{1: 10, 2: 5},
+				transactions: tc.transactions,
+			})
+
+			orderID := s.placeOrder(t, &events.Item{ProductID: 1, Quantity: 2}, &events.Item{ProductID: 2, Quantity: 1})
+
+			s.requireStatus(t, orderID, order.PaymentPending)
+			s.requirePayment(t, orderID, billing.Pending)
+			s.requireQuantities(t, map[uint64]uint64{1: 8, 2: 4})
+
+			// The payment gateway may confirm the payment more than once.
+			s.send(t, events.TopicReceipts, "1", events.Receipt{OrderID: orderID})
+			s.send(t, events.TopicReceipts, "1", events.Receipt{OrderID: orderID})
+			s.settle(t)
+
+			s.requireStatus(t, orderID, order.Collected)
+			s.requirePayment(t, orderID, billing.Paid)
+			s.requireQuantities(t, map[uint64]uint64{1: 8, 2: 4})
+
+			if n := len(s.broker.Messages(events.TopicPaidOrders)); n != 1 {
+				t.Fatalf("paid orders: got %d messages, want 1", n)
+			}
+
+			notifications, err := s.notifications.GetTodayNotifications(context.Background())
+			if err != nil {
+				t.Fatalf("get notifications: %v", err)
+			}
+			if len(notifications) != 1 || notifications[0].OrderID != orderID {
+				t.Fatalf("notifications: got %+v, want one of order %d", notifications, orderID)
+			}
+		})
+	}
+}
+
+func TestCompensationNotEnoughStock(t *testing.T) {
+	s := newSaga(t, sagaOptions{
+		quantities: map[uint64]uint64{1: 10, 2: 1},
+	})
+
+	orderID := s.placeOrder(t, &events.Item{ProductID: 1, Quantity: 2}, &events.Item{ProductID: 2, Quantity: 2})
+
+	s.requireStatus(t, orderID, order.Failed)
+	s.requireQuantities(t, map[uint64]uint64{1: 10, 2: 1})
+
+	if _, err := s.payments.Status(orderID); !errors.Is(err, billing.ErrNotFound) {
+		t.Fatalf("payment status: got %v, want %v", err, billing.ErrNotFound)
+	}
+
+	if n := len(s.broker.Messages(events.TopicReservedOrders)); n != 0 {
+		t.Fatalf("reserved orders: got %d messages, want 0", n)
+	}
+}
+
+func TestCompensationTimeout(t *testing.T) {
+	s := newSaga(t, sagaOptions{
+		quantities: map[uint64]uint64{1: 10},
+		timeouts:   order.Timeouts{order.PaymentPending: time.Millisecond},
+	})
+
+	orderID := s.placeOrder(t, &events.Item{ProductID: 1, Quantity: 3})
+
+	s.requireStatus(t, orderID, order.PaymentPending)
+	s.requireQuantities(t, map[uint64]uint64{1: 7})
+
+	// The receipt never comes.
+	time.Sleep(10 * time.Millisecond)
+
+	n, err := s.orders.ExpireDeadlines(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("expire deadlines: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expired orders: got %d, want 1", n)
+	}
+	s.settle(t)
+
+	s.requireStatus(t, orderID, order.Cancelled)
+	s.requirePayment(t, orderID, billing.Cancelled)
+	s.requireQuantities(t, map[uint64]uint64{1: 10})
+
+	// A late receipt does not revive the order, the orders service resets the saga instead.
+	s.send(t, events.TopicReceipts, "1", events.Receipt{OrderID: orderID})
+	s.settle(t)
+
+	s.requireStatus(t, orderID, order.Cancelled)
+	s.requirePayment(t, orderID, billing.Cancelled)
+	s.requireQuantities(t, map[uint64]uint64{1: 10})
+}
+
+// TestDuplicateSavedOrder redelivers the saved order at another offset. Stock sends the reserved order
+// again under a new message id, which billing takes for a duplicate of the payment it has added
+// rather than a failure resetting the saga.
+func TestDuplicateSavedOrder(t *testing.T) {
+	s := newSaga(t, sagaOptions{
+		quantities: map[uint64]uint64{1: 10},
+	})
+
+	orderID := s.placeOrder(t, &events.Item{ProductID: 1, Quantity: 3})
+	s.requireStatus(t, orderID, order.PaymentPending)
+
+	saved := s.broker.Messages(events.TopicSavedOrders)
+	s.redeliver(t, saved[len(saved)-1])
+	s.settle(t)
+
+	if n := len(s.broker.Messages(events.TopicReservedOrders)); n != 2 {
+		t.Fatalf("reserved orders: got %d messages, want 2", n)
+	}
+	if n := len(s.broker.Messages(events.TopicReset)); n != 0 {
+		t.Fatalf("resets: got %d messages, want none", n)
+	}
+
+	s.requireStatus(t, orderID, order.PaymentPending)
+	s.requirePayment(t, orderID, billing.Pending)
+	s.requireQuantities(t, map[uint64]uint64{1: 7})
+}
+
+// TestCompensationTimeoutBeforeReservation cancels the order on a timeout of the created order
+// before stock gets it. Stock gets the cancellation first and does not reserve the order coming after.
+func TestCompensationTimeoutBeforeReservation(t *testing.T) {
+	s := newSaga(t, sagaOptions{
+		quantities: map[uint64]uint64{1: 10},
+		timeouts:   order.Timeouts{order.Created: time.Millisecond},
+		lateStock:  true,
+	})
+
+	orderID := s.placeOrder(t, &events.Item{ProductID: 1, Quantity: 3})
+	s.requireStatus(t, orderID, order.Created)
+
+	time.Sleep(10 * time.Millisecond)
+
+	n, err := s.orders.ExpireDeadlines(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("expire deadlines: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expired orders: got %d, want 1", n)
+	}
+	s.settle(t)
+	s.requireStatus(t, orderID, order.Cancelled)
+
+	// Consumer groups of their own make stock handle the cancellation before the order.
+	s.consumeStock(t, "stock-compensation", events.TopicCancel, events.TopicReset)
+	s.settle(t)
+	s.consumeStock(t, "stock", events.TopicSavedOrders, events.TopicPaidOrders)
+	s.settle(t)
+
+	s.requireStatus(t, orderID, order.Cancelled)
+	s.requireQuantities(t, map[uint64]uint64{1: 10})
+
+	reservations, err := s.stock.GetReservations(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("get reservations: %v", err)
+	}
+	if len(reservations) != 0 {
+		t.Fatalf("reservations: got %d, want none", len(reservations))
+	}
+	if n := len(s.broker.Messages(events.TopicReservedOrders)); n != 0 {
+		t.Fatalf("reserved orders: got %d messages, want 0", n)
+	}
+	if _, err := s.payments.Status(orderID); !errors.Is(err, billing.ErrNotFound) {
+		t.Fatalf("payment status: got %v, want %v", err, billing.ErrNotFound)
+	}
+}
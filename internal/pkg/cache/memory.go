@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	v         any
+	expiresAt time.Time
+}
+
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// NewMemory creates an instance of memoryCache, a cache keeping values in memory, e.g. in tests.
+// Unlike redis, it returns the values as they have been set.
+func NewMemory() *memoryCache {
+	return &memoryCache{
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+// Set stores the value for d, zero d means the value does not expire.
+func (c *memoryCache) Set(_ context.Context, k string, v any, d time.Duration) error {
+	e := memoryEntry{v: v}
+	if d > 0 {
+		e.expiresAt = time.Now().Add(d)
+	}
+
+	c.mu.Lock()
+	c.entries[k] = e
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *memoryCache) Get(_ context.Context, k string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[k]
+	if ok && !e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt) {
+		delete(c.entries, k)
+		ok = false
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: get: key %q", ErrNotFound, k)
+	}
+
+	return e.v, nil
+}
@@ -5,9 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/cache")
+
 type redisClient struct {
 	redis *redis.Client
 }
@@ -22,14 +30,35 @@ func NewRedisClient(addr string, password string) *redisClient {
 	}
 }
 
-func (c *redisClient) Set(ctx context.Context, k string, v any, d time.Duration) error {
+func (c *redisClient) Set(ctx context.Context, k string, v any, d time.Duration) (err error) {
+	ctx, span := c.startSpan(ctx, "SET", k)
+	defer func() { tracing.End(span, err) }()
+
 	if err := c.redis.Set(ctx, k, v, d).Err(); err != nil {
 		return fmt.Errorf("%w: set: %v", ErrInternal, err)
 	}
 	return nil
 }
 
-func (c *redisClient) Get(ctx context.Context, k string) (any, error) {
+func (c *redisClient) Get(ctx context.Context, k string) (_ any, err error) {
+	ctx, span := c.startSpan(ctx, "GET", k)
+	defer func() {
+		// A cache miss is not a failure of the call.
+		if errors.Is(err, ErrNotFound) {
+			metrics.CacheRequests.WithLabelValues("miss").Inc()
+			span.SetAttributes(attribute.Bool("cache.hit", false))
+			tracing.End(span, nil)
+			return
+		}
+		if err == nil {
+			metrics.CacheRequests.WithLabelValues("hit").Inc()
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+		} else {
+			metrics.CacheRequests.WithLabelValues("error").Inc()
+		}
+		tracing.End(span, err)
+	}()
+
 	v, err := c.redis.Get(ctx, k).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
@@ -40,3 +69,30 @@ func (c *redisClient) Get(ctx context.Context, k string) (any, error) {
 
 	return v, nil
 }
+
+// Close closes the connection to redis.
+func (c *redisClient) Close() error {
+	if err := c.redis.Close(); err != nil {
+		return fmt.Errorf("%w: close: %v", ErrInternal, err)
+	}
+	return nil
+}
+
+// Ping checks the connection to redis.
+func (c *redisClient) Ping(ctx context.Context) error {
+	if err := c.redis.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("%w: ping: %v", ErrInternal, err)
+	}
+	return nil
+}
+
+func (c *redisClient) startSpan(ctx context.Context, op string, k string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "redis "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemRedis,
+			semconv.DBOperationKey.String(op),
+			attribute.String("cache.key", k),
+		),
+	)
+}
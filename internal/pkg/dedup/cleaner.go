@@ -0,0 +1,109 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"time"
+)
+
+// retainedTable is a table whose rows are deleted once column is older than retention.
+type retainedTable struct {
+	name      string
+	column    string
+	retention time.Duration
+}
+
+// CleanerOption configures Cleaner.
+type CleanerOption func(c *Cleaner)
+
+// WithTable makes Cleaner delete the rows of another table once their column, a timestamp,
+// is older than retention, e.g. tombstones kept for redelivered messages the way processed
+// messages are.
+func WithTable(name string, column string, retention time.Duration) CleanerOption {
+	return func(c *Cleaner) {
+		c.tables = append(c.tables, retainedTable{name: name, column: column, retention: retention})
+	}
+}
+
+// Cleaner deletes the processed_messages rows older than the retention, otherwise the table
+// grows with every message handled. A message may be redelivered as long as its topic keeps it,
+// so the retention must be longer than the one of the consumed topics: a message redelivered
+// after its record is deleted is processed again.
+type Cleaner struct {
+	db        DBTX
+	interval  time.Duration
+	batchSize int
+	tables    []retainedTable
+}
+
+// NewCleaner creates an instance of Cleaner.
+func NewCleaner(db DBTX, retention time.Duration, interval time.Duration, batchSize int, opts ...CleanerOption) *Cleaner {
+	c := &Cleaner{
+		db:        db,
+		interval:  interval,
+		batchSize: batchSize,
+		tables:    []retainedTable{{name: processedMessagesTable, column: "processed_at", retention: retention}},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Run deletes expired rows every interval until ctx is done. Rows are deleted in batches,
+// full batches are followed by the next ones right away. Every batch is a step of the progress.
+func (c *Cleaner) Run(ctx context.Context, progress *health.Progress) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			end := progress.Begin()
+			full, err := c.Clean(ctx)
+			end()
+			if err != nil {
+				logger.Error(ctx, "delete expired rows", logger.Err(err))
+			}
+
+			if full {
+				timer.Reset(0)
+			} else {
+				timer.Reset(c.interval)
+			}
+		}
+	}
+}
+
+// Clean deletes a batch of the expired rows of every table and reports whether a batch was full,
+// i.e. more rows may have expired. A failed table does not stop the others from being cleaned.
+func (c *Cleaner) Clean(ctx context.Context) (full bool, err error) {
+	for _, t := range c.tables {
+		query := fmt.Sprintf(`
+DELETE FROM %[1]s
+WHERE ctid IN (SELECT ctid FROM %[1]s WHERE %[2]s < now() - make_interval(secs => $1) LIMIT $2)
+`, t.name, t.column)
+
+		tag, tErr := c.db.Exec(ctx, query, t.retention.Seconds(), c.batchSize)
+		if tErr != nil {
+			if err == nil {
+				err = fmt.Errorf("delete from %s: db exec: %w", t.name, tErr)
+			}
+			continue
+		}
+
+		n := int(tag.RowsAffected())
+		if n > 0 {
+			logger.Info(ctx, "deleted expired rows", logger.String("table", t.name), logger.Int("count", n))
+		}
+		full = full || n == c.batchSize
+	}
+
+	return full, err
+}
@@ -0,0 +1,121 @@
+package dedup_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/pgtest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDB deletes the number of rows set for the table a query deletes from, or fails with the error set for it.
+type fakeDB struct {
+	deleted map[string]int
+	errs    map[string]error
+	calls   []string
+}
+
+func (db *fakeDB) Exec(_ context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	table := strings.Fields(sql)[2]
+	db.calls = append(db.calls, fmt.Sprintf("%s %v", table, args))
+
+	if err := db.errs[table]; err != nil {
+		return nil, err
+	}
+	return pgconn.CommandTag(fmt.Sprintf("DELETE %d", db.deleted[table])), nil
+}
+
+func TestCleanerClean(t *testing.T) {
+	ctx := context.Background()
+	newCleaner := func(db *fakeDB) *dedup.Cleaner {
+		return dedup.NewCleaner(db, time.Hour, time.Minute, 100,
+			dedup.WithTable("cancelled_orders", "cancelled_at", 2*time.Hour),
+		)
+	}
+
+	t.Run("every table", func(t *testing.T) {
+		db := &fakeDB{deleted: map[string]int{"processed_messages": 3}}
+
+		full, err := newCleaner(db).Clean(ctx)
+		if err != nil || full {
+			t.Fatalf("clean: got full %t, %v, want not full", full, err)
+		}
+
+		want := []string{"processed_messages [3600 100]", "cancelled_orders [7200 100]"}
+		if !reflect.DeepEqual(db.calls, want) {
+			t.Fatalf("calls: got %v, want %v", db.calls, want)
+		}
+	})
+
+	t.Run("full batch", func(t *testing.T) {
+		db := &fakeDB{deleted: map[string]int{"cancelled_orders": 100}}
+
+		if full, err := newCleaner(db).Clean(ctx); err != nil || !full {
+			t.Fatalf("clean: got full %t, %v, want full", full, err)
+		}
+	})
+
+	t.Run("failed table", func(t *testing.T) {
+		errDB := errors.New("connection refused")
+		db := &fakeDB{
+			deleted: map[string]int{"cancelled_orders": 100},
+			errs:    map[string]error{"processed_messages": errDB},
+		}
+
+		full, err := newCleaner(db).Clean(ctx)
+		if !errors.Is(err, errDB) {
+			t.Fatalf("clean: got %v, want %v", err, errDB)
+		}
+		if !full || len(db.calls) != 2 {
+			t.Fatalf("clean: got full %t after %v, want the other table cleaned", full, db.calls)
+		}
+	})
+}
+
+func TestCleanerPostgres(t *testing.T) {
+	ctx := context.Background()
+	db := pgtest.Open(t, migrations.Stock)
+
+	for _, query := range []string{
+		`INSERT INTO processed_messages (topic, partition, "offset", processed_at)
+		 SELECT 'orders', 0, n, now() - interval '8 days' FROM generate_series(1, 3) n`,
+		`INSERT INTO processed_messages (topic, partition, "offset") VALUES ('orders', 0, 4)`,
+		`INSERT INTO cancelled_orders (order_id, cancelled_at) VALUES (1, now() - interval '8 days'), (2, now())`,
+	} {
+		if _, err := db.Exec(ctx, query); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	retention := 7 * 24 * time.Hour
+	cleaner := dedup.NewCleaner(db, retention, time.Minute, 2,
+		dedup.WithTable("cancelled_orders", "cancelled_at", retention),
+	)
+
+	if full, err := cleaner.Clean(ctx); err != nil || !full {
+		t.Fatalf("clean: got full %t, %v, want full", full, err)
+	}
+	if full, err := cleaner.Clean(ctx); err != nil || full {
+		t.Fatalf("clean again: got full %t, %v, want not full", full, err)
+	}
+
+	count := func(table string) int {
+		var n int
+		if err := db.QueryRow(ctx, "SELECT count(*) FROM "+table).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		return n
+	}
+	if n := count("processed_messages"); n != 1 {
+		t.Fatalf("processed messages: got %d, want 1", n)
+	}
+	if n := count("cancelled_orders"); n != 1 {
+		t.Fatalf("cancelled orders: got %d, want 1", n)
+	}
+}
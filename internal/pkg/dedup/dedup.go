@@ -0,0 +1,66 @@
+// Package dedup makes kafka message handlers idempotent.
+//
+// Kafka delivers messages at least once, so a handler may see the same message again
+// after a rebalance or a failed offset commit. A handler claims the message with Claim
+// in the same database transaction that applies its side effects: the first claim
+// records the message in the processed_messages table, later ones fail with ErrDuplicate
+// and roll the transaction back. SkipDuplicates middleware then acknowledges the message.
+//
+// The claim is committed before the handler sends its output messages, so a delivery may
+// commit the claim and fail to send them. Handlers that send messages derive them again
+// for a duplicate and send them before returning ErrDuplicate.
+//
+// A message is identified by its topic, partition and offset as well as by its envelope
+// message id, so a message published twice, e.g. by the outbox relay, is processed once.
+//
+// The records are kept for a retention period only, Cleaner deletes the older ones.
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+)
+
+const processedMessagesTable = "processed_messages"
+
+// ErrDuplicate is returned by Claim when the message has already been processed.
+var ErrDuplicate = errors.New("message already processed")
+
+// DBTX is an interface that both *pgxpool.Pool and pgx.Tx implements.
+type DBTX interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+var claimQuery = fmt.Sprintf(`
+INSERT INTO %s
+(topic, partition, "offset", message_id)
+VALUES ($1, $2, $3, NULLIF($4, ''))
+ON CONFLICT DO NOTHING
+`, processedMessagesTable)
+
+// Claim records the kafka message being handled as processed. It must be called within
+// the transaction that applies the message side effects, so they are committed together.
+// Claim does nothing if ctx does not carry a message, e.g. for calls made outside kafka handlers.
+func Claim(ctx context.Context, db DBTX) error {
+	msg, ok := router.MessageFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	env, _ := kafka.EnvelopeFromContext(ctx)
+
+	tag, err := db.Exec(ctx, claimQuery, msg.Topic, msg.Partition, msg.Offset, env.MessageID)
+	if err != nil {
+		return fmt.Errorf("db exec: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s/%d/%d", ErrDuplicate, msg.Topic, msg.Partition, msg.Offset)
+	}
+
+	return nil
+}
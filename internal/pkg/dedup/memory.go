@@ -0,0 +1,75 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"sync"
+)
+
+type messageOffset struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+// Processed is the in-memory counterpart of the processed_messages table for repositories
+// keeping data in memory. A repository checks the message with Check before applying its side
+// effects and records it with Record along with them, so a failed message is not recorded.
+type Processed struct {
+	mu      sync.Mutex
+	offsets map[messageOffset]struct{}
+	ids     map[string]struct{}
+}
+
+// NewProcessed creates an instance of Processed.
+func NewProcessed() *Processed {
+	return &Processed{
+		offsets: make(map[messageOffset]struct{}),
+		ids:     make(map[string]struct{}),
+	}
+}
+
+// Check fails with ErrDuplicate if the message being handled has been recorded already.
+// Like Claim, it does nothing if ctx does not carry a message.
+func (p *Processed) Check(ctx context.Context) error {
+	msg, ok := router.MessageFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	env, _ := kafka.EnvelopeFromContext(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, seen := p.offsets[messageOffset{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset}]
+	if !seen && env.MessageID != "" {
+		_, seen = p.ids[env.MessageID]
+	}
+
+	if seen {
+		return fmt.Errorf("%w: %s/%d/%d", ErrDuplicate, msg.Topic, msg.Partition, msg.Offset)
+	}
+
+	return nil
+}
+
+// Record records the message being handled as processed.
+func (p *Processed) Record(ctx context.Context) {
+	msg, ok := router.MessageFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	env, _ := kafka.EnvelopeFromContext(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.offsets[messageOffset{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset}] = struct{}{}
+	if env.MessageID != "" {
+		p.ids[env.MessageID] = struct{}{}
+	}
+}
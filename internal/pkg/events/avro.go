@@ -0,0 +1,125 @@
+package events
+
+const avroItems = `{
+	"type": "array",
+	"items": {
+		"type": "record",
+		"name": "Item",
+		"fields": [
+			{"name": "product_id", "type": "long"},
+			{"name": "quantity", "type": "long"}
+		]
+	}
+}`
+
+const avroNewOrder = `{
+	"type": "record",
+	"name": "NewOrder",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "user_id", "type": "long"},
+		{"name": "items", "type": ` + avroItems + `},
+		{"name": "delivery_date", "type": "string"},
+		{"name": "email", "type": "string"},
+		{"name": "total", "type": "double"}
+	]
+}`
+
+const avroOrder = `{
+	"type": "record",
+	"name": "Order",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "order_id", "type": "long"},
+		{"name": "user_id", "type": "long"},
+		{"name": "total", "type": "double"},
+		{"name": "delivery_date", "type": "string"},
+		{"name": "email", "type": "string"},
+		{"name": "items", "type": ` + avroItems + `}
+	]
+}`
+
+const avroPayment = `{
+	"type": "record",
+	"name": "Payment",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "order_id", "type": "long"},
+		{"name": "user_id", "type": "long"},
+		{"name": "total", "type": "double"}
+	]
+}`
+
+const avroReceipt = `{
+	"type": "record",
+	"name": "Receipt",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "order_id", "type": "long"}
+	]
+}`
+
+const avroCollectedOrder = `{
+	"type": "record",
+	"name": "CollectedOrder",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "order_id", "type": "long"}
+	]
+}`
+
+const avroResetMsg = `{
+	"type": "record",
+	"name": "ResetMsg",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "order_id", "type": "long"},
+		{"name": "err_msg", "type": "string"}
+	]
+}`
+
+const avroCancelMsg = `{
+	"type": "record",
+	"name": "CancelMsg",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "order_id", "type": "long"},
+		{"name": "reason", "type": "string"}
+	]
+}`
+
+const avroCheck = `{
+	"type": "record",
+	"name": "Check",
+	"namespace": "homework3.events",
+	"fields": []
+}`
+
+const avroEmailNotification = `{
+	"type": "record",
+	"name": "EmailNotification",
+	"namespace": "homework3.events",
+	"fields": [
+		{"name": "OrderID", "type": "long"},
+		{"name": "UserID", "type": "long"}
+	]
+}`
+
+// AvroSchemas returns the Avro schemas of the topic payloads by topic names. They follow the JSON
+// encoding of the payloads, see kafka.NewAvroCodec, and evolve along with them.
+func AvroSchemas() map[string]string {
+	return map[string]string{
+		TopicNewOrders:          avroNewOrder,
+		TopicSavedOrders:        avroOrder,
+		TopicReservedOrders:     avroOrder,
+		TopicPendingPayments:    avroPayment,
+		TopicReceipts:           avroReceipt,
+		TopicPaidPayments:       avroPayment,
+		TopicPaidOrders:         avroOrder,
+		TopicCollectedOrders:    avroCollectedOrder,
+		TopicReset:              avroResetMsg,
+		TopicCancel:             avroCancelMsg,
+		TopicCheck:              avroCheck,
+		TopicEmailNotifications: avroEmailNotification,
+	}
+}
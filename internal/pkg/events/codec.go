@@ -0,0 +1,43 @@
+package events
+
+import (
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/schemaregistry"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+)
+
+// Codec names.
+const (
+	CodecJSON     = "json"
+	CodecAvro     = "avro"
+	CodecProtobuf = "protobuf"
+)
+
+// NewCodecs returns the codec the payloads are produced with and the codecs they are consumed with.
+// The payloads of all the codecs are consumed regardless of the configured one, so services
+// can switch codecs one by one.
+func NewCodecs(cfg util.CodecConfig) (kafka.Codec, []kafka.Codec, error) {
+	var opts []kafka.CodecOption
+	if cfg.SchemaRegistry != "" {
+		opts = append(opts, kafka.WithSchemaRegistry(schemaregistry.NewClient(cfg.SchemaRegistry)))
+	}
+
+	avro, err := kafka.NewAvroCodec(AvroSchemas(), opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("avro codec: %w", err)
+	}
+
+	protobuf := kafka.NewProtobufCodec(ProtobufSchemas(), ProtobufMessages(), opts...)
+
+	switch cfg.Name {
+	case CodecAvro:
+		return avro, []kafka.Codec{avro, protobuf}, nil
+	case CodecProtobuf:
+		return protobuf, []kafka.Codec{avro, protobuf}, nil
+	case CodecJSON, "":
+		return kafka.NewJSONCodec(), []kafka.Codec{avro, protobuf}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown codec %q", cfg.Name)
+	}
+}
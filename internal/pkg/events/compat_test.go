@@ -0,0 +1,176 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/schemaregistry"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testdata holds a directory per released schema version with a payload per topic named <topic>.json.
+// Add a directory when the version is bumped and never change the files of the released ones.
+const testdata = "testdata"
+
+// TestCompatibility checks that the payloads of every released version are still decoded and
+// that encoding them back keeps every field, so the consumers of that version can read them.
+// It also checks that the Avro schemas and the Protobuf messages of the topics encode the payloads.
+func TestCompatibility(t *testing.T) {
+	versions, err := os.ReadDir(testdata)
+	if err != nil {
+		t.Fatalf("read testdata: %v", err)
+	}
+
+	covered := make(map[string]bool)
+
+	for _, version := range versions {
+		files, err := filepath.Glob(filepath.Join(testdata, version.Name(), "*.json"))
+		if err != nil {
+			t.Fatalf("glob %s: %v", version.Name(), err)
+		}
+
+		for _, file := range files {
+			topic := strings.TrimSuffix(filepath.Base(file), ".json")
+			covered[topic] = true
+
+			t.Run(version.Name()+"/"+topic, func(t *testing.T) {
+				checkPayload(t, topic, file)
+			})
+		}
+	}
+
+	for _, topic := range events.Topics() {
+		if !covered[topic] {
+			t.Errorf("topic %s has no payload in testdata, add one to the current version", topic)
+		}
+	}
+}
+
+func checkPayload(t *testing.T, topic string, file string) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+
+	payload, ok := events.New(topic)
+	if !ok {
+		t.Fatalf("topic %s has been removed", topic)
+	}
+
+	if err := events.Decode(context.Background(), topic, raw, payload); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	checkAvro(t, topic, payload, encoded)
+	checkProtobuf(t, topic, payload, encoded)
+
+	want := fieldPaths(t, raw)
+	got := make(map[string]bool)
+	for _, path := range fieldPaths(t, encoded) {
+		got[path] = true
+	}
+
+	for _, path := range want {
+		if !got[path] {
+			t.Errorf("field %s has been removed or renamed", path)
+		}
+	}
+}
+
+// fieldPaths returns the paths of all the fields of a JSON document, e.g. items[].product_id.
+func fieldPaths(t *testing.T, raw []byte) []string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	var paths []string
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, val := range v {
+				path := key
+				if prefix != "" {
+					path = prefix + "." + key
+				}
+				paths = append(paths, path)
+				walk(path, val)
+			}
+		case []interface{}:
+			for _, val := range v {
+				walk(prefix+"[]", val)
+			}
+		}
+	}
+	walk("", v)
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// checkAvro checks that the topic Avro schema encodes the payload without losing anything.
+func checkAvro(t *testing.T, topic string, payload interface{}, encoded []byte) {
+	codec, err := kafka.NewAvroCodec(events.AvroSchemas(), kafka.WithSchemaRegistry(schemaregistry.NewMemory()))
+	if err != nil {
+		t.Fatalf("avro codec: %v", err)
+	}
+
+	ctx := context.Background()
+
+	b, err := codec.Marshal(ctx, topic, payload)
+	if err != nil {
+		t.Fatalf("avro encode: %v", err)
+	}
+
+	decoded, _ := events.New(topic)
+	if err := codec.Unmarshal(ctx, topic, b, decoded); err != nil {
+		t.Fatalf("avro decode: %v", err)
+	}
+
+	got, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if string(got) != string(encoded) {
+		t.Errorf("avro round trip: got %s, want %s", got, encoded)
+	}
+}
+
+// checkProtobuf checks that the topic Protobuf message encodes the payload without losing anything.
+func checkProtobuf(t *testing.T, topic string, payload interface{}, encoded []byte) {
+	codec := kafka.NewProtobufCodec(events.ProtobufSchemas(), events.ProtobufMessages(), kafka.WithSchemaRegistry(schemaregistry.NewMemory()))
+
+	ctx := context.Background()
+
+	b, err := codec.Marshal(ctx, topic, payload)
+	if err != nil {
+		t.Fatalf("protobuf encode: %v", err)
+	}
+
+	decoded, _ := events.New(topic)
+	if err := codec.Unmarshal(ctx, topic, b, decoded); err != nil {
+		t.Fatalf("protobuf decode: %v", err)
+	}
+
+	got, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if string(got) != string(encoded) {
+		t.Errorf("protobuf round trip: got %s, want %s", got, encoded)
+	}
+}
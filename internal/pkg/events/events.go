@@ -0,0 +1,159 @@
+// Package events defines the payloads of the messages the services exchange through kafka.
+//
+// Payloads are the contract between services and are versioned along with the envelope, see
+// kafka.Envelope.SchemaVersion. Changes must keep the older payloads decodable and must keep
+// the fields older consumers read: add optional fields only and never rename, retype or remove
+// one. The compatibility tests decode the payloads of every released version from testdata.
+package events
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"sort"
+	"time"
+)
+
+// Topic names.
+const (
+	TopicNewOrders          = "new_orders"
+	TopicSavedOrders        = "saved_orders"
+	TopicReservedOrders     = "reserved_orders"
+	TopicPendingPayments    = "pending_payments"
+	TopicReceipts           = "receipts"
+	TopicPaidPayments       = "paid_payments"
+	TopicPaidOrders         = "paid_orders"
+	TopicCollectedOrders    = "collected_orders"
+	TopicReset              = "reset"
+	TopicCancel             = "cancel"
+	TopicCheck              = "check"
+	TopicEmailNotifications = "email_notifications"
+)
+
+// Item represents product with its quantity.
+type Item struct {
+	ProductID uint64 `json:"product_id"`
+	Quantity  uint64 `json:"quantity"`
+}
+
+// NewOrder is an order placed by a user, sent to new_orders.
+type NewOrder struct {
+	UserID       uint64    `json:"user_id" validate:"required"`
+	Items        []*Item   `json:"items" validate:"required"`
+	DeliveryDate time.Time `json:"delivery_date" validate:"required"`
+	Email        string    `json:"email" validate:"required"`
+	Total        float64   `json:"total" validate:"required"`
+}
+
+// Order is a saved order, sent to saved_orders, reserved_orders and paid_orders.
+type Order struct {
+	OrderID      uint64    `json:"order_id" validate:"required"`
+	UserID       uint64    `json:"user_id" validate:"required"`
+	Total        float64   `json:"total" validate:"required"`
+	DeliveryDate time.Time `json:"delivery_date" validate:"required"`
+	Email        string    `json:"email" validate:"required"`
+	Items        []*Item   `json:"items" validate:"required"`
+}
+
+// OrderRef is the part every saga payload has in common, it is used by consumers
+// interested in the referenced order only.
+type OrderRef struct {
+	OrderID uint64 `json:"order_id" validate:"required"`
+}
+
+// Payment is sent to pending_payments once the payment is created and to paid_payments once it is approved.
+type Payment struct {
+	OrderID uint64  `json:"order_id" validate:"required"`
+	UserID  uint64  `json:"user_id"`
+	Total   float64 `json:"total"`
+}
+
+// Receipt confirms the order has been paid, sent to receipts.
+type Receipt struct {
+	OrderID uint64 `json:"order_id" validate:"required"`
+}
+
+// CollectedOrder is sent to collected_orders once the order reservation is collected.
+type CollectedOrder struct {
+	OrderID uint64 `json:"order_id" validate:"required"`
+}
+
+// ResetMsg fails the order saga, sent to reset.
+type ResetMsg struct {
+	OrderID uint64 `json:"order_id" validate:"required"`
+	ErrMsg  string `json:"err_msg" validate:"required"`
+}
+
+// CancelMsg cancels the order, sent to cancel.
+type CancelMsg struct {
+	OrderID uint64 `json:"order_id" validate:"required"`
+	Reason  string `json:"reason" validate:"required"`
+}
+
+// Check asks for today notifications to be sent, sent to check.
+type Check struct{}
+
+// EmailNotification is sent to email_notifications.
+// Its fields were published without json tags, so they keep the Go names on the wire.
+type EmailNotification struct {
+	OrderID uint64 `json:"OrderID"`
+	UserID  uint64 `json:"UserID"`
+}
+
+var payloads = map[string]func() interface{}{
+	TopicNewOrders:          func() interface{} { return &NewOrder{} },
+	TopicSavedOrders:        func() interface{} { return &Order{} },
+	TopicReservedOrders:     func() interface{} { return &Order{} },
+	TopicPendingPayments:    func() interface{} { return &Payment{} },
+	TopicReceipts:           func() interface{} { return &Receipt{} },
+	TopicPaidPayments:       func() interface{} { return &Payment{} },
+	TopicPaidOrders:         func() interface{} { return &Order{} },
+	TopicCollectedOrders:    func() interface{} { return &CollectedOrder{} },
+	TopicReset:              func() interface{} { return &ResetMsg{} },
+	TopicCancel:             func() interface{} { return &CancelMsg{} },
+	TopicCheck:              func() interface{} { return &Check{} },
+	TopicEmailNotifications: func() interface{} { return &EmailNotification{} },
+}
+
+// Topics returns the names of all the topics in alphabetical order.
+func Topics() []string {
+	topics := make([]string, 0, len(payloads))
+	for topic := range payloads {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+// New returns a pointer to a new payload of the topic messages.
+func New(topic string) (interface{}, bool) {
+	fn, ok := payloads[topic]
+	if !ok {
+		return nil, false
+	}
+
+	return fn(), true
+}
+
+var validate = validator.New()
+
+// Validate checks that v, a payload or a pointer to one, satisfies its validation tags.
+func Validate(v interface{}) error {
+	return validate.Struct(v)
+}
+
+// Decode decodes raw, a value of a topic message, into v, a pointer to a payload, and validates it.
+// The message is decoded with the codec of ctx, see kafka.Decode.
+func Decode(ctx context.Context, topic string, raw []byte, v interface{}) error {
+	if err := kafka.Decode(ctx, topic, raw, v); err != nil {
+		return fmt.Errorf("decode: %v", err)
+	}
+
+	if err := Validate(v); err != nil {
+		return fmt.Errorf("validate: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// Package eventspb holds the protobuf messages of the topic payloads generated from events.proto.
+package eventspb
+
+import (
+	_ "embed"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative events.proto
+
+// Schema is the source of events.proto, registered as the schema of every topic.
+//
+//go:embed events.proto
+var Schema string
@@ -0,0 +1,36 @@
+package events
+
+import (
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events/eventspb"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufMessages returns the protobuf messages of the topic payloads by topic names. They follow
+// the JSON encoding of the payloads, see kafka.NewProtobufCodec, and evolve along with them.
+func ProtobufMessages() map[string]proto.Message {
+	return map[string]proto.Message{
+		TopicNewOrders:          &eventspb.NewOrder{},
+		TopicSavedOrders:        &eventspb.Order{},
+		TopicReservedOrders:     &eventspb.Order{},
+		TopicPendingPayments:    &eventspb.Payment{},
+		TopicReceipts:           &eventspb.Receipt{},
+		TopicPaidPayments:       &eventspb.Payment{},
+		TopicPaidOrders:         &eventspb.Order{},
+		TopicCollectedOrders:    &eventspb.CollectedOrder{},
+		TopicReset:              &eventspb.ResetMsg{},
+		TopicCancel:             &eventspb.CancelMsg{},
+		TopicCheck:              &eventspb.Check{},
+		TopicEmailNotifications: &eventspb.EmailNotification{},
+	}
+}
+
+// ProtobufSchemas returns the .proto schemas of the topic payloads by topic names,
+// all the messages are defined in a single one.
+func ProtobufSchemas() map[string]string {
+	schemas := make(map[string]string, len(payloads))
+	for topic := range payloads {
+		schemas[topic] = eventspb.Schema
+	}
+
+	return schemas
+}
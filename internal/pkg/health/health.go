@@ -0,0 +1,164 @@
+// Package health serves liveness and readiness probes of a service.
+//
+// Liveness checks tell whether the service is wedged and a restart would help, so they look at
+// the process only: restarts do not bring dependencies back, and failing liveness on a broker outage
+// would restart every instance at once. With no checks /healthz tells that the process serves requests.
+// Readiness checks tell whether the service dependencies are up, so it can take traffic, e.g. its
+// consumer is a member of the consumer group.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is a reasonable time for a check to complete, well below probe timeouts.
+const DefaultTimeout = 2 * time.Second
+
+// Pinger is implemented by dependencies that can be checked.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// CheckFunc adapts a function to Pinger.
+type CheckFunc func(ctx context.Context) error
+
+// Ping calls f(ctx).
+func (f CheckFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+type check struct {
+	name   string
+	pinger Pinger
+}
+
+// Checker runs registered checks and serves their results.
+type Checker struct {
+	timeout time.Duration
+
+	mu        sync.RWMutex
+	liveness  []check
+	readiness []check
+}
+
+// NewChecker creates an instance of Checker. Each check is given timeout to complete.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+	}
+}
+
+// AddLiveness adds a check served by /healthz.
+func (c *Checker) AddLiveness(name string, p Pinger) {
+	c.mu.Lock()
+	c.liveness = append(c.liveness, check{name: name, pinger: p})
+	c.mu.Unlock()
+}
+
+// AddReadiness adds a check served by /readyz.
+func (c *Checker) AddReadiness(name string, p Pinger) {
+	c.mu.Lock()
+	c.readiness = append(c.readiness, check{name: name, pinger: p})
+	c.mu.Unlock()
+}
+
+// Register serves liveness checks on /healthz and readiness checks on /readyz.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		checks := c.liveness
+		c.mu.RUnlock()
+
+		c.serve(w, r, checks)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		checks := c.readiness
+		c.mu.RUnlock()
+
+		c.serve(w, r, checks)
+	})
+}
+
+// Status is a probe response.
+type Status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+const statusOK = "ok"
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, checks []check) {
+	ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+	defer cancel()
+
+	status := Status{
+		Status: statusOK,
+		Checks: c.run(ctx, checks),
+	}
+
+	code := http.StatusOK
+	for _, result := range status.Checks {
+		if result != statusOK {
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logger.Error(r.Context(), "write health status", logger.Err(err))
+	}
+}
+
+// run runs the checks concurrently. A check that does not return in time is reported failed.
+func (c *Checker) run(ctx context.Context, checks []check) map[string]string {
+	results := make(map[string]string, len(checks))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ch := range checks {
+		ch := ch
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := ping(ctx, ch.pinger)
+
+			result := statusOK
+			if err != nil {
+				result = err.Error()
+			}
+
+			mu.Lock()
+			results[ch.name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func ping(ctx context.Context, p Pinger) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.Ping(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	}
+}
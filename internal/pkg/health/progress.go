@@ -0,0 +1,56 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Progress is a liveness check of work done in steps, e.g. handling messages or relaying the outbox:
+// it fails once a step has been in progress longer than the threshold, i.e. the work is stuck.
+// Idle work is alive, so a service without traffic is not restarted.
+type Progress struct {
+	threshold time.Duration
+
+	mu    sync.Mutex
+	next  uint64
+	steps map[uint64]time.Time
+}
+
+// NewProgress creates an instance of Progress failing on steps taking longer than threshold.
+func NewProgress(threshold time.Duration) *Progress {
+	return &Progress{
+		threshold: threshold,
+		steps:     make(map[uint64]time.Time),
+	}
+}
+
+// Begin records the start of a step and returns the function recording its end.
+func (p *Progress) Begin() (end func()) {
+	p.mu.Lock()
+	id := p.next
+	p.next++
+	p.steps[id] = time.Now()
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		delete(p.steps, id)
+		p.mu.Unlock()
+	}
+}
+
+// Ping fails if a step has been in progress longer than the threshold.
+func (p *Progress) Ping(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, start := range p.steps {
+		if took := time.Since(start); took > p.threshold {
+			return fmt.Errorf("step in progress for %s, longer than %s", took.Round(time.Second), p.threshold)
+		}
+	}
+
+	return nil
+}
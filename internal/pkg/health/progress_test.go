@@ -0,0 +1,34 @@
+package health_test
+
+import (
+	"context"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	p := health.NewProgress(10 * time.Millisecond)
+
+	if err := p.Ping(ctx); err != nil {
+		t.Fatalf("idle: %v", err)
+	}
+
+	end := p.Begin()
+	if err := p.Ping(ctx); err != nil {
+		t.Fatalf("step in progress: %v", err)
+	}
+
+	stuck := p.Begin()
+	time.Sleep(20 * time.Millisecond)
+	end()
+	if err := p.Ping(ctx); err == nil {
+		t.Fatal("step stuck: got no error")
+	}
+
+	stuck()
+	if err := p.Ping(ctx); err != nil {
+		t.Fatalf("stuck step ended: %v", err)
+	}
+}
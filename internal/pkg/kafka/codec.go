@@ -0,0 +1,185 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/schemaregistry"
+	"sync"
+)
+
+// HeaderContentType holds the content type of a message value, see Codec.
+const HeaderContentType = "content-type"
+
+// Content types of the codecs.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeAvro     = "application/avro"
+)
+
+// Codec encodes and decodes values of topic messages.
+type Codec interface {
+	ContentType() string
+	Marshal(ctx context.Context, topic string, v interface{}) ([]byte, error)
+	Unmarshal(ctx context.Context, topic string, data []byte, v interface{}) error
+}
+
+// CodecOption configures codecs.
+type CodecOption func(o *codecOptions)
+
+type codecOptions struct {
+	registry schemaregistry.Client
+}
+
+// WithSchemaRegistry makes a codec register the topic schemas in a registry and frame payloads
+// with the schema ids, see schemaregistry.Frame.
+func WithSchemaRegistry(c schemaregistry.Client) CodecOption {
+	return func(o *codecOptions) {
+		o.registry = c
+	}
+}
+
+type jsonCodec struct{}
+
+// NewJSONCodec creates an instance of jsonCodec. It is the codec used unless another one is configured.
+func NewJSONCodec() *jsonCodec {
+	return &jsonCodec{}
+}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(_ context.Context, _ string, v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: marshal: %v", ErrInvalidArgument, err)
+	}
+
+	return b, nil
+}
+
+func (jsonCodec) Unmarshal(_ context.Context, _ string, data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidArgument, err)
+	}
+
+	return nil
+}
+
+// unsupportedCodec fails to decode messages of an unknown content type.
+type unsupportedCodec struct {
+	contentType string
+}
+
+func (c unsupportedCodec) ContentType() string {
+	return c.contentType
+}
+
+func (c unsupportedCodec) Marshal(context.Context, string, interface{}) ([]byte, error) {
+	return nil, fmt.Errorf("%w: unsupported content type %q", ErrInvalidArgument, c.contentType)
+}
+
+func (c unsupportedCodec) Unmarshal(context.Context, string, []byte, interface{}) error {
+	return fmt.Errorf("%w: unsupported content type %q", ErrInvalidArgument, c.contentType)
+}
+
+// Codecs selects a codec by the content type of a message.
+type Codecs map[string]Codec
+
+// NewCodecs creates Codecs of the JSON codec and the given ones.
+func NewCodecs(codecs ...Codec) Codecs {
+	cs := Codecs{ContentTypeJSON: NewJSONCodec()}
+	for _, c := range codecs {
+		cs[c.ContentType()] = c
+	}
+
+	return cs
+}
+
+// ForHeaders returns the codec of the message content type, JSON if the message has none.
+func (cs Codecs) ForHeaders(headers []*sarama.RecordHeader) Codec {
+	contentType := ContentTypeJSON
+	for _, h := range headers {
+		if h != nil && string(h.Key) == HeaderContentType {
+			contentType = string(h.Value)
+			break
+		}
+	}
+
+	if c, ok := cs[contentType]; ok {
+		return c
+	}
+
+	return unsupportedCodec{contentType: contentType}
+}
+
+type codecCtxKey struct{}
+
+// ContextWithCodec returns a copy of ctx carrying the codec of the message being handled.
+func ContextWithCodec(ctx context.Context, c Codec) context.Context {
+	return context.WithValue(ctx, codecCtxKey{}, c)
+}
+
+// CodecFromContext returns the codec ctx carries, JSON if none.
+func CodecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecCtxKey{}).(Codec); ok {
+		return c
+	}
+
+	return NewJSONCodec()
+}
+
+// Decode decodes a value of a topic message with the codec ctx carries, see CodecFromContext.
+func Decode(ctx context.Context, topic string, data []byte, v interface{}) error {
+	return CodecFromContext(ctx).Unmarshal(ctx, topic, data, v)
+}
+
+// schemaIDs registers topic schemas in a registry once and caches their ids.
+type schemaIDs struct {
+	registry   schemaregistry.Client
+	schemaType string
+	schemas    map[string]string
+
+	mu  sync.RWMutex
+	ids map[string]int
+}
+
+func newSchemaIDs(registry schemaregistry.Client, schemaType string, schemas map[string]string) *schemaIDs {
+	return &schemaIDs{
+		registry:   registry,
+		schemaType: schemaType,
+		schemas:    schemas,
+		ids:        make(map[string]int),
+	}
+}
+
+func (s *schemaIDs) id(ctx context.Context, topic string) (int, error) {
+	s.mu.RLock()
+	id, ok := s.ids[topic]
+	s.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	schema, ok := s.schemas[topic]
+	if !ok {
+		return 0, fmt.Errorf("%w: no schema of topic %s", ErrInvalidArgument, topic)
+	}
+
+	id, err := s.registry.Register(ctx, schemaregistry.Subject(topic), schemaregistry.Schema{
+		Type:   s.schemaType,
+		Schema: schema,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%w: register schema: %v", ErrInternal, err)
+	}
+
+	s.mu.Lock()
+	s.ids[topic] = id
+	s.mu.Unlock()
+
+	return id, nil
+}
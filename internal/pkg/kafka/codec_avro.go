@@ -0,0 +1,150 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/schemaregistry"
+	"sync"
+)
+
+// avroCodec encodes values with Avro through their JSON encoding, so values are shaped with json tags
+// and the schemas must match it: a time.Time is a string, for example. Values having fields missing
+// from the schema are refused, so a payload cannot outgrow its schema. Schemas with unions, i.e.
+// nullable fields, are not supported, as their Avro JSON encoding differs from the plain one.
+type avroCodec struct {
+	codecs map[string]*goavro.Codec
+	ids    *schemaIDs
+	opts   codecOptions
+
+	mu   sync.RWMutex
+	byID map[int]*goavro.Codec
+}
+
+// NewAvroCodec creates an instance of avroCodec encoding messages of each topic with its schema.
+// With a schema registry messages are decoded with the schema they were encoded with, so the
+// consumers keep up with the producers having evolved the schema.
+func NewAvroCodec(schemas map[string]string, opts ...CodecOption) (*avroCodec, error) {
+	c := &avroCodec{
+		codecs: make(map[string]*goavro.Codec, len(schemas)),
+		byID:   make(map[int]*goavro.Codec),
+	}
+
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+
+	for topic, schema := range schemas {
+		codec, err := goavro.NewCodec(schema)
+		if err != nil {
+			return nil, fmt.Errorf("%w: schema of topic %s: %v", ErrInvalidArgument, topic, err)
+		}
+		c.codecs[topic] = codec
+	}
+
+	if c.opts.registry != nil {
+		c.ids = newSchemaIDs(c.opts.registry, schemaregistry.TypeAvro, schemas)
+	}
+
+	return c, nil
+}
+
+func (c *avroCodec) ContentType() string {
+	return ContentTypeAvro
+}
+
+func (c *avroCodec) Marshal(ctx context.Context, topic string, v interface{}) ([]byte, error) {
+	codec, ok := c.codecs[topic]
+	if !ok {
+		return nil, fmt.Errorf("%w: no avro schema of topic %s", ErrInvalidArgument, topic)
+	}
+
+	textual, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: marshal: %v", ErrInvalidArgument, err)
+	}
+
+	native, _, err := codec.NativeFromTextual(textual)
+	if err != nil {
+		return nil, fmt.Errorf("%w: value does not match the schema: %v", ErrInvalidArgument, err)
+	}
+
+	b, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, fmt.Errorf("%w: encode: %v", ErrInvalidArgument, err)
+	}
+
+	if c.ids == nil {
+		return b, nil
+	}
+
+	id, err := c.ids.id(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return schemaregistry.Frame(id, b), nil
+}
+
+func (c *avroCodec) Unmarshal(ctx context.Context, topic string, data []byte, v interface{}) error {
+	var codec *goavro.Codec
+	if c.opts.registry != nil {
+		id, payload, err := schemaregistry.Unframe(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+
+		if codec, err = c.writerCodec(ctx, id); err != nil {
+			return err
+		}
+		data = payload
+	} else {
+		var ok bool
+		if codec, ok = c.codecs[topic]; !ok {
+			return fmt.Errorf("%w: no avro schema of topic %s", ErrInvalidArgument, topic)
+		}
+	}
+
+	native, _, err := codec.NativeFromBinary(data)
+	if err != nil {
+		return fmt.Errorf("%w: decode: %v", ErrInvalidArgument, err)
+	}
+
+	textual, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return fmt.Errorf("%w: decode: %v", ErrInvalidArgument, err)
+	}
+
+	if err := json.Unmarshal(textual, v); err != nil {
+		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidArgument, err)
+	}
+
+	return nil
+}
+
+// writerCodec returns the codec of the registered schema with the id.
+func (c *avroCodec) writerCodec(ctx context.Context, id int) (*goavro.Codec, error) {
+	c.mu.RLock()
+	codec, ok := c.byID[id]
+	c.mu.RUnlock()
+	if ok {
+		return codec, nil
+	}
+
+	schema, err := c.opts.registry.GetSchema(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get schema: %v", ErrInternal, err)
+	}
+
+	codec, err = goavro.NewCodec(schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: schema %d: %v", ErrInvalidArgument, id, err)
+	}
+
+	c.mu.Lock()
+	c.byID[id] = codec
+	c.mu.Unlock()
+
+	return codec, nil
+}
@@ -0,0 +1,223 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/schemaregistry"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// protobufCodec encodes values implementing proto.Message as they are. Other values are encoded
+// as the message of their topic through their JSON encoding, like with avroCodec: values are shaped
+// with json tags, which must be the names of the message fields, and a time.Time is a string.
+// Values having fields missing from the message are refused, so a payload cannot outgrow its schema.
+type protobufCodec struct {
+	messages map[string]proto.Message
+	ids      *schemaIDs
+	opts     codecOptions
+}
+
+// NewProtobufCodec creates an instance of protobufCodec encoding values of each topic as its message
+// in messages. The .proto schemas of the topics are registered with a schema registry, they are not
+// needed without one. A topic message must be defined in its schema, as it is referenced by its
+// indexes in the schema in the framed payloads.
+func NewProtobufCodec(schemas map[string]string, messages map[string]proto.Message, opts ...CodecOption) *protobufCodec {
+	c := &protobufCodec{messages: messages}
+
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+
+	if c.opts.registry != nil {
+		c.ids = newSchemaIDs(c.opts.registry, schemaregistry.TypeProtobuf, schemas)
+	}
+
+	return c
+}
+
+func (c *protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (c *protobufCodec) Marshal(ctx context.Context, topic string, v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		var err error
+		if m, err = c.fromJSON(topic, v); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: marshal: %v", ErrInvalidArgument, err)
+	}
+
+	if c.ids == nil {
+		return b, nil
+	}
+
+	id, err := c.ids.id(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return schemaregistry.Frame(id, append(messageIndexes(m.ProtoReflect().Descriptor()), b...)), nil
+}
+
+func (c *protobufCodec) Unmarshal(_ context.Context, topic string, data []byte, v interface{}) error {
+	if c.ids != nil {
+		_, payload, err := schemaregistry.Unframe(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+
+		if data, err = skipMessageIndexes(payload); err != nil {
+			return err
+		}
+	}
+
+	if m, ok := v.(proto.Message); ok {
+		if err := proto.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("%w: unmarshal: %v", ErrInvalidArgument, err)
+		}
+		return nil
+	}
+
+	m, err := c.newMessage(topic)
+	if err != nil {
+		return err
+	}
+
+	if err := proto.Unmarshal(data, m); err != nil {
+		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidArgument, err)
+	}
+
+	textual, err := json.Marshal(jsonFields(m.ProtoReflect()))
+	if err != nil {
+		return fmt.Errorf("%w: decode: %v", ErrInvalidArgument, err)
+	}
+
+	if err := json.Unmarshal(textual, v); err != nil {
+		return fmt.Errorf("%w: unmarshal: %v", ErrInvalidArgument, err)
+	}
+
+	return nil
+}
+
+// newMessage returns a new message of the topic.
+func (c *protobufCodec) newMessage(topic string) (proto.Message, error) {
+	m, ok := c.messages[topic]
+	if !ok {
+		return nil, fmt.Errorf("%w: no protobuf message of topic %s", ErrInvalidArgument, topic)
+	}
+
+	return m.ProtoReflect().New().Interface(), nil
+}
+
+// fromJSON returns the topic message holding v through its JSON encoding.
+func (c *protobufCodec) fromJSON(topic string, v interface{}) (proto.Message, error) {
+	m, err := c.newMessage(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	textual, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: marshal: %v", ErrInvalidArgument, err)
+	}
+
+	if err := protojson.Unmarshal(textual, m); err != nil {
+		return nil, fmt.Errorf("%w: value does not match the message: %v", ErrInvalidArgument, err)
+	}
+
+	return m, nil
+}
+
+// jsonFields returns the populated fields of the message by their names, shaped the way encoding/json
+// decodes them into the values. protojson does not fit, as it encodes 64-bit integers as strings.
+func jsonFields(m protoreflect.Message) map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList():
+			list := v.List()
+			values := make([]interface{}, list.Len())
+			for i := range values {
+				values[i] = jsonValue(fd, list.Get(i))
+			}
+			fields[string(fd.Name())] = values
+		case fd.IsMap():
+			values := make(map[string]interface{})
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				values[k.String()] = jsonValue(fd.MapValue(), v)
+				return true
+			})
+			fields[string(fd.Name())] = values
+		default:
+			fields[string(fd.Name())] = jsonValue(fd, v)
+		}
+		return true
+	})
+
+	return fields
+}
+
+// jsonValue returns a singular value of the field, see jsonFields.
+func jsonValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return jsonFields(v.Message())
+	case protoreflect.EnumKind:
+		return int32(v.Enum())
+	default:
+		return v.Interface()
+	}
+}
+
+// messageIndexes returns the zigzag varint encoded indexes of the message in its schema, i.e. the index
+// of the top level message followed by the indexes of the nested ones, preceded by their count.
+// The indexes [0] of the first message are a single zero.
+func messageIndexes(md protoreflect.MessageDescriptor) []byte {
+	var indexes []int
+	for d := protoreflect.Descriptor(md); d != nil; d = d.Parent() {
+		if _, ok := d.(protoreflect.MessageDescriptor); ok {
+			indexes = append([]int{d.Index()}, indexes...)
+		}
+	}
+
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return []byte{0}
+	}
+
+	b := make([]byte, 0, binary.MaxVarintLen64*(len(indexes)+1))
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, i := range append([]int{len(indexes)}, indexes...) {
+		b = append(b, buf[:binary.PutVarint(buf, int64(i))]...)
+	}
+
+	return b
+}
+
+// skipMessageIndexes skips the zigzag varint encoded count and indexes of the message in its schema.
+func skipMessageIndexes(data []byte) ([]byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return nil, fmt.Errorf("%w: malformed message indexes", ErrInvalidArgument)
+	}
+	data = data[n:]
+
+	for i := int64(0); i < count; i++ {
+		if _, n = binary.Varint(data); n <= 0 {
+			return nil, fmt.Errorf("%w: malformed message indexes", ErrInvalidArgument)
+		}
+		data = data[n:]
+	}
+
+	return data, nil
+}
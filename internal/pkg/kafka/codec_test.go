@@ -0,0 +1,196 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/events/eventspb"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/schemaregistry"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+)
+
+const (
+	paymentV1 = `{"type": "record", "name": "Payment", "fields": [
+		{"name": "order_id", "type": "long"}
+	]}`
+	paymentV2 = `{"type": "record", "name": "Payment", "fields": [
+		{"name": "order_id", "type": "long"},
+		{"name": "total", "type": "double", "default": 0}
+	]}`
+	paymentV3 = `{"type": "record", "name": "Payment", "fields": [
+		{"name": "order_id", "type": "long"},
+		{"name": "total", "type": "double", "default": 0},
+		{"name": "currency", "type": "string"}
+	]}`
+)
+
+type payment struct {
+	OrderID uint64  `json:"order_id"`
+	Total   float64 `json:"total"`
+}
+
+func TestAvroCodecEvolution(t *testing.T) {
+	ctx := context.Background()
+	registry := schemaregistry.NewMemory()
+
+	v1, err := kafka.NewAvroCodec(map[string]string{"payments": paymentV1}, kafka.WithSchemaRegistry(registry))
+	if err != nil {
+		t.Fatalf("v1 codec: %v", err)
+	}
+
+	v2, err := kafka.NewAvroCodec(map[string]string{"payments": paymentV2}, kafka.WithSchemaRegistry(registry))
+	if err != nil {
+		t.Fatalf("v2 codec: %v", err)
+	}
+
+	old, err := v1.Marshal(ctx, "payments", map[string]interface{}{"order_id": 7})
+	if err != nil {
+		t.Fatalf("marshal v1: %v", err)
+	}
+
+	b, err := v2.Marshal(ctx, "payments", payment{OrderID: 8, Total: 99.5})
+	if err != nil {
+		t.Fatalf("marshal v2: %v", err)
+	}
+
+	var got payment
+	if err := v2.Unmarshal(ctx, "payments", old, &got); err != nil {
+		t.Fatalf("unmarshal v1 with v2: %v", err)
+	}
+	if got != (payment{OrderID: 7}) {
+		t.Errorf("unmarshal v1 with v2: got %+v", got)
+	}
+
+	if _, err := v1.Marshal(ctx, "payments", payment{OrderID: 8, Total: 99.5}); !errors.Is(err, kafka.ErrInvalidArgument) {
+		t.Errorf("marshal v2 with v1: got %v, want %v", err, kafka.ErrInvalidArgument)
+	}
+
+	got = payment{}
+	if err := v1.Unmarshal(ctx, "payments", b, &got); err != nil {
+		t.Fatalf("unmarshal v2 with v1: %v", err)
+	}
+	if got != (payment{OrderID: 8, Total: 99.5}) {
+		t.Errorf("unmarshal v2 with v1: got %+v", got)
+	}
+
+	v3, err := kafka.NewAvroCodec(map[string]string{"payments": paymentV3}, kafka.WithSchemaRegistry(registry))
+	if err != nil {
+		t.Fatalf("v3 codec: %v", err)
+	}
+
+	_, err = v3.Marshal(ctx, "payments", map[string]interface{}{"order_id": 9, "total": 1, "currency": "RUB"})
+	if err == nil {
+		t.Fatal("marshal v3: schema adding a field without a default is registered")
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	ctx := context.Background()
+
+	codec := kafka.NewProtobufCodec(
+		map[string]string{"names": `syntax = "proto3"; message StringValue { string value = 1; }`},
+		nil,
+		kafka.WithSchemaRegistry(schemaregistry.NewMemory()),
+	)
+
+	b, err := codec.Marshal(ctx, "names", wrapperspb.String("order"))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var got wrapperspb.StringValue
+	if err := codec.Unmarshal(ctx, "names", b, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !proto.Equal(&got, wrapperspb.String("order")) {
+		t.Errorf("unmarshal: got %v", &got)
+	}
+
+	if _, err := codec.Marshal(ctx, "names", "order"); !errors.Is(err, kafka.ErrInvalidArgument) {
+		t.Errorf("marshal a value of a topic without a message: got %v, want %v", err, kafka.ErrInvalidArgument)
+	}
+}
+
+func TestProtobufCodecValues(t *testing.T) {
+	ctx := context.Background()
+
+	codec := kafka.NewProtobufCodec(
+		map[string]string{"payments": eventspb.Schema},
+		map[string]proto.Message{"payments": &eventspb.Payment{}},
+		kafka.WithSchemaRegistry(schemaregistry.NewMemory()),
+	)
+
+	want := payment{OrderID: 1 << 60, Total: 99.5}
+
+	b, err := codec.Marshal(ctx, "payments", want)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// Payment is the fourth message of its schema, so its indexes are [3], zigzag encoded
+	// along with their count after the magic byte and the schema id.
+	if len(b) < 7 || b[5] != 2 || b[6] != 6 {
+		t.Errorf("message indexes: got %v, want [2 6]", b[5:])
+	}
+
+	var got payment
+	if err := codec.Unmarshal(ctx, "payments", b, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got != want {
+		t.Errorf("unmarshal: got %+v, want %+v", got, want)
+	}
+
+	// The message of the topic decodes the payload a value has been encoded to.
+	var m eventspb.Payment
+	if err := codec.Unmarshal(ctx, "payments", b, &m); err != nil {
+		t.Fatalf("unmarshal message: %v", err)
+	}
+	if m.OrderId != want.OrderID || m.Total != want.Total {
+		t.Errorf("unmarshal message: got %v, want %+v", &m, want)
+	}
+
+	if _, err := codec.Marshal(ctx, "payments", map[string]interface{}{"order_id": 1, "currency": "RUB"}); !errors.Is(err, kafka.ErrInvalidArgument) {
+		t.Errorf("marshal a value outgrowing the message: got %v, want %v", err, kafka.ErrInvalidArgument)
+	}
+
+	if err := codec.Unmarshal(ctx, "names", b, &got); !errors.Is(err, kafka.ErrInvalidArgument) {
+		t.Errorf("unmarshal a value of a topic without a message: got %v, want %v", err, kafka.ErrInvalidArgument)
+	}
+}
+
+func TestCodecsForHeaders(t *testing.T) {
+	codecs := kafka.NewCodecs(kafka.NewProtobufCodec(nil, nil))
+
+	tests := []struct {
+		name        string
+		headers     []*sarama.RecordHeader
+		contentType string
+	}{
+		{"no content type", nil, kafka.ContentTypeJSON},
+		{"json", contentType(kafka.ContentTypeJSON), kafka.ContentTypeJSON},
+		{"protobuf", contentType(kafka.ContentTypeProtobuf), kafka.ContentTypeProtobuf},
+		{"unknown", contentType("text/plain"), "text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codecs.ForHeaders(tt.headers).ContentType(); got != tt.contentType {
+				t.Errorf("got %s, want %s", got, tt.contentType)
+			}
+		})
+	}
+
+	var v interface{}
+	err := codecs.ForHeaders(contentType("text/plain")).Unmarshal(context.Background(), "names", []byte("order"), &v)
+	if !errors.Is(err, kafka.ErrInvalidArgument) {
+		t.Errorf("unmarshal unknown content type: got %v, want %v", err, kafka.ErrInvalidArgument)
+	}
+}
+
+func contentType(v string) []*sarama.RecordHeader {
+	return []*sarama.RecordHeader{{Key: []byte(kafka.HeaderContentType), Value: []byte(v)}}
+}
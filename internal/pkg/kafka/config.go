@@ -0,0 +1,150 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"os"
+)
+
+// NewSaramaConfig creates a sarama config of the clients according to the kafka configuration.
+func NewSaramaConfig(cfg util.KafkaConfig) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+
+	if cfg.ClientID != "" {
+		c.ClientID = cfg.ClientID
+	}
+
+	if cfg.Version != "" {
+		v, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, fmt.Errorf("%w: version: %v", ErrInvalidArgument, err)
+		}
+		c.Version = v
+	}
+
+	if cfg.TLS.Enabled {
+		tlsCfg, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tlsCfg
+	}
+
+	if cfg.SASL.Mechanism != "" {
+		c.Net.SASL.Enable = true
+		c.Net.SASL.User = cfg.SASL.User
+		c.Net.SASL.Password = cfg.SASL.Password
+
+		switch cfg.SASL.Mechanism {
+		case "plain":
+			c.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "scram-sha-256":
+			c.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			c.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClient(scramSHA256)
+		case "scram-sha-512":
+			c.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			c.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClient(scramSHA512)
+		default:
+			return nil, fmt.Errorf("%w: unknown sasl mechanism %q", ErrInvalidArgument, cfg.SASL.Mechanism)
+		}
+	}
+
+	if err := applyConsumerConfig(c, cfg.Consumer); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	return c, nil
+}
+
+func applyConsumerConfig(c *sarama.Config, cfg util.KafkaConsumerConfig) error {
+	switch cfg.InitialOffset {
+	case "":
+	case "oldest":
+		c.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		c.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		return fmt.Errorf("%w: unknown initial offset %q", ErrInvalidArgument, cfg.InitialOffset)
+	}
+
+	switch cfg.IsolationLevel {
+	case "":
+	case "read_uncommitted":
+		c.Consumer.IsolationLevel = sarama.ReadUncommitted
+	case "read_committed":
+		c.Consumer.IsolationLevel = sarama.ReadCommitted
+	default:
+		return fmt.Errorf("%w: unknown isolation level %q", ErrInvalidArgument, cfg.IsolationLevel)
+	}
+
+	switch cfg.Rebalance {
+	case "":
+	case "range":
+		c.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+	case "roundrobin":
+		c.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
+	case "sticky":
+		c.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
+	default:
+		return fmt.Errorf("%w: unknown rebalance strategy %q", ErrInvalidArgument, cfg.Rebalance)
+	}
+
+	if cfg.SessionTimeout > 0 {
+		c.Consumer.Group.Session.Timeout = cfg.SessionTimeout
+	}
+	if cfg.HeartbeatInterval > 0 {
+		c.Consumer.Group.Heartbeat.Interval = cfg.HeartbeatInterval
+	}
+	if cfg.FetchMin > 0 {
+		c.Consumer.Fetch.Min = cfg.FetchMin
+	}
+	if cfg.FetchDefault > 0 {
+		c.Consumer.Fetch.Default = cfg.FetchDefault
+	}
+	if cfg.FetchMax > 0 {
+		c.Consumer.Fetch.Max = cfg.FetchMax
+	}
+	if cfg.MaxWaitTime > 0 {
+		c.Consumer.MaxWaitTime = cfg.MaxWaitTime
+	}
+
+	return nil
+}
+
+func newTLSConfig(cfg util.KafkaTLSConfig) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: read tls ca: %v", ErrInvalidArgument, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: no certificates in tls ca %s", ErrInvalidArgument, cfg.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: load tls certificate: %v", ErrInvalidArgument, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,318 @@
+package kafka_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed PEM certificate and its key to dir and returns their paths.
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func TestNewSaramaConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+
+	notPEM := filepath.Join(dir, "not.pem")
+	writeFile(t, notPEM, []byte("not a certificate"))
+
+	for _, tc := range []struct {
+		name  string
+		tls   util.KafkaTLSConfig
+		err   error
+		check func(t *testing.T, c *tls.Config)
+	}{
+		{
+			name: "disabled",
+			tls:  util.KafkaTLSConfig{CAFile: "missing.pem"},
+			check: func(t *testing.T, c *tls.Config) {
+				if c != nil {
+					t.Fatal("tls config: got one, want none")
+				}
+			},
+		},
+		{
+			name: "system pool",
+			tls:  util.KafkaTLSConfig{Enabled: true},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.RootCAs != nil {
+					t.Fatal("root CAs: got a pool, want the system one")
+				}
+				if c.MinVersion != tls.VersionTLS12 {
+					t.Fatalf("min version: got %x, want %x", c.MinVersion, tls.VersionTLS12)
+				}
+			},
+		},
+		{
+			name: "ca and client certificate",
+			tls:  util.KafkaTLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true},
+			check: func(t *testing.T, c *tls.Config) {
+				if c.RootCAs == nil {
+					t.Fatal("root CAs: got the system pool, want the CA file")
+				}
+				if len(c.Certificates) != 1 {
+					t.Fatalf("client certificates: got %d, want 1", len(c.Certificates))
+				}
+				if !c.InsecureSkipVerify {
+					t.Fatal("insecure skip verify: not set")
+				}
+			},
+		},
+		{
+			name: "missing ca",
+			tls:  util.KafkaTLSConfig{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")},
+			err:  kafka.ErrInvalidArgument,
+		},
+		{
+			name: "no certificates in ca",
+			tls:  util.KafkaTLSConfig{Enabled: true, CAFile: notPEM},
+			err:  kafka.ErrInvalidArgument,
+		},
+		{
+			name: "client key mismatch",
+			tls:  util.KafkaTLSConfig{Enabled: true, CertFile: certFile, KeyFile: notPEM},
+			err:  kafka.ErrInvalidArgument,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := kafka.NewSaramaConfig(util.KafkaConfig{Brokers: []string{"kafka:9092"}, TLS: tc.tls})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("new config: got %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if c.Net.TLS.Enable != tc.tls.Enabled {
+				t.Fatalf("tls enabled: got %t, want %t", c.Net.TLS.Enable, tc.tls.Enabled)
+			}
+			tc.check(t, c.Net.TLS.Config)
+		})
+	}
+}
+
+func TestNewSaramaConfigSASL(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		mechanism string
+		want      sarama.SASLMechanism
+		hash      scram.HashGeneratorFcn
+		err       error
+	}{
+		{name: "none"},
+		{name: "plain", mechanism: "plain", want: sarama.SASLTypePlaintext},
+		{name: "scram-sha-256", mechanism: "scram-sha-256", want: sarama.SASLTypeSCRAMSHA256, hash: scram.SHA256},
+		{name: "scram-sha-512", mechanism: "scram-sha-512", want: sarama.SASLTypeSCRAMSHA512, hash: scram.SHA512},
+		{name: "unknown", mechanism: "gssapi", err: kafka.ErrInvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := kafka.NewSaramaConfig(util.KafkaConfig{
+				Brokers: []string{"kafka:9092"},
+				SASL:    util.KafkaSASLConfig{Mechanism: tc.mechanism, User: "stock", Password: "secret"},
+			})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("new config: got %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if enabled := tc.mechanism != ""; c.Net.SASL.Enable != enabled {
+				t.Fatalf("sasl enabled: got %t, want %t", c.Net.SASL.Enable, enabled)
+			}
+			if !c.Net.SASL.Enable {
+				return
+			}
+
+			if c.Net.SASL.Mechanism != tc.want {
+				t.Fatalf("mechanism: got %s, want %s", c.Net.SASL.Mechanism, tc.want)
+			}
+			if c.Net.SASL.User != "stock" || c.Net.SASL.Password != "secret" {
+				t.Fatalf("credentials: got %s/%s, want stock/secret", c.Net.SASL.User, c.Net.SASL.Password)
+			}
+
+			if tc.hash == nil {
+				if c.Net.SASL.SCRAMClientGeneratorFunc != nil {
+					t.Fatal("scram client generator: got one, want none")
+				}
+				return
+			}
+			if err := authenticate(c.Net.SASL.SCRAMClientGeneratorFunc(), tc.hash, "stock", "secret"); err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if err := authenticate(c.Net.SASL.SCRAMClientGeneratorFunc(), tc.hash, "stock", "wrong"); err == nil {
+				t.Fatal("authenticate with a wrong password: got no error")
+			}
+		})
+	}
+}
+
+// authenticate runs a SCRAM conversation of client with a server using hash and knowing "secret" as the user's password.
+func authenticate(client sarama.SCRAMClient, hash scram.HashGeneratorFcn, user, password string) error {
+	creds, err := hash.NewClient(user, "secret", "")
+	if err != nil {
+		return err
+	}
+	stored := creds.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+
+	server, err := hash.NewServer(func(string) (scram.StoredCredentials, error) {
+		return stored, nil
+	})
+	if err != nil {
+		return err
+	}
+	conv := server.NewConversation()
+
+	if err := client.Begin(user, password, ""); err != nil {
+		return err
+	}
+
+	var challenge string
+	for !client.Done() {
+		msg, err := client.Step(challenge)
+		if err != nil {
+			return err
+		}
+		if client.Done() {
+			break
+		}
+
+		if challenge, err = conv.Step(msg); err != nil {
+			return err
+		}
+	}
+
+	if !conv.Valid() {
+		return errors.New("server: conversation not valid")
+	}
+
+	return nil
+}
+
+func TestNewSaramaConfigConsumer(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		consumer util.KafkaConsumerConfig
+		err      error
+		check    func(t *testing.T, c *sarama.Config)
+	}{
+		{
+			name:     "oldest read committed sticky",
+			consumer: util.KafkaConsumerConfig{InitialOffset: "oldest", IsolationLevel: "read_committed", Rebalance: "sticky"},
+			check: func(t *testing.T, c *sarama.Config) {
+				if c.Consumer.Offsets.Initial != sarama.OffsetOldest {
+					t.Fatalf("initial offset: got %d, want %d", c.Consumer.Offsets.Initial, sarama.OffsetOldest)
+				}
+				if c.Consumer.IsolationLevel != sarama.ReadCommitted {
+					t.Fatalf("isolation level: got %d, want %d", c.Consumer.IsolationLevel, sarama.ReadCommitted)
+				}
+				if c.Consumer.Group.Rebalance.Strategy.Name() != sarama.StickyBalanceStrategyName {
+					t.Fatalf("rebalance: got %s, want %s", c.Consumer.Group.Rebalance.Strategy.Name(), sarama.StickyBalanceStrategyName)
+				}
+			},
+		},
+		{
+			name:     "timeouts and fetch sizes",
+			consumer: util.KafkaConsumerConfig{SessionTimeout: 30 * time.Second, HeartbeatInterval: 5 * time.Second, FetchMin: 10, FetchDefault: 1 << 20, FetchMax: 1 << 24, MaxWaitTime: time.Second},
+			check: func(t *testing.T, c *sarama.Config) {
+				g := c.Consumer.Group
+				if g.Session.Timeout != 30*time.Second || g.Heartbeat.Interval != 5*time.Second {
+					t.Fatalf("session timeout, heartbeat: got %s, %s, want 30s, 5s", g.Session.Timeout, g.Heartbeat.Interval)
+				}
+				f := c.Consumer.Fetch
+				if f.Min != 10 || f.Default != 1<<20 || f.Max != 1<<24 || c.Consumer.MaxWaitTime != time.Second {
+					t.Fatalf("fetch: got %d, %d, %d, %s", f.Min, f.Default, f.Max, c.Consumer.MaxWaitTime)
+				}
+			},
+		},
+		{
+			name: "defaults",
+			check: func(t *testing.T, c *sarama.Config) {
+				d := sarama.NewConfig()
+				if c.Consumer.Offsets.Initial != d.Consumer.Offsets.Initial || c.Consumer.IsolationLevel != d.Consumer.IsolationLevel {
+					t.Fatal("consumer: got changed defaults")
+				}
+			},
+		},
+		{name: "unknown initial offset", consumer: util.KafkaConsumerConfig{InitialOffset: "latest"}, err: kafka.ErrInvalidArgument},
+		{name: "unknown isolation level", consumer: util.KafkaConsumerConfig{IsolationLevel: "serializable"}, err: kafka.ErrInvalidArgument},
+		{name: "unknown rebalance", consumer: util.KafkaConsumerConfig{Rebalance: "cooperative"}, err: kafka.ErrInvalidArgument},
+		{name: "heartbeat not below session timeout", consumer: util.KafkaConsumerConfig{SessionTimeout: time.Second, HeartbeatInterval: time.Second}, err: kafka.ErrInvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := kafka.NewSaramaConfig(util.KafkaConfig{Brokers: []string{"kafka:9092"}, Consumer: tc.consumer})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("new config: got %v, want %v", err, tc.err)
+			}
+			if err == nil {
+				tc.check(t, c)
+			}
+		})
+	}
+}
+
+func TestNewSaramaConfigVersion(t *testing.T) {
+	c, err := kafka.NewSaramaConfig(util.KafkaConfig{Brokers: []string{"kafka:9092"}, ClientID: "stock", Version: "2.8.0"})
+	if err != nil {
+		t.Fatalf("new config: %v", err)
+	}
+	if c.Version != sarama.V2_8_0_0 || c.ClientID != "stock" {
+		t.Fatalf("version, client id: got %s, %s, want 2.8.0, stock", c.Version, c.ClientID)
+	}
+
+	if _, err := kafka.NewSaramaConfig(util.KafkaConfig{Version: "latest"}); !errors.Is(err, kafka.ErrInvalidArgument) {
+		t.Fatalf("unknown version: got %v, want %v", err, kafka.ErrInvalidArgument)
+	}
+}
@@ -4,39 +4,61 @@ import (
 	"context"
 	"fmt"
 	"github.com/Shopify/sarama"
-	"log"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"sync"
+	"time"
 )
 
+// abortTimeout is how long Shutdown waits for aborted handlers to return.
+const abortTimeout = time.Second
+
 // Consumer consumes messages from kafka and sends them to consumer group handler provided via the constructor.
 type Consumer interface {
+	Ping(ctx context.Context) error
+	Shutdown(ctx context.Context) error
 	Close() error
 }
 
+// Aborter is implemented by consumer group handlers able to cancel handling in flight.
+type Aborter interface {
+	Abort()
+}
+
 type saramaConsumer struct {
 	router        sarama.ConsumerGroupHandler
+	handler       sarama.ConsumerGroupHandler
 	consumerGroup sarama.ConsumerGroup
+	groupID       string
 
 	ctx       context.Context
 	cancelCtx context.CancelFunc
+
+	mu      sync.RWMutex
+	member  bool
+	lastErr error
 }
 
 // NewSaramaConsumer creates an instance of sarama consumer.
-func NewSaramaConsumer(ctx context.Context, brokers []string, topics []string, groupID string, h sarama.ConsumerGroupHandler) (*saramaConsumer, error) {
-	var err error
+func NewSaramaConsumer(ctx context.Context, kafkaCfg util.KafkaConfig, topics []string, groupID string, h sarama.ConsumerGroupHandler) (*saramaConsumer, error) {
+	cfg, err := NewSaramaConfig(kafkaCfg)
+	if err != nil {
+		return nil, err
+	}
 
 	internalCtx, cancel := context.WithCancel(ctx)
 
 	c := &saramaConsumer{
 		ctx:       internalCtx,
 		cancelCtx: cancel,
-		router:    h,
+		groupID:   groupID,
+		handler:   h,
 	}
+	c.router = membershipHandler{ConsumerGroupHandler: h, c: c}
 
-	cfg := sarama.NewConfig()
-	cfg.Producer.Return.Successes = true
-
-	c.consumerGroup, err = sarama.NewConsumerGroup(brokers, groupID, cfg)
+	c.consumerGroup, err = sarama.NewConsumerGroup(kafkaCfg.Brokers, groupID, cfg)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("%w: init consumer group err: %v", ErrInternal, err)
 	}
 
@@ -55,8 +77,12 @@ func NewSaramaConsumer(ctx context.Context, brokers []string, topics []string, g
 				return
 			case err := <-consumeMsg():
 				if err != nil {
-					log.Printf("consume msg err: %v", err)
+					logger.Error(c.ctx, "consume messages", logger.String("group", c.groupID), logger.Err(err))
 				}
+
+				c.mu.Lock()
+				c.lastErr = err
+				c.mu.Unlock()
 			}
 		}
 	}()
@@ -64,6 +90,76 @@ func NewSaramaConsumer(ctx context.Context, brokers []string, topics []string, g
 	return c, nil
 }
 
+// Ping reports whether the consumer is a member of its consumer group, i.e. has a session.
+// Sessions end on rebalances, so a failed check is expected to recover shortly.
+func (c *saramaConsumer) Ping(_ context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.member {
+		return nil
+	}
+
+	if c.lastErr != nil {
+		return fmt.Errorf("%w: not a member of group %s: %v", ErrUnavailable, c.groupID, c.lastErr)
+	}
+
+	return fmt.Errorf("%w: not a member of group %s", ErrUnavailable, c.groupID)
+}
+
+func (c *saramaConsumer) setMember(member bool) {
+	c.mu.Lock()
+	c.member = member
+	if member {
+		c.lastErr = nil
+	}
+	c.mu.Unlock()
+}
+
+// membershipHandler tracks consumer group sessions of the consumer.
+type membershipHandler struct {
+	sarama.ConsumerGroupHandler
+	c *saramaConsumer
+}
+
+func (h membershipHandler) Setup(s sarama.ConsumerGroupSession) error {
+	h.c.setMember(true)
+	return h.ConsumerGroupHandler.Setup(s)
+}
+
+func (h membershipHandler) Cleanup(s sarama.ConsumerGroupSession) error {
+	h.c.setMember(false)
+	return h.ConsumerGroupHandler.Cleanup(s)
+}
+
+// Shutdown stops consuming and waits for messages in flight to be handled.
+// If ctx is done first, the handling is aborted provided that the handler is an Aborter.
+func (c *saramaConsumer) Shutdown(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		if a, ok := c.handler.(Aborter); ok {
+			a.Abort()
+		}
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: handling aborted: %v", ErrInternal, ctx.Err())
+	case <-time.After(abortTimeout):
+		return fmt.Errorf("%w: handlers have not returned after abort", ErrInternal)
+	}
+}
+
 // Close closes a connection to kafka.
 func (c *saramaConsumer) Close() error {
 	c.cancelCtx()
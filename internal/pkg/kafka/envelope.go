@@ -0,0 +1,148 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/hashicorp/go-uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"strconv"
+	"time"
+)
+
+// Envelope headers are set on every message sent by Producer.
+const (
+	HeaderMessageID     = "message-id"
+	HeaderCorrelationID = "correlation-id"
+	HeaderCausationID   = "causation-id"
+	HeaderProducedAt    = "produced-at"
+	HeaderProducer      = "producer"
+	HeaderSchemaVersion = "schema-version"
+)
+
+// DefaultSchemaVersion is the schema version of messages sent by producers without WithSchemaVersion.
+const DefaultSchemaVersion = 1
+
+// Envelope describes a kafka message regardless of its payload.
+//
+// CorrelationID is shared by all the messages caused by the same request, e.g. every step
+// of an order saga, while CausationID is the id of the message that caused this one.
+//
+// TraceContext keeps the trace context of the envelope creator for messages sent later,
+// e.g. from an outbox. It is not a header itself, the producer injects trace context on send.
+type Envelope struct {
+	MessageID     string            `json:"message_id"`
+	CorrelationID string            `json:"correlation_id"`
+	CausationID   string            `json:"causation_id,omitempty"`
+	ProducedAt    time.Time         `json:"produced_at"`
+	Producer      string            `json:"producer,omitempty"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	TraceContext  map[string]string `json:"trace_context,omitempty"`
+}
+
+type envelopeCtxKey struct{}
+
+// ContextWithEnvelope returns a copy of ctx carrying the envelope of the message being handled.
+func ContextWithEnvelope(ctx context.Context, env Envelope) context.Context {
+	return context.WithValue(ctx, envelopeCtxKey{}, env)
+}
+
+// EnvelopeFromContext returns the envelope of the message being handled.
+func EnvelopeFromContext(ctx context.Context) (Envelope, bool) {
+	env, ok := ctx.Value(envelopeCtxKey{}).(Envelope)
+	return env, ok
+}
+
+type outgoingCtxKey struct{}
+
+// ContextWithOutgoingEnvelope returns a copy of ctx that makes Producer send the next message
+// with the given envelope instead of a new one. It is used to publish messages whose envelope
+// has been created in advance, e.g. the ones stored in an outbox.
+func ContextWithOutgoingEnvelope(ctx context.Context, env Envelope) context.Context {
+	return context.WithValue(ctx, outgoingCtxKey{}, env)
+}
+
+// NewEnvelope creates an envelope for a message caused by the one being handled in ctx.
+// A message sent outside a message handler starts a new correlation.
+func NewEnvelope(ctx context.Context) (Envelope, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%w: generate message id: %v", ErrInternal, err)
+	}
+
+	env := Envelope{
+		MessageID:     id,
+		CorrelationID: id,
+		ProducedAt:    time.Now().UTC(),
+	}
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		env.TraceContext = carrier
+	}
+
+	if cause, ok := EnvelopeFromContext(ctx); ok {
+		if cause.CorrelationID != "" {
+			env.CorrelationID = cause.CorrelationID
+		}
+		env.CausationID = cause.MessageID
+	}
+
+	return env, nil
+}
+
+// Headers encodes the envelope as kafka headers. Empty fields are omitted.
+func (e Envelope) Headers() []sarama.RecordHeader {
+	var headers []sarama.RecordHeader
+
+	add := func(key, value string) {
+		if value != "" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+
+	add(HeaderMessageID, e.MessageID)
+	add(HeaderCorrelationID, e.CorrelationID)
+	add(HeaderCausationID, e.CausationID)
+	if !e.ProducedAt.IsZero() {
+		add(HeaderProducedAt, e.ProducedAt.Format(time.RFC3339Nano))
+	}
+	add(HeaderProducer, e.Producer)
+	if e.SchemaVersion != 0 {
+		add(HeaderSchemaVersion, strconv.Itoa(e.SchemaVersion))
+	}
+
+	return headers
+}
+
+// EnvelopeFromHeaders decodes the envelope from kafka headers. Messages sent without
+// the envelope, e.g. by other systems, get an empty one; malformed fields are left zero.
+func EnvelopeFromHeaders(headers []*sarama.RecordHeader) Envelope {
+	var env Envelope
+
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+
+		value := string(h.Value)
+		switch string(h.Key) {
+		case HeaderMessageID:
+			env.MessageID = value
+		case HeaderCorrelationID:
+			env.CorrelationID = value
+		case HeaderCausationID:
+			env.CausationID = value
+		case HeaderProducedAt:
+			env.ProducedAt, _ = time.Parse(time.RFC3339Nano, value)
+		case HeaderProducer:
+			env.Producer = value
+		case HeaderSchemaVersion:
+			env.SchemaVersion, _ = strconv.Atoi(value)
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,200 @@
+package kafka_test
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordHeaders returns the headers the way consumers get them.
+func recordHeaders(headers []sarama.RecordHeader) []*sarama.RecordHeader {
+	res := make([]*sarama.RecordHeader, 0, len(headers))
+	for i := range headers {
+		res = append(res, &headers[i])
+	}
+	return res
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		env := kafka.Envelope{
+			MessageID:     "message",
+			CorrelationID: "correlation",
+			CausationID:   "cause",
+			ProducedAt:    time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC),
+			Producer:      "orders",
+			SchemaVersion: 2,
+		}
+
+		headers := env.Headers()
+		if len(headers) != 6 {
+			t.Fatalf("headers: got %d, want 6", len(headers))
+		}
+
+		got := kafka.EnvelopeFromHeaders(recordHeaders(headers))
+		if !reflect.DeepEqual(got, env) {
+			t.Fatalf("envelope: got %+v, want %+v", got, env)
+		}
+	})
+
+	t.Run("empty fields are omitted", func(t *testing.T) {
+		headers := kafka.Envelope{MessageID: "message", CorrelationID: "message"}.Headers()
+
+		want := []sarama.RecordHeader{
+			{Key: []byte(kafka.HeaderMessageID), Value: []byte("message")},
+			{Key: []byte(kafka.HeaderCorrelationID), Value: []byte("message")},
+		}
+		if !reflect.DeepEqual(headers, want) {
+			t.Fatalf("headers: got %v, want %v", headers, want)
+		}
+
+		if headers := (kafka.Envelope{}).Headers(); len(headers) != 0 {
+			t.Fatalf("headers of empty envelope: got %v, want none", headers)
+		}
+	})
+
+	t.Run("foreign and malformed headers", func(t *testing.T) {
+		got := kafka.EnvelopeFromHeaders([]*sarama.RecordHeader{
+			nil,
+			{Key: []byte("traceparent"), Value: []byte("00-trace")},
+			{Key: []byte(kafka.HeaderMessageID), Value: []byte("message")},
+			{Key: []byte(kafka.HeaderProducedAt), Value: []byte("yesterday")},
+			{Key: []byte(kafka.HeaderSchemaVersion), Value: []byte("v2")},
+		})
+
+		if want := (kafka.Envelope{MessageID: "message"}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("envelope: got %+v, want %+v", got, want)
+		}
+
+		if got := kafka.EnvelopeFromHeaders(nil); !reflect.DeepEqual(got, kafka.Envelope{}) {
+			t.Fatalf("envelope without headers: got %+v, want an empty one", got)
+		}
+	})
+}
+
+func TestNewEnvelope(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("new correlation", func(t *testing.T) {
+		before := time.Now()
+
+		env, err := kafka.NewEnvelope(ctx)
+		if err != nil {
+			t.Fatalf("new envelope: %v", err)
+		}
+
+		if env.MessageID == "" || env.CorrelationID != env.MessageID || env.CausationID != "" {
+			t.Fatalf("envelope: got %+v, want a message correlated with itself", env)
+		}
+		if env.ProducedAt.Location() != time.UTC || env.ProducedAt.Before(before.Add(-time.Second)) {
+			t.Fatalf("produced at: got %s, want now in UTC", env.ProducedAt)
+		}
+		if env.TraceContext != nil {
+			t.Fatalf("trace context: got %v, want none without a span", env.TraceContext)
+		}
+
+		next, err := kafka.NewEnvelope(ctx)
+		if err != nil {
+			t.Fatalf("new envelope: %v", err)
+		}
+		if next.MessageID == env.MessageID {
+			t.Fatalf("message id: got %s twice", env.MessageID)
+		}
+	})
+
+	t.Run("caused by the message handled", func(t *testing.T) {
+		cause := kafka.Envelope{MessageID: "cause", CorrelationID: "correlation"}
+
+		env, err := kafka.NewEnvelope(kafka.ContextWithEnvelope(ctx, cause))
+		if err != nil {
+			t.Fatalf("new envelope: %v", err)
+		}
+
+		if env.MessageID == "" || env.MessageID == cause.MessageID {
+			t.Fatalf("message id: got %q, want a new one", env.MessageID)
+		}
+		if env.CorrelationID != "correlation" || env.CausationID != "cause" {
+			t.Fatalf("envelope: got correlation %q, causation %q, want correlation, cause", env.CorrelationID, env.CausationID)
+		}
+	})
+
+	t.Run("caused by a message without envelope", func(t *testing.T) {
+		env, err := kafka.NewEnvelope(kafka.ContextWithEnvelope(ctx, kafka.Envelope{MessageID: "cause"}))
+		if err != nil {
+			t.Fatalf("new envelope: %v", err)
+		}
+
+		if env.CorrelationID != env.MessageID || env.CausationID != "cause" {
+			t.Fatalf("envelope: got %+v, want a new correlation caused by cause", env)
+		}
+	})
+
+	t.Run("trace context", func(t *testing.T) {
+		prev := otel.GetTextMapPropagator()
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		defer otel.SetTextMapPropagator(prev)
+
+		traceID, _ := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+		spanID, _ := trace.SpanIDFromHex("0102030405060708")
+		spanCtx := trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+		}))
+
+		env, err := kafka.NewEnvelope(spanCtx)
+		if err != nil {
+			t.Fatalf("new envelope: %v", err)
+		}
+
+		want := map[string]string{"traceparent": "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01"}
+		if !reflect.DeepEqual(env.TraceContext, want) {
+			t.Fatalf("trace context: got %v, want %v", env.TraceContext, want)
+		}
+	})
+}
+
+// TestEnvelopePropagation checks the envelopes of the messages sent by a producer while handling a message.
+func TestEnvelopePropagation(t *testing.T) {
+	b := kafkatest.NewBroker()
+
+	producer, err := b.Producer("replies", kafka.WithProducerName("stock"))
+	if err != nil {
+		t.Fatalf("create producer: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := producer.SendMessage(ctx, "1", "request"); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	request := kafka.EnvelopeFromHeaders(b.Messages("replies")[0].Headers)
+	if request.MessageID == "" || request.CorrelationID != request.MessageID || request.Producer != "stock" {
+		t.Fatalf("request envelope: got %+v, want a new correlation", request)
+	}
+
+	// The reply is sent while handling the request.
+	if err := producer.SendMessage(kafka.ContextWithEnvelope(ctx, request), "1", "reply"); err != nil {
+		t.Fatalf("send reply: %v", err)
+	}
+	reply := kafka.EnvelopeFromHeaders(b.Messages("replies")[1].Headers)
+	if reply.CorrelationID != request.CorrelationID || reply.CausationID != request.MessageID {
+		t.Fatalf("reply envelope: got %+v, want one caused by %+v", reply, request)
+	}
+
+	// An envelope created in advance is sent as is.
+	outgoing := kafka.Envelope{MessageID: "outbox", CorrelationID: "correlation", CausationID: "cause", ProducedAt: time.Now().UTC()}
+	if err := producer.SendMessage(kafka.ContextWithOutgoingEnvelope(ctx, outgoing), "1", "outbox"); err != nil {
+		t.Fatalf("send outbox message: %v", err)
+	}
+	got := kafka.EnvelopeFromHeaders(b.Messages("replies")[2].Headers)
+	if got.MessageID != "outbox" || got.CorrelationID != "correlation" || got.CausationID != "cause" {
+		t.Fatalf("outbox envelope: got %+v, want %+v", got, outgoing)
+	}
+}
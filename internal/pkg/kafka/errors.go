@@ -5,4 +5,5 @@ import "errors"
 var (
 	ErrInvalidArgument = errors.New("invalid argument")
 	ErrInternal        = errors.New("internal")
+	ErrUnavailable     = errors.New("unavailable")
 )
@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"sync"
+)
+
+// BrokersChecker checks that kafka brokers are reachable and serve cluster metadata.
+type BrokersChecker struct {
+	cfg util.KafkaConfig
+
+	mu     sync.Mutex
+	client sarama.Client
+}
+
+// NewBrokersChecker creates an instance of BrokersChecker. It connects to brokers on the first check.
+func NewBrokersChecker(cfg util.KafkaConfig) *BrokersChecker {
+	return &BrokersChecker{
+		cfg: cfg,
+	}
+}
+
+// Ping refreshes cluster metadata.
+func (c *BrokersChecker) Ping(_ context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		cfg, err := NewSaramaConfig(c.cfg)
+		if err != nil {
+			return err
+		}
+		cfg.Metadata.Retry.Max = 0
+
+		client, err := sarama.NewClient(c.cfg.Brokers, cfg)
+		if err != nil {
+			return fmt.Errorf("%w: new client: %v", ErrUnavailable, err)
+		}
+		c.client = client
+	}
+
+	if err := c.client.RefreshMetadata(); err != nil {
+		return fmt.Errorf("%w: refresh metadata: %v", ErrUnavailable, err)
+	}
+
+	if len(c.client.Brokers()) == 0 {
+		return fmt.Errorf("%w: no brokers available", ErrUnavailable)
+	}
+
+	return nil
+}
+
+// Close closes a connection to kafka.
+func (c *BrokersChecker) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+
+	if err := c.client.Close(); err != nil {
+		return fmt.Errorf("%w: close client err: %v", ErrInternal, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,370 @@
+// Package kafkatest provides an in-memory stand-in for a kafka cluster, so services
+// can be wired together in one process and tested end to end.
+//
+// Broker keeps partitioned topics and consumer group offsets. Producers created with Producer
+// are the ones of the kafka package backed by the broker, so messages carry the same envelope
+// and codec headers as in production. Consumers created with NewConsumer drive consumer group
+// handlers, e.g. router.SaramaRouter, with sessions and claims the way sarama does.
+// WaitIdle waits for every consumer group to have handled all the messages of its topics,
+// which makes the outcome of a chain of handlers deterministic.
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotSupported is returned by the sarama producer methods the broker does not implement.
+var ErrNotSupported = errors.New("not supported by in-memory broker")
+
+// Option configures Broker.
+type Option func(b *Broker)
+
+// WithPartitions sets the number of partitions of the topics, 1 is used otherwise.
+func WithPartitions(n int32) Option {
+	return func(b *Broker) {
+		b.partitions = n
+	}
+}
+
+// WithInitialOffset sets the offset consumer groups without committed offsets start from,
+// sarama.OffsetOldest is used otherwise, so messages sent before a consumer joins are consumed too.
+func WithInitialOffset(offset int64) Option {
+	return func(b *Broker) {
+		b.initialOffset = offset
+	}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// Broker is an in-memory kafka cluster. Topics are created on first use.
+type Broker struct {
+	partitions    int32
+	initialOffset int64
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever messages are appended, offsets are committed
+	// or consumer groups are rebalanced.
+	changed     chan struct{}
+	topics      map[string][][]*sarama.ConsumerMessage
+	roundRobin  map[string]int32
+	partitioner sarama.PartitionerConstructor
+	groups      map[string]*group
+}
+
+// NewBroker creates an instance of Broker.
+func NewBroker(opts ...Option) *Broker {
+	b := &Broker{
+		partitions:    1,
+		initialOffset: sarama.OffsetOldest,
+		changed:       make(chan struct{}),
+		topics:        make(map[string][][]*sarama.ConsumerMessage),
+		roundRobin:    make(map[string]int32),
+		partitioner:   sarama.NewHashPartitioner,
+		groups:        make(map[string]*group),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// Producer creates a producer of the kafka package sending messages of a topic to the broker.
+func (b *Broker) Producer(topic string, opts ...kafka.ProducerOption) (kafka.Producer, error) {
+	return kafka.NewSaramaProducerFrom(b.SyncProducer(), topic, opts...)
+}
+
+// SyncProducer returns a sarama producer appending messages to the broker.
+// Transactions are not supported, see TxProducer.
+func (b *Broker) SyncProducer() sarama.SyncProducer {
+	return syncProducer{b: b}
+}
+
+// Messages returns the messages of a topic in the order of partitions and offsets.
+func (b *Broker) Messages(topic string) []*sarama.ConsumerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var msgs []*sarama.ConsumerMessage
+	for _, log := range b.topic(topic) {
+		msgs = append(msgs, log...)
+	}
+
+	return msgs
+}
+
+// Offset returns the offset committed by a consumer group for a partition, -1 if there is none.
+func (b *Broker) Offset(groupID string, topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, ok := b.groups[groupID]
+	if !ok {
+		return -1
+	}
+
+	offset, ok := g.offsets[topicPartition{topic: topic, partition: partition}]
+	if !ok {
+		return -1
+	}
+
+	return offset
+}
+
+// WaitIdle waits until every consumer group with members has committed the offsets
+// of all the messages in the topics it consumes, i.e. there is nothing left to handle.
+func (b *Broker) WaitIdle(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		idle := b.idle()
+		changed := b.changed
+		b.mu.Unlock()
+
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait idle: %w", ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+func (b *Broker) idle() bool {
+	for _, g := range b.groups {
+		for _, m := range g.members {
+			for _, topic := range m.topics {
+				for p, log := range b.topic(topic) {
+					tp := topicPartition{topic: topic, partition: int32(p)}
+					if offset, ok := g.offsets[tp]; !ok || offset < int64(len(log)) {
+						return false
+					}
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// notify wakes up everyone waiting for the broker state to change. b.mu must be held.
+func (b *Broker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// topic returns the partitions of a topic creating it if needed. b.mu must be held.
+func (b *Broker) topic(name string) [][]*sarama.ConsumerMessage {
+	partitions, ok := b.topics[name]
+	if !ok {
+		partitions = make([][]*sarama.ConsumerMessage, b.partitions)
+		b.topics[name] = partitions
+	}
+
+	return partitions
+}
+
+// produce appends messages to their partitions at once.
+func (b *Broker) produce(msgs ...*sarama.ProducerMessage) error {
+	encoded, err := consumerMessages(msgs)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.append(msgs, encoded); err != nil {
+		return err
+	}
+
+	b.notify()
+
+	return nil
+}
+
+// append appends the encoded messages to their partitions and sets the partitions and offsets of msgs.
+// Messages with a key are partitioned by its hash like sarama does, the others are spread round robin.
+// b.mu must be held.
+func (b *Broker) append(msgs []*sarama.ProducerMessage, encoded []*sarama.ConsumerMessage) error {
+	for i, msg := range msgs {
+		partitions := b.topic(msg.Topic)
+
+		var partition int32
+		if msg.Key == nil {
+			partition = b.roundRobin[msg.Topic] % int32(len(partitions))
+			b.roundRobin[msg.Topic]++
+		} else {
+			var err error
+			partition, err = b.partitioner(msg.Topic).Partition(msg, int32(len(partitions)))
+			if err != nil {
+				return fmt.Errorf("%w: partition: %v", kafka.ErrInternal, err)
+			}
+		}
+
+		m := encoded[i]
+		m.Partition = partition
+		m.Offset = int64(len(partitions[partition]))
+		partitions[partition] = append(partitions[partition], m)
+
+		msg.Partition = m.Partition
+		msg.Offset = m.Offset
+	}
+
+	return nil
+}
+
+// commit moves the offset of a consumer group forward. b.mu must be held.
+func (b *Broker) commit(groupID string, topic string, partition int32, offset int64) {
+	g := b.group(groupID)
+
+	tp := topicPartition{topic: topic, partition: partition}
+	if current, ok := g.offsets[tp]; ok && current >= offset {
+		return
+	}
+	g.offsets[tp] = offset
+
+	b.notify()
+}
+
+// fetch returns the message of a partition at a given offset, if it has been appended already,
+// and the channel closed once the broker state changes otherwise.
+func (b *Broker) fetch(topic string, partition int32, offset int64) (*sarama.ConsumerMessage, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log := b.topic(topic)[partition]
+	if offset < int64(len(log)) {
+		// Handlers get a copy, as sarama decodes a message anew for every consumer.
+		m := *log[offset]
+		return &m, nil
+	}
+
+	return nil, b.changed
+}
+
+// highWaterMark returns the offset of the next message of a partition.
+func (b *Broker) highWaterMark(topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return int64(len(b.topic(topic)[partition]))
+}
+
+func consumerMessages(msgs []*sarama.ProducerMessage) ([]*sarama.ConsumerMessage, error) {
+	encoded := make([]*sarama.ConsumerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		m, err := consumerMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, m)
+	}
+
+	return encoded, nil
+}
+
+func consumerMessage(msg *sarama.ProducerMessage) (*sarama.ConsumerMessage, error) {
+	if msg.Topic == "" {
+		return nil, fmt.Errorf("%w: message without topic", kafka.ErrInvalidArgument)
+	}
+
+	m := &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Timestamp: msg.Timestamp,
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+
+	var err error
+	if msg.Key != nil {
+		if m.Key, err = msg.Key.Encode(); err != nil {
+			return nil, fmt.Errorf("%w: encode key: %v", kafka.ErrInvalidArgument, err)
+		}
+	}
+	if msg.Value != nil {
+		if m.Value, err = msg.Value.Encode(); err != nil {
+			return nil, fmt.Errorf("%w: encode value: %v", kafka.ErrInvalidArgument, err)
+		}
+	}
+
+	for _, h := range msg.Headers {
+		h := h
+		m.Headers = append(m.Headers, &h)
+	}
+
+	return m, nil
+}
+
+// sortedKeys returns the keys of a map in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+type syncProducer struct {
+	b *Broker
+}
+
+func (p syncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if err := p.b.produce(msg); err != nil {
+		return 0, 0, err
+	}
+
+	return msg.Partition, msg.Offset, nil
+}
+
+func (p syncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	return p.b.produce(msgs...)
+}
+
+func (p syncProducer) Close() error {
+	return nil
+}
+
+func (p syncProducer) TxnStatus() sarama.ProducerTxnStatusFlag {
+	return sarama.ProducerTxnFlagReady
+}
+
+func (p syncProducer) IsTransactional() bool {
+	return false
+}
+
+func (p syncProducer) BeginTxn() error {
+	return ErrNotSupported
+}
+
+func (p syncProducer) CommitTxn() error {
+	return ErrNotSupported
+}
+
+func (p syncProducer) AbortTxn() error {
+	return ErrNotSupported
+}
+
+func (p syncProducer) AddOffsetsToTxn(map[string][]*sarama.PartitionOffsetMetadata, string) error {
+	return ErrNotSupported
+}
+
+func (p syncProducer) AddMessageToTxn(*sarama.ConsumerMessage, string, *string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,448 @@
+package kafkatest
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"sort"
+	"sync"
+	"time"
+)
+
+// abortTimeout is how long Shutdown waits for aborted handlers to return.
+const abortTimeout = time.Second
+
+// group is a consumer group. Every change of its members starts a new generation
+// with the partitions of the topics assigned anew.
+type group struct {
+	offsets    map[topicPartition]int64
+	members    map[string]*member
+	nextMember int
+	gen        *generation
+}
+
+type member struct {
+	id     string
+	topics []string
+}
+
+type generation struct {
+	id     int32
+	ctx    context.Context
+	cancel context.CancelFunc
+	// claims are the partitions assigned to the members by member id.
+	claims map[string]map[string][]int32
+	// ready is closed once the sessions of the previous generation are over,
+	// so a partition is never consumed by two members at a time.
+	ready    chan struct{}
+	sessions sync.WaitGroup
+}
+
+// group returns the consumer group creating it if needed. b.mu must be held.
+func (b *Broker) group(groupID string) *group {
+	g, ok := b.groups[groupID]
+	if !ok {
+		g = &group{
+			offsets: make(map[topicPartition]int64),
+			members: make(map[string]*member),
+		}
+		b.groups[groupID] = g
+	}
+
+	return g
+}
+
+func (b *Broker) join(groupID string, topics []string) *member {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(groupID)
+
+	m := &member{
+		id:     fmt.Sprintf("%s-%d", groupID, g.nextMember),
+		topics: topics,
+	}
+	g.nextMember++
+	g.members[m.id] = m
+
+	b.rebalance(g)
+
+	return m
+}
+
+func (b *Broker) leave(groupID string, m *member) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(groupID)
+	delete(g.members, m.id)
+
+	b.rebalance(g)
+}
+
+// rejoin starts a new generation of the group unless gen is over already, as sarama does
+// when a member leaves a session and joins the group again. b.mu must not be held.
+func (b *Broker) rejoin(groupID string, gen *generation) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if g := b.group(groupID); g.gen == gen {
+		b.rebalance(g)
+	}
+}
+
+// rebalance ends the current generation of the group and assigns the partitions
+// of the topics to the members. A partition of a topic goes to the members consuming it
+// in turn. Partitions without committed offsets start from the initial offset.
+// b.mu must be held.
+func (b *Broker) rebalance(g *group) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gen := &generation{
+		ctx:    ctx,
+		cancel: cancel,
+		claims: make(map[string]map[string][]int32, len(g.members)),
+		ready:  make(chan struct{}),
+	}
+
+	consumers := make(map[string][]string)
+	for _, id := range sortedKeys(g.members) {
+		gen.claims[id] = make(map[string][]int32)
+		for _, topic := range g.members[id].topics {
+			consumers[topic] = append(consumers[topic], id)
+		}
+	}
+
+	for topic, ids := range consumers {
+		for p, log := range b.topic(topic) {
+			id := ids[p%len(ids)]
+			gen.claims[id][topic] = append(gen.claims[id][topic], int32(p))
+
+			tp := topicPartition{topic: topic, partition: int32(p)}
+			if _, ok := g.offsets[tp]; ok {
+				continue
+			}
+			if b.initialOffset == sarama.OffsetNewest {
+				g.offsets[tp] = int64(len(log))
+			} else {
+				g.offsets[tp] = 0
+			}
+		}
+	}
+
+	if prev := g.gen; prev != nil {
+		gen.id = prev.id + 1
+		prev.cancel()
+		go func() {
+			prev.sessions.Wait()
+			close(gen.ready)
+		}()
+	} else {
+		close(gen.ready)
+	}
+	g.gen = gen
+
+	b.notify()
+}
+
+// session returns the current generation of the group registering a session in it.
+func (b *Broker) session(groupID string) *generation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	gen := b.group(groupID).gen
+	gen.sessions.Add(1)
+
+	return gen
+}
+
+type consumer struct {
+	b       *Broker
+	groupID string
+	handler sarama.ConsumerGroupHandler
+	member  *member
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.RWMutex
+	inGroup bool
+	lastErr error
+}
+
+// NewConsumer creates a member of a consumer group consuming topics of the broker with the handler,
+// the counterpart of kafka.NewSaramaConsumer. It consumes until ctx is done or the consumer is closed.
+func (b *Broker) NewConsumer(ctx context.Context, topics []string, groupID string, h sarama.ConsumerGroupHandler) *consumer {
+	ctx, cancel := context.WithCancel(ctx)
+
+	c := &consumer{
+		b:       b,
+		groupID: groupID,
+		handler: h,
+		member:  b.join(groupID, topics),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+func (c *consumer) run() {
+	defer close(c.done)
+	defer c.b.leave(c.groupID, c.member)
+
+	for c.ctx.Err() == nil {
+		gen := c.b.session(c.groupID)
+
+		select {
+		case <-gen.ready:
+			c.consume(gen)
+		case <-gen.ctx.Done():
+		case <-c.ctx.Done():
+		}
+
+		gen.sessions.Done()
+	}
+}
+
+// consume runs a session of the generation: the handler consumes every claim in a goroutine
+// until the generation or the consumer is over, or any claim returns.
+func (c *consumer) consume(gen *generation) {
+	ctx, cancel := context.WithCancel(gen.ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s := &session{
+		b:       c.b,
+		groupID: c.groupID,
+		member:  c.member.id,
+		gen:     gen.id,
+		claims:  gen.claims[c.member.id],
+		ctx:     ctx,
+	}
+
+	if err := c.handler.Setup(s); err != nil {
+		c.setErr(fmt.Errorf("setup: %w", err))
+		<-ctx.Done()
+		return
+	}
+	c.setInGroup(true)
+
+	var wg sync.WaitGroup
+	for topic, partitions := range s.claims {
+		for _, partition := range partitions {
+			cl := &claim{
+				b:             c.b,
+				topic:         topic,
+				partition:     partition,
+				initialOffset: c.b.Offset(c.groupID, topic, partition),
+				messages:      make(chan *sarama.ConsumerMessage),
+			}
+
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				cl.feed(ctx)
+			}()
+			go func() {
+				defer wg.Done()
+				defer cancel()
+				if err := c.handler.ConsumeClaim(s, cl); err != nil {
+					c.setErr(fmt.Errorf("consume claim: %w", err))
+				}
+			}()
+		}
+	}
+
+	<-ctx.Done()
+	wg.Wait()
+
+	if err := c.handler.Cleanup(s); err != nil {
+		c.setErr(fmt.Errorf("cleanup: %w", err))
+	}
+	c.setInGroup(false)
+
+	// A claim has returned, so the member joins the group again.
+	if gen.ctx.Err() == nil && c.ctx.Err() == nil {
+		c.b.rejoin(c.groupID, gen)
+	}
+}
+
+func (c *consumer) setInGroup(inGroup bool) {
+	c.mu.Lock()
+	c.inGroup = inGroup
+	if inGroup {
+		c.lastErr = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *consumer) setErr(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+// Ping reports whether the consumer has a session, like the one of kafka.NewSaramaConsumer.
+func (c *consumer) Ping(_ context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.inGroup {
+		return nil
+	}
+
+	if c.lastErr != nil {
+		return fmt.Errorf("%w: not a member of group %s: %v", kafka.ErrUnavailable, c.groupID, c.lastErr)
+	}
+
+	return fmt.Errorf("%w: not a member of group %s", kafka.ErrUnavailable, c.groupID)
+}
+
+// Shutdown stops consuming and waits for messages in flight to be handled.
+// If ctx is done first, the handling is aborted provided that the handler is a kafka.Aborter.
+func (c *consumer) Shutdown(ctx context.Context) error {
+	c.cancel()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		if a, ok := c.handler.(kafka.Aborter); ok {
+			a.Abort()
+		}
+	}
+
+	select {
+	case <-c.done:
+		return fmt.Errorf("%w: handling aborted: %v", kafka.ErrInternal, ctx.Err())
+	case <-time.After(abortTimeout):
+		return fmt.Errorf("%w: handlers have not returned after abort", kafka.ErrInternal)
+	}
+}
+
+// Close stops consuming, waits for the handler to return and leaves the group.
+func (c *consumer) Close() error {
+	c.cancel()
+	<-c.done
+
+	return nil
+}
+
+type session struct {
+	b       *Broker
+	groupID string
+	member  string
+	gen     int32
+	claims  map[string][]int32
+	ctx     context.Context
+}
+
+func (s *session) Claims() map[string][]int32 {
+	claims := make(map[string][]int32, len(s.claims))
+	for topic, partitions := range s.claims {
+		claims[topic] = append([]int32(nil), partitions...)
+		sort.Slice(claims[topic], func(i, j int) bool { return claims[topic][i] < claims[topic][j] })
+	}
+
+	return claims
+}
+
+func (s *session) MemberID() string {
+	return s.member
+}
+
+func (s *session) GenerationID() int32 {
+	return s.gen
+}
+
+// MarkOffset commits the offset right away. Like sarama, it never moves the offset backwards.
+func (s *session) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+
+	s.b.commit(s.groupID, topic, partition, offset)
+}
+
+// Commit does nothing, as offsets are committed once marked.
+func (s *session) Commit() {}
+
+func (s *session) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+
+	s.b.group(s.groupID).offsets[topicPartition{topic: topic, partition: partition}] = offset
+	s.b.notify()
+}
+
+func (s *session) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *session) Context() context.Context {
+	return s.ctx
+}
+
+type claim struct {
+	b             *Broker
+	topic         string
+	partition     int32
+	initialOffset int64
+	messages      chan *sarama.ConsumerMessage
+}
+
+// feed sends the messages of the partition starting from the initial offset until ctx is done.
+func (c *claim) feed(ctx context.Context) {
+	defer close(c.messages)
+
+	offset := c.initialOffset
+	for {
+		msg, changed := c.b.fetch(c.topic, c.partition, offset)
+		if msg == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case c.messages <- msg:
+			offset++
+		}
+	}
+}
+
+func (c *claim) Topic() string {
+	return c.topic
+}
+
+func (c *claim) Partition() int32 {
+	return c.partition
+}
+
+func (c *claim) InitialOffset() int64 {
+	return c.initialOffset
+}
+
+func (c *claim) HighWaterMarkOffset() int64 {
+	return c.b.highWaterMark(c.topic, c.partition)
+}
+
+func (c *claim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
@@ -0,0 +1,23 @@
+package kafkatest
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+)
+
+// HandlerContext returns a copy of ctx carrying a message at the offset of the topic partition 0
+// and its envelope with the message id, the way the router passes them to handlers.
+// It lets repositories be called as if they were handling the message, e.g. to test deduplication.
+func HandlerContext(ctx context.Context, topic string, offset int64, messageID string) context.Context {
+	ctx = router.ContextWithMessage(ctx, &sarama.ConsumerMessage{
+		Topic:  topic,
+		Offset: offset,
+	})
+
+	return kafka.ContextWithEnvelope(ctx, kafka.Envelope{
+		MessageID:     messageID,
+		CorrelationID: messageID,
+	})
+}
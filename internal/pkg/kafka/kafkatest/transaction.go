@@ -0,0 +1,106 @@
+package kafkatest
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"sync"
+)
+
+type txProducer struct {
+	b *Broker
+
+	// mu is held while a transaction is in progress.
+	mu sync.Mutex
+}
+
+// TxProducer creates a transactional producer of the broker, the counterpart of kafka.NewSaramaTxProducer.
+// The messages of a transaction are appended on commit along with the consumed offset,
+// so consumers never see the ones of aborted transactions.
+func (b *Broker) TxProducer() kafka.TxProducer {
+	return &txProducer{b: b}
+}
+
+func (p *txProducer) Begin() (kafka.Tx, error) {
+	p.mu.Lock()
+
+	return &tx{p: p}, nil
+}
+
+func (p *txProducer) Close() error {
+	return nil
+}
+
+type tx struct {
+	p *txProducer
+
+	mu      sync.Mutex
+	done    bool
+	msgs    []*sarama.ProducerMessage
+	encoded []*sarama.ConsumerMessage
+}
+
+func (tx *tx) Send(msg *sarama.ProducerMessage) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return kafka.ErrTxDone
+	}
+
+	m, err := consumerMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	tx.msgs = append(tx.msgs, msg)
+	tx.encoded = append(tx.encoded, m)
+
+	return nil
+}
+
+func (tx *tx) Commit(msg *sarama.ConsumerMessage, groupID string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return kafka.ErrTxDone
+	}
+
+	b := tx.p.b
+
+	b.mu.Lock()
+	err := b.append(tx.msgs, tx.encoded)
+	if err == nil {
+		b.commit(groupID, msg.Topic, msg.Partition, msg.Offset+1)
+		b.notify()
+	}
+	b.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	tx.finish()
+
+	return nil
+}
+
+func (tx *tx) Abort() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return kafka.ErrTxDone
+	}
+
+	tx.finish()
+
+	return nil
+}
+
+// finish releases the producer for the next transaction.
+func (tx *tx) finish() {
+	tx.done = true
+	tx.p.mu.Unlock()
+}
@@ -1,53 +1,334 @@
 package kafka
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"time"
 )
 
-// Producer sends messages to kafka.
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka")
+
+// Producer sends messages to kafka along with their Envelope.
 type Producer interface {
-	SendMessage(key string, msg interface{}) error
+	SendMessage(ctx context.Context, key string, msg interface{}) error
+	Close() error
+}
+
+// RawProducer sends already encoded messages to kafka.
+type RawProducer interface {
+	SendRawMessage(msg *sarama.ProducerMessage) error
 	Close() error
 }
 
+// Flusher is implemented by producers sending messages in background.
+type Flusher interface {
+	// Flush waits for the messages sent before to be delivered or failed.
+	Flush(ctx context.Context) error
+}
+
+// ProducerOption configures producers.
+type ProducerOption func(o *producerOptions)
+
+type producerOptions struct {
+	cfg           *sarama.Config
+	name          string
+	schemaVersion int
+	codec         Codec
+	onError       func(msg *sarama.ProducerMessage, err error)
+}
+
+func newProducerOptions(cfg util.KafkaConfig, opts []ProducerOption) (*producerOptions, error) {
+	c, err := NewSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Producer.Return.Successes = true
+
+	o := &producerOptions{
+		cfg:           c,
+		schemaVersion: DefaultSchemaVersion,
+		codec:         NewJSONCodec(),
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o, nil
+}
+
+// WithProducerName sets the name of the service sending messages, see Envelope.Producer.
+func WithProducerName(name string) ProducerOption {
+	return func(o *producerOptions) {
+		o.name = name
+	}
+}
+
+// WithCodec sets the codec messages are encoded with, JSON is used otherwise.
+func WithCodec(c Codec) ProducerOption {
+	return func(o *producerOptions) {
+		o.codec = c
+	}
+}
+
+// WithSchemaVersion sets the schema version of messages, DefaultSchemaVersion is used otherwise.
+func WithSchemaVersion(v int) ProducerOption {
+	return func(o *producerOptions) {
+		o.schemaVersion = v
+	}
+}
+
+// WithAcks sets the acknowledgements required from the brokers, sarama.WaitForLocal is used otherwise.
+func WithAcks(acks sarama.RequiredAcks) ProducerOption {
+	return func(o *producerOptions) {
+		o.cfg.Producer.RequiredAcks = acks
+	}
+}
+
+// WithCompression sets the codec batches are compressed with.
+func WithCompression(c sarama.CompressionCodec) ProducerOption {
+	return func(o *producerOptions) {
+		o.cfg.Producer.Compression = c
+		// Brokers accept zstd batches since 2.1.
+		if c == sarama.CompressionZSTD && !o.cfg.Version.IsAtLeast(sarama.V2_1_0_0) {
+			o.cfg.Version = sarama.V2_1_0_0
+		}
+	}
+}
+
+// WithIdempotence makes the producer idempotent, so retries do not duplicate messages in a partition.
+// It requires acknowledgements from all the in-sync replicas and a single request in flight.
+func WithIdempotence() ProducerOption {
+	return func(o *producerOptions) {
+		o.cfg.Producer.Idempotent = true
+		o.cfg.Producer.RequiredAcks = sarama.WaitForAll
+		o.cfg.Net.MaxOpenRequests = 1
+		if !o.cfg.Version.IsAtLeast(sarama.V0_11_0_0) {
+			o.cfg.Version = sarama.V0_11_0_0
+		}
+	}
+}
+
+// WithBatching makes the producer send a batch once it has n messages or bytes, or linger has passed
+// since the first message of the batch. Zero values are not limits.
+func WithBatching(n int, bytes int, linger time.Duration) ProducerOption {
+	return func(o *producerOptions) {
+		o.cfg.Producer.Flush.Messages = n
+		o.cfg.Producer.Flush.Bytes = bytes
+		o.cfg.Producer.Flush.Frequency = linger
+	}
+}
+
+// WithErrorHandler sets a callback called with messages that asynchronous producers fail to deliver.
+// The failures are logged otherwise.
+func WithErrorHandler(fn func(msg *sarama.ProducerMessage, err error)) ProducerOption {
+	return func(o *producerOptions) {
+		o.onError = fn
+	}
+}
+
+// ConfigOptions returns the options of a topic producer configuration.
+func ConfigOptions(cfg util.ProducerConfig) ([]ProducerOption, error) {
+	var opts []ProducerOption
+
+	switch cfg.Acks {
+	case "":
+	case "none":
+		opts = append(opts, WithAcks(sarama.NoResponse))
+	case "leader":
+		opts = append(opts, WithAcks(sarama.WaitForLocal))
+	case "all":
+		opts = append(opts, WithAcks(sarama.WaitForAll))
+	default:
+		return nil, fmt.Errorf("%w: unknown acks %q", ErrInvalidArgument, cfg.Acks)
+	}
+
+	switch cfg.Compression {
+	case "", "none":
+	case "gzip":
+		opts = append(opts, WithCompression(sarama.CompressionGZIP))
+	case "snappy":
+		opts = append(opts, WithCompression(sarama.CompressionSnappy))
+	case "lz4":
+		opts = append(opts, WithCompression(sarama.CompressionLZ4))
+	case "zstd":
+		opts = append(opts, WithCompression(sarama.CompressionZSTD))
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %q", ErrInvalidArgument, cfg.Compression)
+	}
+
+	if cfg.Idempotent {
+		if cfg.Acks != "" && cfg.Acks != "all" {
+			return nil, fmt.Errorf("%w: idempotent producer requires acks from all replicas", ErrInvalidArgument)
+		}
+		opts = append(opts, WithIdempotence())
+	}
+
+	if cfg.BatchSize > 0 || cfg.BatchBytes > 0 || cfg.Linger > 0 {
+		opts = append(opts, WithBatching(cfg.BatchSize, cfg.BatchBytes, cfg.Linger))
+	}
+
+	return opts, nil
+}
+
+// NewProducer creates a producer of a topic according to its configuration, an asynchronous one
+// if cfg.Async is set, a synchronous one otherwise. The options are applied after the configuration ones.
+func NewProducer(kafkaCfg util.KafkaConfig, topic string, cfg util.ProducerConfig, opts ...ProducerOption) (Producer, error) {
+	cfgOpts, err := ConfigOptions(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("producer of %s: %w", topic, err)
+	}
+	opts = append(cfgOpts, opts...)
+
+	if cfg.Async {
+		return NewSaramaAsyncProducer(kafkaCfg, topic, opts...)
+	}
+
+	return NewSaramaProducer(kafkaCfg, topic, opts...)
+}
+
+// message encodes msg and wraps it up in a message to the topic with the envelope headers.
+// The returned span of sending is to be ended once the message is delivered.
+func (o *producerOptions) message(ctx context.Context, topic string, key string, msg interface{}) (*sarama.ProducerMessage, trace.Span, error) {
+	b, err := o.codec.Marshal(ctx, topic, msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode: %w", err)
+	}
+
+	env, ok := ctx.Value(outgoingCtxKey{}).(Envelope)
+	if !ok {
+		env, err = NewEnvelope(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("new envelope: %w", err)
+		}
+	}
+	if env.Producer == "" {
+		env.Producer = o.name
+	}
+	if env.SchemaVersion == 0 {
+		env.SchemaVersion = o.schemaVersion
+	}
+
+	// Messages sent long after their envelope was created continue the trace of the creator.
+	if env.TraceContext != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(env.TraceContext))
+	}
+
+	ctx, span := tracer.Start(ctx, topic+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("kafka"),
+			semconv.MessagingDestinationKindTopic,
+			semconv.MessagingDestinationKey.String(topic),
+			semconv.MessagingMessageIDKey.String(env.MessageID),
+			semconv.MessagingConversationIDKey.String(env.CorrelationID),
+			semconv.MessagingKafkaMessageKeyKey.String(key),
+		),
+	)
+
+	headers := append(env.Headers(), sarama.RecordHeader{
+		Key:   []byte(HeaderContentType),
+		Value: []byte(o.codec.ContentType()),
+	})
+	otel.GetTextMapPropagator().Inject(ctx, HeadersCarrier{Headers: &headers})
+
+	return &sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.StringEncoder(key),
+		Value:   sarama.ByteEncoder(b),
+		Headers: headers,
+	}, span, nil
+}
+
+// observeSend records the latency and the result of sending a message.
+func observeSend(topic string, start time.Time, err error) {
+	metrics.ProducerSendDuration.WithLabelValues(topic, metrics.Result(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.ProducerSendFailures.WithLabelValues(topic).Inc()
+	}
+}
+
 type saramaProducer struct {
 	producer sarama.SyncProducer
 	topic    string
+	opts     *producerOptions
 }
 
-// NewSaramaProducer creates an instance of saramaProducer.
-func NewSaramaProducer(brokers []string, topic string) (*saramaProducer, error) {
-	cfg := sarama.NewConfig()
-	cfg.Producer.Return.Successes = true
+// NewSaramaProducer creates an instance of saramaProducer, a producer waiting for every message to be delivered.
+func NewSaramaProducer(cfg util.KafkaConfig, topic string, opts ...ProducerOption) (*saramaProducer, error) {
+	o, err := newProducerOptions(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	producer, err := sarama.NewSyncProducer(cfg.Brokers, o.cfg)
 	if err != nil {
 		return nil, fmt.Errorf("%w: init sync producer err: %v", ErrInternal, err)
 	}
 
-	p := &saramaProducer{
+	return &saramaProducer{
 		producer: producer,
 		topic:    topic,
+		opts:     o,
+	}, nil
+}
+
+// NewSaramaProducerFrom creates an instance of saramaProducer sending messages with a given sarama producer,
+// e.g. an in-memory one in tests. The options configuring sarama have no effect, as the producer is configured already.
+func NewSaramaProducerFrom(producer sarama.SyncProducer, topic string, opts ...ProducerOption) (*saramaProducer, error) {
+	o, err := newProducerOptions(util.KafkaConfig{}, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return p, nil
+	return &saramaProducer{
+		producer: producer,
+		topic:    topic,
+		opts:     o,
+	}, nil
 }
 
-// SendMessage sends a message to kafka.
-func (p *saramaProducer) SendMessage(key string, msg interface{}) error {
-	b, err := json.Marshal(msg)
+// SendMessage encodes a message with the producer codec and sends it to kafka. The message
+// envelope is created with NewEnvelope unless ctx carries one, see ContextWithOutgoingEnvelope.
+// Trace context of the send span and the codec content type are put in the message headers.
+// The message is added to the transaction ctx carries, if any, see ContextWithTx.
+func (p *saramaProducer) SendMessage(ctx context.Context, key string, msg interface{}) (err error) {
+	m, span, err := p.opts.message(ctx, p.topic, key, msg)
 	if err != nil {
-		return fmt.Errorf("%w: marshal err: %v", ErrInvalidArgument, err)
+		return err
 	}
+	defer func() { tracing.End(span, err) }()
+
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx.Send(m)
+	}
+
+	return p.send(m)
+}
+
+// SendRawMessage sends an already encoded message to kafka.
+// The producer topic is used unless the message has its own one.
+func (p *saramaProducer) SendRawMessage(msg *sarama.ProducerMessage) error {
+	if msg.Topic == "" {
+		msg.Topic = p.topic
+	}
+
+	return p.send(msg)
+}
 
-	_, _, err = p.producer.SendMessage(
-		&sarama.ProducerMessage{
-			Topic: p.topic,
-			Key:   sarama.StringEncoder(key),
-			Value: sarama.ByteEncoder(b),
-		})
+// send sends the message observing latency and failures.
+func (p *saramaProducer) send(msg *sarama.ProducerMessage) error {
+	start := time.Now()
+	_, _, err := p.producer.SendMessage(msg)
+	observeSend(msg.Topic, start, err)
 
 	return err
 }
@@ -0,0 +1,245 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// ErrProducerClosed is returned by the asynchronous producer once it is closed.
+var ErrProducerClosed = errors.New("producer closed")
+
+// delivery is the metadata of a message sent by the asynchronous producer.
+type delivery struct {
+	start time.Time
+	span  trace.Span
+}
+
+// saramaAsyncProducer sends messages in background, batching them according to WithBatching.
+// SendMessage returns once the message is queued, so its errors are only about encoding;
+// delivery failures are reported to the callback set with WithErrorHandler.
+// It must not be used where a message is to be confirmed before going on, e.g. for outboxes.
+type saramaAsyncProducer struct {
+	producer sarama.AsyncProducer
+	topic    string
+	opts     *producerOptions
+
+	// closeMu keeps the input open while messages are queued.
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu       sync.Mutex
+	inFlight int
+	idle     chan struct{}
+
+	done chan struct{}
+}
+
+// NewSaramaAsyncProducer creates an instance of saramaAsyncProducer.
+func NewSaramaAsyncProducer(cfg util.KafkaConfig, topic string, opts ...ProducerOption) (*saramaAsyncProducer, error) {
+	o, err := newProducerOptions(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+	o.cfg.Producer.Return.Errors = true
+
+	producer, err := sarama.NewAsyncProducer(cfg.Brokers, o.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: init async producer err: %v", ErrInternal, err)
+	}
+
+	return newSaramaAsyncProducer(producer, topic, o), nil
+}
+
+// NewSaramaAsyncProducerFrom creates an instance of saramaAsyncProducer sending messages with a given sarama producer,
+// e.g. a fake one in tests. The options configuring sarama have no effect, as the producer is configured already;
+// it must return errors.
+func NewSaramaAsyncProducerFrom(producer sarama.AsyncProducer, topic string, opts ...ProducerOption) (*saramaAsyncProducer, error) {
+	o, err := newProducerOptions(util.KafkaConfig{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSaramaAsyncProducer(producer, topic, o), nil
+}
+
+func newSaramaAsyncProducer(producer sarama.AsyncProducer, topic string, o *producerOptions) *saramaAsyncProducer {
+	p := &saramaAsyncProducer{
+		producer: producer,
+		topic:    topic,
+		opts:     o,
+		idle:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	close(p.idle)
+
+	go p.deliveries()
+
+	return p
+}
+
+// SendMessage encodes a message the way saramaProducer.SendMessage does and queues it for sending.
+// It blocks while the queue is full unless ctx is done. Messages of transactions are not queued
+// but added to the transaction ctx carries, see ContextWithTx.
+func (p *saramaAsyncProducer) SendMessage(ctx context.Context, key string, msg interface{}) error {
+	m, span, err := p.opts.message(ctx, p.topic, key, msg)
+	if err != nil {
+		return err
+	}
+
+	if tx, ok := TxFromContext(ctx); ok {
+		err := tx.Send(m)
+		tracing.End(span, err)
+		return err
+	}
+
+	m.Metadata = delivery{start: time.Now(), span: span}
+
+	if err := p.send(ctx, m); err != nil {
+		tracing.End(span, err)
+		return err
+	}
+
+	return nil
+}
+
+// SendRawMessage queues an already encoded message for sending.
+// The producer topic is used unless the message has its own one.
+func (p *saramaAsyncProducer) SendRawMessage(msg *sarama.ProducerMessage) error {
+	if msg.Topic == "" {
+		msg.Topic = p.topic
+	}
+	msg.Metadata = delivery{start: time.Now()}
+
+	return p.send(context.Background(), msg)
+}
+
+func (p *saramaAsyncProducer) send(ctx context.Context, msg *sarama.ProducerMessage) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return ErrProducerClosed
+	}
+
+	p.mu.Lock()
+	if p.inFlight == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.inFlight++
+	p.mu.Unlock()
+
+	select {
+	case p.producer.Input() <- msg:
+		return nil
+	case <-ctx.Done():
+		p.delivered()
+		return ctx.Err()
+	}
+}
+
+// deliveries handles the results of sending until the producer is closed.
+func (p *saramaAsyncProducer) deliveries() {
+	defer close(p.done)
+
+	successes, errs := p.producer.Successes(), p.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			p.complete(msg, nil)
+		case perr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			p.failed(perr.Msg, perr.Err)
+			p.complete(perr.Msg, perr.Err)
+		}
+	}
+}
+
+// complete observes the result of sending a message and ends its span.
+func (p *saramaAsyncProducer) complete(msg *sarama.ProducerMessage, err error) {
+	defer p.delivered()
+
+	d, ok := msg.Metadata.(delivery)
+	if !ok {
+		return
+	}
+
+	observeSend(msg.Topic, d.start, err)
+	if d.span != nil {
+		tracing.End(d.span, err)
+	}
+}
+
+func (p *saramaAsyncProducer) failed(msg *sarama.ProducerMessage, err error) {
+	if p.opts.onError != nil {
+		p.opts.onError(msg, err)
+		return
+	}
+
+	logger.Default().Error("deliver message",
+		logger.String("topic", msg.Topic),
+		logger.String("producer", p.opts.name),
+		logger.Err(err),
+	)
+}
+
+func (p *saramaAsyncProducer) delivered() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight--
+	if p.inFlight == 0 {
+		close(p.idle)
+	}
+}
+
+// Flush waits for the messages queued before to be delivered or failed, with the error callback called.
+func (p *saramaAsyncProducer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	idle := p.idle
+	p.mu.Unlock()
+
+	// A flushed producer is flushed even with ctx done, select would pick either case.
+	select {
+	case <-idle:
+		return nil
+	default:
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: flush producer: %v", ErrUnavailable, ctx.Err())
+	}
+}
+
+// Close stops accepting messages, waits for the queued ones to be delivered or failed and closes
+// a connection to kafka.
+func (p *saramaAsyncProducer) Close() error {
+	p.closeMu.Lock()
+	if p.closed {
+		p.closeMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.closeMu.Unlock()
+
+	p.producer.AsyncClose()
+	<-p.done
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"sync"
+	"testing"
+	"time"
+)
+
+// asyncProducer is a sarama producer delivering messages when a test tells it to. Messages are in flight
+// from being received with receive until being resolved with succeed or fail. Once closed, it closes
+// its successes and errors when no message is in flight, as sarama does.
+type asyncProducer struct {
+	sarama.AsyncProducer
+
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errs      chan *sarama.ProducerError
+
+	mu       sync.Mutex
+	inFlight int
+	closing  bool
+	closed   bool
+}
+
+func newAsyncProducer() *asyncProducer {
+	return &asyncProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage, 16),
+		errs:      make(chan *sarama.ProducerError, 16),
+	}
+}
+
+func (p *asyncProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *asyncProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *asyncProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errs
+}
+
+func (p *asyncProducer) AsyncClose() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closing = true
+	p.closeOutputs()
+}
+
+// closeOutputs closes successes and errors of the closing producer with no messages in flight. p.mu must be held.
+func (p *asyncProducer) closeOutputs() {
+	if p.closing && p.inFlight == 0 && !p.closed {
+		p.closed = true
+		close(p.successes)
+		close(p.errs)
+	}
+}
+
+// receive returns the next message sent to the producer.
+func (p *asyncProducer) receive(t *testing.T) *sarama.ProducerMessage {
+	t.Helper()
+
+	select {
+	case msg := <-p.input:
+		p.mu.Lock()
+		p.inFlight++
+		p.mu.Unlock()
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message sent")
+		return nil
+	}
+}
+
+func (p *asyncProducer) succeed(msg *sarama.ProducerMessage) {
+	p.successes <- msg
+	p.resolved()
+}
+
+func (p *asyncProducer) fail(msg *sarama.ProducerMessage, err error) {
+	p.errs <- &sarama.ProducerError{Msg: msg, Err: err}
+	p.resolved()
+}
+
+func (p *asyncProducer) resolved() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight--
+	p.closeOutputs()
+}
+
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// flushed reports whether Flush returns within a short time.
+func flushed(p flusher) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	return p.Flush(ctx) == nil
+}
+
+func TestAsyncProducer(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("flush waits for messages in flight", func(t *testing.T) {
+		sp := newAsyncProducer()
+		p, err := kafka.NewSaramaAsyncProducerFrom(sp, "orders")
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+
+		if !flushed(p) {
+			t.Fatal("flush idle producer: not flushed")
+		}
+
+		var msgs []*sarama.ProducerMessage
+		for _, key := range []string{"1", "2"} {
+			go func(key string) {
+				if err := p.SendMessage(ctx, key, "order"); err != nil {
+					t.Errorf("send message: %v", err)
+				}
+			}(key)
+			msgs = append(msgs, sp.receive(t))
+		}
+
+		if flushed(p) {
+			t.Fatal("flush with 2 messages in flight: flushed")
+		}
+
+		sp.succeed(msgs[0])
+		if flushed(p) {
+			t.Fatal("flush with a message in flight: flushed")
+		}
+
+		sp.succeed(msgs[1])
+		if !flushed(p) {
+			t.Fatal("flush with messages delivered: not flushed")
+		}
+
+		if err := p.Flush(canceled()); err != nil {
+			t.Fatalf("flush flushed producer: %v", err)
+		}
+	})
+
+	t.Run("flush timeout", func(t *testing.T) {
+		sp := newAsyncProducer()
+		p, err := kafka.NewSaramaAsyncProducerFrom(sp, "orders")
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+
+		go func() { _ = p.SendRawMessage(&sarama.ProducerMessage{Value: sarama.StringEncoder("order")}) }()
+		msg := sp.receive(t)
+
+		if err := p.Flush(canceled()); !errors.Is(err, kafka.ErrUnavailable) {
+			t.Fatalf("flush: got %v, want %v", err, kafka.ErrUnavailable)
+		}
+
+		sp.succeed(msg)
+		if !flushed(p) {
+			t.Fatal("flush with messages delivered: not flushed")
+		}
+	})
+
+	t.Run("delivery errors are reported", func(t *testing.T) {
+		errBroker := errors.New("broker down")
+
+		var mu sync.Mutex
+		var failed []error
+		sp := newAsyncProducer()
+		p, err := kafka.NewSaramaAsyncProducerFrom(sp, "orders", kafka.WithErrorHandler(func(msg *sarama.ProducerMessage, err error) {
+			mu.Lock()
+			failed = append(failed, err)
+			mu.Unlock()
+
+			if msg.Topic != "orders" {
+				t.Errorf("failed message topic: got %s, want orders", msg.Topic)
+			}
+		}))
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+
+		go func() {
+			if err := p.SendMessage(ctx, "1", "order"); err != nil {
+				t.Errorf("send message: %v", err)
+			}
+		}()
+		sp.fail(sp.receive(t), errBroker)
+
+		// The error is reported by the time the message is flushed.
+		if !flushed(p) {
+			t.Fatal("flush failed message: not flushed")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(failed) != 1 || !errors.Is(failed[0], errBroker) {
+			t.Fatalf("reported errors: got %v, want %v", failed, errBroker)
+		}
+	})
+
+	t.Run("canceled send is not in flight", func(t *testing.T) {
+		sp := newAsyncProducer()
+		p, err := kafka.NewSaramaAsyncProducerFrom(sp, "orders")
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+
+		// Nothing receives the message, so the send waits for the queue until ctx is done.
+		if err := p.SendMessage(canceled(), "1", "order"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("send message: got %v, want %v", err, context.Canceled)
+		}
+		if !flushed(p) {
+			t.Fatal("flush after canceled send: not flushed")
+		}
+	})
+
+	t.Run("close waits for messages in flight", func(t *testing.T) {
+		var mu sync.Mutex
+		var failed int
+		sp := newAsyncProducer()
+		p, err := kafka.NewSaramaAsyncProducerFrom(sp, "orders", kafka.WithErrorHandler(func(*sarama.ProducerMessage, error) {
+			mu.Lock()
+			failed++
+			mu.Unlock()
+		}))
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+
+		var msgs []*sarama.ProducerMessage
+		for _, key := range []string{"1", "2"} {
+			go func(key string) {
+				if err := p.SendMessage(ctx, key, "order"); err != nil {
+					t.Errorf("send message: %v", err)
+				}
+			}(key)
+			msgs = append(msgs, sp.receive(t))
+		}
+
+		closed := make(chan error)
+		go func() {
+			closed <- p.Close()
+		}()
+
+		sp.succeed(msgs[0])
+		select {
+		case <-closed:
+			t.Fatal("close returned with a message in flight")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		sp.fail(msgs[1], errors.New("broker down"))
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatalf("close: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("close has not returned with messages delivered")
+		}
+
+		mu.Lock()
+		if failed != 1 {
+			t.Errorf("reported errors: got %d, want 1", failed)
+		}
+		mu.Unlock()
+
+		if err := p.SendMessage(ctx, "3", "order"); !errors.Is(err, kafka.ErrProducerClosed) {
+			t.Fatalf("send to closed: got %v, want %v", err, kafka.ErrProducerClosed)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatalf("close again: %v", err)
+		}
+	})
+}
+
+// canceled returns a context that is done already.
+func canceled() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return ctx
+}
@@ -0,0 +1,20 @@
+package router
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+)
+
+type messageCtxKey struct{}
+
+// ContextWithMessage returns a copy of ctx carrying the kafka message being handled.
+// The router puts every message into the handler context, handlers called otherwise, e.g. in tests, may use it.
+func ContextWithMessage(ctx context.Context, msg *sarama.ConsumerMessage) context.Context {
+	return context.WithValue(ctx, messageCtxKey{}, msg)
+}
+
+// MessageFromContext returns the kafka message being handled.
+func MessageFromContext(ctx context.Context) (*sarama.ConsumerMessage, bool) {
+	msg, ok := ctx.Value(messageCtxKey{}).(*sarama.ConsumerMessage)
+	return msg, ok
+}
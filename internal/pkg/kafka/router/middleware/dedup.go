@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/dedup"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+)
+
+// SkipDuplicates acknowledges messages that have already been processed, see dedup.Claim.
+func SkipDuplicates(fn router.HandlerFunc) router.HandlerFunc {
+	return func(ctx context.Context, topic string, msg []byte) error {
+		err := fn(ctx, topic, msg)
+		if errors.Is(err, dedup.ErrDuplicate) {
+			logger.Info(ctx, "skip duplicate", logger.Err(err))
+			metrics.DuplicateMessages.WithLabelValues(topic).Inc()
+			return nil
+		}
+
+		return err
+	}
+}
@@ -3,17 +3,25 @@ package middleware
 import (
 	"context"
 	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
-	"log"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
 	"time"
 )
 
-// Logger write message handlers results to stdout.
+// Logger writes message handlers results along with the message fields, see logger.WithFields.
+// Message bodies are written at debug level only and have personal data redacted.
 func Logger(fn router.HandlerFunc) router.HandlerFunc {
 	return func(ctx context.Context, topic string, msg []byte) error {
+		logger.Debug(ctx, "message received", logger.JSON("payload", msg))
+
 		start := time.Now()
 		err := fn(ctx, topic, msg)
+		took := logger.Duration("duration", time.Since(start))
 
-		log.Printf("%s %s %v %v", topic, msg, err, time.Now().Sub(start))
+		if err != nil {
+			logger.Error(ctx, "message handled", took, logger.Err(err))
+		} else {
+			logger.Info(ctx, "message handled", took)
+		}
 
 		return err
 	}
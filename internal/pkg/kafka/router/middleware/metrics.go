@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"context"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"time"
+)
+
+// Metrics observes message handling latency and counts errors by class.
+func Metrics(classes metrics.ErrorClasses) router.Middleware {
+	return func(fn router.HandlerFunc) router.HandlerFunc {
+		return func(ctx context.Context, topic string, msg []byte) error {
+			start := time.Now()
+			err := fn(ctx, topic, msg)
+
+			metrics.HandlerDuration.WithLabelValues(topic, metrics.Result(err)).Observe(time.Since(start).Seconds())
+			if err != nil {
+				metrics.HandlerErrors.WithLabelValues(topic, classes.Classify(err)).Inc()
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"context"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/health"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+)
+
+// Progress makes handling a message a step of the progress, so a handler stuck on a message fails liveness.
+func Progress(p *health.Progress) router.Middleware {
+	return func(fn router.HandlerFunc) router.HandlerFunc {
+		return func(ctx context.Context, topic string, msg []byte) error {
+			defer p.Begin()()
+
+			return fn(ctx, topic, msg)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"strconv"
+	"time"
+)
+
+// Headers added to a message forwarded to a dead-letter topic.
+const (
+	HeaderDLQError             = "dlq-error"
+	HeaderDLQAttempts          = "dlq-attempts"
+	HeaderDLQOriginalTopic     = "dlq-original-topic"
+	HeaderDLQOriginalPartition = "dlq-original-partition"
+	HeaderDLQOriginalOffset    = "dlq-original-offset"
+	HeaderDLQFailedAt          = "dlq-failed-at"
+)
+
+// RetryPolicy describes how failed messages are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a handler is called before giving up.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt, it doubles with every next one.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts.
+	MaxBackoff time.Duration
+	// DeadLetterSuffix is appended to a topic name to get its dead-letter topic.
+	DeadLetterSuffix string
+	// Permanent errors are not retried, messages failed with them go to a dead-letter topic at once.
+	Permanent []error
+}
+
+// Retry calls a handler again with exponential backoff when it fails and forwards
+// the message to a dead-letter topic once the attempts are exhausted or the error is permanent.
+// The handler error of a forwarded message is router.Handled. If the message cannot be forwarded
+// either, the returned error wraps the dead-letter one, which is kafka.ErrInternal, and carries
+// the text of the handler error. In a transaction the message is forwarded as a part of it.
+func Retry(policy RetryPolicy, dlq kafka.RawProducer) router.Middleware {
+	return func(fn router.HandlerFunc) router.HandlerFunc {
+		return func(ctx context.Context, topic string, msg []byte) error {
+			var err error
+			var attempts int
+
+			maxAttempts := policy.MaxAttempts
+			if maxAttempts < 1 {
+				maxAttempts = 1
+			}
+
+			backoff := policy.InitialBackoff
+			for attempts < maxAttempts {
+				if attempts > 0 {
+					select {
+					case <-ctx.Done():
+						return fmt.Errorf("retry interrupted: %w", err)
+					case <-time.After(backoff):
+					}
+
+					backoff *= 2
+					if backoff > policy.MaxBackoff {
+						backoff = policy.MaxBackoff
+					}
+				}
+
+				attempts++
+				if err = fn(ctx, topic, msg); err == nil {
+					return nil
+				}
+
+				if policy.isPermanent(err) {
+					break
+				}
+
+				logger.Warn(ctx, "handle message attempt",
+					logger.Int("attempt", attempts),
+					logger.Int("max_attempts", maxAttempts),
+					logger.Err(err),
+				)
+			}
+
+			if dlqErr := sendToDeadLetter(ctx, dlq, topic+policy.DeadLetterSuffix, err, attempts); dlqErr != nil {
+				return fmt.Errorf("%v, dead letter: %w", err, dlqErr)
+			}
+
+			return router.Handled(err)
+		}
+	}
+}
+
+func (p RetryPolicy) isPermanent(err error) bool {
+	for _, target := range p.Permanent {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sendToDeadLetter(ctx context.Context, dlq kafka.RawProducer, topic string, err error, attempts int) error {
+	msg, ok := router.MessageFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("%w: no message in context", kafka.ErrInternal)
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+6)
+	for _, h := range msg.Headers {
+		headers = append(headers, *h)
+	}
+
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderDLQError), Value: []byte(err.Error())},
+		sarama.RecordHeader{Key: []byte(HeaderDLQAttempts), Value: []byte(strconv.Itoa(attempts))},
+		sarama.RecordHeader{Key: []byte(HeaderDLQOriginalTopic), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(HeaderDLQOriginalPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(HeaderDLQOriginalOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(HeaderDLQFailedAt), Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	dlqMsg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	if msg.Key != nil {
+		dlqMsg.Key = sarama.ByteEncoder(msg.Key)
+	}
+
+	send := dlq.SendRawMessage
+	if tx, ok := kafka.TxFromContext(ctx); ok {
+		send = tx.Send
+	}
+
+	if err := send(dlqMsg); err != nil {
+		return fmt.Errorf("%w: send message: %v", kafka.ErrInternal, err)
+	}
+
+	metrics.DeadLetters.WithLabelValues(msg.Topic).Inc()
+
+	return nil
+}
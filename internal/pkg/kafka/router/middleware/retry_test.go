@@ -0,0 +1,245 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router/middleware"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+// fakeProducer records the messages sent to dead-letter topics and fails with err if set.
+type fakeProducer struct {
+	err  error
+	sent []*sarama.ProducerMessage
+}
+
+func (p *fakeProducer) SendRawMessage(msg *sarama.ProducerMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	p.sent = append(p.sent, msg)
+	return nil
+}
+
+func (p *fakeProducer) Close() error {
+	return nil
+}
+
+func policy() middleware.RetryPolicy {
+	return middleware.RetryPolicy{
+		MaxAttempts:      3,
+		InitialBackoff:   time.Millisecond,
+		MaxBackoff:       2 * time.Millisecond,
+		DeadLetterSuffix: ".dlq",
+		Permanent:        []error{errPermanent},
+	}
+}
+
+// handlerContext returns the context of a handler called for the message at partition 2, offset 42 of orders.
+func handlerContext() context.Context {
+	return router.ContextWithMessage(context.Background(), &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    42,
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("message-id"), Value: []byte("id")},
+		},
+	})
+}
+
+// failing returns a handler failing with errs in turn, then succeeding, and the number of its calls.
+func failing(errs ...error) (router.HandlerFunc, *int) {
+	var calls int
+	return func(context.Context, string, []byte) error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func headers(msg *sarama.ProducerMessage) map[string]string {
+	m := make(map[string]string, len(msg.Headers))
+	for _, h := range msg.Headers {
+		m[string(h.Key)] = string(h.Value)
+	}
+	return m
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("succeeds after retries", func(t *testing.T) {
+		dlq := &fakeProducer{}
+		fn, calls := failing(errTransient, errTransient)
+
+		if err := middleware.Retry(policy(), dlq)(fn)(handlerContext(), "orders", nil); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+		if *calls != 3 {
+			t.Fatalf("calls: got %d, want 3", *calls)
+		}
+		if len(dlq.sent) != 0 {
+			t.Fatalf("dead letters: got %d, want none", len(dlq.sent))
+		}
+	})
+
+	t.Run("stops after max attempts", func(t *testing.T) {
+		dlq := &fakeProducer{}
+		fn, calls := failing(errTransient, errTransient, errTransient, errTransient)
+
+		err := middleware.Retry(policy(), dlq)(fn)(handlerContext(), "orders", nil)
+		if !errors.Is(err, errTransient) {
+			t.Fatalf("handle: got %v, want %v", err, errTransient)
+		}
+		if !router.IsHandled(err) {
+			t.Fatalf("handle: got %v, want it handled", err)
+		}
+		if *calls != 3 {
+			t.Fatalf("calls: got %d, want 3", *calls)
+		}
+		if len(dlq.sent) != 1 {
+			t.Fatalf("dead letters: got %d, want 1", len(dlq.sent))
+		}
+		if got := headers(dlq.sent[0])[middleware.HeaderDLQAttempts]; got != "3" {
+			t.Fatalf("attempts header: got %q, want 3", got)
+		}
+	})
+
+	t.Run("permanent error goes to dead letter at once", func(t *testing.T) {
+		dlq := &fakeProducer{}
+		fn, calls := failing(errPermanent)
+
+		err := middleware.Retry(policy(), dlq)(fn)(handlerContext(), "orders", nil)
+		if !errors.Is(err, errPermanent) {
+			t.Fatalf("handle: got %v, want %v", err, errPermanent)
+		}
+		if *calls != 1 {
+			t.Fatalf("calls: got %d, want 1", *calls)
+		}
+		if len(dlq.sent) != 1 {
+			t.Fatalf("dead letters: got %d, want 1", len(dlq.sent))
+		}
+		if dlq.sent[0].Topic != "orders.dlq" {
+			t.Fatalf("dead letter topic: got %s, want orders.dlq", dlq.sent[0].Topic)
+		}
+	})
+
+	t.Run("dead letter keeps message and adds headers", func(t *testing.T) {
+		dlq := &fakeProducer{}
+		fn, _ := failing(errPermanent)
+
+		_ = middleware.Retry(policy(), dlq)(fn)(handlerContext(), "orders", nil)
+		if len(dlq.sent) != 1 {
+			t.Fatalf("dead letters: got %d, want 1", len(dlq.sent))
+		}
+
+		msg := dlq.sent[0]
+		if key, _ := msg.Key.Encode(); string(key) != "key" {
+			t.Fatalf("key: got %q, want key", key)
+		}
+		if value, _ := msg.Value.Encode(); string(value) != "value" {
+			t.Fatalf("value: got %q, want value", value)
+		}
+
+		got := headers(msg)
+		want := map[string]string{
+			"message-id":                          "id",
+			middleware.HeaderDLQError:             errPermanent.Error(),
+			middleware.HeaderDLQAttempts:          "1",
+			middleware.HeaderDLQOriginalTopic:     "orders",
+			middleware.HeaderDLQOriginalPartition: "2",
+			middleware.HeaderDLQOriginalOffset:    "42",
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatalf("header %s: got %q, want %q", k, got[k], v)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, got[middleware.HeaderDLQFailedAt]); err != nil {
+			t.Fatalf("failed at header: %v", err)
+		}
+	})
+
+	t.Run("dead letter failure", func(t *testing.T) {
+		dlq := &fakeProducer{err: errors.New("broker down")}
+		fn, _ := failing(errPermanent)
+
+		err := middleware.Retry(policy(), dlq)(fn)(handlerContext(), "orders", nil)
+		if !errors.Is(err, kafka.ErrInternal) {
+			t.Fatalf("handle: got %v, want %v", err, kafka.ErrInternal)
+		}
+		if !strings.Contains(err.Error(), errPermanent.Error()) {
+			t.Fatalf("handle: got %v, want the handler error in it", err)
+		}
+		if router.IsHandled(err) {
+			t.Fatalf("handle: got %v handled, want it failed", err)
+		}
+	})
+
+	t.Run("dead letter in transaction", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		dlq := &fakeProducer{}
+		fn, _ := failing(errPermanent)
+
+		tx, err := b.TxProducer().Begin()
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+
+		ctx := kafka.ContextWithTx(handlerContext(), tx)
+		if err := middleware.Retry(policy(), dlq)(fn)(ctx, "orders", nil); !router.IsHandled(err) {
+			t.Fatalf("handle: got %v, want it handled", err)
+		}
+		if len(dlq.sent) != 0 {
+			t.Fatalf("dead letters sent outside the transaction: got %d, want none", len(dlq.sent))
+		}
+		if n := len(b.Messages("orders.dlq")); n != 0 {
+			t.Fatalf("dead letters before commit: got %d, want none", n)
+		}
+
+		msg, _ := router.MessageFromContext(ctx)
+		if err := tx.Commit(msg, "group"); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if n := len(b.Messages("orders.dlq")); n != 1 {
+			t.Fatalf("dead letters: got %d, want 1", n)
+		}
+	})
+
+	t.Run("interrupted backoff", func(t *testing.T) {
+		dlq := &fakeProducer{}
+		fn, calls := failing(errTransient, errTransient)
+
+		p := policy()
+		p.InitialBackoff = time.Hour
+		p.MaxBackoff = time.Hour
+
+		ctx, cancel := context.WithCancel(handlerContext())
+		cancel()
+
+		err := middleware.Retry(p, dlq)(fn)(ctx, "orders", nil)
+		if !errors.Is(err, errTransient) {
+			t.Fatalf("handle: got %v, want %v", err, errTransient)
+		}
+		if *calls != 1 {
+			t.Fatalf("calls: got %d, want 1", *calls)
+		}
+		if len(dlq.sent) != 0 {
+			t.Fatalf("dead letters: got %d, want none", len(dlq.sent))
+		}
+	})
+}
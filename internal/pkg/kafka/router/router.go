@@ -2,17 +2,95 @@ package router
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Shopify/sarama"
-	"log"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/metrics"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"hash/fnv"
+	"strconv"
 	"sync"
 )
 
+var tracer = otel.Tracer("gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router")
+
 // HandlerFunc receives a topic name with a message from kafka and handles is somehow.
 type HandlerFunc func(ctx context.Context, topic string, msg []byte) error
 
+// Handled wraps the error of a handler that is done with the message nevertheless, e.g. has forwarded it
+// to a dead-letter topic. The message is not handled again, while the other errors abort its transaction,
+// see WithTransactions.
+func Handled(err error) error {
+	return handledError{err: err}
+}
+
+type handledError struct {
+	err error
+}
+
+func (e handledError) Error() string {
+	return e.err.Error()
+}
+
+func (e handledError) Unwrap() error {
+	return e.err
+}
+
+// IsHandled reports whether err is Handled.
+func IsHandled(err error) bool {
+	var handled handledError
+	return errors.As(err, &handled)
+}
+
 // Middleware takes HandlerFunc in and returns HandlerFunc as well.
 type Middleware func(fn HandlerFunc) HandlerFunc
 
+// Option configures SaramaRouter.
+type Option func(r *SaramaRouter)
+
+// WithWorkers makes the router handle messages of a partition with n workers.
+// Messages with the same key are always handled by the same worker, so their order is preserved.
+func WithWorkers(n int) Option {
+	return func(r *SaramaRouter) {
+		r.workers = n
+	}
+}
+
+// WithMiddlewares adds middlewares to the router. They wrap the ones added with Use.
+func WithMiddlewares(mws ...Middleware) Option {
+	return func(r *SaramaRouter) {
+		r.middlewares = append(r.middlewares, mws...)
+	}
+}
+
+// WithCodecs makes the router decode messages encoded with the codecs besides JSON ones.
+// A codec is selected by the message content type and is put into the handler context,
+// handlers decode messages with kafka.Decode.
+func WithCodecs(codecs ...kafka.Codec) Option {
+	return func(r *SaramaRouter) {
+		r.codecs = kafka.NewCodecs(codecs...)
+	}
+}
+
+// WithTransactions makes the router handle every message in a kafka transaction of the producer:
+// the messages handlers send with the handler context and the offset of the message are committed
+// together, see kafka.Tx. Side effects beyond kafka, e.g. database writes, are not part of it.
+// Messages of a partition are handled one by one then, regardless of WithWorkers, and partitions
+// wait for each other, as the producer runs a transaction at a time. A handler error aborts the transaction,
+// so the message is handled again, unless the error is Handled. groupID is the consumer group
+// the router handles messages of.
+func WithTransactions(p kafka.TxProducer, groupID string) Option {
+	return func(r *SaramaRouter) {
+		r.txProducer = p
+		r.groupID = groupID
+	}
+}
+
 // SaramaRouter routes incoming kafka messages and route them out between handlers based on topic names.
 type SaramaRouter struct {
 	handlers map[string][]HandlerFunc
@@ -20,13 +98,33 @@ type SaramaRouter struct {
 
 	middlewares []Middleware
 	mm          sync.RWMutex
+
+	workers int
+	codecs  kafka.Codecs
+
+	txProducer kafka.TxProducer
+	groupID    string
+
+	// ctx is the base context of handlers. It is not derived from a session context,
+	// so handlers in flight complete when consuming stops, unless Abort is called.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewSaramaRouter craetes an instance of SaramaRouter.
-func NewSaramaRouter() *SaramaRouter {
-	return &SaramaRouter{
+// Messages of a partition are handled one by one unless WithWorkers is provided.
+func NewSaramaRouter(opts ...Option) *SaramaRouter {
+	r := &SaramaRouter{
 		handlers: make(map[string][]HandlerFunc),
+		codecs:   kafka.NewCodecs(),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(r)
 	}
+
+	return r
 }
 
 // Handle binds a provided HandlerFunc to a given topic.
@@ -44,7 +142,7 @@ func (r *SaramaRouter) Use(m Middleware) {
 	r.hm.RLock()
 	defer r.hm.RUnlock()
 	if len(r.handlers) > 0 {
-		log.Panic("Use method must be used before any route is set")
+		panic("Use method must be used before any route is set")
 	}
 
 	r.mm.Lock()
@@ -62,6 +160,11 @@ func (r *SaramaRouter) wrap(fn HandlerFunc) HandlerFunc {
 	return fn
 }
 
+// Abort cancels the context of handlers in flight, e.g. when they have not completed in time on shutdown.
+func (r *SaramaRouter) Abort() {
+	r.cancel()
+}
+
 // Setup does nothing but makes SaramaRouter match sarama.ConsumerGroupHandler interface.
 func (r *SaramaRouter) Setup(s sarama.ConsumerGroupSession) error {
 	return nil
@@ -73,32 +176,262 @@ func (r *SaramaRouter) Cleanup(s sarama.ConsumerGroupSession) error {
 }
 
 // ConsumeClaim receives messages from a channel and calls appropriate handlers based on routes.
+// A message offset is marked only after all the handlers of the message have returned.
+// Handling in flight at the session end is completed and marked; messages interrupted
+// by Abort are left unmarked to be consumed again.
 func (r *SaramaRouter) ConsumeClaim(s sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if r.txProducer != nil {
+		return r.consumeTransactionally(s, claim)
+	}
+
+	if r.workers > 1 {
+		return r.consumeConcurrently(s, claim)
+	}
+
 	for {
 		select {
 		case <-s.Context().Done():
 			return nil
 		case msg, ok := <-claim.Messages():
-			if !ok {
+			if !ok || s.Context().Err() != nil {
 				return nil
 			}
 
-			r.hm.RLock()
-			for topic, topicHandlers := range r.handlers {
-				if msg.Topic == topic {
-					for _, handle := range topicHandlers {
-						topic := topic
-						go func() {
-							if err := handle(s.Context(), topic, msg.Value); err != nil {
-								log.Printf("handle message err: %v", err)
-							}
-						}()
-					}
+			observeLag(claim, msg)
+			r.handle(r.ctx, msg)
+			if r.ctx.Err() != nil {
+				return nil
+			}
+			s.MarkMessage(msg, "")
+		}
+	}
+}
+
+// consumeConcurrently distributes messages between workers by key. Offsets are marked
+// in the order messages were received, so a message is never committed before
+// the ones preceding it in the partition.
+func (r *SaramaRouter) consumeConcurrently(s sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := newOffsetTracker(s, claim.Topic(), claim.Partition())
+
+	var wg sync.WaitGroup
+	queues := make([]chan *sarama.ConsumerMessage, r.workers)
+	for i := range queues {
+		queue := make(chan *sarama.ConsumerMessage)
+		queues[i] = queue
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range queue {
+				r.handle(r.ctx, msg)
+				if r.ctx.Err() == nil {
+					tracker.done(msg.Offset)
 				}
 			}
-			r.hm.RUnlock()
+		}()
+	}
+
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-s.Context().Done():
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+
+			observeLag(claim, msg)
+			tracker.add(msg.Offset)
+
+			select {
+			case <-s.Context().Done():
+				return nil
+			case queues[r.worker(msg)] <- msg:
+			}
 		}
 	}
+}
+
+// consumeTransactionally handles messages one by one, each in a transaction committing its offset.
+// Offsets are not marked in the session. A failed handler or transaction ends the session, so the messages
+// starting from the committed offset are consumed again once the consumer rejoins the group.
+func (r *SaramaRouter) consumeTransactionally(s sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case <-s.Context().Done():
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok || s.Context().Err() != nil {
+				return nil
+			}
+
+			observeLag(claim, msg)
+			if err := r.handleTx(msg); err != nil {
+				return err
+			}
+			if r.ctx.Err() != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// handleTx handles the message in a transaction, which is aborted if the handling is aborted or fails.
+func (r *SaramaRouter) handleTx(msg *sarama.ConsumerMessage) error {
+	tx, err := r.txProducer.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+
+	err = r.handle(kafka.ContextWithTx(r.ctx, tx), msg)
+
+	if r.ctx.Err() != nil {
+		if err := tx.Abort(); err != nil {
+			return fmt.Errorf("abort transaction: %w", err)
+		}
+		return nil
+	}
+
+	if err != nil {
+		if abortErr := tx.Abort(); abortErr != nil {
+			return fmt.Errorf("handle message: %w, abort: %v", err, abortErr)
+		}
+		return fmt.Errorf("handle message: %w", err)
+	}
+
+	if err := tx.Commit(msg, r.groupID); err != nil {
+		if abortErr := tx.Abort(); abortErr != nil {
+			return fmt.Errorf("commit transaction: %w, abort: %v", err, abortErr)
+		}
+		return fmt.Errorf("commit transaction: %w", err)
+	}
 
 	return nil
 }
+
+// observeLag updates the partition lag with the messages left after msg.
+func observeLag(claim sarama.ConsumerGroupClaim, msg *sarama.ConsumerMessage) {
+	lag := claim.HighWaterMarkOffset() - msg.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+
+	metrics.ConsumerLag.WithLabelValues(msg.Topic, strconv.Itoa(int(msg.Partition))).Set(float64(lag))
+}
+
+func (r *SaramaRouter) worker(msg *sarama.ConsumerMessage) int {
+	if len(msg.Key) == 0 {
+		return int(msg.Offset % int64(r.workers))
+	}
+
+	h := fnv.New32a()
+	h.Write(msg.Key)
+
+	return int(h.Sum32() % uint32(r.workers))
+}
+
+// handle calls the handlers of the message topic and returns the first error that is not Handled.
+func (r *SaramaRouter) handle(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	r.hm.RLock()
+	topicHandlers := r.handlers[msg.Topic]
+	r.hm.RUnlock()
+
+	env := kafka.EnvelopeFromHeaders(msg.Headers)
+
+	ctx = ContextWithMessage(ctx, msg)
+	ctx = kafka.ContextWithEnvelope(ctx, env)
+	ctx = kafka.ContextWithCodec(ctx, r.codecs.ForHeaders(msg.Headers))
+	ctx = logger.WithFields(ctx,
+		logger.String("topic", msg.Topic),
+		logger.Int64("partition", int64(msg.Partition)),
+		logger.Int64("offset", msg.Offset),
+		logger.String("message_id", env.MessageID),
+		logger.String("correlation_id", env.CorrelationID),
+	)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, kafka.ConsumerHeadersCarrier(msg.Headers))
+
+	var handleErr error
+	for _, handle := range topicHandlers {
+		hctx, span := tracer.Start(ctx, msg.Topic+" process",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("kafka"),
+				semconv.MessagingOperationProcess,
+				semconv.MessagingDestinationKindTopic,
+				semconv.MessagingDestinationKey.String(msg.Topic),
+				semconv.MessagingMessageIDKey.String(env.MessageID),
+				semconv.MessagingConversationIDKey.String(env.CorrelationID),
+				semconv.MessagingKafkaPartitionKey.Int64(int64(msg.Partition)),
+				semconv.MessagingKafkaMessageKeyKey.String(string(msg.Key)),
+			),
+		)
+
+		err := handle(hctx, msg.Topic, msg.Value)
+		if err != nil {
+			logger.Error(hctx, "handle message", logger.Err(err))
+
+			if handleErr == nil && !IsHandled(err) {
+				handleErr = err
+			}
+		}
+
+		tracing.End(span, err)
+	}
+
+	return handleErr
+}
+
+// offsetTracker marks the highest offset below which all the messages are handled.
+type offsetTracker struct {
+	session   sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+
+	mu      sync.Mutex
+	pending []int64
+	handled map[int64]struct{}
+}
+
+func newOffsetTracker(s sarama.ConsumerGroupSession, topic string, partition int32) *offsetTracker {
+	return &offsetTracker{
+		session:   s,
+		topic:     topic,
+		partition: partition,
+		handled:   make(map[int64]struct{}),
+	}
+}
+
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	t.pending = append(t.pending, offset)
+	t.mu.Unlock()
+}
+
+func (t *offsetTracker) done(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.handled[offset] = struct{}{}
+
+	next := int64(-1)
+	for len(t.pending) > 0 {
+		if _, ok := t.handled[t.pending[0]]; !ok {
+			break
+		}
+
+		next = t.pending[0] + 1
+		delete(t.handled, t.pending[0])
+		t.pending = t.pending[1:]
+	}
+
+	if next >= 0 {
+		t.session.MarkOffset(t.topic, t.partition, next, "")
+	}
+}
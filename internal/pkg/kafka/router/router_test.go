@@ -0,0 +1,390 @@
+package router_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/router"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	topic = "orders"
+
+	// settle is how long a test waits for something that must not happen.
+	settle = 50 * time.Millisecond
+)
+
+// fakeSession records the offsets marked by the router.
+type fakeSession struct {
+	ctx context.Context
+
+	mu     sync.Mutex
+	marked []int64
+}
+
+func newFakeSession(ctx context.Context) *fakeSession {
+	return &fakeSession{ctx: ctx}
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return map[string][]int32{topic: {0}} }
+func (s *fakeSession) MemberID() string           { return "member" }
+func (s *fakeSession) GenerationID() int32        { return 1 }
+func (s *fakeSession) Commit()                    {}
+func (s *fakeSession) Context() context.Context   { return s.ctx }
+
+func (s *fakeSession) MarkOffset(_ string, _ int32, offset int64, _ string) {
+	s.mu.Lock()
+	s.marked = append(s.marked, offset)
+	s.mu.Unlock()
+}
+
+func (s *fakeSession) ResetOffset(string, int32, int64, string) {}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *fakeSession) Marked() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int64(nil), s.marked...)
+}
+
+// fakeClaim feeds the messages of a partition.
+type fakeClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func newFakeClaim(msgs ...*sarama.ConsumerMessage) *fakeClaim {
+	c := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, len(msgs))}
+	for _, msg := range msgs {
+		c.messages <- msg
+	}
+	return c
+}
+
+func (c *fakeClaim) Topic() string                            { return topic }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return int64(cap(c.messages)) }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// message returns the message at the offset, its value is the offset.
+func message(offset int64, key string) *sarama.ConsumerMessage {
+	msg := &sarama.ConsumerMessage{
+		Topic:  topic,
+		Offset: offset,
+		Value:  []byte(strconv.FormatInt(offset, 10)),
+	}
+	if key != "" {
+		msg.Key = []byte(key)
+	}
+	return msg
+}
+
+func offsetOf(t *testing.T, value []byte) int64 {
+	offset, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		t.Errorf("parse offset: %v", err)
+	}
+	return offset
+}
+
+// consume runs ConsumeClaim in the background and returns the channel its result is sent to.
+func consume(r *router.SaramaRouter, s *fakeSession, c *fakeClaim) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- r.ConsumeClaim(s, c) }()
+	return done
+}
+
+func wait(t *testing.T, done <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("consume claim: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consume claim has not returned")
+	}
+}
+
+// waitMarked waits until the offset is the last one marked.
+func waitMarked(t *testing.T, s *fakeSession, offset int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		marked := s.Marked()
+		if len(marked) > 0 && marked[len(marked)-1] == offset {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("marked offsets: got %v, want %d last", marked, offset)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkersPreserveKeyOrder(t *testing.T) {
+	const keys, perKey = 5, 40
+
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < keys*perKey; i++ {
+		msgs = append(msgs, message(int64(i), fmt.Sprintf("key-%d", i%keys)))
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string][]int64)
+
+	r := router.NewSaramaRouter(router.WithWorkers(4))
+	r.Handle(topic, func(ctx context.Context, _ string, value []byte) error {
+		msg, _ := router.MessageFromContext(ctx)
+		offset := offsetOf(t, value)
+
+		// Later messages finish first unless the worker keeps them in order.
+		time.Sleep(time.Duration(keys*perKey-offset) * time.Microsecond * 10)
+
+		mu.Lock()
+		handled[string(msg.Key)] = append(handled[string(msg.Key)], offset)
+		mu.Unlock()
+		return nil
+	})
+
+	s := newFakeSession(context.Background())
+	c := newFakeClaim(msgs...)
+	close(c.messages)
+
+	wait(t, consume(r, s, c))
+
+	for key, offsets := range handled {
+		if len(offsets) != perKey {
+			t.Fatalf("messages of %s: got %d, want %d", key, len(offsets), perKey)
+		}
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] <= offsets[i-1] {
+				t.Fatalf("messages of %s handled out of order: %v", key, offsets)
+			}
+		}
+	}
+
+	if marked := s.Marked(); len(marked) == 0 || marked[len(marked)-1] != keys*perKey {
+		t.Fatalf("marked offsets: got %v, want %d last", marked, keys*perKey)
+	}
+}
+
+func TestWorkersMarkHandledPrefix(t *testing.T) {
+	release := make(chan struct{})
+	var handled sync.WaitGroup
+	handled.Add(2)
+
+	// Messages without keys are distributed by offset, so each goes to a worker of its own.
+	r := router.NewSaramaRouter(router.WithWorkers(3))
+	r.Handle(topic, func(_ context.Context, _ string, value []byte) error {
+		if offsetOf(t, value) == 0 {
+			<-release
+			return nil
+		}
+		handled.Done()
+		return nil
+	})
+
+	s := newFakeSession(context.Background())
+	c := newFakeClaim(message(0, ""), message(1, ""), message(2, ""))
+	done := consume(r, s, c)
+
+	// Offsets 1 and 2 complete first, but nothing is marked while offset 0 is in flight.
+	handled.Wait()
+	time.Sleep(settle)
+	if marked := s.Marked(); len(marked) != 0 {
+		t.Fatalf("marked offsets: got %v, want none", marked)
+	}
+
+	close(release)
+	waitMarked(t, s, 3)
+
+	close(c.messages)
+	wait(t, done)
+
+	if marked := s.Marked(); !reflect.DeepEqual(marked, []int64{3}) {
+		t.Fatalf("marked offsets: got %v, want [3]", marked)
+	}
+}
+
+func TestWorkersShutdownMidBatch(t *testing.T) {
+	t.Run("in flight completes", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		completed := make(chan struct{})
+
+		var mu sync.Mutex
+		var handled []int64
+
+		r := router.NewSaramaRouter(router.WithWorkers(2))
+		r.Handle(topic, func(_ context.Context, _ string, value []byte) error {
+			offset := offsetOf(t, value)
+			if offset == 0 {
+				close(started)
+				<-release
+			}
+
+			mu.Lock()
+			handled = append(handled, offset)
+			mu.Unlock()
+
+			if offset == 1 {
+				close(completed)
+			}
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s := newFakeSession(ctx)
+		// Offset 2 waits for the busy worker of offset 0 and offset 3 is never received.
+		c := newFakeClaim(message(0, ""), message(1, ""), message(2, ""), message(3, ""))
+		done := consume(r, s, c)
+
+		<-started
+		<-completed
+
+		cancel()
+		time.Sleep(settle)
+		select {
+		case <-done:
+			t.Fatal("consume claim returned before the message in flight has been handled")
+		default:
+		}
+
+		close(release)
+		wait(t, done)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if want := []int64{1, 0}; !reflect.DeepEqual(handled, want) {
+			t.Fatalf("handled offsets: got %v, want %v", handled, want)
+		}
+		// Offset 2 has been received but not handled, so it is consumed again.
+		if marked := s.Marked(); len(marked) == 0 || marked[len(marked)-1] != 2 {
+			t.Fatalf("marked offsets: got %v, want 2 last", marked)
+		}
+	})
+
+	t.Run("aborted is not marked", func(t *testing.T) {
+		started := make(chan struct{})
+
+		r := router.NewSaramaRouter(router.WithWorkers(2))
+		r.Handle(topic, func(ctx context.Context, _ string, value []byte) error {
+			if offsetOf(t, value) == 0 {
+				close(started)
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s := newFakeSession(ctx)
+		c := newFakeClaim(message(0, ""), message(1, ""))
+		done := consume(r, s, c)
+
+		<-started
+		cancel()
+		r.Abort()
+		wait(t, done)
+
+		if marked := s.Marked(); len(marked) != 0 {
+			t.Fatalf("marked offsets: got %v, want none", marked)
+		}
+	})
+}
+
+func TestTransactions(t *testing.T) {
+	// handle sends a message with the value of the consumed one to replies and returns the error of the attempt.
+	handle := func(t *testing.T, b *kafkatest.Broker, errs ...error) (router.HandlerFunc, *int32) {
+		replies, err := b.Producer("replies")
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+
+		var calls int32
+		return func(ctx context.Context, _ string, value []byte) error {
+			attempt := atomic.AddInt32(&calls, 1)
+			if err := replies.SendMessage(ctx, "key", string(value)); err != nil {
+				return err
+			}
+			if int(attempt) <= len(errs) {
+				return errs[attempt-1]
+			}
+			return nil
+		}, &calls
+	}
+
+	run := func(t *testing.T, b *kafkatest.Broker, fn router.HandlerFunc) {
+		r := router.NewSaramaRouter(router.WithTransactions(b.TxProducer(), "group"))
+		r.Handle(topic, fn)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		b.NewConsumer(ctx, []string{topic}, "group", r)
+
+		if _, _, err := b.SyncProducer().SendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.StringEncoder("order")}); err != nil {
+			t.Fatalf("send message: %v", err)
+		}
+
+		wctx, wcancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer wcancel()
+		if err := b.WaitIdle(wctx); err != nil {
+			t.Fatalf("wait idle: %v", err)
+		}
+	}
+
+	t.Run("commits handled message", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		fn, calls := handle(t, b)
+		run(t, b, fn)
+
+		if n := atomic.LoadInt32(calls); n != 1 {
+			t.Fatalf("calls: got %d, want 1", n)
+		}
+		if n := len(b.Messages("replies")); n != 1 {
+			t.Fatalf("replies: got %d, want 1", n)
+		}
+	})
+
+	t.Run("aborts on handler error", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		fn, calls := handle(t, b, errors.New("transient"))
+		run(t, b, fn)
+
+		// The message is handled again and the reply of the failed attempt is discarded.
+		if n := atomic.LoadInt32(calls); n != 2 {
+			t.Fatalf("calls: got %d, want 2", n)
+		}
+		if n := len(b.Messages("replies")); n != 1 {
+			t.Fatalf("replies: got %d, want 1", n)
+		}
+	})
+
+	t.Run("commits handled error", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		fn, calls := handle(t, b, router.Handled(errors.New("dead-lettered")))
+		run(t, b, fn)
+
+		if n := atomic.LoadInt32(calls); n != 1 {
+			t.Fatalf("calls: got %d, want 1", n)
+		}
+		if n := len(b.Messages("replies")); n != 1 {
+			t.Fatalf("replies: got %d, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// HeadersCarrier adapts headers of a message being sent to propagation.TextMapCarrier,
+// so trace context can be injected into them.
+type HeadersCarrier struct {
+	Headers *[]sarama.RecordHeader
+}
+
+// Get returns the value of the header with the key.
+func (c HeadersCarrier) Get(key string) string {
+	for _, h := range *c.Headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set replaces the value of the header with the key or adds the header.
+func (c HeadersCarrier) Set(key string, value string) {
+	for i, h := range *c.Headers {
+		if string(h.Key) == key {
+			(*c.Headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.Headers = append(*c.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+// Keys lists the header keys.
+func (c HeadersCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.Headers))
+	for _, h := range *c.Headers {
+		keys = append(keys, string(h.Key))
+	}
+	return keys
+}
+
+// ConsumerHeadersCarrier adapts headers of a consumed message to propagation.TextMapCarrier,
+// so trace context can be extracted from them. Set does nothing.
+type ConsumerHeadersCarrier []*sarama.RecordHeader
+
+// Get returns the value of the header with the key.
+func (c ConsumerHeadersCarrier) Get(key string) string {
+	for _, h := range c {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set does nothing, consumed messages are read only.
+func (c ConsumerHeadersCarrier) Set(string, string) {}
+
+// Keys lists the header keys.
+func (c ConsumerHeadersCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for _, h := range c {
+		if h != nil {
+			keys = append(keys, string(h.Key))
+		}
+	}
+	return keys
+}
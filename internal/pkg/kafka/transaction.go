@@ -0,0 +1,217 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"sync"
+	"time"
+)
+
+// ErrTxDone is returned by a transaction that has already been committed or aborted.
+var ErrTxDone = errors.New("transaction has already been committed or aborted")
+
+// TxProducer runs kafka transactions, one at a time.
+type TxProducer interface {
+	// Begin starts a transaction, waiting for the one in progress to be committed or aborted.
+	Begin() (Tx, error)
+	Close() error
+}
+
+// Tx is a kafka transaction. The messages producers send with a context carrying the transaction,
+// see ContextWithTx, are part of it and become visible to read_committed consumers on Commit.
+type Tx interface {
+	// Send adds a message to the transaction.
+	Send(msg *sarama.ProducerMessage) error
+	// Commit adds the offset of the message following msg to the transaction and commits it,
+	// so the consumer group consumes msg if and only if the messages sent are delivered.
+	Commit(msg *sarama.ConsumerMessage, groupID string) error
+	// Abort discards the messages sent, the consumed offset is not committed.
+	Abort() error
+}
+
+type txCtxKey struct{}
+
+// ContextWithTx returns a copy of ctx carrying the transaction, producers send messages to it.
+func ContextWithTx(ctx context.Context, tx Tx) context.Context {
+	return context.WithValue(ctx, txCtxKey{}, tx)
+}
+
+// TxFromContext returns the transaction carried by ctx.
+func TxFromContext(ctx context.Context) (Tx, bool) {
+	tx, ok := ctx.Value(txCtxKey{}).(Tx)
+	return tx, ok
+}
+
+type saramaTxProducer struct {
+	newProducer func() (sarama.SyncProducer, error)
+
+	// mu is held while a transaction is in progress.
+	mu sync.Mutex
+
+	// pmu guards producer against Close, it is replaced in Begin only, while mu is held.
+	pmu      sync.Mutex
+	producer sarama.SyncProducer
+}
+
+// NewSaramaTxProducer creates an instance of saramaTxProducer. The transactional id must be unique
+// among the producer instances, as kafka fences off the older producers with the same one.
+// Transactional producers are idempotent, so they require kafka 0.11 at least.
+func NewSaramaTxProducer(cfg util.KafkaConfig, transactionalID string) (*saramaTxProducer, error) {
+	c, err := NewSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Producer.Return.Successes = true
+	c.Producer.Transaction.ID = transactionalID
+	c.Producer.Idempotent = true
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Net.MaxOpenRequests = 1
+	if !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+		c.Version = sarama.V0_11_0_0
+	}
+
+	return NewTxProducer(func() (sarama.SyncProducer, error) {
+		return sarama.NewSyncProducer(cfg.Brokers, c)
+	})
+}
+
+// NewTxProducer creates an instance of saramaTxProducer running transactions with a transactional
+// producer newProducer creates. A producer in a fatal state, e.g. having failed to abort a transaction,
+// runs no transactions any longer, so it is closed and replaced with a new one on the next Begin.
+func NewTxProducer(newProducer func() (sarama.SyncProducer, error)) (*saramaTxProducer, error) {
+	producer, err := newProducer()
+	if err != nil {
+		return nil, fmt.Errorf("%w: init transactional producer err: %v", ErrInternal, err)
+	}
+
+	return &saramaTxProducer{
+		newProducer: newProducer,
+		producer:    producer,
+	}, nil
+}
+
+func (p *saramaTxProducer) Begin() (Tx, error) {
+	p.mu.Lock()
+
+	if p.producer.TxnStatus()&sarama.ProducerTxnFlagFatalError != 0 {
+		if err := p.renew(); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	if err := p.producer.BeginTxn(); err != nil {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("%w: begin transaction: %v", ErrInternal, err)
+	}
+
+	return &saramaTx{p: p}, nil
+}
+
+// renew replaces the producer in a fatal state with a new one, which fences off the transactions
+// the old one left open. p.mu must be held.
+func (p *saramaTxProducer) renew() error {
+	logger.Default().Warn("renew transactional producer in a fatal state")
+
+	if err := p.producer.Close(); err != nil {
+		logger.Default().Error("close transactional producer", logger.Err(err))
+	}
+
+	producer, err := p.newProducer()
+	if err != nil {
+		return fmt.Errorf("%w: renew transactional producer: %v", ErrInternal, err)
+	}
+
+	p.pmu.Lock()
+	p.producer = producer
+	p.pmu.Unlock()
+
+	return nil
+}
+
+// Close aborts the transaction in progress, if any, and closes a connection to kafka.
+func (p *saramaTxProducer) Close() error {
+	p.pmu.Lock()
+	producer := p.producer
+	p.pmu.Unlock()
+
+	if err := producer.Close(); err != nil {
+		return fmt.Errorf("%w: close transactional producer err: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+type saramaTx struct {
+	p *saramaTxProducer
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (tx *saramaTx) Send(msg *sarama.ProducerMessage) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+
+	start := time.Now()
+	_, _, err := tx.p.producer.SendMessage(msg)
+	observeSend(msg.Topic, start, err)
+
+	return err
+}
+
+func (tx *saramaTx) Commit(msg *sarama.ConsumerMessage, groupID string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if err := tx.p.producer.AddMessageToTxn(msg, groupID, nil); err != nil {
+		return fmt.Errorf("%w: add offset to transaction: %v", ErrInternal, err)
+	}
+
+	if err := tx.p.producer.CommitTxn(); err != nil {
+		return fmt.Errorf("%w: commit transaction: %v", ErrInternal, err)
+	}
+
+	tx.finish()
+
+	return nil
+}
+
+func (tx *saramaTx) Abort() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.finish()
+
+	if tx.p.producer.TxnStatus()&sarama.ProducerTxnFlagFatalError != 0 {
+		return fmt.Errorf("%w: abort transaction: producer is in a fatal state", ErrInternal)
+	}
+
+	if err := tx.p.producer.AbortTxn(); err != nil {
+		return fmt.Errorf("%w: abort transaction: %v", ErrInternal, err)
+	}
+
+	return nil
+}
+
+// finish releases the producer for the next transaction.
+func (tx *saramaTx) finish() {
+	tx.done = true
+	tx.p.mu.Unlock()
+}
@@ -0,0 +1,279 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/sarama"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/kafka/kafkatest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// txnProducer is a transactional sarama producer sending messages to the in-memory broker right away.
+// It records the transaction calls and fails commits with commitErr if set.
+type txnProducer struct {
+	sarama.SyncProducer
+
+	mu        sync.Mutex
+	status    sarama.ProducerTxnStatusFlag
+	commitErr error
+	calls     []string
+	closed    bool
+}
+
+func newTxnProducer(b *kafkatest.Broker) *txnProducer {
+	return &txnProducer{SyncProducer: b.SyncProducer(), status: sarama.ProducerTxnFlagReady}
+}
+
+func (p *txnProducer) call(name string) {
+	p.mu.Lock()
+	p.calls = append(p.calls, name)
+	p.mu.Unlock()
+}
+
+func (p *txnProducer) Calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.calls...)
+}
+
+func (p *txnProducer) TxnStatus() sarama.ProducerTxnStatusFlag {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.status
+}
+
+func (p *txnProducer) IsTransactional() bool {
+	return true
+}
+
+func (p *txnProducer) BeginTxn() error {
+	p.call("begin")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.status&sarama.ProducerTxnFlagFatalError != 0 {
+		return errors.New("producer in fatal state")
+	}
+	p.status = sarama.ProducerTxnFlagInTransaction
+
+	return nil
+}
+
+func (p *txnProducer) AddMessageToTxn(*sarama.ConsumerMessage, string, *string) error {
+	p.call("add offset")
+	return nil
+}
+
+func (p *txnProducer) CommitTxn() error {
+	p.call("commit")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.commitErr != nil {
+		return p.commitErr
+	}
+	p.status = sarama.ProducerTxnFlagReady
+
+	return nil
+}
+
+func (p *txnProducer) AbortTxn() error {
+	p.call("abort")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.status = sarama.ProducerTxnFlagReady
+
+	return nil
+}
+
+func (p *txnProducer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	return nil
+}
+
+func TestTxProducer(t *testing.T) {
+	consumed := &sarama.ConsumerMessage{Topic: "orders", Offset: 7}
+
+	// newTxProducer returns a producer of the transactional sarama producers it has created so far.
+	newTxProducer := func(t *testing.T, b *kafkatest.Broker) (kafka.TxProducer, *[]*txnProducer) {
+		var created []*txnProducer
+		p, err := kafka.NewTxProducer(func() (sarama.SyncProducer, error) {
+			p := newTxnProducer(b)
+			created = append(created, p)
+			return p, nil
+		})
+		if err != nil {
+			t.Fatalf("new transactional producer: %v", err)
+		}
+
+		return p, &created
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		p, created := newTxProducer(t, b)
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+
+		producer, err := kafka.NewSaramaProducerFrom(b.SyncProducer(), "replies")
+		if err != nil {
+			t.Fatalf("create producer: %v", err)
+		}
+		if err := producer.SendMessage(kafka.ContextWithTx(context.Background(), tx), "key", "reply"); err != nil {
+			t.Fatalf("send message: %v", err)
+		}
+
+		if err := tx.Commit(consumed, "group"); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if n := len(b.Messages("replies")); n != 1 {
+			t.Fatalf("replies: got %d, want 1", n)
+		}
+		if got, want := (*created)[0].Calls(), []string{"begin", "add offset", "commit"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("calls: got %v, want %v", got, want)
+		}
+
+		if err := tx.Commit(consumed, "group"); !errors.Is(err, kafka.ErrTxDone) {
+			t.Fatalf("commit again: got %v, want %v", err, kafka.ErrTxDone)
+		}
+		if err := tx.Abort(); !errors.Is(err, kafka.ErrTxDone) {
+			t.Fatalf("abort committed: got %v, want %v", err, kafka.ErrTxDone)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		p, created := newTxProducer(t, b)
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		if err := tx.Abort(); err != nil {
+			t.Fatalf("abort: %v", err)
+		}
+		if err := tx.Send(&sarama.ProducerMessage{Topic: "replies"}); !errors.Is(err, kafka.ErrTxDone) {
+			t.Fatalf("send to aborted: got %v, want %v", err, kafka.ErrTxDone)
+		}
+		if got, want := (*created)[0].Calls(), []string{"begin", "abort"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("calls: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("next transaction waits", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		p, _ := newTxProducer(t, b)
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+
+		begun := make(chan kafka.Tx)
+		go func() {
+			next, err := p.Begin()
+			if err != nil {
+				t.Errorf("begin next: %v", err)
+			}
+			begun <- next
+		}()
+
+		select {
+		case <-begun:
+			t.Fatal("next transaction has begun before the one in progress is done")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		if err := tx.Commit(consumed, "group"); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+
+		select {
+		case next := <-begun:
+			if err := next.Abort(); err != nil {
+				t.Fatalf("abort next: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("next transaction has not begun")
+		}
+	})
+
+	t.Run("failed commit is aborted", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		p, created := newTxProducer(t, b)
+		(*created)[0].commitErr = errors.New("coordinator not available")
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		if err := tx.Commit(consumed, "group"); !errors.Is(err, kafka.ErrInternal) {
+			t.Fatalf("commit: got %v, want %v", err, kafka.ErrInternal)
+		}
+		if err := tx.Abort(); err != nil {
+			t.Fatalf("abort: %v", err)
+		}
+		if got, want := (*created)[0].Calls(), []string{"begin", "add offset", "commit", "abort"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("calls: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("fatal state renews producer", func(t *testing.T) {
+		b := kafkatest.NewBroker()
+		p, created := newTxProducer(t, b)
+
+		fatal := (*created)[0]
+		fatal.commitErr = errors.New("producer fenced")
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		if err := tx.Commit(consumed, "group"); err == nil {
+			t.Fatal("commit: got no error")
+		}
+
+		fatal.mu.Lock()
+		fatal.status = sarama.ProducerTxnFlagFatalError
+		fatal.mu.Unlock()
+
+		// A fatal producer cannot abort, the transaction is done with anyway.
+		if err := tx.Abort(); !errors.Is(err, kafka.ErrInternal) {
+			t.Fatalf("abort: got %v, want %v", err, kafka.ErrInternal)
+		}
+
+		tx, err = p.Begin()
+		if err != nil {
+			t.Fatalf("begin after fatal error: %v", err)
+		}
+		if err := tx.Commit(consumed, "group"); err != nil {
+			t.Fatalf("commit after fatal error: %v", err)
+		}
+
+		if len(*created) != 2 {
+			t.Fatalf("producers: got %d, want 2", len(*created))
+		}
+		if !fatal.closed {
+			t.Fatal("fatal producer is not closed")
+		}
+		if got, want := (*created)[1].Calls(), []string{"begin", "add offset", "commit"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("renewed producer calls: got %v, want %v", got, want)
+		}
+	})
+}
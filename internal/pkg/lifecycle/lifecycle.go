@@ -0,0 +1,163 @@
+// Package lifecycle runs a service until it is asked to stop and then shuts it down gracefully.
+//
+// On shutdown the goroutines started with Go are waited for first, as they are the ones using
+// the service dependencies, then the shutdown hooks are run: consumers and servers are stopped
+// before producers and databases they use are closed.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit statuses returned by Wait.
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+)
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// App traps SIGINT and SIGTERM and shuts the service down when one is received
+// or a goroutine started with Go fails.
+type App struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+
+	mu     sync.Mutex
+	hooks  []hook
+	failed bool
+
+	wg sync.WaitGroup
+}
+
+// New creates an instance of App. Shutdown hooks are given timeout to complete altogether.
+func New(timeout time.Duration) *App {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	return &App{
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: timeout,
+	}
+}
+
+// Context returns the context canceled when the service is asked to stop.
+func (a *App) Context() context.Context {
+	return a.ctx
+}
+
+// Go runs fn in a goroutine with the app context. fn must return once the context is done.
+// An error other than the context cancellation stops the service with ExitFailure.
+func (a *App) Go(name string, fn func(ctx context.Context) error) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		if err := fn(a.ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error(a.ctx, "run "+name, logger.Err(err))
+			a.fail()
+		}
+	}()
+}
+
+// OnShutdown adds a hook run on shutdown. Hooks run one by one in reverse order of addition,
+// like deferred calls, so a dependency added first is closed after its users.
+func (a *App) OnShutdown(name string, fn func(ctx context.Context) error) {
+	a.mu.Lock()
+	a.hooks = append(a.hooks, hook{name: name, fn: fn})
+	a.mu.Unlock()
+}
+
+// OnClose adds a hook closing c on shutdown, see OnShutdown.
+func (a *App) OnClose(name string, c io.Closer) {
+	a.OnShutdown(name, func(context.Context) error {
+		return c.Close()
+	})
+}
+
+// Serve runs srv in a goroutine and adds a hook shutting it down, see OnShutdown.
+// A server failure stops the service with ExitFailure.
+func (a *App) Serve(name string, srv *http.Server) {
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(a.ctx, "serve "+name, logger.Err(err))
+			a.fail()
+		}
+	}()
+
+	a.OnShutdown(name, srv.Shutdown)
+}
+
+// Wait blocks until the service is asked to stop, waits for goroutines started with Go
+// and runs the shutdown hooks. It returns ExitFailure if the service has failed, a hook
+// has failed or the shutdown has not completed in time, ExitOK otherwise.
+func (a *App) Wait() int {
+	<-a.ctx.Done()
+	a.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	logger.Info(ctx, "shutting down")
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Error(ctx, "goroutines have not returned in time")
+		a.fail()
+	}
+
+	a.mu.Lock()
+	hooks := a.hooks
+	a.mu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			logger.Error(ctx, "shutdown "+hooks[i].name, logger.Err(err))
+			a.fail()
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.failed {
+		return ExitFailure
+	}
+
+	logger.Info(ctx, "shut down")
+
+	return ExitOK
+}
+
+func (a *App) fail() {
+	a.mu.Lock()
+	a.failed = true
+	a.mu.Unlock()
+
+	a.cancel()
+}
+
+// Exit runs Wait and exits with its status.
+func (a *App) Exit() {
+	os.Exit(a.Wait())
+}
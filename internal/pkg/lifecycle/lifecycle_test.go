@@ -0,0 +1,263 @@
+package lifecycle_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/lifecycle"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer logs are written to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// captureLogs makes the default logger write to the returned buffer until the test ends.
+func captureLogs(t *testing.T) *syncBuffer {
+	var buf syncBuffer
+
+	prev := logger.Default()
+	logger.SetDefault(logger.New(&buf, logger.DebugLevel))
+	t.Cleanup(func() { logger.SetDefault(prev) })
+
+	return &buf
+}
+
+// stop asks the service to stop the way the orchestrator does.
+func stop(t *testing.T) {
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("send SIGTERM: %v", err)
+	}
+}
+
+// wait runs app.Wait and returns its status, failing the test unless it returns in time.
+func wait(t *testing.T, app *lifecycle.App) int {
+	t.Helper()
+
+	status := make(chan int, 1)
+	go func() {
+		status <- app.Wait()
+	}()
+
+	select {
+	case s := <-status:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait has not returned")
+		return 0
+	}
+}
+
+func TestShutdownOrder(t *testing.T) {
+	captureLogs(t)
+	app := lifecycle.New(time.Second)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	app.Go("consumer", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		record("consumer returned")
+		return ctx.Err()
+	})
+	app.OnShutdown("db", func(context.Context) error {
+		record("db")
+		return nil
+	})
+	app.OnClose("producer", closer(func() error {
+		record("producer")
+		return nil
+	}))
+	app.OnShutdown("server", func(context.Context) error {
+		record("server")
+		return nil
+	})
+
+	stop(t)
+	if status := wait(t, app); status != lifecycle.ExitOK {
+		t.Fatalf("status: got %d, want %d", status, lifecycle.ExitOK)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"consumer returned", "server", "producer", "db"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order: got %v, want %v", order, want)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Run("hook", func(t *testing.T) {
+		captureLogs(t)
+		app := lifecycle.New(50 * time.Millisecond)
+
+		var deadline bool
+		app.OnShutdown("db", func(context.Context) error {
+			return nil
+		})
+		app.OnShutdown("server", func(ctx context.Context) error {
+			_, deadline = ctx.Deadline()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		start := time.Now()
+		stop(t)
+		if status := wait(t, app); status != lifecycle.ExitFailure {
+			t.Fatalf("status: got %d, want %d", status, lifecycle.ExitFailure)
+		}
+		if !deadline {
+			t.Fatal("hook context: no deadline")
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Fatalf("shutdown took %s, want about the timeout", took)
+		}
+	})
+
+	t.Run("goroutine", func(t *testing.T) {
+		logs := captureLogs(t)
+		app := lifecycle.New(50 * time.Millisecond)
+
+		release := make(chan struct{})
+		defer close(release)
+		app.Go("stuck", func(context.Context) error {
+			<-release
+			return nil
+		})
+
+		var closed bool
+		app.OnShutdown("db", func(context.Context) error {
+			closed = true
+			return nil
+		})
+
+		stop(t)
+		if status := wait(t, app); status != lifecycle.ExitFailure {
+			t.Fatalf("status: got %d, want %d", status, lifecycle.ExitFailure)
+		}
+		if !closed {
+			t.Fatal("hooks have not run after the goroutines timed out")
+		}
+		if !strings.Contains(logs.String(), "goroutines have not returned in time") {
+			t.Fatalf("logs: got %s, want the timeout logged", logs)
+		}
+	})
+}
+
+func TestFailure(t *testing.T) {
+	t.Run("goroutine", func(t *testing.T) {
+		logs := captureLogs(t)
+		app := lifecycle.New(time.Second)
+
+		app.Go("relay", func(context.Context) error {
+			return errors.New("relay failed")
+		})
+
+		var stopped bool
+		app.Go("consumer", func(ctx context.Context) error {
+			<-ctx.Done()
+			stopped = true
+			return ctx.Err()
+		})
+
+		// The failure stops the service without a signal.
+		if status := wait(t, app); status != lifecycle.ExitFailure {
+			t.Fatalf("status: got %d, want %d", status, lifecycle.ExitFailure)
+		}
+		if !stopped {
+			t.Fatal("other goroutines have not been stopped")
+		}
+		if out := logs.String(); !strings.Contains(out, "run relay") || !strings.Contains(out, "relay failed") {
+			t.Fatalf("logs: got %s, want the failure logged", out)
+		}
+	})
+
+	t.Run("canceled goroutine", func(t *testing.T) {
+		captureLogs(t)
+		app := lifecycle.New(time.Second)
+
+		app.Go("consumer", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		stop(t)
+		if status := wait(t, app); status != lifecycle.ExitOK {
+			t.Fatalf("status: got %d, want %d", status, lifecycle.ExitOK)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		logs := captureLogs(t)
+		app := lifecycle.New(time.Second)
+
+		app.Serve("ops server", &http.Server{Addr: "127.0.0.1:-1"})
+
+		if status := wait(t, app); status != lifecycle.ExitFailure {
+			t.Fatalf("status: got %d, want %d", status, lifecycle.ExitFailure)
+		}
+		if !strings.Contains(logs.String(), "serve ops server") {
+			t.Fatalf("logs: got %s, want the failure logged", logs)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		logs := captureLogs(t)
+		app := lifecycle.New(time.Second)
+
+		var closed bool
+		app.OnShutdown("db", func(context.Context) error {
+			closed = true
+			return nil
+		})
+		app.OnClose("producer", closer(func() error {
+			return errors.New("flush timed out")
+		}))
+
+		stop(t)
+		if status := wait(t, app); status != lifecycle.ExitFailure {
+			t.Fatalf("status: got %d, want %d", status, lifecycle.ExitFailure)
+		}
+		if !closed {
+			t.Fatal("hooks after the failed one have not run")
+		}
+		if out := logs.String(); !strings.Contains(out, "shutdown producer") || !strings.Contains(out, "flush timed out") {
+			t.Fatalf("logs: got %s, want the close error logged", out)
+		}
+	})
+}
+
+// closer adapts a function to io.Closer.
+type closer func() error
+
+func (c closer) Close() error {
+	return c()
+}
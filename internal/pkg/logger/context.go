@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type fieldsCtxKey struct{}
+
+// WithFields returns a copy of ctx holding fields added to the ones ctx already holds.
+func WithFields(ctx context.Context, fields ...Field) context.Context {
+	prev := fieldsFromContext(ctx)
+
+	all := make([]Field, 0, len(prev)+len(fields))
+	all = append(all, prev...)
+	all = append(all, fields...)
+
+	return context.WithValue(ctx, fieldsCtxKey{}, all)
+}
+
+func fieldsFromContext(ctx context.Context) []Field {
+	fields, _ := ctx.Value(fieldsCtxKey{}).([]Field)
+	return fields
+}
+
+// FromContext returns the default logger with the fields ctx holds and the trace and span ids of the ctx span.
+func FromContext(ctx context.Context) *Logger {
+	l := Default().With(fieldsFromContext(ctx)...)
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With(
+			String("trace_id", sc.TraceID().String()),
+			String("span_id", sc.SpanID().String()),
+		)
+	}
+
+	return l
+}
+
+// Debug writes an entry at DebugLevel with the ctx fields.
+func Debug(ctx context.Context, msg string, fields ...Field) {
+	FromContext(ctx).Debug(msg, fields...)
+}
+
+// Info writes an entry at InfoLevel with the ctx fields.
+func Info(ctx context.Context, msg string, fields ...Field) {
+	FromContext(ctx).Info(msg, fields...)
+}
+
+// Warn writes an entry at WarnLevel with the ctx fields.
+func Warn(ctx context.Context, msg string, fields ...Field) {
+	FromContext(ctx).Warn(msg, fields...)
+}
+
+// Error writes an entry at ErrorLevel with the ctx fields.
+func Error(ctx context.Context, msg string, fields ...Field) {
+	FromContext(ctx).Error(msg, fields...)
+}
+
+// Fatal writes an entry at FatalLevel with the ctx fields and exits with status 1.
+func Fatal(ctx context.Context, msg string, fields ...Field) {
+	FromContext(ctx).Fatal(msg, fields...)
+}
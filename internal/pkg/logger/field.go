@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// RedactedValue replaces values of the redacted fields.
+const RedactedValue = "[REDACTED]"
+
+// redacted holds the normalized names of fields holding personal data or credentials, see normalize.
+var redacted = []string{"email", "password", "phone", "secret", "token"}
+
+// Redacted reports whether values of a field named key are redacted, i.e. the name ends with one
+// of the personal data or credential field names. Names are compared ignoring case, underscores and dashes,
+// so Email, e_mail and user_email all match email.
+func Redacted(key string) bool {
+	key = normalize(key)
+	for _, name := range redacted {
+		if strings.HasSuffix(key, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalize(key string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+}
+
+// Field is a key-value pair of a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+
+	raw bool
+}
+
+// String constructs a field with a string value.
+func String(key string, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Int constructs a field with an int value.
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Int64 constructs a field with an int64 value.
+func Int64(key string, value int64) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Uint64 constructs a field with an uint64 value.
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Duration constructs a field with a duration value written as a string, e.g. "1.5s".
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, Value: value.String()}
+}
+
+// Err constructs an "error" field. A nil error is written as null.
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error"}
+	}
+
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// Any constructs a field with an arbitrary value written as JSON having its redacted fields replaced.
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// JSON constructs a field with a JSON document, e.g. a message body, having its redacted fields replaced.
+// A malformed document is not written, only its size is, as it may hold personal data.
+func JSON(key string, raw []byte) Field {
+	return Field{Key: key, Value: raw, raw: true}
+}
+
+// value returns the value to be written with personal data redacted.
+func (f Field) value() interface{} {
+	if Redacted(f.Key) {
+		return RedactedValue
+	}
+
+	if f.raw {
+		var v interface{}
+		if err := json.Unmarshal(f.Value.([]byte), &v); err != nil {
+			return map[string]int{"malformed_bytes": len(f.Value.([]byte))}
+		}
+		return redact(v)
+	}
+
+	switch f.Value.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return f.Value
+	}
+
+	b, err := json.Marshal(f.Value)
+	if err != nil {
+		return f.Value
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return f.Value
+	}
+
+	return redact(v)
+}
+
+// redact replaces values of the redacted keys in a decoded JSON document.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if Redacted(key) {
+				v[key] = RedactedValue
+				continue
+			}
+			v[key] = redact(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = redact(val)
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,166 @@
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/logger"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	for key, want := range map[string]bool{
+		"email":         true,
+		"user_email":    true,
+		"E-Mail":        true,
+		"Password":      true,
+		"db_password":   true,
+		"phone":         true,
+		"ClientSecret":  true,
+		"client-secret": true,
+		"token":         true,
+		"AccessToken":   true,
+		"order_id":      false,
+		"topic":         false,
+		"secretary":     false,
+	} {
+		if got := logger.Redacted(key); got != want {
+			t.Errorf("redacted %q: got %v, want %v", key, got, want)
+		}
+	}
+}
+
+// entry writes a debug entry with the fields and returns it decoded.
+func entry(t *testing.T, fields ...logger.Field) map[string]interface{} {
+	t.Helper()
+
+	var buf bytes.Buffer
+	logger.New(&buf, logger.DebugLevel).Debug("test", fields...)
+
+	var e map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("unmarshal entry %q: %v", buf.String(), err)
+	}
+	return e
+}
+
+// lookup returns the value at the path of keys in a decoded JSON document.
+func lookup(t *testing.T, v interface{}, path ...string) interface{} {
+	t.Helper()
+
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: got %v, want an object", strings.Join(path, "."), v)
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func TestAnyRedactsNestedFields(t *testing.T) {
+	// The config is logged at debug level by the services, so its credentials must not be written.
+	type config struct {
+		DB        util.DBConfig
+		Kafka     util.KafkaConfig
+		Webhooks  map[string]map[string]string
+		Upstreams []struct {
+			URL         string
+			ClientToken string
+		}
+		Owner *struct {
+			Name  string
+			Email string
+		}
+	}
+
+	cfg := config{
+		DB: util.DBConfig{Host: "localhost", User: "postgres", Password: "db-password"},
+		Kafka: util.KafkaConfig{
+			Brokers: []string{"kafka:9092"},
+			SASL:    util.KafkaSASLConfig{Mechanism: "plain", User: "user", Password: "sasl-password"},
+		},
+		Webhooks: map[string]map[string]string{
+			"paid": {"url": "http://example.com", "signing_secret": "webhook-secret"},
+		},
+		Upstreams: []struct {
+			URL         string
+			ClientToken string
+		}{{URL: "http://example.com", ClientToken: "upstream-token"}},
+		Owner: &struct {
+			Name  string
+			Email string
+		}{Name: "owner", Email: "owner@example.com"},
+	}
+
+	e := entry(t, logger.Any("config", cfg))
+
+	for _, tc := range []struct {
+		path []string
+		want interface{}
+	}{
+		{path: []string{"config", "DB", "Password"}, want: logger.RedactedValue},
+		{path: []string{"config", "DB", "Host"}, want: "localhost"},
+		{path: []string{"config", "DB", "User"}, want: "postgres"},
+		{path: []string{"config", "Kafka", "SASL", "Password"}, want: logger.RedactedValue},
+		{path: []string{"config", "Kafka", "SASL", "User"}, want: "user"},
+		{path: []string{"config", "Webhooks", "paid", "signing_secret"}, want: logger.RedactedValue},
+		{path: []string{"config", "Webhooks", "paid", "url"}, want: "http://example.com"},
+		{path: []string{"config", "Owner", "Email"}, want: logger.RedactedValue},
+		{path: []string{"config", "Owner", "Name"}, want: "owner"},
+	} {
+		if got := lookup(t, e, tc.path...); got != tc.want {
+			t.Errorf("%s: got %v, want %v", strings.Join(tc.path, "."), got, tc.want)
+		}
+	}
+
+	upstreams, ok := lookup(t, e, "config", "Upstreams").([]interface{})
+	if !ok || len(upstreams) != 1 {
+		t.Fatalf("upstreams: got %v, want one", lookup(t, e, "config", "Upstreams"))
+	}
+	if got := lookup(t, upstreams[0], "ClientToken"); got != logger.RedactedValue {
+		t.Errorf("upstream client token: got %v, want %v", got, logger.RedactedValue)
+	}
+
+	b, _ := json.Marshal(e)
+	for _, secret := range []string{"db-password", "sasl-password", "webhook-secret", "upstream-token", "owner@example.com"} {
+		if bytes.Contains(b, []byte(secret)) {
+			t.Errorf("entry %s: contains %q", b, secret)
+		}
+	}
+}
+
+func TestFieldsRedacted(t *testing.T) {
+	e := entry(t,
+		logger.String("password", "password"),
+		logger.String("api_token", "token"),
+		logger.JSON("payload", []byte(`{"order": {"email": "user@example.com", "items": [{"secret": "x", "id": 1}]}}`)),
+		logger.JSON("malformed", []byte(`{"email": "user@example.com"`)),
+	)
+
+	for _, tc := range []struct {
+		path []string
+		want interface{}
+	}{
+		{path: []string{"password"}, want: logger.RedactedValue},
+		{path: []string{"api_token"}, want: logger.RedactedValue},
+		{path: []string{"payload", "order", "email"}, want: logger.RedactedValue},
+		{path: []string{"malformed", "malformed_bytes"}, want: float64(len(`{"email": "user@example.com"`))},
+	} {
+		if got := lookup(t, e, tc.path...); got != tc.want {
+			t.Errorf("%s: got %v, want %v", strings.Join(tc.path, "."), got, tc.want)
+		}
+	}
+
+	items, ok := lookup(t, e, "payload", "order", "items").([]interface{})
+	if !ok || len(items) != 1 {
+		t.Fatalf("items: got %v, want one", lookup(t, e, "payload", "order", "items"))
+	}
+	if got := lookup(t, items[0], "secret"); got != logger.RedactedValue {
+		t.Errorf("item secret: got %v, want %v", got, logger.RedactedValue)
+	}
+	if got := lookup(t, items[0], "id"); got != float64(1) {
+		t.Errorf("item id: got %v, want 1", got)
+	}
+}
@@ -0,0 +1,204 @@
+// Package logger writes leveled structured logs as JSON lines.
+//
+// Request scoped fields such as the message topic, offset or order id are put in a context
+// with WithFields and are written by the package level functions along with the trace id.
+// Values of personal data and credential fields, e.g. an email or a password, are redacted, see Redacted.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is a logging priority.
+type Level int8
+
+// Logging levels.
+const (
+	DebugLevel Level = iota - 1
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+// String returns a lowercase name of the level.
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	default:
+		return fmt.Sprintf("level(%d)", l)
+	}
+}
+
+// ParseLevel parses a level name, e.g. "debug".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warn":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "fatal":
+		return FatalLevel, nil
+	default:
+		return InfoLevel, fmt.Errorf("unknown level %q", s)
+	}
+}
+
+// Logger writes entries at or above its level to a writer.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  Level
+	fields []Field
+}
+
+// New creates an instance of Logger writing to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		out:   w,
+		mu:    &sync.Mutex{},
+		level: level,
+	}
+}
+
+// With returns a logger adding fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	if len(fields) == 0 {
+		return l
+	}
+
+	c := *l
+	c.fields = make([]Field, 0, len(l.fields)+len(fields))
+	c.fields = append(c.fields, l.fields...)
+	c.fields = append(c.fields, fields...)
+
+	return &c
+}
+
+// Enabled reports whether entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes an entry at DebugLevel.
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.write(DebugLevel, msg, fields)
+}
+
+// Info writes an entry at InfoLevel.
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.write(InfoLevel, msg, fields)
+}
+
+// Warn writes an entry at WarnLevel.
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.write(WarnLevel, msg, fields)
+}
+
+// Error writes an entry at ErrorLevel.
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.write(ErrorLevel, msg, fields)
+}
+
+// Fatal writes an entry at FatalLevel and exits with status 1.
+func (l *Logger) Fatal(msg string, fields ...Field) {
+	l.write(FatalLevel, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) write(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]Field, 0, len(l.fields)+len(fields)+3)
+	all = append(all,
+		String("time", time.Now().UTC().Format(time.RFC3339Nano)),
+		String("level", level.String()),
+		String("msg", msg),
+	)
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	buf := encode(all)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, _ = l.out.Write(buf)
+}
+
+// encode writes fields as a JSON object line. A later field wins over an earlier one with the same key.
+func encode(fields []Field) []byte {
+	last := make(map[string]int, len(fields))
+	for i, f := range fields {
+		last[f.Key] = i
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	first := true
+	for i, f := range fields {
+		if last[f.Key] != i {
+			continue
+		}
+
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+
+		key, _ := json.Marshal(f.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		val, err := json.Marshal(f.value())
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprintf("!marshal: %v", err))
+		}
+		buf.Write(val)
+	}
+
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+var std atomic.Value
+
+func init() {
+	std.Store(New(os.Stdout, InfoLevel))
+}
+
+// Default returns the logger used by the package level functions, it writes to stdout at InfoLevel
+// unless replaced with SetDefault.
+func Default() *Logger {
+	return std.Load().(*Logger)
+}
+
+// SetDefault replaces the logger used by the package level functions.
+func SetDefault(l *Logger) {
+	std.Store(l)
+}
@@ -0,0 +1,107 @@
+// Package metrics defines prometheus metrics shared by the services and serves them.
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Result label values.
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+var (
+	// HandlerDuration observes kafka message handling latency.
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_handler_duration_seconds",
+		Help:    "Kafka message handling latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic", "result"})
+
+	// HandlerErrors counts kafka message handling errors by error class, see ErrorClasses.
+	HandlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_handler_errors_total",
+		Help: "Kafka message handling errors by error class.",
+	}, []string{"topic", "class"})
+
+	// DuplicateMessages counts messages skipped as already processed.
+	DuplicateMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_duplicate_messages_total",
+		Help: "Kafka messages skipped as already processed.",
+	}, []string{"topic"})
+
+	// DeadLetters counts messages sent to dead letter topics.
+	DeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_dead_letters_total",
+		Help: "Kafka messages sent to dead letter topics by original topic.",
+	}, []string{"topic"})
+
+	// ConsumerLag is the number of messages of a partition not consumed yet.
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "Kafka messages of a partition not consumed yet.",
+	}, []string{"topic", "partition"})
+
+	// ProducerSendDuration observes kafka message sending latency.
+	ProducerSendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_producer_send_duration_seconds",
+		Help:    "Kafka message sending latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic", "result"})
+
+	// ProducerSendFailures counts messages kafka has failed to accept.
+	ProducerSendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_producer_send_failures_total",
+		Help: "Kafka messages failed to be sent.",
+	}, []string{"topic"})
+
+	// DBTxDuration observes repository transactions latency.
+	DBTxDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_tx_duration_seconds",
+		Help:    "Repository transactions latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// CacheRequests counts cache lookups by result: hit, miss or error.
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "Cache lookups by result.",
+	}, []string{"result"})
+)
+
+// Result returns the result label value for err.
+func Result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOK
+}
+
+// ErrorClass names a sentinel error for the class label of HandlerErrors.
+type ErrorClass struct {
+	Name string
+	Err  error
+}
+
+// ErrorClasses classifies errors by the first sentinel they wrap.
+type ErrorClasses []ErrorClass
+
+// Classify returns the name of the first class err matches or "other".
+func (c ErrorClasses) Classify(err error) string {
+	for _, class := range c {
+		if errors.Is(err, class.Err) {
+			return class.Name
+		}
+	}
+	return "other"
+}
+
+// Handler serves metrics of the default registry.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,94 @@
+// Package migrate applies the database migrations embedded into the binaries with goose.
+// The versions are kept in the goose_db_version table, so databases migrated with the goose
+// command line tool are migrated further the same way.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/pressly/goose/v3"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/db/migrations"
+	"log"
+	"os"
+	"sync"
+)
+
+const usage = `Usage: <service> migrate [command [args]]
+
+Applies the database migrations embedded into the binary to the database from the config.
+Commands are the ones of goose:
+  up                   migrate the db to the most recent version, the default
+  up-by-one            migrate the db up by 1
+  up-to VERSION        migrate the db to a specific VERSION
+  down                 roll back the version by 1
+  down-to VERSION      roll back to a specific VERSION
+  redo                 re-run the latest migration
+  reset                roll back all migrations
+  status               dump the migration status for the db
+  version              print the current version of the db
+`
+
+// mu guards goose settings, goose keeps them in globals.
+var mu sync.Mutex
+
+// Command runs the migrate subcommand of a service binary with its command line arguments, see usage.
+func Command(dsn string, service string, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stderr, usage)
+		return nil
+	}
+
+	return Run(dsn, service, command, args...)
+}
+
+// Run runs the goose command with its arguments on the migrations of the service.
+// The service is one of the directories of migrations.FS, e.g. migrations.Stock.
+func Run(dsn string, service string, command string, args ...string) error {
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return fmt.Errorf("parse dsn: %w", err)
+	}
+
+	db := stdlib.OpenDB(*cfg)
+	defer db.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	goose.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
+
+	return run(db, service, command, args...)
+}
+
+// Up applies every pending migration of the service to db without logging them, e.g. in tests.
+func Up(db *sql.DB, service string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	goose.SetLogger(goose.NopLogger())
+
+	return run(db, service, "up")
+}
+
+// run runs the goose command. mu must be held.
+func run(db *sql.DB, service string, command string, args ...string) error {
+	goose.SetBaseFS(migrations.FS)
+
+	if err := goose.SetDialect("postgres"); err != nil {
+		return fmt.Errorf("set dialect: %w", err)
+	}
+
+	if err := goose.Run(command, db, service, args...); err != nil {
+		return fmt.Errorf("goose %s: %w", command, err)
+	}
+
+	return nil
+}
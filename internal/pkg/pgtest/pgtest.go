@@ -0,0 +1,80 @@
+// Package pgtest gives tests a postgres database with the migrations of a service applied.
+//
+// Every test gets a schema of its own in the database EnvDSN points to, so tests do not see
+// each other's data and may run in parallel. Tests using it are skipped unless EnvDSN is set, e.g.
+//
+//	TEST_DB_DSN="user=postgres password=postgres dbname=postgres sslmode=disable host=localhost port=5432"
+package pgtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v4/stdlib"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/migrate"
+	"gitlab.ozon.dev/unknownspacewalker/homework3/internal/pkg/util"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// EnvDSN is the environment variable with the dsn of the database tests create their schemas in.
+const EnvDSN = "TEST_DB_DSN"
+
+// schemas makes schema names unique within the test binary.
+var schemas uint64
+
+// Open creates a fresh schema, applies the migrations of the service, e.g. migrations.Stock, to it
+// and connects to the database with the schema as the search path. The schema is dropped
+// and the connection is closed when the test finishes.
+func Open(t testing.TB, service string) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv(EnvDSN)
+	if dsn == "" {
+		t.Skipf("%s is not set", EnvDSN)
+	}
+
+	ctx := context.Background()
+
+	admin, err := util.OpenDB(dsn)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(admin.Close)
+
+	schema := fmt.Sprintf("test_%s_%d_%d", service, time.Now().UnixNano(), atomic.AddUint64(&schemas, 1))
+	ident := pgx.Identifier{schema}.Sanitize()
+
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+ident); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(ctx, "DROP SCHEMA "+ident+" CASCADE"); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("parse dsn: %v", err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+
+	sqlDB := stdlib.OpenDB(*cfg.ConnConfig)
+	defer sqlDB.Close()
+
+	if err := migrate.Up(sqlDB, service); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	db, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
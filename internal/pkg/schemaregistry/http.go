@@ -0,0 +1,174 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// DefaultTimeout is the default timeout of registry requests.
+const DefaultTimeout = 5 * time.Second
+
+// Option configures httpClient.
+type Option func(c *httpClient)
+
+// WithBasicAuth makes the client authenticate with a username and a password.
+func WithBasicAuth(username, password string) Option {
+	return func(c *httpClient) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithHTTPClient replaces the http client with a timeout of DefaultTimeout used otherwise.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *httpClient) {
+		c.http = hc
+	}
+}
+
+type httpClient struct {
+	url      string
+	http     *http.Client
+	username string
+	password string
+
+	mu      sync.RWMutex
+	schemas map[int]Schema
+}
+
+// NewClient creates an instance of httpClient talking to the registry at baseURL, e.g. http://localhost:8085.
+// Schemas looked up by id are cached, as they never change.
+func NewClient(baseURL string, opts ...Option) *httpClient {
+	c := &httpClient{
+		url:     strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Timeout: DefaultTimeout},
+		schemas: make(map[int]Schema),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type schemaReq struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+type schemaResp struct {
+	ID         int    `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+}
+
+type errorResp struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Register registers schema under subject. The registry returns the id of the same schema
+// registered before and refuses a schema incompatible with the subject ones.
+func (c *httpClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	req := schemaReq{Schema: schema.Schema}
+	// The registry defaults to AVRO and older versions do not know the field.
+	if schema.Type != TypeAvro {
+		req.SchemaType = schema.Type
+	}
+
+	var resp schemaResp
+	if err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", req, &resp); err != nil {
+		return 0, fmt.Errorf("register %s: %w", subject, err)
+	}
+
+	return resp.ID, nil
+}
+
+// GetSchema returns the schema with the id.
+func (c *httpClient) GetSchema(ctx context.Context, id int) (Schema, error) {
+	c.mu.RLock()
+	s, ok := c.schemas[id]
+	c.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	var resp schemaResp
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return Schema{}, fmt.Errorf("get schema %d: %w", id, err)
+	}
+
+	s = Schema{Type: resp.SchemaType, Schema: resp.Schema}
+	if s.Type == "" {
+		s.Type = TypeAvro
+	}
+
+	c.mu.Lock()
+	c.schemas[id] = s
+	c.mu.Unlock()
+
+	return s, nil
+}
+
+func (c *httpClient) do(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("%w: marshal: %v", ErrInvalid, err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, r)
+	if err != nil {
+		return fmt.Errorf("%w: new request: %v", ErrInvalid, err)
+	}
+
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: do request: %v", ErrInternal, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e errorResp
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", ErrNotFound, e.Message)
+		case http.StatusConflict:
+			return fmt.Errorf("%w: %s", ErrIncompatible, e.Message)
+		case http.StatusUnprocessableEntity:
+			return fmt.Errorf("%w: %s", ErrInvalid, e.Message)
+		default:
+			return fmt.Errorf("%w: status %d: %s", ErrInternal, resp.StatusCode, e.Message)
+		}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: decode response: %v", ErrInternal, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+type memoryRegistry struct {
+	mu       sync.RWMutex
+	schemas  []Schema
+	subjects map[string][]int
+}
+
+// NewMemory creates an instance of memoryRegistry, an in-memory stand-in for a registry in tests.
+// As the registry does with BACKWARD compatibility, it refuses Avro record schemas that cannot
+// read the data written with the latest schema of the subject: schemas adding a field without
+// a default or changing a field type. Other schema types are not checked.
+func NewMemory() *memoryRegistry {
+	return &memoryRegistry{
+		subjects: make(map[string][]int),
+	}
+}
+
+// Register registers schema under subject unless it is already, and returns its id.
+// The same schema has the same id under every subject.
+func (r *memoryRegistry) Register(_ context.Context, subject string, schema Schema) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := r.subjects[subject]
+	for _, id := range versions {
+		if r.schemas[id-1] == schema {
+			return id, nil
+		}
+	}
+
+	if len(versions) > 0 {
+		latest := r.schemas[versions[len(versions)-1]-1]
+		if err := checkBackward(latest, schema); err != nil {
+			return 0, fmt.Errorf("register %s: %w", subject, err)
+		}
+	}
+
+	id := 0
+	for i, s := range r.schemas {
+		if s == schema {
+			id = i + 1
+			break
+		}
+	}
+	if id == 0 {
+		r.schemas = append(r.schemas, schema)
+		id = len(r.schemas)
+	}
+
+	r.subjects[subject] = append(versions, id)
+
+	return id, nil
+}
+
+// GetSchema returns the schema with the id.
+func (r *memoryRegistry) GetSchema(_ context.Context, id int) (Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id < 1 || id > len(r.schemas) {
+		return Schema{}, fmt.Errorf("%w: schema %d", ErrNotFound, id)
+	}
+
+	return r.schemas[id-1], nil
+}
+
+type avroRecord struct {
+	Type   string      `json:"type"`
+	Fields []avroField `json:"fields"`
+}
+
+type avroField struct {
+	Name    string          `json:"name"`
+	Type    json.RawMessage `json:"type"`
+	Default json.RawMessage `json:"default"`
+}
+
+// checkBackward checks that the top level fields of an Avro record schema can read the data of the previous one.
+func checkBackward(prev, next Schema) error {
+	if prev.Type != TypeAvro || next.Type != TypeAvro {
+		return nil
+	}
+
+	var p, n avroRecord
+	if err := json.Unmarshal([]byte(prev.Schema), &p); err != nil {
+		return fmt.Errorf("%w: previous schema: %v", ErrInvalid, err)
+	}
+	if err := json.Unmarshal([]byte(next.Schema), &n); err != nil {
+		return fmt.Errorf("%w: schema: %v", ErrInvalid, err)
+	}
+	if p.Type != "record" || n.Type != "record" {
+		return nil
+	}
+
+	prevFields := make(map[string]avroField, len(p.Fields))
+	for _, f := range p.Fields {
+		prevFields[f.Name] = f
+	}
+
+	for _, f := range n.Fields {
+		old, ok := prevFields[f.Name]
+		if !ok {
+			if f.Default == nil {
+				return fmt.Errorf("%w: field %s is added without a default", ErrIncompatible, f.Name)
+			}
+			continue
+		}
+
+		if !jsonEqual(old.Type, f.Type) {
+			return fmt.Errorf("%w: type of field %s is changed", ErrIncompatible, f.Name)
+		}
+	}
+
+	return nil
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+
+	xb, _ := json.Marshal(x)
+	yb, _ := json.Marshal(y)
+
+	return string(xb) == string(yb)
+}
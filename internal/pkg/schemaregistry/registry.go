@@ -0,0 +1,44 @@
+// Package schemaregistry registers and looks up message schemas in a Confluent-compatible schema registry.
+//
+// Schemas are registered under subjects named after topics, see Subject, and the registry refuses
+// a schema incompatible with the ones registered before, so payload evolution is governed by it.
+// Encoded payloads are prefixed with the id of their schema, see Frame.
+package schemaregistry
+
+import (
+	"context"
+	"errors"
+)
+
+// Schema types.
+const (
+	TypeAvro     = "AVRO"
+	TypeProtobuf = "PROTOBUF"
+	TypeJSON     = "JSON"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrIncompatible = errors.New("incompatible schema")
+	ErrInvalid      = errors.New("invalid")
+	ErrInternal     = errors.New("internal")
+)
+
+// Schema is a schema definition of a type.
+type Schema struct {
+	Type   string
+	Schema string
+}
+
+// Client registers and looks up schemas.
+type Client interface {
+	// Register registers schema under subject unless it is already, and returns its id.
+	Register(ctx context.Context, subject string, schema Schema) (int, error)
+	// GetSchema returns the schema with the id.
+	GetSchema(ctx context.Context, id int) (Schema, error)
+}
+
+// Subject returns the subject of the topic message values, as Confluent TopicNameStrategy does.
+func Subject(topic string) string {
+	return topic + "-value"
+}
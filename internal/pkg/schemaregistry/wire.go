@@ -0,0 +1,34 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// magicByte starts the framed payloads.
+const magicByte = 0
+
+// headerSize is the size of the magic byte followed by the schema id.
+const headerSize = 5
+
+// Frame prefixes a payload with the magic byte and the big endian schema id, as Confluent serializers do.
+func Frame(id int, payload []byte) []byte {
+	b := make([]byte, headerSize, headerSize+len(payload))
+	b[0] = magicByte
+	binary.BigEndian.PutUint32(b[1:headerSize], uint32(id))
+
+	return append(b, payload...)
+}
+
+// Unframe returns the schema id and the payload of a framed message, see Frame.
+func Unframe(data []byte) (int, []byte, error) {
+	if len(data) < headerSize {
+		return 0, nil, fmt.Errorf("%w: framed payload of %d bytes", ErrInvalid, len(data))
+	}
+
+	if data[0] != magicByte {
+		return 0, nil, fmt.Errorf("%w: unknown magic byte %d", ErrInvalid, data[0])
+	}
+
+	return int(binary.BigEndian.Uint32(data[1:headerSize])), data[headerSize:], nil
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"io"
+	"sync"
+	"time"
+)
+
+// FileSpan is a finished span as written by FileExporter, one JSON object per line.
+type FileSpan struct {
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	Service      string            `json:"service,omitempty"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Status       string            `json:"status"`
+	Error        string            `json:"error,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+}
+
+// FileExporter writes finished spans to w as JSON lines. It is meant for local runs and tests
+// that need to check spans without a collector.
+type FileExporter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewFileExporter creates an instance of FileExporter. w is closed on shutdown if it is an io.Closer.
+func NewFileExporter(w io.Writer) *FileExporter {
+	return &FileExporter{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *FileExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range spans {
+		fs := FileSpan{
+			Name:    s.Name(),
+			Kind:    s.SpanKind().String(),
+			TraceID: s.SpanContext().TraceID().String(),
+			SpanID:  s.SpanContext().SpanID().String(),
+			Start:   s.StartTime(),
+			End:     s.EndTime(),
+			Status:  s.Status().Code.String(),
+			Error:   s.Status().Description,
+		}
+
+		if s.Parent().IsValid() {
+			fs.ParentSpanID = s.Parent().SpanID().String()
+		}
+
+		if s.Resource() != nil {
+			for _, kv := range s.Resource().Attributes() {
+				if kv.Key == "service.name" {
+					fs.Service = kv.Value.Emit()
+				}
+			}
+		}
+
+		if attrs := s.Attributes(); len(attrs) > 0 {
+			fs.Attributes = make(map[string]string, len(attrs))
+			for _, kv := range attrs {
+				fs.Attributes[string(kv.Key)] = kv.Value.Emit()
+			}
+		}
+
+		if err := e.enc.Encode(fs); err != nil {
+			return fmt.Errorf("encode span: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *FileExporter) Shutdown(_ context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
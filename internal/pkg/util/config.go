@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
+	"time"
 )
 
 // DBConfig represents a common db configuration.
@@ -16,6 +17,126 @@ type DBConfig struct {
 	SSLMode  string `mapstructure:"sslmode" validate:"required"`
 }
 
+// RetryConfig represents a common configuration of message handling retries.
+type RetryConfig struct {
+	MaxAttempts      int           `mapstructure:"maxAttempts" validate:"required"`
+	InitialBackoff   time.Duration `mapstructure:"initialBackoff" validate:"required"`
+	MaxBackoff       time.Duration `mapstructure:"maxBackoff" validate:"required"`
+	DeadLetterSuffix string        `mapstructure:"deadLetterSuffix" validate:"required"`
+}
+
+// TracingConfig represents a common tracing configuration.
+// Exporter is one of otlp, file and none; Endpoint is an OTLP/HTTP collector address
+// and File is a path spans are written to by the file exporter.
+type TracingConfig struct {
+	Exporter    string  `mapstructure:"exporter" validate:"oneof=otlp file none"`
+	Endpoint    string  `mapstructure:"endpoint" validate:"required_if=Exporter otlp"`
+	File        string  `mapstructure:"file" validate:"required_if=Exporter file"`
+	SampleRatio float64 `mapstructure:"sampleRatio" validate:"gte=0,lte=1"`
+}
+
+// MetricsConfig represents a common configuration of the endpoint serving metrics and health probes.
+// StallTimeout is the longest time a step of the service work, e.g. handling a message, may take
+// before liveness fails, see health.Progress.
+type MetricsConfig struct {
+	Addr         string        `mapstructure:"addr" validate:"required"`
+	StallTimeout time.Duration `mapstructure:"stallTimeout" validate:"required"`
+}
+
+// RetentionConfig represents a configuration of the cleanup of processed messages, see dedup.Cleaner.
+// Rows older than Retention are deleted every Interval in batches of BatchSize rows. Retention must be
+// longer than the retention of the consumed topics, messages redelivered later are processed again.
+type RetentionConfig struct {
+	Retention time.Duration `mapstructure:"retention" validate:"required"`
+	Interval  time.Duration `mapstructure:"interval" validate:"required"`
+	BatchSize int           `mapstructure:"batchSize" validate:"required,gt=0"`
+}
+
+// LogConfig represents a common logging configuration.
+type LogConfig struct {
+	Level string `mapstructure:"level" validate:"oneof=debug info warn error"`
+}
+
+// CodecConfig represents a common configuration of message encoding.
+// Name is one of json, avro and protobuf; SchemaRegistry is an address of a Confluent-compatible
+// schema registry, schemas are not registered unless it is set.
+type CodecConfig struct {
+	Name           string `mapstructure:"name" validate:"oneof=json avro protobuf"`
+	SchemaRegistry string `mapstructure:"schemaRegistry" validate:"omitempty,url"`
+}
+
+// KafkaConfig represents a common configuration of kafka clients, applied to every producer and consumer.
+// Version is the kafka version the clients speak, e.g. 2.8.0; sarama's default is used unless it is set.
+type KafkaConfig struct {
+	Brokers  []string            `mapstructure:"brokers" validate:"required"`
+	ClientID string              `mapstructure:"clientId"`
+	Version  string              `mapstructure:"version"`
+	TLS      KafkaTLSConfig      `mapstructure:"tls"`
+	SASL     KafkaSASLConfig     `mapstructure:"sasl"`
+	Consumer KafkaConsumerConfig `mapstructure:"consumer"`
+}
+
+// KafkaTLSConfig represents a configuration of TLS connections to kafka.
+// CAFile is a PEM bundle brokers are verified with, the system pool is used unless it is set;
+// CertFile and KeyFile are a PEM client certificate and its key.
+type KafkaTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"caFile"`
+	CertFile           string `mapstructure:"certFile" validate:"required_with=KeyFile"`
+	KeyFile            string `mapstructure:"keyFile" validate:"required_with=CertFile"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+// KafkaSASLConfig represents a configuration of SASL authentication.
+// Mechanism is one of plain, scram-sha-256 and scram-sha-512; clients do not authenticate unless it is set.
+type KafkaSASLConfig struct {
+	Mechanism string `mapstructure:"mechanism" validate:"omitempty,oneof=plain scram-sha-256 scram-sha-512"`
+	User      string `mapstructure:"user" validate:"required_with=Mechanism"`
+	Password  string `mapstructure:"password" validate:"required_with=Mechanism"`
+}
+
+// KafkaConsumerConfig represents a configuration of consumer groups. InitialOffset is one of oldest
+// and newest and is where groups without committed offsets start from; Rebalance is one of range,
+// roundrobin and sticky; IsolationLevel is one of read_uncommitted and read_committed, the latter
+// skips the messages of aborted transactions; Fetch sizes are in bytes. Sarama's defaults are used
+// for the unset fields.
+type KafkaConsumerConfig struct {
+	InitialOffset     string        `mapstructure:"initialOffset" validate:"omitempty,oneof=oldest newest"`
+	IsolationLevel    string        `mapstructure:"isolationLevel" validate:"omitempty,oneof=read_uncommitted read_committed"`
+	Rebalance         string        `mapstructure:"rebalance" validate:"omitempty,oneof=range roundrobin sticky"`
+	SessionTimeout    time.Duration `mapstructure:"sessionTimeout" validate:"gte=0"`
+	HeartbeatInterval time.Duration `mapstructure:"heartbeatInterval" validate:"gte=0"`
+	FetchMin          int32         `mapstructure:"fetchMin" validate:"gte=0"`
+	FetchDefault      int32         `mapstructure:"fetchDefault" validate:"gte=0"`
+	FetchMax          int32         `mapstructure:"fetchMax" validate:"gte=0"`
+	MaxWaitTime       time.Duration `mapstructure:"maxWaitTime" validate:"gte=0"`
+}
+
+// TransactionsConfig represents a configuration of consume-transform-produce kafka transactions.
+// ID prefixes the transactional ids of the service instances, so it must be unique among services.
+// Instance tells the instances apart and may refer to environment variables, e.g. ${POD_NAME}.
+// It must be unique among the instances and stay the same when an instance restarts, e.g. a StatefulSet
+// pod name, as a restarted instance fences the transactions of its predecessor by reusing its transactional id.
+type TransactionsConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	ID       string `mapstructure:"id" validate:"required_if=Enabled true"`
+	Instance string `mapstructure:"instance" validate:"required_if=Enabled true"`
+}
+
+// ProducerConfig represents a configuration of a topic producer.
+// Async producers send messages in batches of up to BatchSize messages or BatchBytes bytes,
+// waiting for Linger at most; Compression is one of none, gzip, snappy, lz4 and zstd;
+// Acks is one of none, leader and all; Idempotent producers require all acks.
+type ProducerConfig struct {
+	Async       bool          `mapstructure:"async"`
+	BatchSize   int           `mapstructure:"batchSize" validate:"gte=0"`
+	BatchBytes  int           `mapstructure:"batchBytes" validate:"gte=0"`
+	Linger      time.Duration `mapstructure:"linger" validate:"gte=0"`
+	Compression string        `mapstructure:"compression" validate:"omitempty,oneof=none gzip snappy lz4 zstd"`
+	Acks        string        `mapstructure:"acks" validate:"omitempty,oneof=none leader all"`
+	Idempotent  bool          `mapstructure:"idempotent"`
+}
+
 // LoadConfig loads yaml config and populates provided config struct.
 func LoadConfig(path string, name string, v interface{}) error {
 	viper.AddConfigPath(path)